@@ -0,0 +1,789 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// event is something that happened in the window, the platform layer
+// translates its native messages to these and passes them to app.handle.
+type event interface{}
+
+type keyDownEvent struct {
+	key keyChord
+}
+
+// charEvent is a typed character, repeatCount is > 1 if the key is held down
+// and the platform combined the repeated characters.
+type charEvent struct {
+	char        rune
+	repeatCount int
+}
+
+type mouseDownEvent struct {
+	x, y             int
+	shift, ctrl, alt bool
+}
+
+type mouseMoveEvent struct {
+	x, y int
+}
+
+type mouseUpEvent struct {
+	x, y int
+}
+
+// resizeEvent gives the new size of the window's client area.
+type resizeEvent struct {
+	width, height int
+}
+
+type focusEvent struct {
+	focused bool
+}
+
+// closeEvent means the user wants to close the window.
+type closeEvent struct{}
+
+// timerEvent is sent periodically for every timer started with
+// platform.startTimer.
+type timerEvent struct {
+	id int
+}
+
+// platform is what the app needs from the operating system.
+type platform interface {
+	// invalidate schedules a paint for the region
+	invalidate(r rectangle)
+	// startTimer makes the platform send a timerEvent with the given id every
+	// interval until stopTimer is called
+	startTimer(id int, interval time.Duration)
+	stopTimer(id int)
+	// wake makes the platform send one timerEvent with the given id as soon
+	// as possible, it is the only method that may be called from any
+	// goroutine
+	wake(id int)
+	now() time.Time
+	// quit closes the window and ends the program
+	quit()
+	// showError tells the user that something went wrong
+	showError(title, message string)
+}
+
+const (
+	// loadProgressTimer redraws the progress bar while a file is loading
+	loadProgressTimer = 1 + iota
+	// semanticTimer runs while the semantic highlighting is outdated, it is
+	// restarted with every edit so the analysis waits for a typing pause
+	semanticTimer
+	// languageServerTimer is not started, the language server client wakes
+	// the app with it when messages arrive
+	languageServerTimer
+	// vetTimer waits for go vet to finish
+	vetTimer
+	// completionTimer waits for the local completer's results
+	completionTimer
+	// navigationTimer waits for the result of a search for definitions or
+	// references
+	navigationTimer
+	// renameTimer waits for the edits of a rename
+	renameTimer
+	// extractTimer waits for the edits of an extract function or variable
+	extractTimer
+	// taskTimer collects the output of a running task
+	taskTimer
+	// coverageTimer waits for a cover profile to be read
+	coverageTimer
+	// debugTimer collects the debugger's messages while a program is
+	// debugged
+	debugTimer
+)
+
+const (
+	semanticDelay  = 500 * time.Millisecond
+	vetPoll        = 200 * time.Millisecond
+	completionPoll = 20 * time.Millisecond
+	navigationPoll = 50 * time.Millisecond
+	renamePoll     = 50 * time.Millisecond
+	extractPoll    = 50 * time.Millisecond
+	taskPoll       = 100 * time.Millisecond
+	coveragePoll   = 50 * time.Millisecond
+	debugPoll      = 50 * time.Millisecond
+)
+
+const (
+	windowBackgroundColor = 0xFF072727
+	windowMargin          = 10
+)
+
+// app is the platform-neutral part of the program. It owns the editor and
+// reacts to events.
+type app struct {
+	platform platform
+	graphics graphics
+	keyboard *keyDispatcher
+	frames   *frameScheduler
+	// file is the file given on the command line. While it is still being
+	// indexed, editor is nil and a preview of the file content is shown
+	// instead.
+	file *fileLoad
+	// path is where the editor's document is saved, it is empty for a new
+	// document
+	path     string
+	editor   *editor
+	semantic *semanticAnalyzer
+	settings settings
+	// languageServer, if not nil, starts a language server for the
+	// workspace folder dir, it is called when the first Go file is opened.
+	// lsp is the running server.
+	languageServer func(dir string) (*lspClient, error)
+	lsp            *lspClient
+	// hover, if not nil, shows the language server's information about the
+	// identifier at the caret. The code actions panel lists what the server
+	// offers to do at the caret.
+	hover          *hoverPopup
+	codeActions    codeActionsPanel
+	codeActionKeys *keymap
+	// diagnostics are the problems that go/types, go vet and the language
+	// server found, they are listed in the problems panel
+	diagnostics *diagnosticSet
+	problems    problemsPanel
+	vet         *vetRunner
+	// completer finds completions in Go files while there is no language
+	// server
+	completer *localCompleter
+	// navigator finds definitions and references, the locations panel lists
+	// them and history remembers where the jumps came from
+	navigator *navigator
+	locations locationsPanel
+	history   navigationHistory
+	// prompt, if not nil, asks for a line of text and gets the keyboard input
+	prompt     *prompt
+	promptKeys *keymap
+	// renaming computes a rename in the background, the preview shows the
+	// result until it is applied
+	renaming          *backgroundWork
+	renamePreview     *renamePreview
+	renamePreviewKeys *keymap
+	// extracting plans an extract refactoring in the background
+	extracting *backgroundWork
+	// tasks runs go commands like go build, the output panel shows what they
+	// print
+	tasks  *taskRunner
+	output outputPanel
+	// explorer shows the results of go test
+	explorer testExplorer
+	// coverage is the result of the last coverage run, which the editor and
+	// the coverage report show
+	coverage        *coverageSet
+	coverageReport  coveragePanel
+	loadingCoverage *backgroundWork
+	// debugAdapter, if not nil, starts the debugger for a program in dir.
+	// debug is the running debug session, the debug panel shows its state.
+	// The breakpoints and the watch expressions are kept between sessions.
+	debugAdapter func(dir string) (*dapClient, error)
+	debug        *debugSession
+	debugView    debugPanel
+	breakpoints  *breakpointSet
+	watches      []string
+	// benchmarks are the runs of go test -bench, if benchmarkDir is not empty
+	// they are saved there
+	benchmarks   benchmarkPanel
+	benchmarkDir string
+	// stopFollowing ends the tracking of edits in the editor's document for
+	// the diagnostics, the coverage and the breakpoints of its file
+	stopFollowing func()
+	// jump, if not nil, is where the caret goes once the file that is loading
+	// is shown
+	jump    *textPosition
+	screen  rectangle
+	focused bool
+}
+
+func newApp(p platform, g graphics, keys *keymap, commands *commandRegistry) *app {
+	a := &app{
+		platform:    p,
+		graphics:    g,
+		keyboard:    newKeyDispatcher(keys, commands),
+		frames:      newFrameScheduler(),
+		focused:     true,
+		settings:    defaultSettings(),
+		diagnostics: newDiagnosticSet(),
+		problems:    newProblemsPanel(),
+		vet:         newVetRunner(goVet),
+		completer:   newLocalCompleter(),
+		navigator:   newNavigator(findLocations),
+		locations:   newLocationsPanel(),
+		promptKeys:  newKeymapFrom(promptKeyBindings),
+		renaming:    newBackgroundWork(),
+		extracting:  newBackgroundWork(),
+		tasks:       newTaskRunner(startGoCommand),
+		output:      newOutputPanel(),
+		explorer:    newTestExplorer(),
+		coverage:    &coverageSet{},
+
+		coverageReport:  newCoveragePanel(),
+		loadingCoverage: newBackgroundWork(),
+		debugView:       newDebugPanel(),
+		breakpoints:     newBreakpointSet(),
+		benchmarks:      newBenchmarkPanel(),
+
+		renamePreviewKeys: newKeymapFrom(renamePreviewKeyBindings),
+		codeActions:       newCodeActionsPanel(),
+		codeActionKeys:    newKeymapFrom(codeActionKeyBindings),
+	}
+	a.frames.request = p.invalidate
+	a.diagnostics.changed = a.diagnosticsChanged
+	a.coverage.changed = a.coverageChanged
+	a.breakpoints.changed = a.breakpointsChanged
+	a.breakpoints.moved = a.breakpointsMoved
+	registerViewCommands(commands, a.frames)
+	registerFileCommands(commands, a)
+	registerProblemCommands(commands, a)
+	registerNavigationCommands(commands, a)
+	registerLanguageServerCommands(commands, a)
+	registerPromptCommands(commands, a)
+	registerRenameCommands(commands, a)
+	registerExtractCommands(commands, a)
+	registerTaskCommands(commands, a)
+	registerTestCommands(commands, a)
+	registerCoverageCommands(commands, a)
+	registerDebugCommands(commands, a)
+	registerBenchmarkCommands(commands, a)
+	// the debug panel shows its sections even before the first session
+	a.debugChanged()
+	return a
+}
+
+// registerFileCommands registers the commands that need to know the app's
+// file.
+func registerFileCommands(r *commandRegistry, a *app) {
+	r.register("file.save", func(*editor) {
+		if err := a.save(); err != nil {
+			a.platform.showError("Save", err.Error())
+		}
+	})
+	r.register("editor.organizeImports", func(e *editor) {
+		// a syntax error is shown in the editor
+		e.organizeImports(a.path)
+	})
+}
+
+// openFile starts loading the file in the background. The editor is created
+// once it is indexed.
+func (a *app) openFile(path string) error {
+	file, err := loadFile(path, nil)
+	if err != nil {
+		return err
+	}
+	if a.lsp != nil && a.path != "" {
+		a.lsp.close(a.path)
+	}
+	if a.stopFollowing != nil {
+		a.stopFollowing()
+		a.stopFollowing = nil
+	}
+	a.jump = nil
+	a.closeCodeActions()
+	a.closeFile()
+	a.file = file
+	a.path = path
+	a.editor = nil
+	// the analysis of the old document must not run without an editor
+	a.semantic = nil
+	a.platform.stopTimer(semanticTimer)
+	a.platform.startTimer(loadProgressTimer, 100*time.Millisecond)
+	a.frames.invalidateAll()
+	return nil
+}
+
+// quit stops everything that runs in the background and closes the window.
+func (a *app) quit() {
+	// the task's programs would keep running without the window
+	a.tasks.cancel()
+	if a.debug != nil {
+		a.debug.client.disconnect()
+	}
+	if a.lsp != nil {
+		a.lsp.shutdown()
+	}
+	a.platform.quit()
+	// the window is gone, nothing draws the editor's document anymore
+	a.closeFile()
+}
+
+// closeFile releases the mapping of the app's file, call it only when its
+// document is not drawn or edited anymore. A file that is still being indexed
+// is released once that is done.
+func (a *app) closeFile() {
+	if a.file == nil {
+		return
+	}
+	go a.file.close()
+	a.file = nil
+}
+
+func (a *app) setEditor(e *editor) {
+	a.editor = e
+	a.hover = nil
+	a.semantic = nil
+	a.platform.stopTimer(semanticTimer)
+	e.invalidate = a.frames.invalidate
+	e.now = a.platform.now
+	e.focused = a.focused
+	if a.path != "" {
+		e.diagnostics = a.diagnostics.inFile(a.path)
+		if a.coverageReport.visible {
+			e.coverage = a.coverage.inFile(a.path)
+		}
+		e.breakpoints = a.breakpoints.inFile(a.path)
+	}
+	a.showExecutionLine()
+	a.frames.invalidateAll()
+}
+
+// diagnosticsChanged updates the problems panel and the editor after the
+// diagnostics changed.
+func (a *app) diagnosticsChanged() {
+	a.problems.setList(a.diagnostics.all())
+	if a.editor != nil && a.path != "" {
+		a.editor.diagnostics = a.diagnostics.inFile(a.path)
+	}
+	a.frames.invalidateAll()
+}
+
+// handle reacts to the event. It returns false if the event was not used, in
+// which case the platform may do its default handling, e.g. for Alt+F4.
+func (a *app) handle(ev event) bool {
+	switch ev.(type) {
+	case keyDownEvent, charEvent, mouseDownEvent:
+		// the hover information is only shown until the user does something
+		a.closeHover()
+	}
+	switch ev := ev.(type) {
+	case keyDownEvent:
+		e := a.inputEditor()
+		return e != nil && a.keyboard.keyDown(e, ev.key)
+	case charEvent:
+		e := a.inputEditor()
+		if e == nil {
+			// the key press may have opened another file, e.g. Enter in a
+			// prompt, its character must not be swallowed from the next one
+			a.keyboard.swallowChar = false
+			return false
+		}
+		a.keyboard.char(e, ev.char, ev.repeatCount)
+	case mouseDownEvent:
+		if a.prompt != nil {
+			if a.prompt.area.contains(ev.x, ev.y) {
+				a.prompt.editor.mouseDown(a.graphics, ev.x, ev.y, ev.shift, ev.ctrl, ev.alt)
+				return true
+			}
+			a.closePrompt()
+		}
+		if a.renamePreview != nil || a.codeActions.visible {
+			// the preview and the code actions are closed with the keyboard
+			return true
+		}
+		if e := a.editor; e != nil && e.completion != nil && e.overlay.contains(ev.x, ev.y) {
+			if e.completion.list.contains(ev.x, ev.y) {
+				e.clickCompletion(a.graphics, ev.y)
+			}
+			return true
+		}
+		if a.editor != nil {
+			a.editor.closeCompletion()
+		}
+		if a.problems.visible && a.problems.area.contains(ev.x, ev.y) {
+			if i := a.problems.rowAt(a.graphics, ev.y); i != -1 {
+				a.showProblem(i)
+			}
+			return true
+		}
+		if a.locations.visible && a.locations.area.contains(ev.x, ev.y) {
+			if i := a.locations.rowAt(a.graphics, ev.y); i != -1 {
+				a.showLocation(i)
+			}
+			return true
+		}
+		if a.output.visible && a.output.area.contains(ev.x, ev.y) {
+			if i := a.output.rowAt(a.graphics, ev.y); i != -1 {
+				a.showOutputLine(i)
+			}
+			return true
+		}
+		if a.explorer.visible && a.explorer.area.contains(ev.x, ev.y) {
+			if i := a.explorer.rowAt(a.graphics, ev.y); i != -1 {
+				a.showTest(i)
+			}
+			return true
+		}
+		if a.coverageReport.visible && a.coverageReport.area.contains(ev.x, ev.y) {
+			if i := a.coverageReport.rowAt(a.graphics, ev.y); i != -1 {
+				a.showCoverageRow(i)
+			}
+			return true
+		}
+		if a.debugView.visible && a.debugView.area.contains(ev.x, ev.y) {
+			if i := a.debugView.rowAt(a.graphics, ev.y); i != -1 {
+				a.showDebugRow(i)
+			}
+			return true
+		}
+		if a.benchmarks.visible && a.benchmarks.area.contains(ev.x, ev.y) {
+			if i := a.benchmarks.rowAt(a.graphics, ev.y); i != -1 {
+				a.showBenchmarkRow(i)
+			}
+			return true
+		}
+		if e := a.editor; e != nil && e.gutter.contains(ev.x, ev.y) {
+			if m, ok := e.testMarkerAt(a.graphics, ev.y); ok {
+				a.runTest(m.name)
+				return true
+			}
+			if line, ok := e.gutterLine(a.graphics, ev.y); ok && isGoFile(a.path) {
+				a.toggleBreakpoint(line)
+				return true
+			}
+		}
+		if a.editor != nil {
+			a.editor.mouseDown(a.graphics, ev.x, ev.y, ev.shift, ev.ctrl, ev.alt)
+		}
+	case mouseMoveEvent:
+		if e := a.inputEditor(); e != nil {
+			e.mouseMove(a.graphics, ev.x, ev.y)
+		}
+	case mouseUpEvent:
+		if e := a.inputEditor(); e != nil {
+			e.mouseUp()
+		}
+	case resizeEvent:
+		a.screen = rect(0, 0, ev.width, ev.height)
+		a.frames.invalidateAll()
+	case focusEvent:
+		a.focused = ev.focused
+		if a.editor != nil {
+			a.editor.focused = ev.focused
+			if !ev.focused {
+				a.editor.closeCompletion()
+				// whatever happens in other windows starts a new undo step
+				a.editor.mouseUp()
+				a.editor.history.closeStep()
+			}
+			a.editor.changed()
+		}
+	case closeEvent:
+		// the window stays open if the user keeps the unsaved changes
+		a.leaveFile(a.quit)
+	case timerEvent:
+		if ev.id == languageServerTimer && a.lsp != nil {
+			if err := a.lsp.poll(); err != nil {
+				a.lsp.abort()
+				a.lsp = nil
+				a.diagnostics.setSource("lsp", nil)
+				a.platform.showError("Language Server", err.Error())
+			}
+		}
+		if ev.id == vetTimer {
+			a.updateVet()
+		}
+		if ev.id == completionTimer && !a.completer.poll() {
+			a.platform.stopTimer(completionTimer)
+		}
+		if ev.id == navigationTimer {
+			a.updateNavigation()
+		}
+		if ev.id == renameTimer && !a.renaming.poll() {
+			a.platform.stopTimer(renameTimer)
+		}
+		if ev.id == extractTimer && !a.extracting.poll() {
+			a.platform.stopTimer(extractTimer)
+		}
+		if ev.id == taskTimer {
+			a.updateTask()
+		}
+		if ev.id == coverageTimer && !a.loadingCoverage.poll() {
+			a.platform.stopTimer(coverageTimer)
+		}
+		if ev.id == debugTimer {
+			a.updateDebugging()
+		}
+		if ev.id == semanticTimer && a.semantic != nil {
+			changed, busy := a.semantic.update(a.editor.highlighter)
+			if changed {
+				a.editor.changed()
+			}
+			if !busy {
+				a.platform.stopTimer(semanticTimer)
+			}
+		}
+		if ev.id == loadProgressTimer {
+			if a.file.isDone() {
+				a.platform.stopTimer(loadProgressTimer)
+				e := newEditor(a.file.document())
+				if a.settings.PersistentUndo {
+					// there is often no history or it belongs to an older
+					// version of the file, then the editor starts without one
+					if h, err := loadHistory(historyPath(a.path), e.doc); err == nil {
+						e.history = h
+					}
+				}
+				a.setEditor(e)
+				stopDiagnostics := a.diagnostics.follow(a.path, e.doc)
+				stopCoverage := a.coverage.follow(a.path, e.doc)
+				stopBreakpoints := a.breakpoints.follow(a.path, e.doc)
+				a.stopFollowing = func() {
+					stopDiagnostics()
+					stopCoverage()
+					stopBreakpoints()
+				}
+				if a.jump != nil {
+					e.moveCaretTo(*a.jump)
+					a.jump = nil
+				}
+				if isGoFile(a.file.path) {
+					e.complete = a.complete
+					if strings.HasSuffix(a.file.path, "_test.go") {
+						e.testMarkers = a.testMarkers
+					}
+					a.highlightGo(a.file.path)
+					a.openInLanguageServer()
+				}
+			}
+			a.frames.invalidateAll()
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// save writes the document to its file. The imports of Go files are
+// organized and the code is formatted first if the settings say so, a syntax
+// error is shown in the editor but the file is saved anyway. Afterwards the
+// package is vetted in the background. A new document without a path is not
+// saved.
+func (a *app) save() error {
+	if a.editor == nil || a.path == "" {
+		return nil
+	}
+	if isGoFile(a.path) {
+		var err error
+		if a.settings.OrganizeImportsOnSave {
+			err = a.editor.organizeImports(a.path)
+		}
+		if a.settings.FormatOnSave && err == nil {
+			a.editor.format()
+		}
+	}
+	if a.file != nil {
+		if err := a.file.detach(); err != nil {
+			return err
+		}
+	}
+	if err := writeDocument(a.path, a.editor.doc); err != nil {
+		return err
+	}
+	a.editor.history.markSaved()
+	if a.settings.PersistentUndo {
+		// the file itself is saved, so this is not an error of the save
+		if err := a.editor.history.save(historyPath(a.path)); err != nil {
+			a.platform.showError("Undo History", err.Error())
+		}
+	}
+	if a.lsp != nil {
+		a.lsp.saved(a.path)
+	}
+	if isGoFile(a.path) && a.settings.VetOnSave {
+		a.vet.run(filepath.Dir(diagnosticPath(a.path)))
+		a.platform.startTimer(vetTimer, vetPoll)
+	}
+	return nil
+}
+
+// updateVet shows the result of go vet once it is done. If vet cannot run at
+// all, it is turned off for the rest of the session.
+func (a *app) updateVet() {
+	result, busy := a.vet.update()
+	if !busy {
+		a.platform.stopTimer(vetTimer)
+	}
+	if result == nil {
+		return
+	}
+	if result.err != nil {
+		a.settings.VetOnSave = false
+		a.platform.showError("go vet", result.err.Error())
+		return
+	}
+	// vet cannot check a package with type errors and reports them again
+	a.diagnostics.setSource("go vet", a.diagnostics.withoutDuplicates("go vet", result.diagnostics))
+}
+
+// highlightGo turns on syntax and semantic highlighting for the editor, path
+// is the Go file that it shows.
+func (a *app) highlightGo(path string) {
+	h := newGoHighlighter(a.editor.doc)
+	a.editor.highlighter = h
+	a.semantic = newSemanticAnalyzer(path)
+	a.semantic.diagnosticsChanged = func(list []diagnostic) {
+		// the language server reports the same errors
+		if a.lsp == nil {
+			a.diagnostics.setSource("go/types", list)
+		}
+	}
+	// scanning for importable packages takes a moment, it is done before
+	// imports are organized for the first time
+	go newPackageIndex(filepath.Dir(path))
+	h.changed = func() {
+		a.platform.startTimer(semanticTimer, semanticDelay)
+	}
+	a.platform.startTimer(semanticTimer, semanticDelay)
+}
+
+// openInLanguageServer sends the editor's document to the language server,
+// which is started first if necessary. The workspace is the module that the
+// file belongs to.
+func (a *app) openInLanguageServer() {
+	if a.lsp == nil && a.languageServer != nil {
+		dir, _ := filepath.Abs(filepath.Dir(a.path))
+		if root, _, ok := findModule(dir); ok {
+			dir = root
+		}
+		lsp, err := a.languageServer(dir)
+		if err != nil {
+			// the editor works without it, do not try again
+			a.languageServer = nil
+			a.platform.showError("Language Server", err.Error())
+			return
+		}
+		a.lsp = lsp
+		lsp.diagnosticsChanged = func(path string, list []lspDiagnostic) {
+			a.diagnostics.setFile("lsp", path, lsp.convertDiagnostics(path, list))
+		}
+		lsp.applyEdit = func(edit *lspWorkspaceEdit) {
+			if err := a.applyWorkspaceEdit(edit, lsp.utf8); err != nil {
+				a.platform.showError("Language Server", err.Error())
+			}
+		}
+		a.diagnostics.setSource("go/types", nil)
+		lsp.setWake(func() { a.platform.wake(languageServerTimer) })
+	}
+	if a.lsp != nil {
+		a.lsp.open(a.path, a.editor.doc)
+	}
+}
+
+// complete is the completion source for Go files. It asks the language
+// server, if there is one, and type-checks the package itself otherwise.
+func (a *app) complete(doc *document, offset int, done func([]completionItem, error)) {
+	if a.lsp != nil && a.lsp.ready {
+		a.lsp.completion(a.path, offset, func(list []lspCompletionItem, err error) {
+			done(lspCompletionItems(list), err)
+		})
+		return
+	}
+	a.completer.complete(a.path, doc.bytes(), offset, done)
+	a.platform.startTimer(completionTimer, completionPoll)
+}
+
+func isGoFile(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path), ".go")
+}
+
+// paint draws a frame if anything needs to be redrawn. update is the region
+// that the platform wants redrawn in addition to what the app invalidated.
+func (a *app) paint(update rectangle) error {
+	a.frames.invalidate(update)
+	return a.frames.drawFrame(a.graphics, a.screen, a.draw)
+}
+
+// draw draws the whole window content.
+func (a *app) draw() {
+	g := a.graphics
+	screen := a.screen
+	g.rect(screen.x, screen.y, screen.w, screen.h, windowBackgroundColor)
+	area := rect(
+		screen.x+windowMargin,
+		screen.y+windowMargin,
+		screen.w-2*windowMargin,
+		screen.h-2*windowMargin,
+	)
+	if h := a.problems.height(g); h > 0 {
+		h = min(h, area.h/2)
+		a.problems.draw(g, rect(area.x, area.y+area.h-h, area.w, h))
+		area.h -= h + windowMargin
+	}
+	if h := a.output.height(g); h > 0 {
+		h = min(h, area.h/2)
+		a.output.draw(g, rect(area.x, area.y+area.h-h, area.w, h))
+		area.h -= h + windowMargin
+	}
+	if h := a.explorer.height(g); h > 0 {
+		h = min(h, area.h/2)
+		a.explorer.draw(g, rect(area.x, area.y+area.h-h, area.w, h))
+		area.h -= h + windowMargin
+	}
+	if h := a.coverageReport.height(g); h > 0 {
+		h = min(h, area.h/2)
+		a.coverageReport.draw(g, rect(area.x, area.y+area.h-h, area.w, h))
+		area.h -= h + windowMargin
+	}
+	if h := a.debugView.height(g); h > 0 {
+		h = min(h, area.h/2)
+		a.debugView.draw(g, rect(area.x, area.y+area.h-h, area.w, h))
+		area.h -= h + windowMargin
+	}
+	if h := a.benchmarks.height(g); h > 0 {
+		h = min(h, area.h/2)
+		a.benchmarks.draw(g, rect(area.x, area.y+area.h-h, area.w, h))
+		area.h -= h + windowMargin
+	}
+	if h := a.locations.height(g); h > 0 {
+		h = min(h, area.h/2)
+		a.locations.draw(g, rect(area.x, area.y+area.h-h, area.w, h))
+		area.h -= h + windowMargin
+	}
+	if h := a.codeActions.height(g); h > 0 {
+		h = min(h, area.h/2)
+		a.codeActions.draw(g, rect(area.x, area.y+area.h-h, area.w, h))
+		area.h -= h + windowMargin
+	}
+	if a.renamePreview != nil {
+		h := min(a.renamePreview.height(g), area.h/2)
+		a.renamePreview.draw(g, rect(area.x, area.y+area.h-h, area.w, h))
+		area.h -= h + windowMargin
+	}
+	if a.editor != nil {
+		a.editor.draw(g, area)
+		// the popups may cover everything around the editor
+		a.editor.drawCompletion(g, screen)
+		if a.hover != nil {
+			a.drawHover(g, a.editor, screen)
+		}
+		if a.prompt != nil {
+			a.prompt.draw(g, a.editor, screen)
+		}
+		return
+	}
+	if a.file == nil {
+		return
+	}
+	// only the beginning of the first few lines can be visible, do not hand
+	// the whole file to the renderer
+	g.rect(area.x, area.y, area.w, area.h, editorBackgroundColor)
+	g.text(
+		a.file.preview(area.h/g.lineHeight()+1, maxVisibleLineLength),
+		area.x, area.y,
+		area,
+		editorTextColor,
+	)
+	// show a progress bar while the file is being indexed
+	g.rect(area.x, area.y+area.h-6, area.w, 6, 0xFF204040)
+	g.rect(
+		area.x, area.y+area.h-6,
+		round(float64(area.w)*a.file.progress()), 6,
+		0xFF40C0C0,
+	)
+}
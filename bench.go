@@ -0,0 +1,643 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// benchmarkRun holds the results of one go test -bench run.
+type benchmarkRun struct {
+	time time.Time
+	// packages are the packages in the order of the output
+	packages []string
+	// names are the benchmarks in the order of the output, they are prefixed
+	// with their package if the run has more than one
+	names []string
+	// units are the units of all measurements, ns/op first
+	units []string
+	// values are the measurements of each benchmark by unit, one per -count
+	values map[string]map[string][]float64
+	// output is what go test printed, it is saved as is because benchstat
+	// reads the same format
+	output string
+}
+
+const (
+	// benchmarkFileLayout is the time format of the names of the saved runs
+	benchmarkFileLayout = "2006-01-02_15-04-05"
+	// benchmarkAlpha is the p-value below which a difference is significant
+	benchmarkAlpha = 0.05
+)
+
+// parseBenchmarks reads the output of go test -bench. Lines that are not
+// results are skipped, like benchstat does.
+func parseBenchmarks(output string) *benchmarkRun {
+	type result struct {
+		pkg, name string
+		units     []string
+		values    []float64
+	}
+	run := &benchmarkRun{values: make(map[string]map[string][]float64), output: output}
+	var results []result
+	pkg := ""
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "pkg: ") {
+			pkg = strings.TrimSpace(line[len("pkg: "):])
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 || len(fields)%2 != 0 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[1]); err != nil {
+			continue
+		}
+		r := result{pkg: pkg, name: strings.TrimPrefix(fields[0], "Benchmark")}
+		for i := 2; i < len(fields); i += 2 {
+			v, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				r.units = nil
+				break
+			}
+			r.values = append(r.values, v)
+			r.units = append(r.units, fields[i+1])
+		}
+		if len(r.units) > 0 {
+			results = append(results, r)
+		}
+	}
+
+	for _, r := range results {
+		if !containsString(run.packages, r.pkg) {
+			run.packages = append(run.packages, r.pkg)
+		}
+	}
+	for _, r := range results {
+		name := r.name
+		if len(run.packages) > 1 {
+			name = path.Base(r.pkg) + "." + name
+		}
+		if run.values[name] == nil {
+			run.names = append(run.names, name)
+			run.values[name] = make(map[string][]float64)
+		}
+		for i, unit := range r.units {
+			if !containsString(run.units, unit) {
+				run.units = append(run.units, unit)
+			}
+			run.values[name][unit] = append(run.values[name][unit], r.values[i])
+		}
+	}
+	sort.SliceStable(run.units, func(i, j int) bool {
+		return run.units[i] == "ns/op" && run.units[j] != "ns/op"
+	})
+	return run
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// benchmarkPath is the directory with the user's saved benchmark runs.
+func benchmarkPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "gonutz-ide", "benchmarks")
+}
+
+// loadBenchmarkRuns reads the runs that were saved in dir, the oldest first.
+// A missing directory is not an error.
+func loadBenchmarkRuns(dir string) ([]*benchmarkRun, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, makeErr("load benchmarks", err)
+	}
+	var runs []*benchmarkRun
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), ".txt")
+		t, err := time.ParseInLocation(benchmarkFileLayout, name, time.Local)
+		if f.IsDir() || err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return runs, makeErr("load benchmarks", err)
+		}
+		run := parseBenchmarks(string(data))
+		run.time = t
+		if len(run.names) > 0 {
+			runs = append(runs, run)
+		}
+	}
+	return runs, nil
+}
+
+// saveBenchmarkRun writes the run's output to dir, named after its time.
+func saveBenchmarkRun(dir string, run *benchmarkRun) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return makeErr("save benchmarks", err)
+	}
+	name := run.time.Format(benchmarkFileLayout) + ".txt"
+	err := ioutil.WriteFile(filepath.Join(dir, name), []byte(run.output), 0666)
+	if err != nil {
+		return makeErr("save benchmarks", err)
+	}
+	return nil
+}
+
+// benchmarkStats sum up the measurements of one benchmark in one unit the
+// way benchstat does: outliers are removed and the rest is given as their
+// mean and their largest deviation from it.
+type benchmarkStats struct {
+	// values are the measurements without outliers
+	values []float64
+	mean   float64
+	// deviation is relative to the mean
+	deviation float64
+}
+
+func newBenchmarkStats(values []float64) benchmarkStats {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	q1, q3 := quantile(sorted, 0.25), quantile(sorted, 0.75)
+	low, high := q1-1.5*(q3-q1), q3+1.5*(q3-q1)
+	var s benchmarkStats
+	for _, v := range sorted {
+		if low <= v && v <= high {
+			s.values = append(s.values, v)
+			s.mean += v
+		}
+	}
+	s.mean /= float64(len(s.values))
+	for _, v := range s.values {
+		if s.mean != 0 {
+			s.deviation = math.Max(s.deviation, math.Abs(v-s.mean)/s.mean)
+		}
+	}
+	return s
+}
+
+// quantile interpolates between the sorted values, q is in [0, 1].
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	x := q * float64(len(sorted)-1)
+	i := int(x)
+	if i+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (x-float64(i))*(sorted[i+1]-sorted[i])
+}
+
+// mannWhitneyU returns the p-value of the two-sided Mann-Whitney U test, the
+// probability of samples at least as different as x and y if they came from
+// the same distribution. Small samples without ties get the exact
+// distribution, the others the normal approximation.
+func mannWhitneyU(x, y []float64) float64 {
+	n1, n2 := len(x), len(y)
+	if n1 == 0 || n2 == 0 {
+		return 1
+	}
+	type value struct {
+		v     float64
+		fromX bool
+	}
+	var all []value
+	for _, v := range x {
+		all = append(all, value{v, true})
+	}
+	for _, v := range y {
+		all = append(all, value{v, false})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].v < all[j].v })
+
+	// equal values share the mean of their ranks
+	rankSum, ties := 0.0, 0.0
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		rank := float64(i+1+j) / 2
+		if t := float64(j - i); t > 1 {
+			ties += t*t*t - t
+		}
+		for k := i; k < j; k++ {
+			if all[k].fromX {
+				rankSum += rank
+			}
+		}
+		i = j
+	}
+	u := rankSum - float64(n1*(n1+1))/2
+
+	if ties == 0 && n1 <= 50 && n2 <= 50 {
+		counts := mannWhitneyCounts(n1, n2)
+		k := int(u + 0.5)
+		lower, upper, total := 0.0, 0.0, 0.0
+		for i, c := range counts {
+			if i <= k {
+				lower += c
+			}
+			if i >= k {
+				upper += c
+			}
+			total += c
+		}
+		return math.Min(1, 2*math.Min(lower, upper)/total)
+	}
+	n := float64(n1 + n2)
+	variance := float64(n1*n2) / 12 * (n + 1 - ties/(n*(n-1)))
+	if variance <= 0 {
+		return 1
+	}
+	z := math.Max(0, math.Abs(u-float64(n1*n2)/2)-0.5) / math.Sqrt(variance)
+	return math.Erfc(z / math.Sqrt2)
+}
+
+// mannWhitneyCounts returns for each U the number of orders of n1 and n2
+// distinct values in which that many pairs have the first sample's value
+// above the second's.
+func mannWhitneyCounts(n1, n2 int) []float64 {
+	// prev[j] are the counts for i-1 and j values, the largest value either
+	// comes from the first sample and is above all j others, or not
+	prev := make([][]float64, n2+1)
+	for j := range prev {
+		prev[j] = []float64{1}
+	}
+	for i := 1; i <= n1; i++ {
+		cur := make([][]float64, n2+1)
+		cur[0] = []float64{1}
+		for j := 1; j <= n2; j++ {
+			counts := make([]float64, i*j+1)
+			for u, c := range prev[j] {
+				counts[u+j] += c
+			}
+			for u, c := range cur[j-1] {
+				counts[u] += c
+			}
+			cur[j] = counts
+		}
+		prev = cur
+	}
+	return prev[n2]
+}
+
+// benchmarkUnitName is the column name that benchstat uses for the unit.
+func benchmarkUnitName(unit string) string {
+	switch unit {
+	case "ns/op":
+		return "time/op"
+	case "B/op":
+		return "alloc/op"
+	case "MB/s":
+		return "speed"
+	}
+	return unit
+}
+
+// lowerIsBetter tells if a decrease in the unit is an improvement.
+func lowerIsBetter(unit string) bool {
+	return !strings.HasSuffix(unit, "/s")
+}
+
+// benchmarkScaler returns a function that formats values of the unit with
+// three significant digits, in the scale that suits v.
+func benchmarkScaler(v float64, unit string) func(float64) string {
+	type scale struct {
+		factor float64
+		suffix string
+	}
+	scales := []scale{{1e9, "G"}, {1e6, "M"}, {1e3, "k"}, {1, ""}}
+	switch unit {
+	case "ns/op":
+		scales = []scale{{1e9, "s"}, {1e6, "ms"}, {1e3, "µs"}, {1, "ns"}}
+	case "B/op":
+		scales = []scale{{1e9, "GB"}, {1e6, "MB"}, {1e3, "kB"}, {1, "B"}}
+	case "MB/s":
+		scales = []scale{{1e3, "GB/s"}, {1, "MB/s"}, {1e-3, "kB/s"}}
+	}
+	s := scales[len(scales)-1]
+	for _, candidate := range scales {
+		if math.Abs(v) >= candidate.factor {
+			s = candidate
+			break
+		}
+	}
+	return func(x float64) string {
+		x /= s.factor
+		switch {
+		case math.Abs(x) >= 99.5:
+			return fmt.Sprintf("%.0f%s", x, s.suffix)
+		case math.Abs(x) >= 9.995:
+			return fmt.Sprintf("%.1f%s", x, s.suffix)
+		}
+		return fmt.Sprintf("%.2f%s", x, s.suffix)
+	}
+}
+
+func formatBenchmarkStats(s benchmarkStats, scale func(float64) string) string {
+	return fmt.Sprintf("%s ± %.0f%%", scale(s.mean), 100*s.deviation)
+}
+
+// benchmarkRow is a line of the comparison table.
+type benchmarkRow struct {
+	text    string
+	heading bool
+	color   uint32
+}
+
+const (
+	benchmarkBetterColor = 0xFF1E8E3E
+	benchmarkWorseColor  = 0xFFD93025
+)
+
+// compareBenchmarks makes a table like benchstat's of the benchmarks that are
+// in both runs, one section per unit. A delta is only given if it is
+// significant, otherwise it is "~". If before is nil the table only sums up
+// the run after.
+func compareBenchmarks(before, after *benchmarkRun) []benchmarkRow {
+	var rows []benchmarkRow
+	for _, unit := range after.units {
+		header := []string{"name", benchmarkUnitName(unit)}
+		if before != nil {
+			header = []string{"name", "old " + benchmarkUnitName(unit), "new " + benchmarkUnitName(unit), "delta", ""}
+		}
+		table := [][]string{header}
+		colors := []uint32{0}
+		for _, name := range after.names {
+			newValues, ok := after.values[name][unit]
+			if !ok {
+				continue
+			}
+			newStats := newBenchmarkStats(newValues)
+			if before == nil {
+				scale := benchmarkScaler(newStats.mean, unit)
+				table = append(table, []string{name, formatBenchmarkStats(newStats, scale)})
+				colors = append(colors, editorTextColor)
+				continue
+			}
+			oldValues, ok := before.values[name][unit]
+			if !ok {
+				continue
+			}
+			oldStats := newBenchmarkStats(oldValues)
+			scale := benchmarkScaler(oldStats.mean, unit)
+			p := mannWhitneyU(oldStats.values, newStats.values)
+			delta, color := "~", uint32(editorTextColor)
+			if p < benchmarkAlpha && oldStats.mean != 0 {
+				change := newStats.mean/oldStats.mean - 1
+				delta = fmt.Sprintf("%+.2f%%", 100*change)
+				if change != 0 {
+					color = benchmarkWorseColor
+					if (change < 0) == lowerIsBetter(unit) {
+						color = benchmarkBetterColor
+					}
+				}
+			}
+			note := fmt.Sprintf("(p=%.3f n=%d+%d)", p, len(oldStats.values), len(newStats.values))
+			table = append(table, []string{
+				name,
+				formatBenchmarkStats(oldStats, scale),
+				formatBenchmarkStats(newStats, scale),
+				delta,
+				note,
+			})
+			colors = append(colors, color)
+		}
+		if len(table) == 1 {
+			continue
+		}
+		if len(rows) > 0 {
+			rows = append(rows, benchmarkRow{color: editorTextColor})
+		}
+		for i, line := range alignColumns(table) {
+			rows = append(rows, benchmarkRow{text: line, heading: i == 0, color: colors[i]})
+		}
+	}
+	if len(rows) == 0 {
+		rows = append(rows, benchmarkRow{text: "no benchmarks in common", color: editorTextColor})
+	}
+	return rows
+}
+
+// alignColumns pads the cells so that the columns line up in a monospace
+// font. The delta column is right-aligned like in benchstat.
+func alignColumns(table [][]string) []string {
+	widths := make([]int, len(table[0]))
+	for _, row := range table {
+		for i, cell := range row {
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+	lines := make([]string, len(table))
+	for r, row := range table {
+		var line strings.Builder
+		for i, cell := range row {
+			padding := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell))
+			if i > 0 {
+				line.WriteString("  ")
+			}
+			if i == 3 && r > 0 {
+				line.WriteString(padding + cell)
+			} else {
+				line.WriteString(cell + padding)
+			}
+		}
+		lines[r] = strings.TrimRight(line.String(), " ")
+	}
+	return lines
+}
+
+// benchmarkPanel lists the benchmark runs and compares two of them, the base
+// run A and the run B.
+type benchmarkPanel struct {
+	listPanel
+	runs []*benchmarkRun
+	// base and compared are indexes in runs or -1
+	base, compared int
+	// table is the comparison of the two runs, it follows the runs in the
+	// list
+	table []benchmarkRow
+}
+
+func newBenchmarkPanel() benchmarkPanel {
+	return benchmarkPanel{
+		listPanel: listPanel{title: "Benchmarks", selected: -1},
+		base:      -1,
+		compared:  -1,
+	}
+}
+
+// add appends a run and compares it with the one that was shown before.
+func (p *benchmarkPanel) add(run *benchmarkRun) {
+	p.runs = append(p.runs, run)
+	p.base = p.compared
+	if p.base == -1 {
+		p.base = len(p.runs) - 2
+	}
+	p.compared = len(p.runs) - 1
+	p.update()
+	// the new comparison is more interesting than the list of runs
+	p.top = clamp(len(p.runs), 0, max(0, p.rows-listPanelRows))
+}
+
+// setRuns replaces the runs and compares the last two.
+func (p *benchmarkPanel) setRuns(runs []*benchmarkRun) {
+	p.runs = runs
+	p.base, p.compared = len(runs)-2, len(runs)-1
+	if p.base < 0 {
+		p.base = -1
+	}
+	p.update()
+}
+
+// choose makes run i the compared one, the one that was compared becomes the
+// base. Choosing the compared run again shows it alone.
+func (p *benchmarkPanel) choose(i int) {
+	if i == p.compared {
+		p.base = -1
+	} else {
+		p.base, p.compared = p.compared, i
+	}
+	p.update()
+}
+
+func (p *benchmarkPanel) update() {
+	p.table = nil
+	p.title = "Benchmarks"
+	if p.compared != -1 {
+		var base *benchmarkRun
+		if p.base != -1 {
+			base = p.runs[p.base]
+			p.title += " - A vs B"
+		}
+		p.table = append([]benchmarkRow{{}}, compareBenchmarks(base, p.runs[p.compared])...)
+	}
+	p.setRows(len(p.runs) + len(p.table))
+}
+
+// runText describes run i with its mark, time, packages and size.
+func (p *benchmarkPanel) runText(i int) string {
+	run := p.runs[i]
+	mark := "  "
+	if i == p.base {
+		mark = "A "
+	}
+	if i == p.compared {
+		mark = "B "
+	}
+	packages := strings.Join(run.packages, ", ")
+	if packages == "" {
+		packages = "(unknown package)"
+	}
+	return mark + run.time.Format("2006-01-02 15:04:05") + "  " + packages +
+		"  (" + strconv.Itoa(len(run.names)) + " benchmarks)"
+}
+
+func (p *benchmarkPanel) draw(g graphics, area rectangle) {
+	p.listPanel.draw(g, area, func(i int, row rectangle) {
+		if i < len(p.runs) {
+			g.text([]byte(p.runText(i)), row.x+4, row.y, row, editorTextColor)
+			return
+		}
+		r := p.table[i-len(p.runs)]
+		if r.heading {
+			fillRect(g, row, listHeaderColor)
+		}
+		g.text([]byte(r.text), row.x+4, row.y, row, r.color)
+	})
+}
+
+// registerBenchmarkCommands registers the commands that run the benchmarks
+// and compare their runs.
+func registerBenchmarkCommands(r *commandRegistry, a *app) {
+	r.register("task.benchmark", func(*editor) {
+		a.runBenchmarks(false)
+	})
+	r.register("task.benchmarkModule", func(*editor) {
+		a.runBenchmarks(true)
+	})
+	r.register("view.toggleBenchmarks", func(*editor) {
+		a.benchmarks.visible = !a.benchmarks.visible
+		a.frames.invalidateAll()
+	})
+	r.register("benchmarks.pageUp", func(*editor) {
+		a.benchmarks.top = max(0, a.benchmarks.top-listPanelRows)
+		a.frames.invalidateAll()
+	})
+	r.register("benchmarks.pageDown", func(*editor) {
+		p := &a.benchmarks
+		p.top = clamp(p.top+listPanelRows, 0, max(0, p.rows-listPanelRows))
+		a.frames.invalidateAll()
+	})
+}
+
+// runBenchmarks runs the benchmarks of the package of the app's file, or its
+// module, as often as the settings say.
+func (a *app) runBenchmarks(moduleWide bool) {
+	target := "."
+	if moduleWide {
+		target = "./..."
+	}
+	count := max(1, a.settings.BenchmarkCount)
+	args := []string{"test", "-run=^$", "-bench=.", "-count=" + strconv.Itoa(count), "-benchmem", target}
+	title := "go " + strings.Join(args, " ")
+	dir, ok := a.taskDir(title, moduleWide)
+	if !ok {
+		return
+	}
+	a.startTask(task{title: title, dir: dir, args: args, benchmarks: true})
+}
+
+// addBenchmarkRun keeps the results of the finished benchmark task, which
+// are in the output panel, and compares them with the last run.
+func (a *app) addBenchmarkRun(failed bool) {
+	lines := make([]string, len(a.output.lines))
+	for i, line := range a.output.lines {
+		lines[i] = line.text
+	}
+	run := parseBenchmarks(strings.Join(lines, "\n") + "\n")
+	if len(run.names) == 0 {
+		if !failed {
+			a.platform.showError("Benchmarks", "no benchmarks ran")
+		}
+		return
+	}
+	run.time = a.platform.now()
+	if a.benchmarkDir != "" {
+		if err := saveBenchmarkRun(a.benchmarkDir, run); err != nil {
+			a.platform.showError("Benchmarks", err.Error())
+		}
+	}
+	a.benchmarks.add(run)
+	a.benchmarks.visible = true
+}
+
+// showBenchmarkRow chooses the run in row i for the comparison.
+func (a *app) showBenchmarkRow(i int) {
+	if i < len(a.benchmarks.runs) {
+		a.benchmarks.choose(i)
+		a.frames.invalidateAll()
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBenchmarks(t *testing.T) {
+	// the output of go test -bench=. -benchmem -count=2 -cpu=1,4
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "benchmarks.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := parseBenchmarks(string(data))
+	if fmt.Sprint(run.packages) != "[example.com/brec]" {
+		t.Errorf("the packages are %v", run.packages)
+	}
+	// the CPU suffixes tell the runs with different GOMAXPROCS apart
+	names := "[Join Join-4 Repeat/n=10 Repeat/n=10-4 Repeat/n=1000 Repeat/n=1000-4]"
+	if fmt.Sprint(run.names) != names {
+		t.Errorf("the names are %v, want %v", run.names, names)
+	}
+	if fmt.Sprint(run.units) != "[ns/op B/op allocs/op MB/s]" {
+		t.Errorf("the units are %v", run.units)
+	}
+	values := []struct {
+		name, unit string
+		want       string
+	}{
+		{"Join", "ns/op", "[102.6 78.46]"},
+		{"Join-4", "B/op", "[8 8]"},
+		{"Repeat/n=1000", "ns/op", "[1111 324.7]"},
+		{"Repeat/n=10-4", "MB/s", "[62.61 92.86]"},
+		{"Repeat/n=1000-4", "allocs/op", "[1 1]"},
+		{"Join", "MB/s", "[]"},
+	}
+	for _, v := range values {
+		if got := fmt.Sprint(run.values[v.name][v.unit]); got != v.want {
+			t.Errorf("%s has the %s %s, want %s", v.name, v.unit, got, v.want)
+		}
+	}
+	if run.output != string(data) {
+		t.Error("the output is not kept as it is")
+	}
+
+	// with more than one package the names get the package's name, lines
+	// that are not results are skipped
+	two := parseBenchmarks(`pkg: a/x
+BenchmarkA-8 	 1 	 1 ns/op
+BenchmarkBroken-8 	 many 	 1 ns/op
+BenchmarkOdd-8 	 1 	 1 ns/op 	 2
+pkg: a/y
+BenchmarkA-8 	 1 	 2 ns/op
+--- FAIL: BenchmarkC
+`)
+	if fmt.Sprint(two.names) != "[x.A-8 y.A-8]" || fmt.Sprint(two.values["y.A-8"]["ns/op"]) != "[2]" {
+		t.Errorf("two packages give %v with %v", two.names, two.values)
+	}
+}
+
+func TestBenchmarkStats(t *testing.T) {
+	// the outlier 500 is left out
+	s := newBenchmarkStats([]float64{100, 101, 99, 100, 500})
+	if len(s.values) != 4 || s.mean != 100 || s.deviation != 0.01 {
+		t.Errorf("the stats are %+v", s)
+	}
+	if s := newBenchmarkStats([]float64{0, 0}); s.mean != 0 || s.deviation != 0 {
+		t.Errorf("zeros give %+v", s)
+	}
+}
+
+func TestMannWhitneyU(t *testing.T) {
+	tests := []struct {
+		name string
+		x, y []float64
+		want float64
+	}{
+		// 2 of the 20 orders of 3 and 3 values are as extreme
+		{"3 vs 3 apart", []float64{1, 2, 3}, []float64{4, 5, 6}, 0.1},
+		{"3 vs 3 reversed", []float64{4, 5, 6}, []float64{1, 2, 3}, 0.1},
+		{"3 vs 3 mixed", []float64{1, 3, 5}, []float64{2, 4, 6}, 0.7},
+		{"6 vs 6 apart", []float64{1, 2, 3, 4, 5, 6}, []float64{7, 8, 9, 10, 11, 12}, 2.0 / 924},
+		{"4 vs 4 apart", []float64{100, 101, 102, 103}, []float64{80, 81, 82, 83}, 2.0 / 70},
+		{"all equal", []float64{1, 1, 1}, []float64{1, 1, 1}, 1},
+		{"empty", nil, []float64{1, 2}, 1},
+	}
+	for _, tt := range tests {
+		if p := mannWhitneyU(tt.x, tt.y); math.Abs(p-tt.want) > 1e-12 {
+			t.Errorf("%s: p is %v, want %v", tt.name, p, tt.want)
+		}
+	}
+
+	// ties use the normal approximation, it is symmetric
+	x := []float64{1, 1, 2, 2, 3, 3}
+	y := []float64{5, 5, 6, 6, 7, 7}
+	p := mannWhitneyU(x, y)
+	if p < 0.001 || p > 0.01 {
+		t.Errorf("p with ties is %v", p)
+	}
+	if q := mannWhitneyU(y, x); q != p {
+		t.Errorf("p with ties is %v one way and %v the other", p, q)
+	}
+
+	// the exact counts of each U add up to all orders of the values
+	counts := mannWhitneyCounts(3, 3)
+	if fmt.Sprint(counts) != "[1 1 2 3 3 3 3 2 1 1]" {
+		t.Errorf("the counts for 3 and 3 values are %v", counts)
+	}
+}
+
+func TestBenchmarkScaler(t *testing.T) {
+	tests := []struct {
+		v    float64
+		unit string
+		want string
+	}{
+		{1234, "ns/op", "1.23µs"},
+		{12345, "ns/op", "12.3µs"},
+		{123456, "ns/op", "123µs"},
+		{2.5e9, "ns/op", "2.50s"},
+		{64, "B/op", "64.0B"},
+		{2048, "B/op", "2.05kB"},
+		{2, "allocs/op", "2.00"},
+		{0.5, "MB/s", "500kB/s"},
+		{1205.61, "MB/s", "1.21GB/s"},
+	}
+	for _, tt := range tests {
+		if got := benchmarkScaler(tt.v, tt.unit)(tt.v); got != tt.want {
+			t.Errorf("%v %s is %s, want %s", tt.v, tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestCompareBenchmarks(t *testing.T) {
+	before := parseBenchmarks(`pkg: p
+BenchmarkFast 1 100 ns/op 8 B/op
+BenchmarkFast 1 101 ns/op 8 B/op
+BenchmarkFast 1 102 ns/op 8 B/op
+BenchmarkFast 1 103 ns/op 8 B/op
+BenchmarkSame 1 50 ns/op 0 B/op
+BenchmarkSame 1 52 ns/op 0 B/op
+BenchmarkSame 1 51 ns/op 0 B/op
+BenchmarkSame 1 53 ns/op 0 B/op
+BenchmarkGone 1 5 ns/op
+`)
+	after := parseBenchmarks(`pkg: p
+BenchmarkFast 1 80 ns/op 8 B/op
+BenchmarkFast 1 81 ns/op 8 B/op
+BenchmarkFast 1 82 ns/op 8 B/op
+BenchmarkFast 1 83 ns/op 8 B/op
+BenchmarkSame 1 51.5 ns/op 0 B/op
+BenchmarkSame 1 50.5 ns/op 0 B/op
+BenchmarkSame 1 52.5 ns/op 0 B/op
+BenchmarkSame 1 53.5 ns/op 0 B/op
+`)
+	rows := compareBenchmarks(before, after)
+	var lines []string
+	for _, r := range rows {
+		lines = append(lines, r.text)
+	}
+	want := `name  old time/op  new time/op  delta
+Fast  102ns ± 1%   81.5ns ± 2%  -19.70%  (p=0.029 n=4+4)
+Same  51.5ns ± 3%  52.0ns ± 3%        ~  (p=0.686 n=4+4)
+
+name  old alloc/op  new alloc/op  delta
+Fast  8.00B ± 0%    8.00B ± 0%        ~  (p=1.000 n=4+4)
+Same  0.00B ± 0%    0.00B ± 0%        ~  (p=1.000 n=4+4)`
+	if got := strings.Join(lines, "\n"); got != want {
+		t.Fatalf("the comparison is\n%s\nwant\n%s", got, want)
+	}
+	if !rows[0].heading || rows[1].heading {
+		t.Error("the wrong rows are headings")
+	}
+	if rows[1].color != benchmarkBetterColor || rows[2].color != editorTextColor {
+		t.Errorf("the faster benchmark has the color %X, the other one %X", rows[1].color, rows[2].color)
+	}
+
+	single := compareBenchmarks(nil, after)
+	if single[0].text != "name  time/op" || !strings.HasPrefix(single[1].text, "Fast  81.5ns ± 2%") {
+		t.Errorf("a single run gives %v", single)
+	}
+	other := parseBenchmarks("BenchmarkX 1 1 ns/op\n")
+	if r := compareBenchmarks(other, after); len(r) != 1 || r[0].text != "no benchmarks in common" {
+		t.Errorf("runs without common benchmarks give %v", r)
+	}
+}
+
+func TestBenchmarkPanel(t *testing.T) {
+	a := parseBenchmarks("BenchmarkX 1 1 ns/op\n")
+	b := parseBenchmarks("BenchmarkX 1 2 ns/op\n")
+	p := newBenchmarkPanel()
+	p.add(a)
+	if p.base != -1 || p.compared != 0 || p.title != "Benchmarks" {
+		t.Errorf("after the first run A is %d and B is %d", p.base, p.compared)
+	}
+	// the new run is compared with the previous one
+	p.add(b)
+	if p.base != 0 || p.compared != 1 || p.title != "Benchmarks - A vs B" {
+		t.Errorf("after the second run A is %d and B is %d", p.base, p.compared)
+	}
+	if !strings.HasPrefix(p.runText(0), "A ") || !strings.HasPrefix(p.runText(1), "B ") {
+		t.Errorf("the runs are %q and %q", p.runText(0), p.runText(1))
+	}
+	p.choose(0)
+	if p.base != 1 || p.compared != 0 {
+		t.Errorf("after choosing the first run A is %d and B is %d", p.base, p.compared)
+	}
+	p.choose(0)
+	if p.base != -1 || p.compared != 0 {
+		t.Errorf("after choosing B again A is %d and B is %d", p.base, p.compared)
+	}
+}
+
+func TestSaveBenchmarkRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	before := parseBenchmarks("BenchmarkX 1 1 ns/op\n")
+	after := parseBenchmarks("BenchmarkY 1 2 ns/op\n")
+	before.time = time.Date(2026, 1, 2, 3, 4, 5, 0, time.Local)
+	after.time = before.time.Add(time.Hour)
+	if err := saveBenchmarkRun(dir, after); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveBenchmarkRun(dir, before); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("BenchmarkZ 1 1 ns/op\n"), 0666)
+
+	// the runs are loaded in order, other files are skipped
+	runs, err := loadBenchmarkRuns(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 || !runs[0].time.Equal(before.time) || fmt.Sprint(runs[1].names) != "[Y]" {
+		t.Errorf("the loaded runs are %v", runs)
+	}
+	if runs, err := loadBenchmarkRuns(filepath.Join(dir, "missing")); err != nil || runs != nil {
+		t.Errorf("a missing directory gives %v, %v", runs, err)
+	}
+}
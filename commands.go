@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// commandRegistry holds all named actions that can be bound to keys.
+type commandRegistry struct {
+	commands map[string]func(e *editor)
+}
+
+func newCommandRegistry() *commandRegistry {
+	return &commandRegistry{commands: make(map[string]func(e *editor))}
+}
+
+func (r *commandRegistry) register(name string, f func(e *editor)) {
+	r.commands[name] = f
+}
+
+// run executes the named command. It returns false if there is no such
+// command.
+func (r *commandRegistry) run(name string, e *editor) bool {
+	f, ok := r.commands[name]
+	if ok {
+		f(e)
+	}
+	return ok
+}
+
+// registerEditorCommands registers all commands that work on the text in an
+// editor.
+func registerEditorCommands(r *commandRegistry) {
+	// every motion is registered twice, once for moving the cursors and once,
+	// with the suffix "Select", for extending their selections
+	motions := []struct {
+		name string
+		move func(e *editor, extend bool)
+	}{
+		{"cursorLeft", (*editor).moveLeft},
+		{"cursorRight", (*editor).moveRight},
+		{"cursorUp", func(e *editor, extend bool) { e.moveLines(-1, extend) }},
+		{"cursorDown", func(e *editor, extend bool) { e.moveLines(1, extend) }},
+		{"cursorPageUp", func(e *editor, extend bool) { e.movePages(-1, extend) }},
+		{"cursorPageDown", func(e *editor, extend bool) { e.movePages(1, extend) }},
+		{"cursorWordLeft", motionCommand(wordLeft)},
+		{"cursorWordRight", motionCommand(wordRight)},
+		{"cursorHome", motionCommand(lineHome)},
+		{"cursorEnd", motionCommand(lineEnd)},
+		{"cursorTop", motionCommand(documentStart)},
+		{"cursorBottom", motionCommand(documentEnd)},
+	}
+	for _, m := range motions {
+		move := m.move
+		r.register("editor."+m.name, func(e *editor) { move(e, false) })
+		r.register("editor."+m.name+"Select", func(e *editor) { move(e, true) })
+	}
+
+	r.register("editor.deleteLeft", func(e *editor) {
+		e.deleteBackward(e.now())
+	})
+	r.register("editor.deleteRight", func(e *editor) {
+		e.deleteForward(e.now())
+	})
+	r.register("editor.deleteWordLeft", func(e *editor) {
+		e.deleteAround(wordLeft, e.now())
+	})
+	r.register("editor.deleteWordRight", func(e *editor) {
+		e.deleteAround(wordRight, e.now())
+	})
+	r.register("editor.newLine", func(e *editor) {
+		e.insertText([]byte{'\n'}, typingEdit, e.now())
+	})
+	r.register("editor.tab", func(e *editor) {
+		e.insertText([]byte{'\t'}, typingEdit, e.now())
+	})
+	r.register("editor.commentLine", func(e *editor) {
+		e.commentLines(true, e.now())
+	})
+	r.register("editor.uncommentLine", func(e *editor) {
+		e.commentLines(false, e.now())
+	})
+	r.register("editor.selectAll", (*editor).selectAll)
+	r.register("editor.undo", (*editor).undo)
+	r.register("editor.redo", (*editor).redo)
+	r.register("editor.addCursorAbove", func(e *editor) {
+		e.addCursorVertically(-1)
+	})
+	r.register("editor.addCursorBelow", func(e *editor) {
+		e.addCursorVertically(1)
+	})
+	r.register("editor.addNextOccurrence", (*editor).addNextOccurrence)
+	r.register("editor.singleCursor", (*editor).singleCursor)
+	r.register("editor.triggerCompletion", (*editor).triggerCompletion)
+	r.register("completion.next", func(e *editor) {
+		e.moveCompletionSelection(1)
+	})
+	r.register("completion.previous", func(e *editor) {
+		e.moveCompletionSelection(-1)
+	})
+	r.register("completion.nextPage", func(e *editor) {
+		e.moveCompletionSelection(completionRows)
+	})
+	r.register("completion.previousPage", func(e *editor) {
+		e.moveCompletionSelection(-completionRows)
+	})
+	r.register("completion.accept", (*editor).acceptCompletion)
+	r.register("completion.close", (*editor).closeCompletion)
+	r.register("snippet.nextPlaceholder", func(e *editor) {
+		e.nextPlaceholder(1)
+	})
+	r.register("snippet.previousPlaceholder", func(e *editor) {
+		e.nextPlaceholder(-1)
+	})
+	r.register("snippet.exit", (*editor).endSnippet)
+	r.register("editor.format", func(e *editor) {
+		// a syntax error is shown in the editor, there is nothing else to do
+		// about it here
+		e.format()
+	})
+}
+
+func motionCommand(m motion) func(e *editor, extend bool) {
+	return func(e *editor, extend bool) {
+		e.moveCaret(m, extend)
+	}
+}
+
+type keyBinding struct {
+	keys, command string
+}
+
+// defaultKeyBindings are used unless the user configuration overrides them.
+var defaultKeyBindings = []keyBinding{
+	{"Left", "editor.cursorLeft"},
+	{"Shift+Left", "editor.cursorLeftSelect"},
+	{"Right", "editor.cursorRight"},
+	{"Shift+Right", "editor.cursorRightSelect"},
+	{"Up", "editor.cursorUp"},
+	{"Shift+Up", "editor.cursorUpSelect"},
+	{"Down", "editor.cursorDown"},
+	{"Shift+Down", "editor.cursorDownSelect"},
+	{"PageUp", "editor.cursorPageUp"},
+	{"Shift+PageUp", "editor.cursorPageUpSelect"},
+	{"PageDown", "editor.cursorPageDown"},
+	{"Shift+PageDown", "editor.cursorPageDownSelect"},
+	{"Ctrl+Left", "editor.cursorWordLeft"},
+	{"Ctrl+Shift+Left", "editor.cursorWordLeftSelect"},
+	{"Ctrl+Right", "editor.cursorWordRight"},
+	{"Ctrl+Shift+Right", "editor.cursorWordRightSelect"},
+	{"Home", "editor.cursorHome"},
+	{"Shift+Home", "editor.cursorHomeSelect"},
+	{"End", "editor.cursorEnd"},
+	{"Shift+End", "editor.cursorEndSelect"},
+	{"Ctrl+Home", "editor.cursorTop"},
+	{"Ctrl+Shift+Home", "editor.cursorTopSelect"},
+	{"Ctrl+End", "editor.cursorBottom"},
+	{"Ctrl+Shift+End", "editor.cursorBottomSelect"},
+	{"Backspace", "editor.deleteLeft"},
+	{"Shift+Backspace", "editor.deleteLeft"},
+	{"Delete", "editor.deleteRight"},
+	{"Ctrl+Backspace", "editor.deleteWordLeft"},
+	{"Ctrl+Delete", "editor.deleteWordRight"},
+	{"Enter", "editor.newLine"},
+	{"Shift+Enter", "editor.newLine"},
+	{"Tab", "editor.tab"},
+	{"Ctrl+K Ctrl+C", "editor.commentLine"},
+	{"Ctrl+K Ctrl+U", "editor.uncommentLine"},
+	{"Ctrl+A", "editor.selectAll"},
+	{"Ctrl+Z", "editor.undo"},
+	{"Ctrl+Y", "editor.redo"},
+	{"Ctrl+Shift+Z", "editor.redo"},
+	{"Ctrl+Alt+Up", "editor.addCursorAbove"},
+	{"Ctrl+Alt+Down", "editor.addCursorBelow"},
+	{"Ctrl+D", "editor.addNextOccurrence"},
+	{"Escape", "editor.singleCursor"},
+	{"Shift+Alt+F", "editor.format"},
+	{"Shift+Alt+O", "editor.organizeImports"},
+	{"Ctrl+Space", "editor.triggerCompletion"},
+	{"Ctrl+S", "file.save"},
+	{"F8", "editor.nextProblem"},
+	{"Shift+F8", "editor.previousProblem"},
+	{"Ctrl+Shift+M", "view.toggleProblems"},
+	{"F12", "editor.goToDefinition"},
+	{"Ctrl+Shift+F12", "editor.goToTypeDefinition"},
+	{"Shift+F12", "editor.findReferences"},
+	{"Ctrl+F12", "editor.findImplementations"},
+	{"Alt+Left", "navigate.back"},
+	{"Alt+Right", "navigate.forward"},
+	{"F4", "editor.nextLocation"},
+	{"Shift+F4", "editor.previousLocation"},
+	{"Shift+Escape", "view.closeLocations"},
+	{"F2", "editor.rename"},
+	{"Ctrl+K Ctrl+I", "editor.hover"},
+	{"Ctrl+.", "editor.codeActions"},
+	{"Ctrl+Alt+M", "editor.extractFunction"},
+	{"Ctrl+Alt+V", "editor.extractVariable"},
+	{"Ctrl+Shift+B", "task.build"},
+	{"Ctrl+K Ctrl+B", "task.buildModule"},
+	{"Ctrl+F5", "task.run"},
+	{"Ctrl+Shift+T", "task.test"},
+	{"Ctrl+K Ctrl+T", "task.testModule"},
+	{"Ctrl+Shift+V", "task.vet"},
+	{"Ctrl+K Ctrl+V", "task.vetModule"},
+	{"Ctrl+Alt+C", "task.cancel"},
+	{"Ctrl+Shift+U", "view.toggleOutput"},
+	{"Ctrl+Shift+PageUp", "output.pageUp"},
+	{"Ctrl+Shift+PageDown", "output.pageDown"},
+	{"Ctrl+K Ctrl+R", "test.runAtCaret"},
+	{"Ctrl+K Ctrl+F", "test.rerunFailed"},
+	{"Ctrl+K Ctrl+E", "view.toggleTests"},
+	{"Ctrl+K Ctrl+O", "task.coverage"},
+	{"Ctrl+K Ctrl+Shift+O", "task.coverageModule"},
+	{"Ctrl+Shift+O", "view.toggleCoverage"},
+	{"F5", "debug.start"},
+	{"Shift+F5", "debug.stop"},
+	{"F6", "debug.pause"},
+	{"F10", "debug.stepOver"},
+	{"F11", "debug.stepInto"},
+	{"Shift+F11", "debug.stepOut"},
+	{"F9", "debug.toggleBreakpoint"},
+	{"Shift+F9", "debug.conditionalBreakpoint"},
+	{"Alt+F9", "debug.logpoint"},
+	{"Ctrl+K Ctrl+W", "debug.addWatch"},
+	{"Ctrl+K Ctrl+Shift+W", "debug.removeWatch"},
+	{"Ctrl+Shift+D", "view.toggleDebug"},
+	{"Alt+PageUp", "debug.pageUp"},
+	{"Alt+PageDown", "debug.pageDown"},
+	{"Ctrl+K Ctrl+M", "task.benchmark"},
+	{"Ctrl+K Ctrl+Shift+M", "task.benchmarkModule"},
+	{"Ctrl+Alt+B", "view.toggleBenchmarks"},
+	{"Ctrl+Alt+PageUp", "benchmarks.pageUp"},
+	{"Ctrl+Alt+PageDown", "benchmarks.pageDown"},
+	{"Ctrl+Alt+F12", "view.toggleFrameTime"},
+}
+
+// completionKeyBindings take precedence over all others while the completion
+// popup is open.
+var completionKeyBindings = []keyBinding{
+	{"Down", "completion.next"},
+	{"Up", "completion.previous"},
+	{"PageDown", "completion.nextPage"},
+	{"PageUp", "completion.previousPage"},
+	{"Enter", "completion.accept"},
+	{"Tab", "completion.accept"},
+	{"Escape", "completion.close"},
+}
+
+// snippetKeyBindings take precedence over the default bindings while the
+// placeholders of an inserted snippet are visited.
+var snippetKeyBindings = []keyBinding{
+	{"Tab", "snippet.nextPlaceholder"},
+	{"Shift+Tab", "snippet.previousPlaceholder"},
+	{"Escape", "snippet.exit"},
+}
+
+// promptKeyBindings take precedence over all others while a prompt is open.
+var promptKeyBindings = []keyBinding{
+	{"Enter", "prompt.accept"},
+	{"Escape", "prompt.cancel"},
+}
+
+// renamePreviewKeyBindings are the only ones that work while the preview of a
+// rename is shown.
+var renamePreviewKeyBindings = []keyBinding{
+	{"Enter", "rename.apply"},
+	{"Escape", "rename.cancel"},
+	{"Down", "rename.scrollDown"},
+	{"Up", "rename.scrollUp"},
+	{"PageDown", "rename.pageDown"},
+	{"PageUp", "rename.pageUp"},
+}
+
+// codeActionKeyBindings are the only ones that work while the code actions
+// are listed.
+var codeActionKeyBindings = []keyBinding{
+	{"Enter", "codeActions.apply"},
+	{"Escape", "codeActions.cancel"},
+	{"Down", "codeActions.next"},
+	{"Up", "codeActions.previous"},
+}
+
+func newDefaultKeymap() *keymap {
+	return newKeymapFrom(defaultKeyBindings)
+}
+
+func newKeymapFrom(bindings []keyBinding) *keymap {
+	m := newKeymap()
+	for _, b := range bindings {
+		if err := m.bind(b.keys, b.command); err != nil {
+			// this is only expected to happen during development if we make
+			// a typo in the default bindings
+			panic(err)
+		}
+	}
+	return m
+}
+
+// keyBindingsPath is the user's key binding configuration file.
+func keyBindingsPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "gonutz-ide", "keybindings.json")
+}
+
+// loadKeyBindings adds the bindings from the JSON file at path to m. The file
+// contains a list of objects like this:
+//
+//	[
+//	    { "key": "Ctrl+K Ctrl+C", "command": "editor.commentLine" },
+//	    { "key": "Ctrl+D", "command": "" }
+//	]
+//
+// An empty command removes a default binding. A missing file is not an error.
+func loadKeyBindings(path string, m *keymap, commands *commandRegistry) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return makeErr("load key bindings", err)
+	}
+	var bindings []struct {
+		Key     string `json:"key"`
+		Command string `json:"command"`
+	}
+	if err := json.Unmarshal(data, &bindings); err != nil {
+		return makeErr("load key bindings from "+path, err)
+	}
+	for _, b := range bindings {
+		if _, ok := commands.commands[b.Command]; !ok && b.Command != "" {
+			return errors.New(
+				"load key bindings from " + path +
+					": unknown command '" + b.Command + "'",
+			)
+		}
+		if err := m.bind(b.Key, b.Command); err != nil {
+			return makeErr("load key bindings from "+path, err)
+		}
+	}
+	return nil
+}
+
+// keyDispatcher turns key presses and typed characters into commands and
+// text input for an editor.
+type keyDispatcher struct {
+	keys     *keymap
+	commands *commandRegistry
+	// completionKeys and snippetKeys are used before keys while the
+	// completion popup is open or a snippet is active
+	completionKeys *keymap
+	snippetKeys    *keymap
+	// mode, if not nil, is used before all other bindings
+	mode *keyMode
+	// swallowChar is set when a key press was used for a command. The
+	// character that the platform generates for the same key press must then
+	// not be typed.
+	swallowChar bool
+}
+
+func newKeyDispatcher(keys *keymap, commands *commandRegistry) *keyDispatcher {
+	return &keyDispatcher{
+		keys:           keys,
+		commands:       commands,
+		completionKeys: newKeymapFrom(completionKeyBindings),
+		snippetKeys:    newKeymapFrom(snippetKeyBindings),
+	}
+}
+
+// keyDown runs the command bound to the key, if any. It returns false if the
+// key is not used so the platform can handle it, e.g. Alt+F4.
+func (d *keyDispatcher) keyDown(e *editor, k keyChord) bool {
+	if d.mode != nil && len(d.keys.pending) == 0 {
+		command, ok := d.mode.keys.bindings[k.String()]
+		if ok {
+			d.commands.run(command, e)
+		}
+		if ok || d.mode.exclusive {
+			d.swallowChar = true
+			return true
+		}
+	}
+	if command, ok := d.contextCommand(e, k); ok {
+		d.commands.run(command, e)
+		d.swallowChar = true
+		return true
+	}
+	command, result := d.keys.press(k)
+	switch result {
+	case keyCommand:
+		d.commands.run(command, e)
+		// the command might have moved the caret out of the completed word
+		e.updateCompletion()
+		d.swallowChar = true
+		return true
+	case keyPending, keyCancelled:
+		d.swallowChar = true
+		return true
+	default:
+		d.swallowChar = false
+		return false
+	}
+}
+
+// char types the character unless it belongs to a key that was used as a
+// command. Control characters are never typed, keys like Enter and Tab are
+// handled as commands.
+func (d *keyDispatcher) char(e *editor, r rune, repeatCount int) {
+	if d.swallowChar {
+		d.swallowChar = false
+		return
+	}
+	if r < ' ' || r == 0x7F || d.mode != nil && d.mode.exclusive {
+		return
+	}
+	e.insertText(runeBytes(r, repeatCount), typingEdit, e.now())
+	if r == '.' {
+		e.triggerCompletion()
+	} else {
+		e.updateCompletion()
+	}
+}
+
+// contextCommand returns the command that k is bound to in the popup or
+// snippet bindings, if they are active. Key sequences that were started in the
+// default bindings are finished there.
+func (d *keyDispatcher) contextCommand(e *editor, k keyChord) (string, bool) {
+	if len(d.keys.pending) > 0 {
+		return "", false
+	}
+	for _, context := range []struct {
+		active bool
+		keys   *keymap
+	}{
+		{e.completion != nil, d.completionKeys},
+		{e.snippet != nil, d.snippetKeys},
+	} {
+		if command, ok := context.keys.bindings[k.String()]; ok && context.active {
+			return command, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestDispatcher dispatches the default key bindings to the editor
+// commands.
+func newTestDispatcher() (*keyDispatcher, *commandRegistry) {
+	commands := newCommandRegistry()
+	registerEditorCommands(commands)
+	return newKeyDispatcher(newDefaultKeymap(), commands), commands
+}
+
+// pressKeys sends the space-separated key chords to the dispatcher, each
+// followed by the character that the platform generates for it, if any.
+func pressKeys(t *testing.T, d *keyDispatcher, e *editor, keys string, chars string) {
+	t.Helper()
+	sequence, err := parseKeySequence(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, k := range sequence {
+		d.keyDown(e, k)
+		if i < len(chars) {
+			d.char(e, rune(chars[i]), 1)
+		}
+	}
+}
+
+func TestKeyDispatcher(t *testing.T) {
+	d, _ := newTestDispatcher()
+	e := newEditor(newDocument([]byte("a\n  b\n\nc")))
+
+	pressKeys(t, d, e, "Ctrl+A Ctrl+K Ctrl+C", "")
+	if s := string(e.doc.bytes()); s != "// a\n  // b\n\n// c" {
+		t.Fatalf("commenting gives %q", s)
+	}
+	pressKeys(t, d, e, "Ctrl+K Ctrl+U", "")
+	if s := string(e.doc.bytes()); s != "a\n  b\n\nc" {
+		t.Fatalf("uncommenting gives %q", s)
+	}
+	// the key that cancels a sequence does not type its character
+	pressKeys(t, d, e, "Ctrl+K X", "\x0bx")
+	if s := string(e.doc.bytes()); s != "a\n  b\n\nc" {
+		t.Fatalf("the cancelled sequence typed %q", s)
+	}
+	if len(d.keys.pending) != 0 {
+		t.Fatal("the sequence is still pending")
+	}
+	// unbound keys type their characters
+	pressKeys(t, d, e, "X", "x")
+	if s := string(e.doc.bytes()); s != "x" {
+		t.Fatalf("typing replaces the selection with %q", s)
+	}
+	pressKeys(t, d, e, "Ctrl+Z Ctrl+End Backspace", "\x1a\x00\x08")
+	if s := string(e.doc.bytes()); s != "a\n  b\n\n" {
+		t.Fatalf("undo and backspace give %q", s)
+	}
+}
+
+func TestKeyDispatcherUnboundKeys(t *testing.T) {
+	d, _ := newTestDispatcher()
+	e := newEditor(newDocument(nil))
+	k, _ := parseKeyChord("Alt+F4")
+	if d.keyDown(e, k) {
+		t.Error("Alt+F4 was used, the platform does not get it")
+	}
+	k, _ = parseKeyChord("Ctrl+K")
+	if !d.keyDown(e, k) {
+		t.Error("the start of a sequence was not used")
+	}
+}
+
+func TestCommandRegistry(t *testing.T) {
+	r := newCommandRegistry()
+	ran := 0
+	r.register("test.count", func(*editor) { ran++ })
+	if !r.run("test.count", nil) || ran != 1 {
+		t.Errorf("the command ran %d times", ran)
+	}
+	if r.run("test.missing", nil) {
+		t.Error("a missing command ran")
+	}
+
+	// the app registers the commands that need more than the editor, every
+	// binding has its command
+	d := newHeadlessDriver(newRecordingGraphics(fixedWidthFont{10, 20}), 640, 480, time.Unix(0, 0))
+	bindings := [][]keyBinding{
+		defaultKeyBindings,
+		completionKeyBindings,
+		snippetKeyBindings,
+		promptKeyBindings,
+		renamePreviewKeyBindings,
+		codeActionKeyBindings,
+	}
+	for _, list := range bindings {
+		for _, b := range list {
+			if _, ok := d.app.keyboard.commands.commands[b.command]; !ok {
+				t.Errorf("%s is bound to the unknown command %s", b.keys, b.command)
+			}
+		}
+	}
+}
+
+func TestLoadKeyBindings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keybindings.json")
+	load := func(content string) (*keymap, error) {
+		ioutil.WriteFile(path, []byte(content), 0666)
+		_, commands := newTestDispatcher()
+		m := newDefaultKeymap()
+		return m, loadKeyBindings(path, m, commands)
+	}
+
+	// the user overrides and removes default bindings and adds sequences
+	m, err := load(`[
+		{ "key": "Ctrl+D", "command": "editor.undo" },
+		{ "key": "Ctrl+Z", "command": "" },
+		{ "key": "Ctrl+K Ctrl+K", "command": "editor.selectAll" }
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"Ctrl+D":        "editor.undo",
+		"Ctrl+Z":        "",
+		"Ctrl+K Ctrl+K": "editor.selectAll",
+		"Ctrl+K Ctrl+C": "editor.commentLine",
+	}
+	for keys, command := range want {
+		if c := m.bindings[keys]; c != command {
+			t.Errorf("%s is bound to %q, want %q", keys, c, command)
+		}
+	}
+
+	errors := []struct {
+		content string
+		err     string
+	}{
+		{`[{ "key": "Ctrl+D", "command": "editor.nope" }]`, "unknown command 'editor.nope'"},
+		{`[{ "key": "Ctrl+Nope", "command": "editor.undo" }]`, "unknown key 'nope'"},
+		{`{ "key": "Ctrl+D" }`, "cannot unmarshal"},
+		{`[`, "unexpected end of JSON input"},
+	}
+	for _, tt := range errors {
+		_, err := load(tt.content)
+		if err == nil || !strings.Contains(err.Error(), tt.err) ||
+			!strings.HasPrefix(err.Error(), "load key bindings from "+path) {
+			t.Errorf("%s gives the error %v, want one with %q", tt.content, err, tt.err)
+		}
+	}
+
+	// a missing file keeps the defaults
+	m = newDefaultKeymap()
+	_, commands := newTestDispatcher()
+	if err := loadKeyBindings(filepath.Join(dir, "missing.json"), m, commands); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.bindings) != len(newDefaultKeymap().bindings) {
+		t.Error("a missing file changed the bindings")
+	}
+}
@@ -12,3 +12,17 @@ func round(x float64) int {
 	}
 	return int(x + 0.5)
 }
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// completionKind tells what a completion inserts, it decides the color of the
+// item's icon.
+type completionKind int
+
+const (
+	completionText completionKind = iota
+	completionVariable
+	completionConstant
+	completionFunction
+	completionMethod
+	completionField
+	completionType
+	completionPackage
+	completionKeyword
+)
+
+var completionKindColors = []uint32{
+	completionText:     0xFF6C6C6C,
+	completionVariable: semanticColors[localName],
+	completionConstant: semanticColors[constantName],
+	completionFunction: semanticColors[functionName],
+	completionMethod:   semanticColors[methodName],
+	completionField:    semanticColors[fieldName],
+	completionType:     semanticColors[typeName],
+	completionPackage:  semanticColors[packageName],
+	completionKeyword:  0xFF0000FF,
+}
+
+// completionItem is one suggestion in the completion popup.
+type completionItem struct {
+	label string
+	kind  completionKind
+	// detail is a short description, e.g. the type, documentation can be
+	// several paragraphs
+	detail        string
+	documentation string
+	// insertText replaces the word before the caret. If snippet is true it
+	// can contain placeholders like ${1:name}, see parseSnippet.
+	insertText string
+	snippet    bool
+}
+
+// completionSource finds the completions at offset in doc. done is called
+// later, on the UI thread.
+type completionSource func(doc *document, offset int, done func([]completionItem, error))
+
+// completionPopup is the list of completions for the word before the caret.
+type completionPopup struct {
+	// start is the offset of the word that is completed, the text from there
+	// to the caret filters the items
+	start int
+	// waiting is true until the source delivered the items
+	waiting bool
+	items   []completionItem
+	// matches are the indexes of the items that match the typed text, the
+	// best match first
+	matches  []int
+	selected int
+	// top is the index of the first visible match
+	top int
+	// list is the screen rectangle of the list, it is updated when drawing
+	list rectangle
+}
+
+const (
+	completionRows          = 10
+	completionMinWidth      = 200
+	completionMaxWidth      = 500
+	completionDocWidth      = 320
+	completionDocMaxLines   = 12
+	completionIconSize      = 8
+	completionPadding       = 4
+	completionBackground    = 0xFFF3F3F3
+	completionBorderColor   = 0xFFC8C8C8
+	completionSelectedRow   = editorSelectionColor
+	completionDetailColor   = 0xFF6C6C6C
+	completionDocBackground = 0xFFFAFAFA
+)
+
+// triggerCompletion opens the completion popup for the word before the
+// primary caret and asks the completion source for the items. Other cursors
+// are not completed.
+func (e *editor) triggerCompletion() {
+	if e.complete == nil {
+		return
+	}
+	caret := e.primaryCursor().caret
+	start := scanBackward(e.doc, caret, func(_ int, r rune) bool {
+		return charClassOf(r) == wordClass
+	})
+	popup := &completionPopup{start: start, waiting: true}
+	e.completion = popup
+	e.complete(e.doc, caret, func(items []completionItem, err error) {
+		if e.completion != popup {
+			// the popup was closed or replaced in the mean time
+			return
+		}
+		popup.waiting = false
+		popup.items = items
+		e.updateCompletion()
+	})
+}
+
+// updateCompletion filters the items of the open popup by the text that was
+// typed since it opened. The popup is closed if the caret left the word or if
+// nothing matches.
+func (e *editor) updateCompletion() {
+	p := e.completion
+	if p == nil {
+		return
+	}
+	caret := e.primaryCursor().caret
+	if len(e.cursors) > 1 || !e.primaryCursor().empty() || caret < p.start ||
+		e.doc.lineOf(caret) != e.doc.lineOf(p.start) {
+		e.closeCompletion()
+		return
+	}
+	typed := string(e.doc.slice(p.start, caret))
+	for _, r := range typed {
+		if charClassOf(r) != wordClass {
+			e.closeCompletion()
+			return
+		}
+	}
+	if p.waiting {
+		return
+	}
+	p.matches = filterCompletions(p.items, typed)
+	if len(p.matches) == 0 {
+		e.closeCompletion()
+		return
+	}
+	p.selected, p.top = 0, 0
+	e.changed()
+}
+
+func (e *editor) closeCompletion() {
+	if e.completion != nil {
+		e.completion = nil
+		e.changed()
+	}
+}
+
+// filterCompletions returns the indexes of the items whose labels match the
+// typed text, sorted from best to worst match. Items that match equally well
+// keep their order.
+func filterCompletions(items []completionItem, typed string) []int {
+	var matches []int
+	scores := make(map[int]int)
+	for i, item := range items {
+		if score, ok := fuzzyScore(typed, item.label); ok {
+			matches = append(matches, i)
+			scores[i] = score
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return scores[matches[i]] > scores[matches[j]]
+	})
+	return matches
+}
+
+// fuzzyScore matches the pattern against a label: all characters of the
+// pattern must appear in the label in the same order, case is ignored. The
+// score is higher for characters at the start of the label or of a word in
+// it, for consecutive characters and for matching case, so that "rf" ranks
+// "readFile" above "ref".
+func fuzzyScore(pattern, label string) (score int, ok bool) {
+	if pattern == "" {
+		return 0, true
+	}
+	p := []rune(pattern)
+	l := []rune(label)
+	j := 0
+	last := -2
+	for i := 0; i < len(l) && j < len(p); i++ {
+		if unicode.ToLower(l[i]) != unicode.ToLower(p[j]) {
+			continue
+		}
+		s := 1
+		if l[i] == p[j] {
+			s++
+		}
+		if i == 0 {
+			s += 8
+		} else if isWordStart(l, i) {
+			s += 4
+		}
+		if last == i-1 {
+			s += 5
+		}
+		score += s
+		last = i
+		j++
+	}
+	if j < len(p) {
+		return 0, false
+	}
+	// prefer short labels, they have less that was not typed
+	return score*8 - len(l), true
+}
+
+// isWordStart tells if the rune at i starts a word inside an identifier, e.g.
+// the F in readFile or the f in read_file.
+func isWordStart(label []rune, i int) bool {
+	prev, r := label[i-1], label[i]
+	return prev == '_' && r != '_' ||
+		unicode.IsLower(prev) && unicode.IsUpper(r) ||
+		unicode.IsLetter(r) && !unicode.IsLetter(prev) && !unicode.IsDigit(prev)
+}
+
+// moveCompletionSelection moves the highlighted item by delta rows, it stops
+// at the first and last item.
+func (e *editor) moveCompletionSelection(delta int) {
+	p := e.completion
+	if p == nil || len(p.matches) == 0 {
+		return
+	}
+	p.selected = clamp(p.selected+delta, 0, len(p.matches)-1)
+	if p.selected < p.top {
+		p.top = p.selected
+	}
+	if p.selected >= p.top+completionRows {
+		p.top = p.selected - completionRows + 1
+	}
+	e.changed()
+}
+
+// acceptCompletion replaces the word before the caret with the highlighted
+// item. Snippets start a snippet session at their first placeholder.
+func (e *editor) acceptCompletion() {
+	p := e.completion
+	e.closeCompletion()
+	if p == nil || len(p.matches) == 0 {
+		return
+	}
+	item := p.items[p.matches[p.selected]]
+	caret := e.primaryCursor().caret
+	text, stops := item.insertText, []textRange(nil)
+	if text == "" {
+		text = item.label
+	}
+	if item.snippet {
+		text, stops = parseSnippet(text)
+	}
+	e.applyReplacements(
+		otherEdit,
+		[]replacement{{offset: p.start, count: caret - p.start, text: []byte(text)}},
+		e.now(),
+	)
+	e.startSnippet(p.start, len(text), stops)
+}
+
+// clickCompletion accepts the item at screen position y in the popup list.
+func (e *editor) clickCompletion(g graphics, y int) {
+	p := e.completion
+	if p == nil {
+		return
+	}
+	row := p.top + (y-p.list.y-1)/g.lineHeight()
+	if row < 0 || row >= len(p.matches) {
+		return
+	}
+	p.selected = row
+	e.acceptCompletion()
+}
+
+// snippetSession remembers the placeholders of an inserted snippet, Tab and
+// Shift+Tab select them one after the other. The placeholders move along
+// with edits, typing over a selected placeholder replaces it.
+type snippetSession struct {
+	// placeholders are in the order that Tab visits them, the last one is
+	// where the caret ends up
+	placeholders  []textRange
+	current       int
+	stopObserving func()
+}
+
+// startSnippet selects the first placeholder of a snippet that was inserted
+// at offset with the given length. stops are relative to the snippet, as
+// returned by parseSnippet. Without placeholders the caret is placed at the
+// final stop or the end of the snippet.
+func (e *editor) startSnippet(offset, length int, stops []textRange) {
+	e.endSnippet()
+	if len(stops) == 0 {
+		stops = []textRange{{start: length, end: length}}
+	}
+	s := &snippetSession{}
+	for _, stop := range stops {
+		s.placeholders = append(s.placeholders, textRange{
+			start: offset + stop.start,
+			end:   offset + stop.end,
+		})
+	}
+	if len(s.placeholders) == 1 {
+		e.selectRange(s.placeholders[0])
+		return
+	}
+	s.stopObserving = e.doc.observeChanges(func(offset, count int, text []byte) {
+		for i := range s.placeholders {
+			r := &s.placeholders[i]
+			r.start = shiftOffset(r.start, offset, count, len(text), false)
+			r.end = shiftOffset(r.end, offset, count, len(text), true)
+		}
+	})
+	e.snippet = s
+	e.selectRange(s.placeholders[0])
+}
+
+// shiftOffset moves an offset for the replacement of count bytes at at by
+// added bytes. An offset that is right at an insertion stays in front of it
+// unless sticky is true.
+func shiftOffset(offset, at, count, added int, sticky bool) int {
+	switch {
+	case offset > at+count || offset == at+count && (count > 0 || sticky):
+		return offset - count + added
+	case offset > at:
+		return at
+	}
+	return offset
+}
+
+// nextPlaceholder selects the next (step 1) or previous (step -1)
+// placeholder of the snippet. The session ends at the last one.
+func (e *editor) nextPlaceholder(step int) {
+	s := e.snippet
+	if s == nil {
+		return
+	}
+	s.current = clamp(s.current+step, 0, len(s.placeholders)-1)
+	e.selectRange(s.placeholders[s.current])
+	if s.current == len(s.placeholders)-1 {
+		e.endSnippet()
+	}
+}
+
+func (e *editor) endSnippet() {
+	if e.snippet != nil {
+		e.snippet.stopObserving()
+		e.snippet = nil
+	}
+}
+
+// selectRange collapses the cursors to one that selects r, the caret is at
+// its end.
+func (e *editor) selectRange(r textRange) {
+	e.cursors = []cursor{newCursor(r.start)}
+	e.primary = 0
+	e.cursors[0].moveTo(r.end, true)
+	e.afterMove()
+}
+
+// parseSnippet returns the text of a snippet in the format of the Language
+// Server Protocol, e.g. "Println(${1:a})$0", and the ranges of its tab stops
+// in the order that they are visited. The final stop $0 is last, without
+// one the end of the text is the final stop. Nested placeholders are taken as
+// plain text.
+func parseSnippet(snippet string) (text string, stops []textRange) {
+	type stop struct {
+		number int
+		r      textRange
+	}
+	var found []stop
+	var b strings.Builder
+	for i := 0; i < len(snippet); i++ {
+		c := snippet[i]
+		if c == '\\' && i+1 < len(snippet) && strings.IndexByte(`$}\`, snippet[i+1]) != -1 {
+			i++
+			b.WriteByte(snippet[i])
+			continue
+		}
+		if c != '$' || i+1 == len(snippet) {
+			b.WriteByte(c)
+			continue
+		}
+		// $1 or ${1} or ${1:text}
+		j := i + 1
+		braced := snippet[j] == '{'
+		if braced {
+			j++
+		}
+		numberStart := j
+		for j < len(snippet) && '0' <= snippet[j] && snippet[j] <= '9' {
+			j++
+		}
+		if j == numberStart {
+			b.WriteByte(c)
+			continue
+		}
+		number := 0
+		for _, d := range snippet[numberStart:j] {
+			number = number*10 + int(d-'0')
+		}
+		start := b.Len()
+		if braced {
+			if j < len(snippet) && snippet[j] == ':' {
+				end := matchingBrace(snippet, j+1)
+				inner, _ := parseSnippet(snippet[j+1 : end])
+				b.WriteString(inner)
+				j = end
+			}
+			if j < len(snippet) && snippet[j] == '}' {
+				j++
+			}
+		}
+		found = append(found, stop{number: number, r: textRange{start: start, end: b.Len()}})
+		i = j - 1
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		a, b := found[i].number, found[j].number
+		return a != 0 && (b == 0 || a < b)
+	})
+	for _, s := range found {
+		stops = append(stops, s.r)
+	}
+	if len(found) == 0 || found[len(found)-1].number != 0 {
+		stops = append(stops, textRange{start: b.Len(), end: b.Len()})
+	}
+	return b.String(), stops
+}
+
+// matchingBrace returns the index of the } that closes a placeholder whose
+// text starts at i, or the string length.
+func matchingBrace(s string, i int) int {
+	depth := 0
+	for ; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return len(s)
+}
+
+// drawCompletion draws the popup below the word that is completed, or above
+// it if there is not enough space below, with the documentation of the
+// highlighted item next to it. Everything is clipped to the window.
+func (e *editor) drawCompletion(g graphics, window rectangle) {
+	e.overlay = rectangle{}
+	p := e.completion
+	if p == nil || p.waiting || len(p.matches) == 0 {
+		return
+	}
+	lineHeight := g.lineHeight()
+	line := e.doc.lineOf(p.start)
+	if line < e.topLine || line >= e.topLine+e.visibleLines {
+		return
+	}
+	x := e.area.x + e.textWidth(g, e.doc.lineStart(line), p.start)
+	lineTop := e.area.y + (line-e.topLine)*lineHeight
+
+	rows := min(completionRows, len(p.matches)-p.top)
+	textX := completionPadding + completionIconSize + completionPadding
+	width := completionMinWidth
+	for _, m := range p.matches[p.top : p.top+rows] {
+		item := p.items[m]
+		w, _ := g.textExtent([]byte(item.label + "   " + item.detail))
+		width = max(width, textX+w+completionPadding)
+	}
+	width = min(width, completionMaxWidth)
+	list := rect(x-textX, lineTop+lineHeight, width, rows*lineHeight+2)
+	if list.y+list.h > window.y+window.h && lineTop-list.h >= window.y {
+		list.y = lineTop - list.h
+	}
+	if list.x+list.w > window.x+window.w {
+		list.x = window.x + window.w - list.w
+	}
+	if list.x < window.x {
+		list.x = window.x
+	}
+	list = list.intersect(window)
+	p.list = list
+	e.overlay = list
+
+	fillRect(g, list, completionBorderColor)
+	inner := rect(list.x+1, list.y+1, list.w-2, list.h-2).intersect(list)
+	fillRect(g, inner, completionBackground)
+	for i := 0; i < rows; i++ {
+		item := p.items[p.matches[p.top+i]]
+		row := rect(inner.x, inner.y+i*lineHeight, inner.w, lineHeight).intersect(inner)
+		if p.top+i == p.selected {
+			fillRect(g, row, completionSelectedRow)
+		}
+		icon := rect(
+			row.x+completionPadding,
+			row.y+(lineHeight-completionIconSize)/2,
+			completionIconSize,
+			completionIconSize,
+		)
+		fillRect(g, icon.intersect(row), item.kind.color())
+		labelX := row.x + textX
+		g.text([]byte(item.label), labelX, row.y, row, editorTextColor)
+		if item.detail != "" {
+			w, _ := g.textExtent([]byte(item.label + "   "))
+			detail := rect(labelX+w, row.y, row.x+row.w-labelX-w-completionPadding, row.h)
+			g.text([]byte(item.detail), detail.x, detail.y, detail.intersect(row), completionDetailColor)
+		}
+	}
+
+	e.drawCompletionDoc(g, window, list, p.items[p.matches[p.selected]])
+}
+
+// drawCompletionDoc shows the detail and documentation of item in a box right
+// of the list, or left of it if there is no space on the right.
+func (e *editor) drawCompletionDoc(g graphics, window, list rectangle, item completionItem) {
+	text := item.detail
+	if item.documentation != "" {
+		if text != "" {
+			text += "\n\n"
+		}
+		text += item.documentation
+	}
+	if text == "" {
+		return
+	}
+	lineHeight := g.lineHeight()
+	lines := wrapText(g, strings.TrimSpace(text), completionDocWidth-2*completionPadding)
+	if len(lines) > completionDocMaxLines {
+		lines = append(lines[:completionDocMaxLines-1], "…")
+	}
+	box := rect(list.x+list.w, list.y, completionDocWidth, len(lines)*lineHeight+2*completionPadding)
+	if box.x+box.w > window.x+window.w {
+		box.x = list.x - box.w
+	}
+	if box.x < window.x {
+		return
+	}
+	box = box.intersect(window)
+	e.overlay = e.overlay.union(box)
+	fillRect(g, box, completionBorderColor)
+	inner := rect(box.x+1, box.y+1, box.w-2, box.h-2).intersect(box)
+	fillRect(g, inner, completionDocBackground)
+	g.text(
+		[]byte(strings.Join(lines, "\n")),
+		inner.x+completionPadding-1, inner.y+completionPadding-1,
+		inner,
+		editorTextColor,
+	)
+}
+
+func (k completionKind) color() uint32 {
+	if k < 0 || int(k) >= len(completionKindColors) {
+		return completionKindColors[completionText]
+	}
+	return completionKindColors[k]
+}
+
+// wrapText breaks text into lines that are at most width pixels wide, at
+// spaces where possible. Line breaks in the text are kept.
+func wrapText(g graphics, text string, width int) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+			if w, _ := g.textExtent([]byte(candidate)); w <= width || line == "" {
+				line = candidate
+				continue
+			}
+			lines = append(lines, line)
+			line = word
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// completionWordStart is where the word before offset in src starts.
+func completionWordStart(src []byte, offset int) int {
+	for offset > 0 {
+		r, size := utf8.DecodeLastRune(src[:offset])
+		if charClassOf(r) != wordClass {
+			break
+		}
+		offset -= size
+	}
+	return offset
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strconv"
+	"strings"
+)
+
+// localCompleter finds completions for Go files with go/types, without a
+// language server. It works in the background, the app calls poll
+// periodically while it is busy.
+type localCompleter struct {
+	fset     *token.FileSet
+	importer types.Importer
+	// docs caches the files that declare imported objects, they are parsed
+	// with comments to find documentation
+	docs    map[string]*ast.File
+	docFset *token.FileSet
+	// running is true while a goroutine computes completions, the callback
+	// to run with its result arrives in done. next is the request that was
+	// made in the mean time.
+	running bool
+	next    *completionRequest
+	done    chan func()
+}
+
+type completionRequest struct {
+	path   string
+	src    []byte
+	offset int
+	done   func([]completionItem, error)
+}
+
+func newLocalCompleter() *localCompleter {
+	fset := token.NewFileSet()
+	return &localCompleter{
+		fset:     fset,
+		importer: importer.ForCompiler(fset, "source", nil),
+		docs:     make(map[string]*ast.File),
+		docFset:  token.NewFileSet(),
+		done:     make(chan func(), 1),
+	}
+}
+
+// complete finds the completions at offset in src, which is the content of
+// the file at path. done is called from poll. Only the latest request that
+// arrives while another one runs is kept.
+func (c *localCompleter) complete(path string, src []byte, offset int, done func([]completionItem, error)) {
+	r := &completionRequest{path: path, src: src, offset: offset, done: done}
+	if c.running {
+		c.next = r
+		return
+	}
+	c.start(r)
+}
+
+func (c *localCompleter) start(r *completionRequest) {
+	c.running = true
+	go func() {
+		items := c.completions(r.path, r.src, r.offset)
+		c.done <- func() { r.done(items, nil) }
+	}()
+}
+
+// poll runs the callback of a finished request. busy is true while a request
+// is still running.
+func (c *localCompleter) poll() (busy bool) {
+	if !c.running {
+		return false
+	}
+	select {
+	case callback := <-c.done:
+		c.running = false
+		if c.next != nil {
+			r := c.next
+			c.next = nil
+			c.start(r)
+		}
+		callback()
+		return c.running
+	default:
+		return true
+	}
+}
+
+// goKeywords are suggested where an identifier, not a selector, is completed.
+var goKeywords = []string{
+	"break", "case", "chan", "const", "continue", "default", "defer", "else",
+	"fallthrough", "for", "func", "go", "goto", "if", "import", "interface",
+	"map", "package", "range", "return", "select", "struct", "switch", "type",
+	"var",
+}
+
+// completions type-checks the package of the file at path and lists what can
+// be written at offset. After a dot these are the members of the package,
+// value or type in front of it, otherwise all names that are visible at
+// offset and the keywords. The items are not filtered by the word that was
+// already typed.
+func (c *localCompleter) completions(path string, src []byte, offset int) []completionItem {
+	file, files, _ := parseGoPackage(path, src, c.fset, parser.ParseComments)
+	if file == nil {
+		return nil
+	}
+	info := &types.Info{
+		Types:  make(map[ast.Expr]types.TypeAndValue),
+		Defs:   make(map[*ast.Ident]types.Object),
+		Uses:   make(map[*ast.Ident]types.Object),
+		Scopes: make(map[ast.Node]*types.Scope),
+	}
+	conf := types.Config{
+		Importer: c.importer,
+		// errors are expected while typing, whatever could be resolved is
+		// good enough
+		Error: func(error) {},
+	}
+	pkg, _ := conf.Check(file.Name.Name, c.fset, files, info)
+	if pkg == nil {
+		return nil
+	}
+	tokens := c.fset.File(file.Pos())
+	offset = clamp(offset, 0, tokens.Size())
+	start := completionWordStart(src, offset)
+	pos := tokens.Pos(start)
+
+	list := &completionList{
+		c:     c,
+		pkg:   pkg,
+		files: files,
+		seen:  make(map[string]bool),
+	}
+	if start > 0 && src[start-1] == '.' {
+		dot := tokens.Pos(start - 1)
+		var selector *ast.SelectorExpr
+		ast.Inspect(file, func(n ast.Node) bool {
+			if s, ok := n.(*ast.SelectorExpr); ok && s.X.End() == dot {
+				selector = s
+			}
+			return selector == nil
+		})
+		if selector != nil {
+			list.addSelection(selector.X, info)
+		}
+		return list.items
+	}
+
+	innermost := pkg.Scope().Innermost(pos)
+	if innermost == nil {
+		innermost = pkg.Scope()
+	}
+	for scope := innermost; scope != nil; scope = scope.Parent() {
+		// the package and file scopes are visible everywhere, in functions
+		// only what was declared before
+		local := scope != types.Universe && scope != pkg.Scope() &&
+			scope.Parent() != pkg.Scope()
+		for _, name := range scope.Names() {
+			obj := scope.Lookup(name)
+			if local && obj.Pos() > pos {
+				// declared after the caret
+				continue
+			}
+			list.add(obj)
+		}
+	}
+	for _, keyword := range goKeywords {
+		if !list.seen[keyword] {
+			list.items = append(list.items, completionItem{
+				label: keyword,
+				kind:  completionKeyword,
+			})
+		}
+	}
+	return list.items
+}
+
+// completionList collects the completion items for objects, names that were
+// already added hide later objects of the same name.
+type completionList struct {
+	c     *localCompleter
+	pkg   *types.Package
+	files []*ast.File
+	seen  map[string]bool
+	items []completionItem
+}
+
+// addSelection adds the members of x, which is followed by a dot.
+func (l *completionList) addSelection(x ast.Expr, info *types.Info) {
+	if id, ok := x.(*ast.Ident); ok {
+		if name, ok := info.Uses[id].(*types.PkgName); ok {
+			scope := name.Imported().Scope()
+			for _, n := range scope.Names() {
+				if obj := scope.Lookup(n); obj.Exported() {
+					l.add(obj)
+				}
+			}
+			return
+		}
+	}
+	tv, ok := info.Types[x]
+	if !ok || tv.Type == nil {
+		return
+	}
+	t := tv.Type
+	if p, ok := t.Underlying().(*types.Pointer); ok {
+		t = p.Elem()
+	}
+	// fields, the ones of embedded structs after the ones on the outer level
+	type level struct {
+		t     types.Type
+		depth int
+	}
+	queue := []level{{t: t}}
+	visited := make(map[types.Type]bool)
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if visited[next.t] || next.depth > 8 {
+			continue
+		}
+		visited[next.t] = true
+		s, ok := next.t.Underlying().(*types.Struct)
+		if !ok {
+			continue
+		}
+		for i := 0; i < s.NumFields(); i++ {
+			f := s.Field(i)
+			if l.visible(f) {
+				l.add(f)
+			}
+			if f.Embedded() {
+				embedded := f.Type()
+				if p, ok := embedded.(*types.Pointer); ok {
+					embedded = p.Elem()
+				}
+				queue = append(queue, level{t: embedded, depth: next.depth + 1})
+			}
+		}
+	}
+	methods := types.NewMethodSet(t)
+	if !types.IsInterface(t) {
+		methods = types.NewMethodSet(types.NewPointer(t))
+	}
+	for i := 0; i < methods.Len(); i++ {
+		if m := methods.At(i).Obj(); l.visible(m) {
+			l.add(m)
+		}
+	}
+}
+
+// visible tells if obj can be used in the completed package.
+func (l *completionList) visible(obj types.Object) bool {
+	return obj.Exported() || obj.Pkg() == l.pkg
+}
+
+func (l *completionList) add(obj types.Object) {
+	name := obj.Name()
+	if name == "_" || l.seen[name] {
+		return
+	}
+	l.seen[name] = true
+	item := completionItem{
+		label:         name,
+		kind:          completionKindOf(obj),
+		detail:        types.ObjectString(obj, types.RelativeTo(l.pkg)),
+		documentation: l.c.documentation(obj, l.files),
+	}
+	switch obj := obj.(type) {
+	case *types.Func:
+		if sig, ok := obj.Type().(*types.Signature); ok {
+			item.insertText, item.snippet = callSnippet(name, sig, l.pkg)
+		}
+	case *types.Builtin:
+		item.detail = "builtin " + name
+		item.insertText, item.snippet = name+"(${1})", true
+	}
+	l.items = append(l.items, item)
+}
+
+func completionKindOf(obj types.Object) completionKind {
+	switch obj := obj.(type) {
+	case *types.PkgName:
+		return completionPackage
+	case *types.TypeName:
+		return completionType
+	case *types.Func:
+		if sig, ok := obj.Type().(*types.Signature); ok && sig.Recv() != nil {
+			return completionMethod
+		}
+		return completionFunction
+	case *types.Builtin:
+		return completionFunction
+	case *types.Const, *types.Nil:
+		return completionConstant
+	case *types.Var:
+		if obj.IsField() {
+			return completionField
+		}
+		return completionVariable
+	}
+	return completionText
+}
+
+// callSnippet returns a call of the function with a placeholder for each
+// parameter, e.g. "Println(${1:a})". A function without parameters is
+// completed as a plain call.
+func callSnippet(name string, sig *types.Signature, pkg *types.Package) (string, bool) {
+	params := sig.Params()
+	if params.Len() == 0 {
+		return name + "()", false
+	}
+	var b strings.Builder
+	b.WriteString(name + "(")
+	for i := 0; i < params.Len(); i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		p := params.At(i)
+		text := p.Name()
+		if text == "" || text == "_" {
+			text = types.TypeString(p.Type(), types.RelativeTo(pkg))
+		}
+		if sig.Variadic() && i == params.Len()-1 {
+			text += "..."
+		}
+		b.WriteString("${" + strconv.Itoa(i+1) + ":" + escapeSnippet(text) + "}")
+	}
+	b.WriteString(")")
+	return b.String(), true
+}
+
+// escapeSnippet escapes the characters that have a meaning in snippets.
+func escapeSnippet(text string) string {
+	return strings.NewReplacer(`\`, `\\`, `$`, `\$`, `}`, `\}`).Replace(text)
+}
+
+// documentation returns the doc comment of the declaration of obj. Objects of
+// the completed package are looked up in files, others in their source files,
+// which are parsed once and cached.
+func (c *localCompleter) documentation(obj types.Object, files []*ast.File) string {
+	if !obj.Pos().IsValid() {
+		return ""
+	}
+	tokens := c.fset.File(obj.Pos())
+	if tokens == nil {
+		return ""
+	}
+	for _, f := range files {
+		if c.fset.File(f.Pos()) == tokens {
+			return declarationDoc(f, obj.Pos())
+		}
+	}
+	position := c.fset.Position(obj.Pos())
+	f, ok := c.docs[position.Filename]
+	if !ok {
+		f, _ = parser.ParseFile(c.docFset, position.Filename, nil, parser.ParseComments)
+		c.docs[position.Filename] = f
+	}
+	if f == nil {
+		return ""
+	}
+	docTokens := c.docFset.File(f.Pos())
+	if position.Offset > docTokens.Size() {
+		return ""
+	}
+	return declarationDoc(f, docTokens.Pos(position.Offset))
+}
+
+// declarationDoc returns the doc comment of the declaration in f whose name
+// is at pos, or the comment behind it, e.g. for struct fields.
+func declarationDoc(f *ast.File, pos token.Pos) string {
+	var doc string
+	found := false
+	comments := func(groups ...*ast.CommentGroup) {
+		for _, g := range groups {
+			if g != nil {
+				doc = g.Text()
+				return
+			}
+		}
+	}
+	hasName := func(names []*ast.Ident) bool {
+		for _, name := range names {
+			if name.Pos() == pos {
+				return true
+			}
+		}
+		return false
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		if found || n == nil {
+			return false
+		}
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			if n.Name.Pos() == pos {
+				comments(n.Doc)
+				found = true
+			}
+		case *ast.GenDecl:
+			for _, spec := range n.Specs {
+				var outer *ast.CommentGroup
+				if len(n.Specs) == 1 {
+					outer = n.Doc
+				}
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					if spec.Name.Pos() == pos {
+						comments(spec.Doc, outer, spec.Comment)
+						found = true
+					}
+				case *ast.ValueSpec:
+					if hasName(spec.Names) {
+						comments(spec.Doc, outer, spec.Comment)
+						found = true
+					}
+				}
+			}
+		case *ast.Field:
+			if hasName(n.Names) {
+				comments(n.Doc, n.Comment)
+				found = true
+			}
+		}
+		return !found
+	})
+	return strings.TrimSpace(doc)
+}
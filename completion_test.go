@@ -0,0 +1,303 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilterCompletions(t *testing.T) {
+	tests := []struct {
+		typed  string
+		labels []string
+		want   []string
+	}{
+		// nothing typed keeps all items in their order
+		{"", []string{"b", "a", "c"}, []string{"b", "a", "c"}},
+		// the characters must appear in order, case is ignored
+		{"pri", []string{"Sprintf", "Println", "Print", "pair"}, []string{"Print", "Println", "Sprintf"}},
+		{"xyz", []string{"readFile", "x"}, nil},
+		// the start of the label and of its words count most
+		{"rf", []string{"ref", "readFile", "buffer"}, []string{"readFile", "ref"}},
+		{"rf", []string{"rof", "read_file"}, []string{"read_file", "rof"}},
+		{"nb", []string{"NewBuffer", "number"}, []string{"NewBuffer", "number"}},
+		// matching case is better
+		{"Err", []string{"err", "Err"}, []string{"Err", "err"}},
+		// shorter labels are better, equal ones keep their order
+		{"len", []string{"length", "len", "lenient"}, []string{"len", "length", "lenient"}},
+		{"a", []string{"ab", "ac"}, []string{"ab", "ac"}},
+	}
+	for _, tt := range tests {
+		items := make([]completionItem, len(tt.labels))
+		for i, label := range tt.labels {
+			items[i] = completionItem{label: label}
+		}
+		var got []string
+		for _, i := range filterCompletions(items, tt.typed) {
+			got = append(got, items[i].label)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%q filters %v to %v, want %v", tt.typed, tt.labels, got, tt.want)
+		}
+	}
+}
+
+func TestParseSnippet(t *testing.T) {
+	tests := []struct {
+		snippet string
+		text    string
+		stops   []textRange
+	}{
+		{"Println(${1:a})", "Println(a)", []textRange{{8, 9}, {10, 10}}},
+		{`Println(${1:a}, ${2:b\}})$0x`, "Println(a, b})x", []textRange{{8, 9}, {11, 13}, {14, 14}}},
+		{"f($2, $1)", "f(, )", []textRange{{4, 4}, {2, 2}, {5, 5}}},
+		{"f(${1:g(${2:x})})", "f(g(x))", []textRange{{2, 6}, {7, 7}}},
+		{`cost \$5`, "cost $5", []textRange{{7, 7}}},
+		{"plain", "plain", []textRange{{5, 5}}},
+	}
+	for _, tt := range tests {
+		text, stops := parseSnippet(tt.snippet)
+		if text != tt.text || len(stops) != len(tt.stops) {
+			t.Errorf("%s gives %q with the stops %v, want %q with %v", tt.snippet, text, stops, tt.text, tt.stops)
+			continue
+		}
+		for i := range stops {
+			if stops[i] != tt.stops[i] {
+				t.Errorf("%s has the stops %v, want %v", tt.snippet, stops, tt.stops)
+				break
+			}
+		}
+	}
+}
+
+func TestLocalCompletions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "completion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, map[string]string{
+		"go.mod": "module example.com/comp\n",
+		"thing.go": `package comp
+
+// Thing is a thing.
+type Thing struct {
+	Name string // the name
+	inner
+}
+
+type inner struct{ Deep int }
+
+// Do does it.
+func (Thing) Do(x int, rest ...string) {}
+
+const limit = 3
+`,
+	})
+	path := filepath.Join(dir, "a.go")
+
+	type item struct {
+		label      string
+		kind       completionKind
+		insertText string
+		doc        string
+	}
+	tests := []struct {
+		name string
+		// src has the caret at «»
+		src     string
+		want    []item
+		missing []string
+	}{
+		{
+			name: "the names in scope",
+			src: `package comp
+
+func f(t Thing) {
+	local := 1
+	«»
+	later := 2
+	_, _ = local, later
+}
+`,
+			want: []item{
+				{label: "local", kind: completionVariable},
+				{label: "t", kind: completionVariable},
+				{label: "Thing", kind: completionType, doc: "Thing is a thing."},
+				{label: "limit", kind: completionConstant},
+				{label: "f", kind: completionFunction, insertText: "f(${1:t})"},
+				{label: "append", kind: completionFunction, insertText: "append(${1})"},
+				{label: "string", kind: completionType},
+				{label: "return", kind: completionKeyword},
+			},
+			// declared after the caret
+			missing: []string{"later"},
+		},
+		{
+			name: "fields and methods",
+			src: `package comp
+
+func f(t *Thing) {
+	t.«»
+}
+`,
+			want: []item{
+				{label: "Name", kind: completionField, doc: "the name"},
+				{label: "inner", kind: completionField},
+				{label: "Deep", kind: completionField},
+				{label: "Do", kind: completionMethod, insertText: "Do(${1:x}, ${2:rest...})", doc: "Do does it."},
+			},
+			missing: []string{"f", "return"},
+		},
+		{
+			name: "the members of an imported package",
+			src: `package comp
+
+import "errors"
+
+func f() {
+	errors.«»
+}
+`,
+			want: []item{
+				{label: "New", kind: completionFunction, insertText: "New(${1:text})"},
+			},
+			// unexported
+			missing: []string{"errorString"},
+		},
+	}
+	c := newLocalCompleter()
+	for _, tt := range tests {
+		src, caret, _ := selectionMarkers(tt.src)
+		items := make(map[string]completionItem)
+		for _, it := range c.completions(path, []byte(src), caret) {
+			items[it.label] = it
+		}
+		for _, w := range tt.want {
+			it, ok := items[w.label]
+			if !ok {
+				t.Errorf("%s: %s is missing", tt.name, w.label)
+				continue
+			}
+			if it.kind != w.kind || it.insertText != w.insertText || it.snippet != strings.Contains(w.insertText, "$") {
+				t.Errorf("%s: %s is %+v", tt.name, w.label, it)
+			}
+			if w.doc != "" && it.documentation != w.doc {
+				t.Errorf("%s: the documentation of %s is %q, want %q", tt.name, w.label, it.documentation, w.doc)
+			}
+		}
+		for _, label := range tt.missing {
+			if _, ok := items[label]; ok {
+				t.Errorf("%s: %s is completed", tt.name, label)
+			}
+		}
+	}
+}
+
+// completeWith makes the editor complete the labels.
+func completeWith(e *editor, labels ...string) {
+	e.complete = func(doc *document, offset int, done func([]completionItem, error)) {
+		items := make([]completionItem, len(labels))
+		for i, label := range labels {
+			items[i] = completionItem{label: label}
+		}
+		done(items, nil)
+	}
+}
+
+// completionLabels are the labels of the matches in the open popup.
+func completionLabels(e *editor) []string {
+	if e.completion == nil {
+		return nil
+	}
+	var labels []string
+	for _, i := range e.completion.matches {
+		labels = append(labels, e.completion.items[i].label)
+	}
+	return labels
+}
+
+func TestCompletionPopup(t *testing.T) {
+	d, _ := newTestDispatcher()
+	e := newEditor(newDocument([]byte("x := pr")))
+	e.now = func() time.Time { return time.Unix(0, 0) }
+	e.moveCaretTo(textPosition{line: 0, column: 7})
+	completeWith(e, "Sprintf", "print", "Println", "make")
+
+	// the word before the caret filters the items
+	pressKeys(t, d, e, "Ctrl+Space", "")
+	if got := strings.Join(completionLabels(e), " "); got != "print Println Sprintf" {
+		t.Fatalf("the popup shows %q", got)
+	}
+	// typing filters further
+	pressKeys(t, d, e, "I", "i")
+	if got := strings.Join(completionLabels(e), " "); got != "print Println Sprintf" {
+		t.Fatalf("after typing i the popup shows %q", got)
+	}
+	pressKeys(t, d, e, "L", "l")
+	if got := strings.Join(completionLabels(e), " "); got != "Println" {
+		t.Fatalf("after typing l the popup shows %q", got)
+	}
+	// Backspace widens the filter again, Enter accepts
+	pressKeys(t, d, e, "Backspace Down Enter", "\x08\x00\r")
+	if got := string(e.doc.bytes()); got != "x := Println" || e.completion != nil {
+		t.Fatalf("accepting gives %q", got)
+	}
+
+	// the popup closes if nothing matches, at a character that ends the word,
+	// with Escape and if the caret leaves the word
+	closers := []struct {
+		keys, chars string
+	}{
+		{"Q", "q"},
+		{"Space", " "},
+		{"Escape", "\x1b"},
+		{"Home", ""},
+	}
+	for _, c := range closers {
+		e.moveCaretTo(textPosition{line: 0, column: 11})
+		pressKeys(t, d, e, "Ctrl+Space", "")
+		if e.completion == nil {
+			t.Fatal("the popup did not open")
+		}
+		pressKeys(t, d, e, c.keys, c.chars)
+		if e.completion != nil {
+			t.Errorf("%s keeps the popup open with %v", c.keys, completionLabels(e))
+		}
+		e.undo()
+	}
+}
+
+func TestCompletionSnippet(t *testing.T) {
+	d, _ := newTestDispatcher()
+	e := newEditor(newDocument([]byte("x := Pr")))
+	e.now = func() time.Time { return time.Unix(0, 0) }
+	e.moveCaretTo(textPosition{line: 0, column: 7})
+	e.complete = func(doc *document, offset int, done func([]completionItem, error)) {
+		done([]completionItem{
+			{label: "Printf", insertText: "Printf(${1:format}, ${2:a})", snippet: true},
+		}, nil)
+	}
+	selected := func() string {
+		r := e.selectedRanges()[0]
+		return string(e.doc.slice(r.start, r.end))
+	}
+
+	pressKeys(t, d, e, "Ctrl+Space Tab", "\x00\t")
+	if got := string(e.doc.bytes()); got != "x := Printf(format, a)" || selected() != "format" {
+		t.Fatalf("the snippet gives %q with %q selected", got, selected())
+	}
+	// typing replaces the placeholder, Tab moves to the next one and ends
+	// the session at the last
+	pressKeys(t, d, e, `Shift+' S Shift+' Tab`, `"s"`+"\t")
+	if got := string(e.doc.bytes()); got != `x := Printf("s", a)` || selected() != "a" {
+		t.Fatalf("the first placeholder gives %q with %q selected", got, selected())
+	}
+	pressKeys(t, d, e, "Tab", "\t")
+	if e.snippet != nil || e.primaryCursor().caret != e.doc.len() {
+		t.Errorf("after the last placeholder the caret is at %d", e.primaryCursor().caret)
+	}
+}
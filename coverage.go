@@ -0,0 +1,456 @@
+package main
+
+import (
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// coverBlock is a range of statements from a cover profile, count tells how
+// often they ran.
+type coverBlock struct {
+	start, end textPosition
+	statements int
+	count      int
+}
+
+// coverageFunc is a function of a file with coverage and the number of its
+// statements that ran.
+type coverageFunc struct {
+	name                string
+	pos                 textPosition
+	covered, statements int
+}
+
+// coverageFile is the coverage of one file. name is how the profile calls it,
+// the import path of its package and the file name.
+type coverageFile struct {
+	path, name          string
+	blocks              []coverBlock
+	funcs               []coverageFunc
+	covered, statements int
+}
+
+// coverageSet is the coverage of the last coverage run. Its positions follow
+// the edits in the open file until the next run replaces it.
+type coverageSet struct {
+	files []*coverageFile
+	// changed, if not nil, is called after the coverage changed
+	changed func()
+}
+
+func (s *coverageSet) set(files []*coverageFile) {
+	s.files = files
+	if s.changed != nil {
+		s.changed()
+	}
+}
+
+// inFile returns the blocks of the file at path.
+func (s *coverageSet) inFile(path string) []coverBlock {
+	path = diagnosticPath(path)
+	for _, f := range s.files {
+		if f.path == path {
+			return f.blocks
+		}
+	}
+	return nil
+}
+
+// follow moves the coverage of the file at path with the edits in doc until
+// stop is called. The blocks are moved in place, the editor shows the same
+// ones and the edit redraws it, so changed is not called.
+func (s *coverageSet) follow(path string, doc *document) (stop func()) {
+	path = diagnosticPath(path)
+	return doc.observeChanges(func(offset, count int, text []byte) {
+		line, column := doc.offsetToLineCol(offset)
+		endLine, endColumn := doc.offsetToLineCol(offset + count)
+		move := positionMover(
+			textPosition{line, column},
+			textPosition{endLine, endColumn},
+			text,
+		)
+		for _, f := range s.files {
+			if f.path != path {
+				continue
+			}
+			for i := range f.blocks {
+				b := &f.blocks[i]
+				b.start, b.end = move(b.start), move(b.end)
+			}
+			for i := range f.funcs {
+				f.funcs[i].pos = move(f.funcs[i].pos)
+			}
+		}
+	})
+}
+
+// loadCoverage reads the cover profile that go test wrote for the packages
+// of the module or the GOPATH that dir is in. Files outside of it are left
+// out.
+func loadCoverage(profile, dir string) ([]*coverageFile, error) {
+	data, err := ioutil.ReadFile(profile)
+	if err != nil {
+		return nil, makeErr("read cover profile", err)
+	}
+	// the profile names files by their package's import path, in a module it
+	// starts with the module path, in GOPATH it is relative to GOPATH/src
+	prefix := ""
+	root, module, ok := findModule(dir)
+	if ok {
+		prefix = module + "/"
+	} else if root, ok = gopathSrc(dir); !ok {
+		return nil, errors.New("coverage needs a Go module or GOPATH, " + dir + " is in neither")
+	}
+	byName := make(map[string]*coverageFile)
+	outside := make(map[string]bool)
+	lines := strings.Split(string(data), "\n")
+	if !strings.HasPrefix(lines[0], "mode: ") {
+		return nil, errors.New("the cover profile does not start with its mode")
+	}
+	for i, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, b, ok := parseCoverLine(line)
+		if !ok {
+			return nil, errors.New("invalid cover profile line " + strconv.Itoa(i+2) + ": " + line)
+		}
+		f := byName[name]
+		if f == nil {
+			if outside[name] || !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			path := filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(name, prefix)))
+			if prefix == "" {
+				// e.g. a package in another GOPATH entry
+				if _, err := os.Stat(path); err != nil {
+					outside[name] = true
+					continue
+				}
+			}
+			f = &coverageFile{path: diagnosticPath(path), name: name}
+			byName[name] = f
+		}
+		f.blocks = append(f.blocks, b)
+	}
+
+	files := make([]*coverageFile, 0, len(byName))
+	for _, f := range byName {
+		f.blocks = mergeCoverBlocks(f.blocks)
+		for _, b := range f.blocks {
+			f.statements += b.statements
+			if b.count > 0 {
+				f.covered += b.statements
+			}
+		}
+		funcs, err := coverageFuncs(f.path, f.blocks)
+		if err != nil {
+			return nil, err
+		}
+		f.funcs = funcs
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files, nil
+}
+
+// parseCoverLine parses a block of a cover profile, like
+//
+//	example.com/pkg/file.go:12.34,15.2 3 1
+//
+// which are the file, the start and end line and column, the number of
+// statements and how often they ran.
+func parseCoverLine(line string) (name string, b coverBlock, ok bool) {
+	colon := strings.LastIndexByte(line, ':')
+	if colon == -1 {
+		return "", b, false
+	}
+	name = line[:colon]
+	fields := strings.Fields(line[colon+1:])
+	if len(fields) != 3 {
+		return "", b, false
+	}
+	positions := strings.Split(fields[0], ",")
+	if len(positions) != 2 {
+		return "", b, false
+	}
+	var err1, err2, err3, err4 error
+	b.start, err1 = parseCoverPosition(positions[0])
+	b.end, err2 = parseCoverPosition(positions[1])
+	b.statements, err3 = strconv.Atoi(fields[1])
+	b.count, err4 = strconv.Atoi(fields[2])
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return "", b, false
+	}
+	return name, b, true
+}
+
+// parseCoverPosition parses the 1-indexed line.column of a cover profile.
+func parseCoverPosition(s string) (textPosition, error) {
+	dot := strings.IndexByte(s, '.')
+	if dot == -1 {
+		return textPosition{}, errors.New("missing column")
+	}
+	line, err := strconv.Atoi(s[:dot])
+	if err != nil {
+		return textPosition{}, err
+	}
+	column, err := strconv.Atoi(s[dot+1:])
+	if err != nil {
+		return textPosition{}, err
+	}
+	return textPosition{line: line - 1, column: column - 1}, nil
+}
+
+// mergeCoverBlocks sorts the blocks and adds up the counts of blocks that
+// appear more than once, e.g. if several test binaries cover the same
+// package.
+func mergeCoverBlocks(blocks []coverBlock) []coverBlock {
+	sort.SliceStable(blocks, func(i, j int) bool {
+		return blocks[i].start.less(blocks[j].start)
+	})
+	merged := blocks[:0]
+	for _, b := range blocks {
+		if n := len(merged); n > 0 && merged[n-1].start == b.start && merged[n-1].end == b.end {
+			merged[n-1].count += b.count
+			continue
+		}
+		merged = append(merged, b)
+	}
+	return merged
+}
+
+// coverageFuncs finds the functions of the Go file at path and counts the
+// statements of the blocks in them.
+func coverageFuncs(path string, blocks []coverBlock) ([]coverageFunc, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, nil, 0)
+	if err != nil {
+		return nil, makeErr("coverage of "+filepath.Base(path), err)
+	}
+	position := func(pos token.Pos) textPosition {
+		p := fset.Position(pos)
+		return textPosition{line: p.Line - 1, column: p.Column - 1}
+	}
+	var funcs []coverageFunc
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Body == nil {
+			continue
+		}
+		f := coverageFunc{name: fn.Name.Name, pos: position(fn.Pos())}
+		if fn.Recv != nil && len(fn.Recv.List) == 1 {
+			f.name = receiverTypeName(fn.Recv.List[0].Type) + "." + f.name
+		}
+		start, end := position(fn.Body.Pos()), position(fn.Body.End())
+		for _, b := range blocks {
+			if !b.start.less(start) && !end.less(b.end) {
+				f.statements += b.statements
+				if b.count > 0 {
+					f.covered += b.statements
+				}
+			}
+		}
+		funcs = append(funcs, f)
+	}
+	return funcs, nil
+}
+
+// receiverTypeName returns the name of the type of a method's receiver,
+// without pointer and type parameters.
+func receiverTypeName(x ast.Expr) string {
+	for {
+		switch t := x.(type) {
+		case *ast.StarExpr:
+			x = t.X
+		case *ast.ParenExpr:
+			x = t.X
+		case *ast.IndexExpr:
+			x = t.X
+		case *ast.Ident:
+			return t.Name
+		default:
+			return "?"
+		}
+	}
+}
+
+// coveragePercent formats the share of covered statements.
+func coveragePercent(covered, statements int) string {
+	if statements == 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(100*float64(covered)/float64(statements), 'f', 1, 64) + "%"
+}
+
+const (
+	coveredColor   = 0xFFDDF4E4
+	uncoveredColor = 0xFFFDE0E0
+)
+
+// drawCoverage tints the background of the blocks in the visible lines, the
+// ones that ran green and the others red.
+func (e *editor) drawCoverage(g graphics, lastLine int) {
+	lineHeight := g.lineHeight()
+	for _, b := range e.coverage {
+		if b.end.line < e.topLine || b.start.line > lastLine {
+			continue
+		}
+		color := uint32(uncoveredColor)
+		if b.count > 0 {
+			color = coveredColor
+		}
+		start := e.doc.lineColToOffset(b.start.line, b.start.column)
+		end := e.doc.lineColToOffset(b.end.line, b.end.column)
+		first := max(e.topLine, e.doc.lineOf(start))
+		last := min(lastLine, e.doc.lineOf(end))
+		for line := first; line <= last; line++ {
+			lineStart, lineEnd := e.doc.lineStart(line), e.doc.lineEnd(line)
+			from, to := max(start, lineStart), min(end, lineEnd)
+			x0 := e.area.x + e.textWidth(g, lineStart, from)
+			x1 := e.area.x + e.textWidth(g, lineStart, to)
+			y := e.area.y + (line-e.topLine)*lineHeight
+			fillRect(g, rect(x0, y, x1-x0, lineHeight).intersect(e.area), color)
+		}
+	}
+}
+
+// coveragePanel lists the coverage of the files and their functions. A
+// clicked row opens the file at the function.
+type coveragePanel struct {
+	listPanel
+	list []coverageRow
+}
+
+// coverageRow is a file or, if fn is not nil, one of its functions.
+type coverageRow struct {
+	file *coverageFile
+	fn   *coverageFunc
+}
+
+func newCoveragePanel() coveragePanel {
+	return coveragePanel{listPanel: listPanel{title: "Coverage", selected: -1}}
+}
+
+// setFiles replaces the listed files.
+func (p *coveragePanel) setFiles(files []*coverageFile) {
+	p.list = p.list[:0]
+	covered, statements := 0, 0
+	for _, f := range files {
+		p.list = append(p.list, coverageRow{file: f})
+		for i := range f.funcs {
+			p.list = append(p.list, coverageRow{file: f, fn: &f.funcs[i]})
+		}
+		covered += f.covered
+		statements += f.statements
+	}
+	p.title = "Coverage " + coveragePercent(covered, statements)
+	p.setRows(len(p.list))
+}
+
+func (p *coveragePanel) draw(g graphics, area rectangle) {
+	p.listPanel.draw(g, area, func(i int, row rectangle) {
+		r := p.list[i]
+		text := r.file.name + "  " + coveragePercent(r.file.covered, r.file.statements)
+		if r.fn != nil {
+			text = "    " + r.fn.name + "  " + coveragePercent(r.fn.covered, r.fn.statements)
+		}
+		g.text([]byte(text), row.x+4, row.y, row, editorTextColor)
+	})
+}
+
+// registerCoverageCommands registers the commands that run the tests with
+// coverage and show it.
+func registerCoverageCommands(r *commandRegistry, a *app) {
+	r.register("task.coverage", func(*editor) {
+		a.runCoverage(false)
+	})
+	r.register("task.coverageModule", func(*editor) {
+		a.runCoverage(true)
+	})
+	r.register("view.toggleCoverage", func(*editor) {
+		a.coverageReport.visible = !a.coverageReport.visible
+		a.coverageChanged()
+	})
+}
+
+// runCoverage runs the tests of the package of the app's file, or its
+// module, and shows which statements they ran. The coverage of the last run
+// is removed.
+func (a *app) runCoverage(moduleWide bool) {
+	target := "."
+	if moduleWide {
+		target = "./..."
+	}
+	title := "go test -cover " + target
+	dir, ok := a.taskDir(title, moduleWide)
+	if !ok {
+		return
+	}
+	profile, err := ioutil.TempFile("", "cover")
+	if err != nil {
+		a.platform.showError(title, err.Error())
+		return
+	}
+	profile.Close()
+	args := []string{"test", "-json", "-coverprofile=" + profile.Name(), target}
+	a.explorer.clear()
+	a.coverage.set(nil)
+	a.startTask(task{title: title, dir: dir, args: args, tests: true, coverProfile: profile.Name()})
+}
+
+// showCoverage loads the cover profile of the finished task t. If the tests
+// did not build there is no coverage and no error.
+func (a *app) showCoverage(t task, failed bool) {
+	a.loadingCoverage.start(func() func() {
+		files, err := loadCoverage(t.coverProfile, t.dir)
+		os.Remove(t.coverProfile)
+		if failed && (err != nil || len(files) == 0) {
+			return func() {}
+		}
+		return func() {
+			if err != nil {
+				a.platform.showError("Coverage", err.Error())
+				return
+			}
+			a.coverageReport.visible = true
+			a.coverage.set(files)
+		}
+	})
+	a.platform.startTimer(coverageTimer, coveragePoll)
+}
+
+// coverageChanged updates the coverage panel and the editor's overlay, which
+// are hidden together.
+func (a *app) coverageChanged() {
+	a.coverageReport.setFiles(a.coverage.files)
+	if a.editor != nil {
+		a.editor.coverage = nil
+		if a.coverageReport.visible && a.path != "" {
+			a.editor.coverage = a.coverage.inFile(a.path)
+		}
+	}
+	a.frames.invalidateAll()
+}
+
+// showCoverageRow selects row i of the coverage panel and opens its file at
+// the function.
+func (a *app) showCoverageRow(i int) {
+	a.coverageReport.selectRow(i)
+	r := a.coverageReport.list[i]
+	loc := codeLocation{path: r.file.path}
+	if r.fn != nil {
+		loc.pos = r.fn.pos
+	}
+	a.jumpTo(loc)
+	a.frames.invalidateAll()
+}
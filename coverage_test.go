@@ -0,0 +1,158 @@
+package main
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const coverageSource = `package cov
+
+type T struct{}
+
+func (t *T) Used(x int) int {
+	if x > 0 {
+		return x
+	}
+	return -x
+}
+
+func Unused() int {
+	return 1
+}
+`
+
+// coverageProfile covers cov.go, which is in the package with the import
+// path pkg. The first block is listed twice, like for two test binaries.
+func coverageProfile(pkg string) string {
+	return "mode: set\n" +
+		pkg + "/cov.go:5.29,6.11 1 1\n" +
+		pkg + "/cov.go:6.11,8.3 1 1\n" +
+		pkg + "/cov.go:9.2,9.11 1 0\n" +
+		pkg + "/cov.go:12.20,14.2 1 0\n" +
+		pkg + "/cov.go:5.29,6.11 1 0\n" +
+		"other.org/x/x.go:1.1,2.2 1 1\n"
+}
+
+// checkCoverage compares the coverage of cov.go with the profile.
+func checkCoverage(t *testing.T, files []*coverageFile, path, name string) {
+	t.Helper()
+	if len(files) != 1 {
+		t.Fatalf("the coverage has %d files", len(files))
+	}
+	f := files[0]
+	if f.path != path || f.name != name || len(f.blocks) != 4 ||
+		f.covered != 2 || f.statements != 4 {
+		t.Fatalf("the file is %s %s with %d blocks and %d of %d statements covered",
+			f.path, f.name, len(f.blocks), f.covered, f.statements)
+	}
+	if b := f.blocks[0]; b.start != (textPosition{4, 28}) || b.end != (textPosition{5, 10}) || b.count != 1 {
+		t.Errorf("the merged first block is %+v", b)
+	}
+	if len(f.funcs) != 2 ||
+		f.funcs[0].name != "T.Used" || f.funcs[0].covered != 2 || f.funcs[0].statements != 3 ||
+		f.funcs[1].name != "Unused" || f.funcs[1].covered != 0 || f.funcs[1].pos != (textPosition{11, 0}) {
+		t.Errorf("the functions are %+v", f.funcs)
+	}
+}
+
+func TestLoadCoverage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coverage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/cov\n"), 0666)
+	path := filepath.Join(dir, "cov.go")
+	ioutil.WriteFile(path, []byte(coverageSource), 0666)
+	profile := filepath.Join(dir, "c.out")
+	ioutil.WriteFile(profile, []byte(coverageProfile("example.com/cov")), 0666)
+
+	files, err := loadCoverage(profile, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCoverage(t, files, path, "example.com/cov/cov.go")
+
+	ioutil.WriteFile(profile, []byte("mode: set\nbroken\n"), 0666)
+	if _, err := loadCoverage(profile, dir); err == nil || err.Error() != "invalid cover profile line 2: broken" {
+		t.Errorf("a broken line gives %v", err)
+	}
+	ioutil.WriteFile(profile, []byte("example.com/cov/cov.go:5.29,6.11 1 1\n"), 0666)
+	if _, err := loadCoverage(profile, dir); err == nil {
+		t.Error("a profile without its mode loaded")
+	}
+}
+
+func TestLoadCoverageInGOPATH(t *testing.T) {
+	gopath, err := ioutil.TempDir("", "coverage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gopath)
+	// the package scans of other tests read GOPATH in the background
+	localPackageScans.Wait()
+	defer func(old string) { build.Default.GOPATH = old }(build.Default.GOPATH)
+	build.Default.GOPATH = gopath
+	dir := filepath.Join(gopath, "src", "example.com", "cov")
+	os.MkdirAll(dir, 0777)
+	path := filepath.Join(dir, "cov.go")
+	ioutil.WriteFile(path, []byte(coverageSource), 0666)
+	profile := filepath.Join(gopath, "c.out")
+	ioutil.WriteFile(profile, []byte(coverageProfile("example.com/cov")), 0666)
+
+	files, err := loadCoverage(profile, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCoverage(t, files, path, "example.com/cov/cov.go")
+
+	outside := filepath.Dir(gopath)
+	if _, err := loadCoverage(profile, outside); err == nil ||
+		!strings.HasPrefix(err.Error(), "coverage needs a Go module or GOPATH") {
+		t.Errorf("coverage outside of GOPATH gives %v", err)
+	}
+}
+
+func TestCoverageFollowsEdits(t *testing.T) {
+	path := diagnosticPath("cov.go")
+	s := &coverageSet{files: []*coverageFile{{
+		path: path,
+		blocks: []coverBlock{
+			{start: textPosition{4, 28}, end: textPosition{5, 10}, statements: 1, count: 1},
+			{start: textPosition{11, 19}, end: textPosition{13, 1}, statements: 1},
+		},
+		funcs: []coverageFunc{{name: "Unused", pos: textPosition{11, 0}}},
+	}}}
+	changed := 0
+	s.changed = func() { changed++ }
+	doc := newDocument([]byte(coverageSource))
+	stop := s.follow(path, doc)
+	// the editor shows the blocks that were there before the edits
+	shown := s.inFile(path)
+
+	doc.insert(0, []byte("// x\n\n"))
+	if b := shown[0]; b.start != (textPosition{6, 28}) || b.end != (textPosition{7, 10}) {
+		t.Errorf("inserted lines move the block to %v-%v", b.start, b.end)
+	}
+	// the block's end moves with text inserted in its line
+	doc.insert(doc.lineColToOffset(15, 0), []byte("\t"))
+	if b := shown[1]; b.start != (textPosition{13, 19}) || b.end != (textPosition{15, 2}) {
+		t.Errorf("the second block moved to %v-%v", b.start, b.end)
+	}
+	if pos := s.files[0].funcs[0].pos; pos != (textPosition{13, 0}) {
+		t.Errorf("the function moved to %v", pos)
+	}
+	if changed != 0 {
+		t.Errorf("the edits changed the coverage %d times", changed)
+	}
+
+	stop()
+	doc.insert(0, []byte("\n"))
+	if b := shown[0]; b.start != (textPosition{6, 28}) {
+		t.Errorf("the block moved after stop to %v", b.start)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// selection is a range of text in a document. caret is where the cursor is
+// drawn, anchor is the other end of the selection. If they are the same there
+// is no selected text.
+type selection struct {
+	anchor, caret int
+}
+
+func (s selection) empty() bool {
+	return s.anchor == s.caret
+}
+
+func (s selection) start() int {
+	if s.anchor < s.caret {
+		return s.anchor
+	}
+	return s.caret
+}
+
+func (s selection) end() int {
+	if s.anchor > s.caret {
+		return s.anchor
+	}
+	return s.caret
+}
+
+// cursor is a selection that remembers the visual column it came from when
+// moving up and down. Moving through a short line and back to a long one puts
+// the caret at the original column again.
+type cursor struct {
+	selection
+	// column is the visual column that vertical motions try to reach, it is
+	// -1 if it has to be computed from the caret position
+	column int
+}
+
+func newCursor(offset int) cursor {
+	return cursor{selection: selection{anchor: offset, caret: offset}, column: -1}
+}
+
+// moveTo places the caret at offset. If extend is true the anchor stays where
+// it is, extending the selection, otherwise the selection is collapsed.
+func (c *cursor) moveTo(offset int, extend bool) {
+	c.caret = offset
+	if !extend {
+		c.anchor = offset
+	}
+	c.column = -1
+}
+
+// moveVertically moves the caret the given number of lines up (negative) or
+// down (positive), trying to keep its visual column.
+func (c *cursor) moveVertically(doc *document, lines int, extend bool) {
+	if c.column == -1 {
+		c.column = visualColumn(doc, c.caret)
+	}
+	column := c.column
+	line := doc.lineOf(c.caret) + lines
+	if line < 0 {
+		c.moveTo(0, extend)
+	} else if line >= doc.lineCount() {
+		c.moveTo(doc.len(), extend)
+	} else {
+		c.moveTo(offsetAtColumn(doc, line, column), extend)
+	}
+	c.column = column
+}
+
+// motion computes a new caret position from the current one.
+type motion func(doc *document, offset int) int
+
+func runeLeft(doc *document, offset int) int {
+	r, size := runeBefore(doc, offset)
+	if r == '\n' {
+		// treat Windows line breaks as one character
+		if r, _ := runeBefore(doc, offset-size); r == '\r' {
+			return offset - size - 1
+		}
+	}
+	return offset - size
+}
+
+func runeRight(doc *document, offset int) int {
+	r, size := runeAt(doc, offset)
+	if r == '\r' {
+		if r, _ := runeAt(doc, offset+size); r == '\n' {
+			return offset + size + 1
+		}
+	}
+	return offset + size
+}
+
+// wordRight moves to the end of the next word. Whitespace before it is
+// skipped, a run of punctuation counts as a word and line breaks stop the
+// motion.
+func wordRight(doc *document, offset int) int {
+	r, size := runeAt(doc, offset)
+	if size == 0 {
+		return offset
+	}
+	if charClassOf(r) == lineBreakClass {
+		return runeRight(doc, offset)
+	}
+	offset = scanForward(doc, offset, func(_ int, r rune) bool {
+		return charClassOf(r) == spaceClass
+	})
+	r, size = runeAt(doc, offset)
+	class := charClassOf(r)
+	if size == 0 || class == lineBreakClass {
+		return offset
+	}
+	return scanForward(doc, offset, func(_ int, r rune) bool {
+		return charClassOf(r) == class
+	})
+}
+
+// wordLeft is the mirror image of wordRight, it moves to the start of the
+// previous word.
+func wordLeft(doc *document, offset int) int {
+	r, size := runeBefore(doc, offset)
+	if size == 0 {
+		return offset
+	}
+	if charClassOf(r) == lineBreakClass {
+		return runeLeft(doc, offset)
+	}
+	offset = scanBackward(doc, offset, func(_ int, r rune) bool {
+		return charClassOf(r) == spaceClass
+	})
+	r, size = runeBefore(doc, offset)
+	class := charClassOf(r)
+	if size == 0 || class == lineBreakClass {
+		return offset
+	}
+	return scanBackward(doc, offset, func(_ int, r rune) bool {
+		return charClassOf(r) == class
+	})
+}
+
+// lineHome moves to the first non-blank character in the line or, if the
+// caret is already there, to the very start of the line.
+func lineHome(doc *document, offset int) int {
+	start := doc.lineStart(doc.lineOf(offset))
+	firstNonBlank := scanForward(doc, start, func(_ int, r rune) bool {
+		return charClassOf(r) == spaceClass
+	})
+	if offset == firstNonBlank {
+		return start
+	}
+	return firstNonBlank
+}
+
+// lineEnd moves in front of the line break, a Windows line break (\r\n) is
+// treated as one character.
+func lineEnd(doc *document, offset int) int {
+	end := doc.lineEnd(doc.lineOf(offset))
+	if r, _ := runeBefore(doc, end); r == '\r' && end < doc.len() {
+		return end - 1
+	}
+	return end
+}
+
+func documentStart(doc *document, offset int) int {
+	return 0
+}
+
+func documentEnd(doc *document, offset int) int {
+	return doc.len()
+}
+
+// tabWidth is the number of columns that a tab takes up. The font renderer
+// draws a tab as wide as this many spaces.
+const tabWidth = 4
+
+// columnWidth is the number of visual columns that a character takes up, it
+// matches the way the font renderer advances the cursor.
+func columnWidth(r rune) int {
+	if r == '\t' {
+		return tabWidth
+	}
+	if unicode.IsControl(r) {
+		return 0
+	}
+	return 1
+}
+
+// visualColumn returns the column in which the character at offset is drawn.
+func visualColumn(doc *document, offset int) int {
+	col := 0
+	start := doc.lineStart(doc.lineOf(offset))
+	scanForward(doc, start, func(at int, r rune) bool {
+		if at >= offset {
+			return false
+		}
+		col += columnWidth(r)
+		return true
+	})
+	return col
+}
+
+// offsetAtColumn returns the offset of the character in line that is drawn
+// closest to the given visual column. If the line is too short, the offset
+// of the line end is returned.
+func offsetAtColumn(doc *document, line, column int) int {
+	col := 0
+	return scanForward(doc, doc.lineStart(line), func(_ int, r rune) bool {
+		if col >= column || r == '\n' || r == '\r' {
+			return false
+		}
+		w := columnWidth(r)
+		if col+w > column && column-col < (w+1)/2 {
+			// column is inside this (wide) character but closer to its left
+			// edge
+			return false
+		}
+		col += w
+		return true
+	})
+}
+
+type charClass int
+
+const (
+	spaceClass charClass = iota
+	lineBreakClass
+	wordClass
+	punctuationClass
+)
+
+func charClassOf(r rune) charClass {
+	switch {
+	case r == ' ' || r == '\t':
+		return spaceClass
+	case r == '\n' || r == '\r':
+		return lineBreakClass
+	case r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+		return wordClass
+	default:
+		return punctuationClass
+	}
+}
+
+// runeAt decodes the rune starting at offset. The size is 0 at the end of the
+// document.
+func runeAt(doc *document, offset int) (r rune, size int) {
+	var buf [utf8.UTFMax]byte
+	n := doc.readAt(buf[:], offset)
+	if n == 0 {
+		return utf8.RuneError, 0
+	}
+	return utf8.DecodeRune(buf[:n])
+}
+
+// runeBefore decodes the rune that ends at offset. The size is 0 at the start
+// of the document.
+func runeBefore(doc *document, offset int) (r rune, size int) {
+	start := offset - utf8.UTFMax
+	if start < 0 {
+		start = 0
+	}
+	var buf [utf8.UTFMax]byte
+	n := doc.readAt(buf[:offset-start], start)
+	if n == 0 {
+		return utf8.RuneError, 0
+	}
+	return utf8.DecodeLastRune(buf[:n])
+}
+
+// scanForward calls f for every rune, and its offset, starting at the given
+// offset until f returns false or the document ends. It returns the offset of
+// the rune for which f returned false or the document length. The document is
+// read in chunks so this is fast even for very long lines.
+func scanForward(doc *document, offset int, f func(offset int, r rune) bool) int {
+	var buf [4096]byte
+	for offset < doc.len() {
+		chunk := buf[:doc.readAt(buf[:], offset)]
+		for len(chunk) > 0 {
+			if !utf8.FullRune(chunk) && offset+len(chunk) < doc.len() {
+				// the rest of this rune is in the next chunk
+				break
+			}
+			r, size := utf8.DecodeRune(chunk)
+			if !f(offset, r) {
+				return offset
+			}
+			offset += size
+			chunk = chunk[size:]
+		}
+	}
+	return offset
+}
+
+// scanBackward is like scanForward but goes towards the document start. f is
+// called with the offset at which each rune starts. It returns the offset
+// right after the rune for which f returned false or 0.
+func scanBackward(doc *document, offset int, f func(offset int, r rune) bool) int {
+	var buf [4096]byte
+	for offset > 0 {
+		start := offset - len(buf)
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:doc.readAt(buf[:offset-start], start)]
+		for len(chunk) > 0 {
+			if start > 0 && len(chunk) < utf8.UTFMax {
+				// the start of this rune might be in the previous chunk
+				break
+			}
+			r, size := utf8.DecodeLastRune(chunk)
+			if !f(offset-size, r) {
+				return offset
+			}
+			offset -= size
+			chunk = chunk[:len(chunk)-size]
+		}
+	}
+	return offset
+}
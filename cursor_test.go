@@ -0,0 +1,205 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCursorMotions(t *testing.T) {
+	// the offsets are
+	//   0: "  foo.bar(baz)\r\n"
+	//  16: "\tx := \"ä\"\n", ä takes up two bytes
+	//  27: "end"
+	doc := newDocument([]byte("  foo.bar(baz)\r\n\tx := \"ä\"\nend"))
+	tests := []struct {
+		name     string
+		m        motion
+		from, to int
+	}{
+		{"runeRight", runeRight, 0, 1},
+		{"runeRight", runeRight, 23, 25},
+		{"runeRight", runeRight, 14, 16},
+		{"runeRight", runeRight, 30, 30},
+		{"runeLeft", runeLeft, 25, 23},
+		{"runeLeft", runeLeft, 16, 14},
+		{"runeLeft", runeLeft, 0, 0},
+		{"wordRight", wordRight, 0, 5},
+		{"wordRight", wordRight, 5, 6},
+		{"wordRight", wordRight, 13, 14},
+		{"wordRight", wordRight, 14, 16},
+		{"wordRight", wordRight, 22, 23},
+		{"wordRight", wordRight, 23, 25},
+		{"wordRight", wordRight, 30, 30},
+		{"wordLeft", wordLeft, 9, 6},
+		{"wordLeft", wordLeft, 25, 23},
+		{"wordLeft", wordLeft, 16, 14},
+		{"wordLeft", wordLeft, 17, 16},
+		{"wordLeft", wordLeft, 0, 0},
+		{"lineHome", lineHome, 5, 2},
+		{"lineHome", lineHome, 2, 0},
+		{"lineHome", lineHome, 0, 2},
+		{"lineHome", lineHome, 20, 17},
+		{"lineEnd", lineEnd, 3, 14},
+		{"lineEnd", lineEnd, 14, 14},
+		{"lineEnd", lineEnd, 17, 26},
+		{"lineEnd", lineEnd, 28, 30},
+		{"documentStart", documentStart, 20, 0},
+		{"documentEnd", documentEnd, 20, 30},
+	}
+	for _, tt := range tests {
+		if to := tt.m(doc, tt.from); to != tt.to {
+			t.Errorf("%s from %d goes to %d, want %d", tt.name, tt.from, to, tt.to)
+		}
+	}
+}
+
+func TestVisualColumns(t *testing.T) {
+	doc := newDocument([]byte("\tx := \"ä\"\nab\r\n"))
+	columns := []struct {
+		offset, column int
+	}{
+		{0, 0},
+		{1, 4},
+		{3, 6},
+		{7, 10},
+		{9, 11},
+		{13, 2},
+	}
+	for _, tt := range columns {
+		if c := visualColumn(doc, tt.offset); c != tt.column {
+			t.Errorf("offset %d is in column %d, want %d", tt.offset, c, tt.column)
+		}
+	}
+
+	offsets := []struct {
+		line, column, offset int
+	}{
+		// a column inside the tab goes to its closer edge
+		{0, 0, 0},
+		{0, 1, 0},
+		{0, 2, 1},
+		{0, 3, 1},
+		{0, 4, 1},
+		{0, 10, 7},
+		{0, 11, 9},
+		// short lines end before their line break
+		{0, 100, 10},
+		{1, 100, 13},
+		{2, 5, 15},
+	}
+	for _, tt := range offsets {
+		if o := offsetAtColumn(doc, tt.line, tt.column); o != tt.offset {
+			t.Errorf("column %d of line %d is at offset %d, want %d", tt.column, tt.line, o, tt.offset)
+		}
+	}
+}
+
+func TestCursorMovesVertically(t *testing.T) {
+	doc := newDocument([]byte("abcdef\nab\n\tabcdef"))
+	c := newCursor(5)
+	// the short line does not change the column the cursor goes back to
+	steps := []struct {
+		lines int
+		caret int
+	}{
+		{1, 9},
+		{1, 12},
+		{-1, 9},
+		{-1, 5},
+		{-1, 0},
+		{3, doc.len()},
+	}
+	for i, s := range steps {
+		c.moveVertically(doc, s.lines, false)
+		if c.caret != s.caret || !c.empty() {
+			t.Fatalf("step %d moves the cursor to %v, want the caret at %d", i, c.selection, s.caret)
+		}
+	}
+
+	// a horizontal motion forgets the column
+	c.moveTo(2, false)
+	c.moveVertically(doc, 2, true)
+	if c.anchor != 2 || c.caret != 11 {
+		t.Errorf("extending down selects %v", c.selection)
+	}
+}
+
+func TestEditorMotions(t *testing.T) {
+	e := newEditor(newDocument([]byte("one two\nthree")))
+	e.moveCaret(wordRight, true)
+	e.moveCaret(wordRight, true)
+	if c := e.primaryCursor(); c.anchor != 0 || c.caret != 7 {
+		t.Fatalf("extending two words selects %v", c.selection)
+	}
+	// without shift a selection collapses to its side
+	e.moveLeft(false)
+	if c := e.primaryCursor(); !c.empty() || c.caret != 0 {
+		t.Errorf("Left collapses the selection to %v", c.selection)
+	}
+	e.moveCaret(wordRight, true)
+	e.moveRight(false)
+	if c := e.primaryCursor(); !c.empty() || c.caret != 3 {
+		t.Errorf("Right collapses the selection to %v", c.selection)
+	}
+	e.moveLines(1, true)
+	if c := e.primaryCursor(); c.anchor != 3 || c.caret != 11 {
+		t.Errorf("Shift+Down selects %v", c.selection)
+	}
+	e.selectAll()
+	if c := e.primaryCursor(); c.anchor != 0 || c.caret != e.doc.len() {
+		t.Errorf("select all selects %v", c.selection)
+	}
+
+	// deleting a character respects UTF-8
+	e = newEditor(newDocument([]byte("aä\r\nb")))
+	e.cursors[0].moveTo(3, false)
+	e.deleteBackward(time.Unix(0, 0))
+	e.deleteForward(time.Unix(0, 0))
+	if got := string(e.doc.bytes()); got != "ab" {
+		t.Errorf("deleting ä and the line break gives %q", got)
+	}
+}
+
+func TestEditorDrawsCaretAndSelection(t *testing.T) {
+	e := newEditor(newDocument([]byte("ab\n\tcd")))
+	e.cursors[0].anchor = 1
+	e.cursors[0].caret = 5
+	g := newRecordingGraphics(fixedWidthFont{10, 20})
+	e.draw(g, rect(0, 0, 200, 100))
+
+	// the selection is drawn behind the text, the selected line break as one
+	// space, the caret in front of it
+	x := editorGutterWidth
+	want := []drawCommand{
+		{op: rectOp, area: rect(x+10, 0, 20, 20), color: editorSelectionColor},
+		{op: rectOp, area: rect(x, 20, 50, 20), color: editorSelectionColor},
+		{op: textOp},
+		{op: rectOp, area: rect(x+50-editorCaretWidth/2, 20, editorCaretWidth, 20), color: editorCaretColor},
+	}
+	var got []drawCommand
+	for _, c := range g.displayList() {
+		if c.op == textOp {
+			got = append(got, drawCommand{op: textOp})
+		} else if c.op == rectOp && (c.color == editorSelectionColor || c.color == editorCaretColor) {
+			got = append(got, c)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("the editor draws %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("command %d is %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	// without the focus there is no caret
+	e.focused = false
+	g = newRecordingGraphics(fixedWidthFont{10, 20})
+	e.draw(g, rect(0, 0, 200, 100))
+	for _, c := range g.displayList() {
+		if c.op == rectOp && c.color == editorCaretColor {
+			t.Errorf("the unfocused editor draws a caret at %v", c.area)
+		}
+	}
+}
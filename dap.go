@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// dapMessage is a message of the Debug Adapter Protocol: a request, the
+// response to one or an event. It has the same Content-Length framing as the
+// Language Server Protocol but is not JSON-RPC.
+type dapMessage struct {
+	Seq        int             `json:"seq"`
+	Type       string          `json:"type"`
+	Command    string          `json:"command,omitempty"`
+	Arguments  json.RawMessage `json:"arguments,omitempty"`
+	RequestSeq int             `json:"request_seq,omitempty"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message,omitempty"`
+	Body       json.RawMessage `json:"body,omitempty"`
+	Event      string          `json:"event,omitempty"`
+}
+
+// dapConn is a connection to the other side of the Debug Adapter Protocol.
+// Messages are read in a background goroutine, responses and incoming
+// messages are handed to callbacks on that goroutine.
+type dapConn struct {
+	writeMutex sync.Mutex
+	w          io.Writer
+
+	mutex  sync.Mutex
+	seq    int
+	calls  map[int]func(body json.RawMessage, err error)
+	closed error
+
+	// handle is called for events and requests from the other side,
+	// requests must be answered with respond
+	handle func(msg dapMessage)
+	// done is closed when the reader stopped
+	done chan bool
+}
+
+func newDAPConn(r io.Reader, w io.Writer, handle func(msg dapMessage)) *dapConn {
+	c := &dapConn{
+		w:      w,
+		calls:  make(map[int]func(json.RawMessage, error)),
+		handle: handle,
+		done:   make(chan bool),
+	}
+	go c.read(bufio.NewReader(r))
+	return c
+}
+
+// call sends a request. done is called with the body of the response once it
+// arrives, on the reader goroutine. A failed request is an error.
+func (c *dapConn) call(command string, arguments interface{}, done func(body json.RawMessage, err error)) {
+	args, err := json.Marshal(arguments)
+	if err != nil {
+		done(nil, makeErr("encode "+command, err))
+		return
+	}
+	c.mutex.Lock()
+	if c.closed != nil {
+		err := c.closed
+		c.mutex.Unlock()
+		done(nil, err)
+		return
+	}
+	c.seq++
+	seq := c.seq
+	c.calls[seq] = done
+	c.mutex.Unlock()
+
+	msg := dapMessage{Seq: seq, Type: "request", Command: command, Arguments: args}
+	if err := c.write(msg); err != nil {
+		c.mutex.Lock()
+		delete(c.calls, seq)
+		c.mutex.Unlock()
+		done(nil, err)
+	}
+}
+
+// respond answers the request, with body if err is nil.
+func (c *dapConn) respond(request dapMessage, body interface{}, err error) error {
+	response := dapMessage{
+		Type:       "response",
+		Command:    request.Command,
+		RequestSeq: request.Seq,
+		Success:    err == nil,
+	}
+	if err == nil {
+		response.Body, err = json.Marshal(body)
+	}
+	if err != nil {
+		response.Success = false
+		response.Message = err.Error()
+	}
+	return c.write(response)
+}
+
+// event sends an event, which has no response.
+func (c *dapConn) event(event string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return makeErr("encode "+event, err)
+	}
+	return c.write(dapMessage{Type: "event", Event: event, Body: data})
+}
+
+func (c *dapConn) write(msg dapMessage) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if msg.Seq == 0 {
+		c.mutex.Lock()
+		c.seq++
+		msg.Seq = c.seq
+		c.mutex.Unlock()
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return writeFramedMessage(c.w, data)
+}
+
+// read handles incoming messages until the connection breaks. Then all calls
+// that are still waiting fail.
+func (c *dapConn) read(r *bufio.Reader) {
+	var err error
+	for err == nil {
+		var data []byte
+		data, err = readFramedMessage(r)
+		if err == nil {
+			var msg dapMessage
+			if err = json.Unmarshal(data, &msg); err != nil {
+				err = makeErr("invalid debug adapter message", err)
+			} else {
+				c.receive(msg)
+			}
+		}
+	}
+	if err == io.EOF {
+		err = errConnectionClosed
+	}
+	c.mutex.Lock()
+	c.closed = err
+	calls := c.calls
+	c.calls = nil
+	c.mutex.Unlock()
+	for _, done := range calls {
+		done(nil, err)
+	}
+	close(c.done)
+}
+
+func (c *dapConn) receive(msg dapMessage) {
+	if msg.Type != "response" {
+		c.handle(msg)
+		return
+	}
+	c.mutex.Lock()
+	done := c.calls[msg.RequestSeq]
+	delete(c.calls, msg.RequestSeq)
+	c.mutex.Unlock()
+	if done == nil {
+		return
+	}
+	if !msg.Success {
+		done(nil, dapResponseError(msg))
+		return
+	}
+	done(msg.Body, nil)
+}
+
+// dapResponseError returns the reason why a request failed. Adapters put the
+// details into the body, the message is often only a short error code.
+func dapResponseError(msg dapMessage) error {
+	var body struct {
+		Error struct {
+			Format string `json:"format"`
+		} `json:"error"`
+	}
+	json.Unmarshal(msg.Body, &body)
+	if body.Error.Format != "" {
+		return errors.New(body.Error.Format)
+	}
+	if msg.Message != "" {
+		return errors.New(msg.Message)
+	}
+	return errors.New(msg.Command + " failed")
+}
+
+type dapSource struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type dapSourceBreakpoint struct {
+	Line       int    `json:"line"`
+	Condition  string `json:"condition,omitempty"`
+	LogMessage string `json:"logMessage,omitempty"`
+}
+
+type dapBreakpoint struct {
+	ID       int        `json:"id,omitempty"`
+	Verified bool       `json:"verified"`
+	Message  string     `json:"message,omitempty"`
+	Source   *dapSource `json:"source,omitempty"`
+	Line     int        `json:"line,omitempty"`
+}
+
+type dapThread struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type dapStackFrame struct {
+	ID     int        `json:"id"`
+	Name   string     `json:"name"`
+	Source *dapSource `json:"source,omitempty"`
+	Line   int        `json:"line"`
+	Column int        `json:"column"`
+}
+
+type dapScope struct {
+	Name               string `json:"name"`
+	VariablesReference int    `json:"variablesReference"`
+	Expensive          bool   `json:"expensive"`
+}
+
+// dapVariable is a variable or the result of an evaluation. If
+// VariablesReference is not 0, it has children.
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type,omitempty"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+// dapStoppedEvent tells that the program stopped, e.g. at a breakpoint or
+// after a step.
+type dapStoppedEvent struct {
+	Reason            string `json:"reason"`
+	Description       string `json:"description,omitempty"`
+	ThreadID          int    `json:"threadId"`
+	AllThreadsStopped bool   `json:"allThreadsStopped"`
+}
+
+// dapClient talks to a debug adapter like dlv dap. Like the lspClient, it
+// collects the responses and events in the background and hands them to the
+// callbacks when poll is called, on the caller's goroutine.
+type dapClient struct {
+	conn   *dapConn
+	closer io.Closer
+
+	mutex sync.Mutex
+	queue []func()
+	// err is set when the connection is broken
+	err error
+
+	// event, if not nil, is called from poll for the events of the adapter
+	event func(event string, body json.RawMessage)
+}
+
+// startDebugAdapter starts dlv, the command, in dir. Delve connects back to
+// the editor, which waits for it for a few seconds.
+func startDebugAdapter(command string, dir string) (*dapClient, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, makeErr("start "+command, err)
+	}
+	defer l.Close()
+	cmd := exec.Command(command, "dap", "--client-addr="+l.Addr().String())
+	cmd.Dir = dir
+	hideProcessWindow(cmd)
+	// the debugged program is ended with it
+	newProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, makeErr("start "+command, err)
+	}
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Second))
+	conn, err := l.Accept()
+	if err != nil {
+		killProcessGroup(cmd)
+		cmd.Wait()
+		return nil, makeErr(command+" did not connect", err)
+	}
+	return newDAPClient(conn, conn, debugAdapterCloser{cmd, conn}), nil
+}
+
+// debugAdapterCloser ends the debug adapter process and its program.
+type debugAdapterCloser struct {
+	cmd  *exec.Cmd
+	conn io.Closer
+}
+
+func (d debugAdapterCloser) Close() error {
+	d.conn.Close()
+	killProcessGroup(d.cmd)
+	return d.cmd.Wait()
+}
+
+// newDAPClient creates a client that reads the adapter's messages from r and
+// writes to w. Call initialize before using it.
+func newDAPClient(r io.Reader, w io.Writer, closer io.Closer) *dapClient {
+	c := &dapClient{closer: closer}
+	c.conn = newDAPConn(r, w, c.handle)
+	return c
+}
+
+// request sends a request and queues done for poll.
+func (c *dapClient) request(command string, arguments interface{}, done func(body json.RawMessage, err error)) {
+	c.conn.call(command, arguments, func(body json.RawMessage, err error) {
+		if len(body) == 0 {
+			body = json.RawMessage("null")
+		}
+		c.enqueue(func() {
+			done(body, err)
+		})
+	})
+}
+
+func (c *dapClient) enqueue(f func()) {
+	c.mutex.Lock()
+	c.queue = append(c.queue, f)
+	c.mutex.Unlock()
+}
+
+// handle is called on the reader goroutine for messages from the adapter.
+func (c *dapClient) handle(msg dapMessage) {
+	if msg.Type == "request" {
+		// reverse requests like runInTerminal are not supported, the
+		// program's output arrives in output events
+		c.conn.respond(msg, nil, errors.New("unsupported request "+msg.Command))
+		return
+	}
+	if msg.Type == "event" {
+		c.enqueue(func() {
+			if c.event != nil {
+				c.event(msg.Event, msg.Body)
+			}
+		})
+	}
+}
+
+// poll runs the callbacks of all requests that are done and of the events
+// that the adapter sent. It returns an error if the connection broke.
+func (c *dapClient) poll() error {
+	c.mutex.Lock()
+	queue := c.queue
+	c.queue = nil
+	c.mutex.Unlock()
+	for _, f := range queue {
+		f()
+	}
+	if c.err == nil {
+		select {
+		case <-c.conn.done:
+			c.err = c.conn.closed
+		default:
+		}
+	}
+	return c.err
+}
+
+// initialize starts the handshake with the adapter. The adapter sends the
+// initialized event when it wants the breakpoints.
+func (c *dapClient) initialize(done func(error)) {
+	args := map[string]interface{}{
+		"clientID":                     "gonutz-ide",
+		"clientName":                   "gonutz/ide",
+		"adapterID":                    "go",
+		"pathFormat":                   "path",
+		"linesStartAt1":                true,
+		"columnsStartAt1":              true,
+		"supportsVariableType":         true,
+		"supportsRunInTerminalRequest": false,
+	}
+	c.request("initialize", args, func(_ json.RawMessage, err error) {
+		done(err)
+	})
+}
+
+// launch builds and starts the program in dir. mode is "debug" for a main
+// package and "test" for the tests of a package.
+func (c *dapClient) launch(mode, dir string, done func(error)) {
+	args := map[string]interface{}{
+		"request": "launch",
+		"mode":    mode,
+		"program": dir,
+		"cwd":     dir,
+		// the program's output is sent in output events
+		"outputMode": "remote",
+	}
+	c.request("launch", args, func(_ json.RawMessage, err error) {
+		done(err)
+	})
+}
+
+// setBreakpoints replaces the breakpoints of the file at path, the result
+// has one entry per breakpoint in the same order.
+func (c *dapClient) setBreakpoints(path string, list []dapSourceBreakpoint, done func([]dapBreakpoint, error)) {
+	args := map[string]interface{}{
+		"source":      dapSource{Path: path},
+		"breakpoints": list,
+	}
+	c.request("setBreakpoints", args, func(body json.RawMessage, err error) {
+		var result struct {
+			Breakpoints []dapBreakpoint `json:"breakpoints"`
+		}
+		if err == nil {
+			err = json.Unmarshal(body, &result)
+		}
+		done(result.Breakpoints, err)
+	})
+}
+
+// configurationDone tells the adapter that all breakpoints are set and the
+// program can run.
+func (c *dapClient) configurationDone(done func(error)) {
+	c.request("configurationDone", nil, func(_ json.RawMessage, err error) {
+		done(err)
+	})
+}
+
+// resume continues the stopped program. command is one of continue, next,
+// stepIn and stepOut, the steps are done by the thread.
+func (c *dapClient) resume(command string, threadID int, done func(error)) {
+	args := map[string]int{"threadId": threadID}
+	c.request(command, args, func(_ json.RawMessage, err error) {
+		done(err)
+	})
+}
+
+// pause stops the running program.
+func (c *dapClient) pause(threadID int, done func(error)) {
+	c.resume("pause", threadID, done)
+}
+
+// threads lists the goroutines.
+func (c *dapClient) threads(done func([]dapThread, error)) {
+	c.request("threads", nil, func(body json.RawMessage, err error) {
+		var result struct {
+			Threads []dapThread `json:"threads"`
+		}
+		if err == nil {
+			err = json.Unmarshal(body, &result)
+		}
+		done(result.Threads, err)
+	})
+}
+
+// maxStackFrames is the number of calls of a goroutine that are shown.
+const maxStackFrames = 50
+
+// stackTrace returns the calls of the thread, the innermost first.
+func (c *dapClient) stackTrace(threadID int, done func([]dapStackFrame, error)) {
+	args := map[string]int{"threadId": threadID, "startFrame": 0, "levels": maxStackFrames}
+	c.request("stackTrace", args, func(body json.RawMessage, err error) {
+		var result struct {
+			StackFrames []dapStackFrame `json:"stackFrames"`
+		}
+		if err == nil {
+			err = json.Unmarshal(body, &result)
+		}
+		done(result.StackFrames, err)
+	})
+}
+
+// scopes returns the groups of variables of a stack frame, like the locals.
+func (c *dapClient) scopes(frameID int, done func([]dapScope, error)) {
+	c.request("scopes", map[string]int{"frameId": frameID}, func(body json.RawMessage, err error) {
+		var result struct {
+			Scopes []dapScope `json:"scopes"`
+		}
+		if err == nil {
+			err = json.Unmarshal(body, &result)
+		}
+		done(result.Scopes, err)
+	})
+}
+
+// variables returns the variables of a scope or the children of a variable.
+func (c *dapClient) variables(reference int, done func([]dapVariable, error)) {
+	args := map[string]int{"variablesReference": reference}
+	c.request("variables", args, func(body json.RawMessage, err error) {
+		var result struct {
+			Variables []dapVariable `json:"variables"`
+		}
+		if err == nil {
+			err = json.Unmarshal(body, &result)
+		}
+		done(result.Variables, err)
+	})
+}
+
+// evaluate computes the watch expression in the stack frame. The result is a
+// variable named after the expression.
+func (c *dapClient) evaluate(expression string, frameID int, done func(dapVariable, error)) {
+	args := map[string]interface{}{
+		"expression": expression,
+		"frameId":    frameID,
+		"context":    "watch",
+	}
+	c.request("evaluate", args, func(body json.RawMessage, err error) {
+		var result struct {
+			Result             string `json:"result"`
+			Type               string `json:"type"`
+			VariablesReference int    `json:"variablesReference"`
+		}
+		if err == nil {
+			err = json.Unmarshal(body, &result)
+		}
+		done(dapVariable{
+			Name:               expression,
+			Value:              result.Result,
+			Type:               result.Type,
+			VariablesReference: result.VariablesReference,
+		}, err)
+	})
+}
+
+// disconnect ends the program and closes the connection.
+func (c *dapClient) disconnect() {
+	args := map[string]bool{"terminateDebuggee": true}
+	c.conn.call("disconnect", args, func(json.RawMessage, error) {
+		if c.closer != nil {
+			c.closer.Close()
+		}
+	})
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fakeDebugAdapter is a debug adapter that runs in the same process. Instead
+// of a program it runs a script, the lines that the program passes through
+// with the call stack and the variables at each of them. That is enough to
+// drive the client through the whole protocol without dlv installed:
+//
+//   - continue runs to the next step on a line with a breakpoint whose
+//     condition holds, conditions compare a variable with a value like
+//     "i == 2" or "i != 2"
+//   - logpoints print their message, with the variables in braces replaced
+//     by their values, and do not stop
+//   - next, stepIn and stepOut go to the next step in the same or a calling
+//     function, to the next step at all or to the next step in a calling
+//     function, unless a breakpoint comes first
+//   - after the last step the program exits
+//
+// Goroutine 1 runs the script, goroutine 2 only waits.
+type fakeDebugAdapter struct {
+	conn  *dapConn
+	steps []fakeDebugStep
+	// current is the index of the step where the program stopped, -1 before
+	// it started
+	current     int
+	breakpoints map[string][]dapSourceBreakpoint
+	// breakpointID is the last ID given to a breakpoint
+	breakpointID int
+	// references are the variables that the variable references stand for
+	references [][]fakeVariable
+
+	mutex sync.Mutex
+	// received are the commands of all requests from the client
+	received []string
+	closer   io.Closer
+}
+
+// fakeDebugStep is a line that the script passes through.
+type fakeDebugStep struct {
+	path string
+	// line is 1-based, like in the protocol
+	line int
+	// stack are the functions that are running, the innermost first
+	stack []string
+	// variables are the locals of the innermost function
+	variables []fakeVariable
+	// output is what the program prints when it gets to the line
+	output string
+}
+
+type fakeVariable struct {
+	name, value, typ string
+	children         []fakeVariable
+}
+
+// newFakeDebugAdapter connects a client to a new fake adapter that runs
+// steps.
+func newFakeDebugAdapter(steps []fakeDebugStep) (*fakeDebugAdapter, *dapClient) {
+	toServer, fromClient := io.Pipe()
+	toClient, fromServer := io.Pipe()
+	s := &fakeDebugAdapter{
+		steps:       steps,
+		current:     -1,
+		breakpoints: make(map[string][]dapSourceBreakpoint),
+		closer:      fromServer,
+	}
+	s.conn = newDAPConn(toServer, fromServer, s.handle)
+	return s, newDAPClient(toClient, fromClient, fromClient)
+}
+
+// receivedCommands returns the commands of all requests that the adapter got
+// so far.
+func (s *fakeDebugAdapter) receivedCommands() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.received...)
+}
+
+func (s *fakeDebugAdapter) handle(msg dapMessage) {
+	if msg.Type != "request" {
+		return
+	}
+	s.mutex.Lock()
+	s.received = append(s.received, msg.Command)
+	s.mutex.Unlock()
+
+	var args struct {
+		Source             dapSource             `json:"source"`
+		Breakpoints        []dapSourceBreakpoint `json:"breakpoints"`
+		ThreadID           int                   `json:"threadId"`
+		FrameID            int                   `json:"frameId"`
+		VariablesReference int                   `json:"variablesReference"`
+		Expression         string                `json:"expression"`
+	}
+	if len(msg.Arguments) > 0 {
+		json.Unmarshal(msg.Arguments, &args)
+	}
+
+	switch msg.Command {
+	case "initialize":
+		s.conn.respond(msg, map[string]bool{
+			"supportsConfigurationDoneRequest": true,
+			"supportsConditionalBreakpoints":   true,
+			"supportsLogPoints":                true,
+		}, nil)
+		s.conn.event("initialized", nil)
+	case "launch":
+		s.conn.respond(msg, nil, nil)
+	case "setBreakpoints":
+		s.breakpoints[args.Source.Path] = args.Breakpoints
+		result := []dapBreakpoint{}
+		for _, b := range args.Breakpoints {
+			s.breakpointID++
+			r := dapBreakpoint{ID: s.breakpointID, Line: b.Line, Verified: true}
+			if !s.reaches(args.Source.Path, b.Line) {
+				r.Verified = false
+				r.Message = "could not find statement at line " + strconv.Itoa(b.Line)
+			} else if _, _, _, ok := parseFakeCondition(b.Condition); b.Condition != "" && !ok {
+				r.Verified = false
+				r.Message = "invalid condition " + b.Condition
+			}
+			result = append(result, r)
+		}
+		s.conn.respond(msg, map[string]interface{}{"breakpoints": result}, nil)
+	case "configurationDone":
+		s.conn.respond(msg, nil, nil)
+		s.run(func(int) bool { return false })
+	case "continue":
+		s.conn.respond(msg, map[string]bool{"allThreadsContinued": true}, nil)
+		s.run(func(int) bool { return false })
+	case "next", "stepIn", "stepOut":
+		if s.current < 0 {
+			s.conn.respond(msg, nil, errors.New("the program is not stopped"))
+			return
+		}
+		depth := len(s.steps[s.current].stack)
+		command := msg.Command
+		s.conn.respond(msg, nil, nil)
+		s.run(func(i int) bool {
+			d := len(s.steps[i].stack)
+			return command == "stepIn" || command == "next" && d <= depth || d < depth
+		})
+	case "pause":
+		// the script never runs in the background
+		s.conn.respond(msg, nil, nil)
+	case "threads":
+		threads := []dapThread{{ID: 2, Name: "[Go 2] runtime.gopark"}}
+		if s.current >= 0 {
+			main := dapThread{ID: 1, Name: "[Go 1] " + s.steps[s.current].stack[0]}
+			threads = append([]dapThread{main}, threads...)
+		}
+		s.conn.respond(msg, map[string]interface{}{"threads": threads}, nil)
+	case "stackTrace":
+		s.conn.respond(msg, map[string]interface{}{"stackFrames": s.stackFrames(args.ThreadID)}, nil)
+	case "scopes":
+		var locals []fakeVariable
+		if args.FrameID == 1 && s.current >= 0 {
+			locals = s.steps[s.current].variables
+		}
+		scopes := []dapScope{{Name: "Locals", VariablesReference: s.reference(locals)}}
+		s.conn.respond(msg, map[string]interface{}{"scopes": scopes}, nil)
+	case "variables":
+		var list []dapVariable
+		if r := args.VariablesReference - 1; r >= 0 && r < len(s.references) {
+			for _, v := range s.references[r] {
+				list = append(list, s.variable(v))
+			}
+		}
+		s.conn.respond(msg, map[string]interface{}{"variables": list}, nil)
+	case "evaluate":
+		v, ok := s.lookUp(args.Expression)
+		if !ok {
+			s.conn.respond(msg, nil, errors.New("could not find symbol value for "+args.Expression))
+			return
+		}
+		result := s.variable(v)
+		s.conn.respond(msg, map[string]interface{}{
+			"result":             result.Value,
+			"type":               result.Type,
+			"variablesReference": result.VariablesReference,
+		}, nil)
+	case "disconnect":
+		s.conn.respond(msg, nil, nil)
+		s.closer.Close()
+	default:
+		s.conn.respond(msg, nil, errors.New("unknown command "+msg.Command))
+	}
+}
+
+// reaches tells if the script passes through the line.
+func (s *fakeDebugAdapter) reaches(path string, line int) bool {
+	for _, step := range s.steps {
+		if step.path == path && step.line == line {
+			return true
+		}
+	}
+	return false
+}
+
+// run goes through the steps after the current one until stop returns true
+// for one or it hits a breakpoint. The program exits after the last step.
+func (s *fakeDebugAdapter) run(stop func(step int) bool) {
+	for i := s.current + 1; i < len(s.steps); i++ {
+		s.current = i
+		step := s.steps[i]
+		if step.output != "" {
+			s.conn.event("output", map[string]string{"category": "stdout", "output": step.output})
+		}
+		if s.breakpointHit(step) {
+			s.conn.event("stopped", dapStoppedEvent{Reason: "breakpoint", ThreadID: 1, AllThreadsStopped: true})
+			return
+		}
+		if stop(i) {
+			s.conn.event("stopped", dapStoppedEvent{Reason: "step", ThreadID: 1, AllThreadsStopped: true})
+			return
+		}
+	}
+	s.conn.event("exited", map[string]int{"exitCode": 0})
+	s.conn.event("terminated", nil)
+}
+
+// breakpointHit prints the messages of the logpoints on the step's line and
+// tells if a breakpoint stops there.
+func (s *fakeDebugAdapter) breakpointHit(step fakeDebugStep) bool {
+	hit := false
+	for _, b := range s.breakpoints[step.path] {
+		if b.Line != step.line || !s.conditionHolds(b.Condition) {
+			continue
+		}
+		if b.LogMessage != "" {
+			s.conn.event("output", map[string]string{"category": "console", "output": s.interpolate(b.LogMessage) + "\n"})
+		} else {
+			hit = true
+		}
+	}
+	return hit
+}
+
+var fakeConditionPattern = regexp.MustCompile(`^([\w.]+)\s*(==|!=)\s*(.+)$`)
+
+func parseFakeCondition(condition string) (name, operator, value string, ok bool) {
+	m := fakeConditionPattern.FindStringSubmatch(strings.TrimSpace(condition))
+	if m == nil {
+		return "", "", "", false
+	}
+	return m[1], m[2], strings.TrimSpace(m[3]), true
+}
+
+func (s *fakeDebugAdapter) conditionHolds(condition string) bool {
+	if condition == "" {
+		return true
+	}
+	name, operator, value, ok := parseFakeCondition(condition)
+	if !ok {
+		return false
+	}
+	v, _ := s.lookUp(name)
+	return (v.value == value) == (operator == "==")
+}
+
+var fakeLogPattern = regexp.MustCompile(`\{[\w.]+\}`)
+
+// interpolate replaces the variables in braces with their values.
+func (s *fakeDebugAdapter) interpolate(message string) string {
+	return fakeLogPattern.ReplaceAllStringFunc(message, func(m string) string {
+		if v, ok := s.lookUp(m[1 : len(m)-1]); ok {
+			return v.value
+		}
+		return m
+	})
+}
+
+// lookUp finds a variable of the current step, the names of children are
+// separated by dots.
+func (s *fakeDebugAdapter) lookUp(name string) (fakeVariable, bool) {
+	if s.current < 0 {
+		return fakeVariable{}, false
+	}
+	list := s.steps[s.current].variables
+	var found fakeVariable
+	for _, part := range strings.Split(name, ".") {
+		ok := false
+		for _, v := range list {
+			if v.name == part {
+				found, list, ok = v, v.children, true
+				break
+			}
+		}
+		if !ok {
+			return fakeVariable{}, false
+		}
+	}
+	return found, true
+}
+
+// stackFrames returns the calls of the thread. The lines of the outer calls
+// are the last steps in the calling functions.
+func (s *fakeDebugAdapter) stackFrames(threadID int) []dapStackFrame {
+	if threadID != 1 || s.current < 0 {
+		return []dapStackFrame{{ID: 100, Name: "runtime.gopark"}}
+	}
+	step := s.steps[s.current]
+	var frames []dapStackFrame
+	for i, name := range step.stack {
+		frame := dapStackFrame{ID: i + 1, Name: name, Line: step.line, Column: 1}
+		frame.Source = &dapSource{Path: step.path}
+		depth := len(step.stack) - i
+		for j := s.current - 1; i > 0 && j >= 0; j-- {
+			if len(s.steps[j].stack) == depth {
+				frame.Source.Path = s.steps[j].path
+				frame.Line = s.steps[j].line
+				break
+			}
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// reference returns a new variables reference for the list.
+func (s *fakeDebugAdapter) reference(list []fakeVariable) int {
+	s.references = append(s.references, list)
+	return len(s.references)
+}
+
+func (s *fakeDebugAdapter) variable(v fakeVariable) dapVariable {
+	result := dapVariable{Name: v.name, Value: v.value, Type: v.typ}
+	if len(v.children) > 0 {
+		result.VariablesReference = s.reference(v.children)
+	}
+	return result
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pollDAPUntil polls the client until done returns true.
+func pollDAPUntil(t *testing.T, c *dapClient, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if err := c.poll(); err != nil {
+			t.Fatal(err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// fakeScript runs main, which calls f in line 6 and prints in line 7.
+func fakeScript(path string) []fakeDebugStep {
+	main := []string{"main.main"}
+	f := []string{"main.f", "main.main"}
+	i := fakeVariable{name: "i", value: "0", typ: "int"}
+	return []fakeDebugStep{
+		{path: path, line: 5, stack: main},
+		{path: path, line: 6, stack: main, variables: []fakeVariable{i}},
+		{path: path, line: 10, stack: f, variables: []fakeVariable{
+			{name: "p", value: "main.point {x: 1}", typ: "main.point", children: []fakeVariable{
+				{name: "x", value: "1", typ: "int"},
+			}},
+		}},
+		{path: path, line: 7, stack: main, variables: []fakeVariable{i}, output: "done\n"},
+	}
+}
+
+func TestDAPSession(t *testing.T) {
+	path := "/work/main.go"
+	s, c := newFakeDebugAdapter(fakeScript(path))
+	var events []string
+	var stopped dapStoppedEvent
+	c.event = func(event string, body json.RawMessage) {
+		events = append(events, event)
+		if event == "stopped" {
+			json.Unmarshal(body, &stopped)
+		}
+	}
+	// call runs one request and waits for its answer
+	call := func(request func(done func(error))) error {
+		t.Helper()
+		done := false
+		var err error
+		request(func(e error) {
+			err = e
+			done = true
+		})
+		pollDAPUntil(t, c, func() bool { return done })
+		return err
+	}
+
+	if err := call(c.initialize); err != nil {
+		t.Fatal(err)
+	}
+	pollDAPUntil(t, c, func() bool { return len(events) == 1 })
+	if err := call(func(done func(error)) { c.launch("debug", "/work", done) }); err != nil {
+		t.Fatal(err)
+	}
+	var breakpoints []dapBreakpoint
+	err := call(func(done func(error)) {
+		list := []dapSourceBreakpoint{{Line: 10}, {Line: 3}}
+		c.setBreakpoints(path, list, func(result []dapBreakpoint, err error) {
+			breakpoints = result
+			done(err)
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(breakpoints) != 2 || !breakpoints[0].Verified || breakpoints[1].Verified ||
+		breakpoints[1].Message != "could not find statement at line 3" {
+		t.Fatalf("the breakpoints are %+v", breakpoints)
+	}
+	// a failed request is an error with the adapter's message
+	err = call(func(done func(error)) { c.resume("next", 1, done) })
+	if err == nil || err.Error() != "the program is not stopped" {
+		t.Errorf("stepping before the start gives %v", err)
+	}
+
+	// the program runs to the breakpoint
+	if err := call(c.configurationDone); err != nil {
+		t.Fatal(err)
+	}
+	pollDAPUntil(t, c, func() bool { return len(events) == 2 })
+	if events[1] != "stopped" || stopped.Reason != "breakpoint" || stopped.ThreadID != 1 {
+		t.Fatalf("the program stopped with %s %+v", events[1], stopped)
+	}
+	var threads []dapThread
+	call(func(done func(error)) {
+		c.threads(func(list []dapThread, err error) {
+			threads = list
+			done(err)
+		})
+	})
+	if len(threads) != 2 || threads[0].Name != "[Go 1] main.f" {
+		t.Errorf("the threads are %+v", threads)
+	}
+	var frames []dapStackFrame
+	call(func(done func(error)) {
+		c.stackTrace(1, func(list []dapStackFrame, err error) {
+			frames = list
+			done(err)
+		})
+	})
+	if len(frames) != 2 || frames[0].Name != "main.f" || frames[0].Line != 10 ||
+		frames[1].Name != "main.main" || frames[1].Line != 6 || frames[1].Source.Path != path {
+		t.Fatalf("the stack frames are %+v", frames)
+	}
+	var scopes []dapScope
+	call(func(done func(error)) {
+		c.scopes(frames[0].ID, func(list []dapScope, err error) {
+			scopes = list
+			done(err)
+		})
+	})
+	var variables []dapVariable
+	call(func(done func(error)) {
+		c.variables(scopes[0].VariablesReference, func(list []dapVariable, err error) {
+			variables = list
+			done(err)
+		})
+	})
+	if len(variables) != 1 || variables[0].Value != "main.point {x: 1}" || variables[0].VariablesReference == 0 {
+		t.Errorf("the locals are %+v", variables)
+	}
+	var watch dapVariable
+	call(func(done func(error)) {
+		c.evaluate("p.x", frames[0].ID, func(v dapVariable, err error) {
+			watch = v
+			done(err)
+		})
+	})
+	if watch.Name != "p.x" || watch.Value != "1" || watch.Type != "int" {
+		t.Errorf("p.x is %+v", watch)
+	}
+
+	// without another breakpoint the program prints and exits
+	if err := call(func(done func(error)) { c.resume("continue", 1, done) }); err != nil {
+		t.Fatal(err)
+	}
+	pollDAPUntil(t, c, func() bool { return len(events) == 5 })
+	if got := strings.Join(events[2:], " "); got != "output exited terminated" {
+		t.Errorf("the program ends with %s", got)
+	}
+	c.disconnect()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.poll() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the connection was not closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	want := "initialize launch setBreakpoints next configurationDone threads stackTrace scopes variables evaluate continue disconnect"
+	if got := strings.Join(s.receivedCommands(), " "); got != want {
+		t.Errorf("the adapter received %s, want %s", got, want)
+	}
+}
+
+func TestDAPResponseSuccess(t *testing.T) {
+	var buf bytes.Buffer
+	c := newDAPConn(strings.NewReader(""), &buf, nil)
+	request := dapMessage{Seq: 1, Type: "request", Command: "next"}
+	c.respond(request, nil, errors.New("no"))
+	if !strings.Contains(buf.String(), `"success":false`) {
+		t.Errorf("the failed response is %s", buf.String())
+	}
+	buf.Reset()
+	c.respond(request, nil, nil)
+	if !strings.Contains(buf.String(), `"success":true`) {
+		t.Errorf("the response is %s", buf.String())
+	}
+}
+
+func TestBreakpointSet(t *testing.T) {
+	s := newBreakpointSet()
+	changed, moved := 0, 0
+	s.changed = func() { changed++ }
+	s.moved = func() { moved++ }
+	path := "/work/a.go"
+	s.toggle(path, 3)
+	s.toggle(path, 1)
+	s.put(path, breakpoint{line: 3, condition: "x > 1"})
+	list := s.inFile(path)
+	if len(list) != 2 || list[0].line != 1 || list[1].condition != "x > 1" || changed != 3 {
+		t.Fatalf("the breakpoints are %+v after %d changes", list, changed)
+	}
+
+	doc := newDocument([]byte("a\nb\nc\nd\ne\n"))
+	stop := s.follow(path, doc)
+	// edits within lines move nothing
+	doc.insert(doc.lineStart(1), []byte("x"))
+	doc.delete(doc.lineStart(3), 1)
+	if moved != 0 || changed != 3 {
+		t.Errorf("edits within lines moved the breakpoints %d times", moved)
+	}
+	doc.insert(doc.lineStart(2), []byte("x\ny\n"))
+	if list = s.inFile(path); list[0].line != 1 || list[1].line != 5 || moved != 1 {
+		t.Fatalf("inserting lines moves the breakpoints to %+v", list)
+	}
+	// deleting the lines between moves both to the same line, one is kept
+	doc.delete(doc.lineStart(1), doc.lineStart(5)-doc.lineStart(1))
+	if list = s.inFile(path); len(list) != 1 || list[0].line != 1 || moved != 2 {
+		t.Fatalf("deleting lines leaves %+v", list)
+	}
+	stop()
+	if changed != 3 {
+		t.Errorf("moving the breakpoints changed them %d times", changed-3)
+	}
+
+	s.verify(path, []int{1, 7}, []dapBreakpoint{{ID: 4, Message: "no"}, {ID: 5}}, nil)
+	if b, _ := s.at(path, 1); !b.rejected || b.id != 4 || b.message != "no" {
+		t.Errorf("the rejected breakpoint is %+v", b)
+	}
+	s.update(dapBreakpoint{ID: 4, Verified: true})
+	if b, _ := s.at(path, 1); b.rejected {
+		t.Error("the breakpoint is still rejected")
+	}
+	s.reset()
+	if b, _ := s.at(path, 1); b.id != 0 {
+		t.Errorf("the breakpoint keeps the ID %d", b.id)
+	}
+	s.toggle(path, 1)
+	if len(s.paths()) != 0 {
+		t.Errorf("the files %v have breakpoints", s.paths())
+	}
+}
@@ -0,0 +1,962 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// breakpoint is a line where the debugger stops the program. With a
+// condition it only stops if the condition is true, a logpoint does not stop
+// but prints its message, in which expressions in braces are replaced by
+// their values.
+type breakpoint struct {
+	line       int
+	condition  string
+	logMessage string
+	// id is the debugger's ID for the breakpoint while a program is debugged.
+	// rejected is true if the debugger could not set it, message tells why.
+	id       int
+	rejected bool
+	message  string
+}
+
+// breakpointSet holds the breakpoints of all files. They are kept between
+// debug sessions and follow the edits in the open file.
+type breakpointSet struct {
+	// files maps paths to their breakpoints, sorted by line
+	files map[string][]breakpoint
+	// changed, if not nil, is called after the breakpoints changed
+	changed func()
+	// moved, if not nil, is called instead of changed when an edit moved
+	// breakpoints to other lines
+	moved func()
+}
+
+func newBreakpointSet() *breakpointSet {
+	return &breakpointSet{files: make(map[string][]breakpoint)}
+}
+
+// inFile returns the breakpoints of the file at path.
+func (s *breakpointSet) inFile(path string) []breakpoint {
+	return s.files[diagnosticPath(path)]
+}
+
+// at returns the breakpoint on the line of the file at path.
+func (s *breakpointSet) at(path string, line int) (breakpoint, bool) {
+	for _, b := range s.inFile(path) {
+		if b.line == line {
+			return b, true
+		}
+	}
+	return breakpoint{}, false
+}
+
+// paths returns the sorted paths of the files with breakpoints.
+func (s *breakpointSet) paths() []string {
+	var paths []string
+	for path := range s.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// put adds b, it replaces the breakpoint on the same line.
+func (s *breakpointSet) put(path string, b breakpoint) {
+	list := []breakpoint{b}
+	for _, other := range s.inFile(path) {
+		if other.line != b.line {
+			list = append(list, other)
+		}
+	}
+	s.set(path, list)
+}
+
+// toggle removes the breakpoint on the line or adds one.
+func (s *breakpointSet) toggle(path string, line int) {
+	if _, ok := s.at(path, line); !ok {
+		s.put(path, breakpoint{line: line})
+		return
+	}
+	var list []breakpoint
+	for _, b := range s.inFile(path) {
+		if b.line != line {
+			list = append(list, b)
+		}
+	}
+	s.set(path, list)
+}
+
+// set replaces the breakpoints of the file, only the first one per line is
+// kept.
+func (s *breakpointSet) set(path string, list []breakpoint) {
+	s.replace(path, list)
+	if s.changed != nil {
+		s.changed()
+	}
+}
+
+func (s *breakpointSet) replace(path string, list []breakpoint) {
+	path = diagnosticPath(path)
+	sort.SliceStable(list, func(i, j int) bool { return list[i].line < list[j].line })
+	n := 0
+	for i, b := range list {
+		if i == 0 || b.line != list[n-1].line {
+			list[n] = b
+			n++
+		}
+	}
+	if n == 0 {
+		delete(s.files, path)
+	} else {
+		s.files[path] = list[:n]
+	}
+}
+
+// follow moves the breakpoints of the file at path with the edits in doc
+// until stop is called. The debugger keeps the old lines, they belong to the
+// code that it runs. Most edits move no breakpoint, they change nothing.
+func (s *breakpointSet) follow(path string, doc *document) (stop func()) {
+	return doc.observeChanges(func(offset, count int, text []byte) {
+		list := s.inFile(path)
+		if len(list) == 0 {
+			return
+		}
+		line, column := doc.offsetToLineCol(offset)
+		endLine, endColumn := doc.offsetToLineCol(offset + count)
+		move := positionMover(
+			textPosition{line, column},
+			textPosition{endLine, endColumn},
+			text,
+		)
+		moved := make([]breakpoint, len(list))
+		changed := false
+		for i, b := range list {
+			b.line = move(textPosition{line: b.line}).line
+			changed = changed || b.line != list[i].line
+			moved[i] = b
+		}
+		if !changed {
+			return
+		}
+		s.replace(path, moved)
+		if s.moved != nil {
+			s.moved()
+		} else if s.changed != nil {
+			s.changed()
+		}
+	})
+}
+
+// verify stores the debugger's answer for the breakpoints that were on the
+// lines of the file at path.
+func (s *breakpointSet) verify(path string, lines []int, result []dapBreakpoint, err error) {
+	list := append([]breakpoint(nil), s.inFile(path)...)
+	for i, line := range lines {
+		for j := range list {
+			if list[j].line != line {
+				continue
+			}
+			if err != nil {
+				list[j].rejected = true
+				list[j].message = err.Error()
+			} else if i < len(result) {
+				list[j].id = result[i].ID
+				list[j].rejected = !result[i].Verified
+				list[j].message = result[i].Message
+			}
+		}
+	}
+	s.set(path, list)
+}
+
+// update stores a change of a breakpoint that the debugger reported.
+func (s *breakpointSet) update(r dapBreakpoint) {
+	for path, list := range s.files {
+		for i, b := range list {
+			if r.ID != 0 && b.id == r.ID {
+				list[i].rejected = !r.Verified
+				list[i].message = r.Message
+				s.set(path, list)
+				return
+			}
+		}
+	}
+}
+
+// reset forgets what the debugger said about the breakpoints after a
+// debug session ended.
+func (s *breakpointSet) reset() {
+	for path, list := range s.files {
+		for i := range list {
+			list[i].id = 0
+			list[i].rejected = false
+			list[i].message = ""
+		}
+		s.files[path] = list
+	}
+	if s.changed != nil {
+		s.changed()
+	}
+}
+
+const (
+	breakpointColor         = 0xFFE51400
+	rejectedBreakpointColor = 0xFF9E9E9E
+	executionLineColor      = 0xFFFFF3B0
+	executionMarkerColor    = 0xFFFFB000
+)
+
+// drawExecutionLine tints the line where the debugged program stopped.
+func (e *editor) drawExecutionLine(g graphics, lastLine int) {
+	if e.executionLine < e.topLine || e.executionLine > lastLine {
+		return
+	}
+	lineHeight := g.lineHeight()
+	y := e.area.y + (e.executionLine-e.topLine)*lineHeight
+	fillRect(g, rect(e.area.x, y, e.area.w, lineHeight).intersect(e.area), executionLineColor)
+}
+
+// drawBreakpoints marks the breakpoints in the visible lines in the gutter: a
+// dot for plain breakpoints, a dot with two bars for conditional ones and a
+// diamond for logpoints. The line where the program stopped gets an arrow.
+func (e *editor) drawBreakpoints(g graphics, lastLine int) {
+	lineHeight := g.lineHeight()
+	const size = gutterMarkerSize + 2
+	x := e.gutter.x + (e.gutter.w-size)/2
+	for _, b := range e.breakpoints {
+		if b.line < e.topLine || b.line > lastLine {
+			continue
+		}
+		color := uint32(breakpointColor)
+		if b.rejected {
+			color = rejectedBreakpointColor
+		}
+		y := e.area.y + (b.line-e.topLine)*lineHeight + (lineHeight-size)/2
+		for i := 0; i < size; i++ {
+			var w int
+			if b.logMessage != "" {
+				w = 2*min(i, size-1-i) + 2
+			} else {
+				r := float64(size) / 2
+				dy := float64(i) + 0.5 - r
+				w = 2 * round(math.Sqrt(r*r-dy*dy))
+			}
+			fillRect(g, rect(x+(size-w)/2, y+i, w, 1).intersect(e.gutter), color)
+		}
+		if b.condition != "" && b.logMessage == "" {
+			for _, i := range []int{size/2 - 2, size/2 + 1} {
+				fillRect(g, rect(x+2, y+i, size-4, 1).intersect(e.gutter), editorBackgroundColor)
+			}
+		}
+	}
+	if e.executionLine >= e.topLine && e.executionLine <= lastLine {
+		y := e.area.y + (e.executionLine-e.topLine)*lineHeight + (lineHeight-size)/2
+		for i := 0; i < size; i++ {
+			w := 2*min(i, size-1-i) + 1
+			fillRect(g, rect(x, y+i, w, 1).intersect(e.gutter), executionMarkerColor)
+		}
+	}
+}
+
+// gutterLine returns the line of the document next to screen position y in
+// the gutter.
+func (e *editor) gutterLine(g graphics, y int) (int, bool) {
+	line := e.topLine + (y-e.gutter.y)/g.lineHeight()
+	return line, y >= e.gutter.y && line < e.doc.lineCount()
+}
+
+// debugSession is a program that runs in the debugger.
+type debugSession struct {
+	client *dapClient
+	dir    string
+	// stopped is true while the program is paused, reason tells why, e.g.
+	// "breakpoint" or "step"
+	stopped bool
+	reason  string
+	// thread is the goroutine that stopped or that the user selected, frames
+	// are its calls, the innermost first, and frame is the index of the
+	// selected one
+	thread  int
+	threads []dapThread
+	frames  []dapStackFrame
+	frame   int
+	// scopes are the variables of the selected frame, watches the values of
+	// the app's watch expressions in it
+	scopes  []*debugVariable
+	watches []*debugVariable
+	// expanded are the paths of the variables whose children are shown, they
+	// stay open while stepping
+	expanded map[string]bool
+	// generation changes whenever the program runs or another frame is
+	// selected, responses for an older generation are dropped
+	generation int
+	// result is how the program ended, for the output panel
+	result string
+}
+
+// debugVariable is a node in the tree of variables.
+type debugVariable struct {
+	name, value, typ string
+	// err is set for watch expressions that could not be evaluated
+	err string
+	// reference is the debugger's reference for the children, it is 0 if
+	// there are none
+	reference int
+	// path is the names from the root, it identifies the variable from one
+	// stop to the next
+	path     string
+	children []*debugVariable
+}
+
+// debugPanel shows the goroutines, the call stack, the variables, the watch
+// expressions and the breakpoints.
+type debugPanel struct {
+	listPanel
+	list []debugRow
+}
+
+type debugRowKind int
+
+const (
+	debugHeadingRow debugRowKind = iota
+	debugThreadRow
+	debugFrameRow
+	debugVariableRow
+	debugWatchRow
+	debugBreakpointRow
+)
+
+type debugRow struct {
+	kind  debugRowKind
+	text  string
+	depth int
+	// index is the ID of a thread, the index of a frame or a watch expression
+	// or the line of a breakpoint in the file at path
+	index    int
+	path     string
+	variable *debugVariable
+	// gray rows are shown in gray, e.g. rejected breakpoints
+	gray bool
+}
+
+func newDebugPanel() debugPanel {
+	return debugPanel{listPanel: listPanel{title: "Debug", selected: -1}}
+}
+
+// update lists the state of the session, which is nil when nothing is
+// debugged.
+func (p *debugPanel) update(s *debugSession, watches []string, breakpoints *breakpointSet) {
+	p.list = nil
+	p.title = "Debug"
+	p.add(debugRow{kind: debugHeadingRow, text: "Goroutines"})
+	if s != nil {
+		p.title = "Debug - running"
+		if s.stopped {
+			p.title = "Debug - paused on " + s.reason
+		}
+		for _, t := range s.threads {
+			p.add(debugRow{kind: debugThreadRow, text: currentMark(t.ID == s.thread) + t.Name, depth: 1, index: t.ID})
+		}
+	}
+	p.add(debugRow{kind: debugHeadingRow, text: "Call Stack"})
+	if s != nil {
+		for i, f := range s.frames {
+			text := currentMark(i == s.frame) + f.Name
+			if f.Source != nil && f.Source.Path != "" {
+				text += "  " + filepath.Base(f.Source.Path) + ":" + strconv.Itoa(f.Line)
+			}
+			p.add(debugRow{kind: debugFrameRow, text: text, depth: 1, index: i})
+		}
+	}
+	p.add(debugRow{kind: debugHeadingRow, text: "Variables"})
+	if s != nil {
+		for _, v := range s.scopes {
+			p.addVariable(s, v, debugVariableRow, 1, 0)
+		}
+	}
+	p.add(debugRow{kind: debugHeadingRow, text: "Watch"})
+	for i, expression := range watches {
+		if s != nil && i < len(s.watches) {
+			p.addVariable(s, s.watches[i], debugWatchRow, 1, i)
+		} else {
+			p.add(debugRow{kind: debugWatchRow, text: "  " + expression, depth: 1, index: i})
+		}
+	}
+	p.add(debugRow{kind: debugHeadingRow, text: "Breakpoints"})
+	for _, path := range breakpoints.paths() {
+		for _, b := range breakpoints.files[path] {
+			text := filepath.Base(path) + ":" + strconv.Itoa(b.line+1)
+			if b.condition != "" {
+				text += " if " + b.condition
+			}
+			if b.logMessage != "" {
+				text += " log " + b.logMessage
+			}
+			if b.message != "" {
+				text += " - " + b.message
+			}
+			p.add(debugRow{kind: debugBreakpointRow, text: text, depth: 1, index: b.line, path: path, gray: b.rejected})
+		}
+	}
+	p.setRows(len(p.list))
+}
+
+func (p *debugPanel) add(r debugRow) {
+	p.list = append(p.list, r)
+}
+
+// addVariable adds the row of v and, if it is expanded, the rows of its
+// children.
+func (p *debugPanel) addVariable(s *debugSession, v *debugVariable, kind debugRowKind, depth, index int) {
+	mark := "  "
+	if v.reference != 0 {
+		mark = "+ "
+		if s.expanded[v.path] {
+			mark = "- "
+		}
+	}
+	text := mark + v.name
+	if v.err != "" {
+		text += ": " + v.err
+	} else if v.value != "" {
+		text += " = " + v.value
+	}
+	p.add(debugRow{kind: kind, text: text, depth: depth, index: index, variable: v, gray: v.err != ""})
+	if v.reference != 0 && s.expanded[v.path] {
+		for _, c := range v.children {
+			p.addVariable(s, c, debugVariableRow, depth+1, 0)
+		}
+	}
+}
+
+// currentMark starts the text of the selected goroutine and stack frame.
+func currentMark(current bool) string {
+	if current {
+		return "> "
+	}
+	return "  "
+}
+
+func (p *debugPanel) draw(g graphics, area rectangle) {
+	p.listPanel.draw(g, area, func(i int, row rectangle) {
+		r := p.list[i]
+		if r.kind == debugHeadingRow && i != p.selected {
+			fillRect(g, row, listHeaderColor)
+		}
+		color := uint32(editorTextColor)
+		if r.gray {
+			color = rejectedBreakpointColor
+		}
+		indent := strings.Repeat("  ", r.depth)
+		g.text([]byte(indent+r.text), row.x+4, row.y, row, color)
+	})
+}
+
+// registerDebugCommands registers the commands of the debugger.
+func registerDebugCommands(r *commandRegistry, a *app) {
+	r.register("debug.start", func(*editor) {
+		if a.debug != nil {
+			a.resumeDebugging("continue")
+		} else {
+			a.startDebugging()
+		}
+	})
+	r.register("debug.stop", func(*editor) {
+		if a.debug != nil {
+			a.debug.result = "stopped"
+			a.endDebugging(nil)
+		}
+	})
+	r.register("debug.pause", func(*editor) {
+		if s := a.debug; s != nil && !s.stopped {
+			s.client.pause(s.thread, a.debugFailed(s))
+		}
+	})
+	r.register("debug.stepOver", func(*editor) {
+		a.resumeDebugging("next")
+	})
+	r.register("debug.stepInto", func(*editor) {
+		a.resumeDebugging("stepIn")
+	})
+	r.register("debug.stepOut", func(*editor) {
+		a.resumeDebugging("stepOut")
+	})
+	r.register("debug.toggleBreakpoint", func(e *editor) {
+		a.toggleBreakpoint(e.doc.lineOf(e.primaryCursor().caret))
+	})
+	r.register("debug.conditionalBreakpoint", func(e *editor) {
+		a.editBreakpoint(e.doc.lineOf(e.primaryCursor().caret), false)
+	})
+	r.register("debug.logpoint", func(e *editor) {
+		a.editBreakpoint(e.doc.lineOf(e.primaryCursor().caret), true)
+	})
+	r.register("debug.addWatch", func(e *editor) {
+		text := ""
+		if c := e.primaryCursor(); !c.empty() {
+			text = string(e.doc.slice(c.start(), c.end()))
+		}
+		a.showPrompt("Watch: ", text, func(expression string) {
+			if expression != "" {
+				a.watches = append(a.watches, expression)
+				a.debugView.visible = true
+				a.evaluateWatches()
+			}
+		})
+	})
+	r.register("debug.removeWatch", func(*editor) {
+		p := &a.debugView
+		if p.selected == -1 || p.list[p.selected].kind != debugWatchRow {
+			a.platform.showError("Remove Watch", "select a watch expression in the debug panel")
+			return
+		}
+		i := p.list[p.selected].index
+		a.watches = append(a.watches[:i], a.watches[i+1:]...)
+		if s := a.debug; s != nil && i < len(s.watches) {
+			s.watches = append(s.watches[:i], s.watches[i+1:]...)
+		}
+		a.debugChanged()
+	})
+	r.register("view.toggleDebug", func(*editor) {
+		a.debugView.visible = !a.debugView.visible
+		a.debugChanged()
+	})
+	r.register("debug.pageUp", func(*editor) {
+		a.debugView.top = max(0, a.debugView.top-listPanelRows)
+		a.frames.invalidateAll()
+	})
+	r.register("debug.pageDown", func(*editor) {
+		p := &a.debugView
+		p.top = clamp(p.top+listPanelRows, 0, max(0, p.rows-listPanelRows))
+		a.frames.invalidateAll()
+	})
+}
+
+// toggleBreakpoint sets or removes a breakpoint on the line of the app's
+// file.
+func (a *app) toggleBreakpoint(line int) {
+	if a.path == "" {
+		a.platform.showError("Breakpoint", "save the file first")
+		return
+	}
+	a.breakpoints.toggle(a.path, line)
+	a.sendBreakpoints(a.path)
+}
+
+// editBreakpoint asks for the condition or, for a logpoint, the message of
+// the breakpoint on the line. An empty text makes it a plain breakpoint.
+func (a *app) editBreakpoint(line int, logpoint bool) {
+	if a.path == "" {
+		a.platform.showError("Breakpoint", "save the file first")
+		return
+	}
+	path := a.path
+	b, _ := a.breakpoints.at(path, line)
+	label, text := "Condition: ", b.condition
+	if logpoint {
+		label, text = "Log message: ", b.logMessage
+	}
+	a.showPrompt(label, text, func(text string) {
+		b, _ := a.breakpoints.at(path, line)
+		b.line = line
+		if logpoint {
+			b.logMessage = text
+		} else {
+			b.condition = text
+		}
+		a.breakpoints.put(path, b)
+		a.sendBreakpoints(path)
+	})
+}
+
+// sendBreakpoints tells the debugger about the breakpoints of the file at
+// path, they replace the ones it had for the file.
+func (a *app) sendBreakpoints(path string) {
+	s := a.debug
+	if s == nil {
+		return
+	}
+	list := a.breakpoints.inFile(path)
+	lines := make([]int, len(list))
+	args := make([]dapSourceBreakpoint, len(list))
+	for i, b := range list {
+		lines[i] = b.line
+		args[i] = dapSourceBreakpoint{Line: b.line + 1, Condition: b.condition, LogMessage: b.logMessage}
+	}
+	s.client.setBreakpoints(diagnosticPath(path), args, func(result []dapBreakpoint, err error) {
+		if a.debug == s {
+			a.breakpoints.verify(path, lines, result, err)
+		}
+	})
+}
+
+// breakpointsChanged updates the editor's gutter and the debug panel.
+func (a *app) breakpointsChanged() {
+	if a.editor != nil && a.path != "" {
+		a.editor.breakpoints = a.breakpoints.inFile(a.path)
+	}
+	a.debugChanged()
+}
+
+// breakpointsMoved shows the breakpoints that an edit moved. Only the gutter
+// and the breakpoints in the debug panel change.
+func (a *app) breakpointsMoved() {
+	if a.editor == nil || a.path == "" {
+		return
+	}
+	a.editor.breakpoints = a.breakpoints.inFile(a.path)
+	a.frames.invalidate(a.editor.gutter)
+	a.debugView.update(a.debug, a.watches, a.breakpoints)
+	if a.debugView.visible {
+		a.frames.invalidate(a.debugView.area)
+	}
+}
+
+// debugChanged updates the debug panel.
+func (a *app) debugChanged() {
+	a.debugView.update(a.debug, a.watches, a.breakpoints)
+	a.frames.invalidateAll()
+}
+
+// startDebugging builds the package of the app's file and runs it in the
+// debugger, for a test file its tests are run.
+func (a *app) startDebugging() {
+	const title = "Debug"
+	dir, ok := a.taskDir(title, false)
+	if !ok {
+		return
+	}
+	if a.debugAdapter == nil {
+		a.platform.showError(title, "dlv was not found, install it with: go install github.com/go-delve/delve/cmd/dlv@latest")
+		return
+	}
+	client, err := a.debugAdapter(dir)
+	if err != nil {
+		a.platform.showError(title, err.Error())
+		return
+	}
+	mode := "debug"
+	if strings.HasSuffix(a.path, "_test.go") {
+		mode = "test"
+	}
+	s := &debugSession{client: client, dir: dir, expanded: make(map[string]bool), result: "done"}
+	a.debug = s
+	client.event = func(event string, body json.RawMessage) {
+		a.debugEvent(s, event, body)
+	}
+	client.initialize(func(err error) {
+		if a.debug != s {
+			return
+		}
+		if err != nil {
+			a.endDebugging(makeErr("initialize debugger", err))
+			return
+		}
+		client.launch(mode, dir, func(err error) {
+			if err != nil && a.debug == s {
+				a.endDebugging(err)
+			}
+		})
+	})
+	a.output.start(task{title: "dlv " + mode, dir: dir})
+	a.output.visible = true
+	a.debugView.visible = true
+	a.platform.startTimer(debugTimer, debugPoll)
+	a.debugChanged()
+}
+
+// debugEvent reacts to an event of the session's debugger.
+func (a *app) debugEvent(s *debugSession, event string, body json.RawMessage) {
+	if a.debug != s {
+		return
+	}
+	switch event {
+	case "initialized":
+		for _, path := range a.breakpoints.paths() {
+			a.sendBreakpoints(path)
+		}
+		s.client.configurationDone(a.debugFailed(s))
+	case "stopped":
+		var e dapStoppedEvent
+		json.Unmarshal(body, &e)
+		s.generation++
+		s.stopped = true
+		s.reason = e.Reason
+		if e.ThreadID != 0 {
+			s.thread = e.ThreadID
+		}
+		a.loadStack()
+	case "continued":
+		a.debugRunning()
+	case "output":
+		var e struct {
+			Category string `json:"category"`
+			Output   string `json:"output"`
+		}
+		json.Unmarshal(body, &e)
+		if e.Category != "telemetry" {
+			a.output.write([]byte(e.Output))
+		}
+	case "breakpoint":
+		var e struct {
+			Breakpoint dapBreakpoint `json:"breakpoint"`
+		}
+		json.Unmarshal(body, &e)
+		a.breakpoints.update(e.Breakpoint)
+	case "exited":
+		var e struct {
+			ExitCode int `json:"exitCode"`
+		}
+		json.Unmarshal(body, &e)
+		if e.ExitCode != 0 {
+			s.result = "exit status " + strconv.Itoa(e.ExitCode)
+		}
+	case "terminated":
+		a.endDebugging(nil)
+		return
+	}
+	a.debugChanged()
+}
+
+// debugFailed returns a callback that shows the error of a request of the
+// session, as long as it is running.
+func (a *app) debugFailed(s *debugSession) func(error) {
+	return func(err error) {
+		if err != nil && a.debug == s {
+			a.platform.showError("Debug", err.Error())
+		}
+	}
+}
+
+// updateDebugging runs the callbacks of the debugger.
+func (a *app) updateDebugging() {
+	s := a.debug
+	if s == nil {
+		a.platform.stopTimer(debugTimer)
+		return
+	}
+	if err := s.client.poll(); err != nil && a.debug == s {
+		a.endDebugging(err)
+	}
+}
+
+// endDebugging ends the program and the debugger. err, if not nil, is why it
+// ended unexpectedly.
+func (a *app) endDebugging(err error) {
+	s := a.debug
+	if s == nil {
+		return
+	}
+	a.debug = nil
+	s.client.disconnect()
+	a.platform.stopTimer(debugTimer)
+	if err != nil {
+		s.result = err.Error()
+		a.platform.showError("Debug", err.Error())
+	}
+	a.output.finish(s.result)
+	a.showExecutionLine()
+	// resetting updates the panel as well
+	a.breakpoints.reset()
+}
+
+// resumeDebugging lets the stopped program continue or do a step, command is
+// the request for it.
+func (a *app) resumeDebugging(command string) {
+	s := a.debug
+	if s == nil {
+		a.platform.showError("Debug", "start debugging first")
+		return
+	}
+	if !s.stopped {
+		a.platform.showError("Debug", "the program is running, pause it first")
+		return
+	}
+	a.debugRunning()
+	s.client.resume(command, s.thread, a.debugFailed(s))
+}
+
+// debugRunning forgets the state of the stopped program when it runs again.
+func (a *app) debugRunning() {
+	s := a.debug
+	s.generation++
+	s.stopped = false
+	s.threads = nil
+	s.frames = nil
+	s.scopes = nil
+	s.watches = nil
+	a.showExecutionLine()
+	a.debugChanged()
+}
+
+// loadStack gets the goroutines and the calls of the selected one, then the
+// innermost call is shown.
+func (a *app) loadStack() {
+	s := a.debug
+	generation := s.generation
+	s.client.threads(func(threads []dapThread, err error) {
+		if a.debug == s && s.generation == generation {
+			s.threads = threads
+			a.debugChanged()
+		}
+	})
+	s.client.stackTrace(s.thread, func(frames []dapStackFrame, err error) {
+		if a.debug != s || s.generation != generation {
+			return
+		}
+		if err != nil {
+			a.platform.showError("Debug", err.Error())
+			return
+		}
+		s.frames = frames
+		a.selectFrame(0)
+	})
+}
+
+// selectFrame shows the location of the stack frame with index i and loads
+// its variables.
+func (a *app) selectFrame(i int) {
+	s := a.debug
+	s.generation++
+	s.frame = i
+	s.scopes = nil
+	s.watches = nil
+	if i >= len(s.frames) {
+		a.showExecutionLine()
+		a.debugChanged()
+		return
+	}
+	f := s.frames[i]
+	if f.Source != nil && f.Source.Path != "" && f.Line > 0 {
+		a.openFileAt(f.Source.Path, textPosition{line: f.Line - 1, column: max(0, f.Column-1)})
+	}
+	a.showExecutionLine()
+	generation := s.generation
+	s.client.scopes(f.ID, func(scopes []dapScope, err error) {
+		if a.debug != s || s.generation != generation {
+			return
+		}
+		for i, scope := range scopes {
+			v := &debugVariable{name: scope.Name, reference: scope.VariablesReference, path: scope.Name}
+			if _, ok := s.expanded[v.path]; !ok && i == 0 && !scope.Expensive {
+				// the locals are shown right away
+				s.expanded[v.path] = true
+			}
+			s.scopes = append(s.scopes, v)
+			if s.expanded[v.path] {
+				a.loadVariables(v)
+			}
+		}
+		a.debugChanged()
+	})
+	a.evaluateWatches()
+}
+
+// loadVariables gets the children of v and of its expanded children.
+func (a *app) loadVariables(v *debugVariable) {
+	s := a.debug
+	generation := s.generation
+	s.client.variables(v.reference, func(list []dapVariable, err error) {
+		if a.debug != s || s.generation != generation {
+			return
+		}
+		v.children = nil
+		if err != nil {
+			v.children = []*debugVariable{{name: "error", value: err.Error()}}
+		}
+		for _, d := range list {
+			c := &debugVariable{
+				name:      d.Name,
+				value:     d.Value,
+				typ:       d.Type,
+				reference: d.VariablesReference,
+				path:      v.path + "/" + d.Name,
+			}
+			v.children = append(v.children, c)
+			if c.reference != 0 && s.expanded[c.path] {
+				a.loadVariables(c)
+			}
+		}
+		a.debugChanged()
+	})
+}
+
+// evaluateWatches computes the watch expressions in the selected stack frame.
+func (a *app) evaluateWatches() {
+	s := a.debug
+	if s == nil || !s.stopped || s.frame >= len(s.frames) {
+		a.debugChanged()
+		return
+	}
+	generation := s.generation
+	s.watches = make([]*debugVariable, len(a.watches))
+	for i, expression := range a.watches {
+		v := &debugVariable{name: expression, path: "Watch/" + expression}
+		s.watches[i] = v
+		s.client.evaluate(expression, s.frames[s.frame].ID, func(result dapVariable, err error) {
+			if a.debug != s || s.generation != generation {
+				return
+			}
+			if err != nil {
+				v.err = err.Error()
+			} else {
+				v.value, v.typ, v.reference = result.Value, result.Type, result.VariablesReference
+				if v.reference != 0 && s.expanded[v.path] {
+					a.loadVariables(v)
+				}
+			}
+			a.debugChanged()
+		})
+	}
+	a.debugChanged()
+}
+
+// showExecutionLine marks the line of the selected stack frame in the editor
+// if it shows its file.
+func (a *app) showExecutionLine() {
+	e := a.editor
+	if e == nil {
+		return
+	}
+	e.executionLine = -1
+	if s := a.debug; s != nil && s.stopped && s.frame < len(s.frames) && a.path != "" {
+		f := s.frames[s.frame]
+		if f.Source != nil && f.Source.Path != "" && diagnosticPath(f.Source.Path) == diagnosticPath(a.path) {
+			e.executionLine = f.Line - 1
+		}
+	}
+	a.frames.invalidateAll()
+}
+
+// showDebugRow selects row i of the debug panel. A goroutine or stack frame
+// is selected, a variable is expanded or collapsed and a breakpoint is shown.
+func (a *app) showDebugRow(i int) {
+	a.debugView.selectRow(i)
+	r := a.debugView.list[i]
+	s := a.debug
+	switch r.kind {
+	case debugThreadRow:
+		s.thread = r.index
+		s.generation++
+		s.frames = nil
+		a.loadStack()
+	case debugFrameRow:
+		a.selectFrame(r.index)
+	case debugVariableRow, debugWatchRow:
+		v := r.variable
+		if s == nil || v == nil || v.reference == 0 {
+			break
+		}
+		s.expanded[v.path] = !s.expanded[v.path]
+		if s.expanded[v.path] && v.children == nil {
+			a.loadVariables(v)
+		}
+	case debugBreakpointRow:
+		a.jumpTo(codeLocation{path: r.path, pos: textPosition{line: r.index}})
+	}
+	a.debugChanged()
+}
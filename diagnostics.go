@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"go/scanner"
+	"go/token"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// severity tells how bad a diagnostic is. The values are the ones of the
+// Language Server Protocol.
+type severity int
+
+const (
+	severityError severity = 1 + iota
+	severityWarning
+	severityInformation
+	severityHint
+)
+
+// severityColors are the colors of squiggles and gutter markers.
+var severityColors = []uint32{
+	severityError:       problemColor,
+	severityWarning:     0xFFBF8803,
+	severityInformation: 0xFF1A85FF,
+	severityHint:        0xFF6C6C6C,
+}
+
+func (s severity) color() uint32 {
+	if s < severityError || s > severityHint {
+		return severityColors[severityError]
+	}
+	return severityColors[s]
+}
+
+func (s severity) String() string {
+	switch s {
+	case severityWarning:
+		return "warning"
+	case severityInformation:
+		return "info"
+	case severityHint:
+		return "hint"
+	}
+	return "error"
+}
+
+// textPosition is a 0-indexed line and byte column.
+type textPosition struct {
+	line, column int
+}
+
+func (p textPosition) less(q textPosition) bool {
+	return p.line < q.line || p.line == q.line && p.column < q.column
+}
+
+// diagnostic is a problem that a tool found in a file, e.g. a type error. If
+// start and end are the same, the diagnostic covers the word at start.
+type diagnostic struct {
+	path       string
+	start, end textPosition
+	severity   severity
+	message    string
+	// source is the tool that reported the diagnostic, e.g. "go vet"
+	source string
+}
+
+// diagnosticLess sorts diagnostics by file and position.
+func diagnosticLess(a, b diagnostic) bool {
+	if a.path != b.path || a.start != b.start {
+		return locationLess(a.path, a.start, b.path, b.start)
+	}
+	return a.severity < b.severity
+}
+
+// locationLess orders positions in different files by the file paths.
+func locationLess(pathA string, a textPosition, pathB string, b textPosition) bool {
+	if pathA != pathB {
+		return pathA < pathB
+	}
+	return a.less(b)
+}
+
+// diagnosticSet holds the diagnostics of all sources. Every source replaces
+// its own diagnostics when it has new ones, either for all files or for a
+// single file. Diagnostics without a source of their own are labeled with the
+// source that set them.
+type diagnosticSet struct {
+	// bySource maps each source to its diagnostics per file, paths are
+	// absolute
+	bySource map[string]map[string][]diagnostic
+	// changed, if not nil, is called after the diagnostics changed
+	changed func()
+}
+
+func newDiagnosticSet() *diagnosticSet {
+	return &diagnosticSet{bySource: make(map[string]map[string][]diagnostic)}
+}
+
+// diagnosticPath makes paths comparable, tools report them relative to
+// different directories.
+func diagnosticPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// setSource replaces all diagnostics of the source with list.
+func (s *diagnosticSet) setSource(source string, list []diagnostic) {
+	files := make(map[string][]diagnostic)
+	for _, d := range list {
+		d.path = diagnosticPath(d.path)
+		if d.source == "" {
+			d.source = source
+		}
+		files[d.path] = append(files[d.path], d)
+	}
+	s.bySource[source] = files
+	s.notify()
+}
+
+// setFile replaces the diagnostics of the source for the file at path.
+func (s *diagnosticSet) setFile(source, path string, list []diagnostic) {
+	path = diagnosticPath(path)
+	files := s.bySource[source]
+	if files == nil {
+		files = make(map[string][]diagnostic)
+		s.bySource[source] = files
+	}
+	delete(files, path)
+	for _, d := range list {
+		d.path = path
+		if d.source == "" {
+			d.source = source
+		}
+		files[path] = append(files[path], d)
+	}
+	s.notify()
+}
+
+// withoutDuplicates returns the diagnostics of list that no other source
+// reports as an error at the same position. go vet, e.g., reports the type
+// errors of a package that it cannot check.
+func (s *diagnosticSet) withoutDuplicates(source string, list []diagnostic) []diagnostic {
+	type position struct {
+		path  string
+		start textPosition
+	}
+	reported := make(map[position]bool)
+	for other, files := range s.bySource {
+		if other == source {
+			continue
+		}
+		for path, l := range files {
+			for _, d := range l {
+				if d.severity == severityError {
+					reported[position{path, d.start}] = true
+				}
+			}
+		}
+	}
+	var kept []diagnostic
+	for _, d := range list {
+		if !reported[position{diagnosticPath(d.path), d.start}] {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+func (s *diagnosticSet) notify() {
+	if s.changed != nil {
+		s.changed()
+	}
+}
+
+// all returns the diagnostics of all files, sorted.
+func (s *diagnosticSet) all() []diagnostic {
+	var list []diagnostic
+	for _, files := range s.bySource {
+		for _, l := range files {
+			list = append(list, l...)
+		}
+	}
+	sortDiagnostics(list)
+	return list
+}
+
+// inFile returns the sorted diagnostics of the file at path.
+func (s *diagnosticSet) inFile(path string) []diagnostic {
+	path = diagnosticPath(path)
+	var list []diagnostic
+	for _, files := range s.bySource {
+		list = append(list, files[path]...)
+	}
+	sortDiagnostics(list)
+	return list
+}
+
+func sortDiagnostics(list []diagnostic) {
+	sort.SliceStable(list, func(i, j int) bool {
+		return diagnosticLess(list[i], list[j])
+	})
+}
+
+// follow keeps the diagnostics of the file at path in place while doc, which
+// shows that file, is edited. Call stop when the document is closed.
+func (s *diagnosticSet) follow(path string, doc *document) (stop func()) {
+	path = diagnosticPath(path)
+	return doc.observeChanges(func(offset, count int, text []byte) {
+		line, column := doc.offsetToLineCol(offset)
+		endLine, endColumn := doc.offsetToLineCol(offset + count)
+		s.edited(
+			path,
+			textPosition{line, column},
+			textPosition{endLine, endColumn},
+			text,
+		)
+	})
+}
+
+// edited moves the diagnostics of the file at path after the text from start
+// to end was replaced by text.
+func (s *diagnosticSet) edited(path string, start, end textPosition, text []byte) {
+	move := positionMover(start, end, text)
+	changed := false
+	for _, files := range s.bySource {
+		for i := range files[path] {
+			d := &files[path][i]
+			d.start, d.end = move(d.start), move(d.end)
+			changed = true
+		}
+	}
+	if changed {
+		s.notify()
+	}
+}
+
+// positionMover returns a function that moves positions in a document after
+// the text from start to end was replaced by text. Positions in the replaced
+// text move to its start, positions after it move with the text that follows.
+func positionMover(start, end textPosition, text []byte) func(textPosition) textPosition {
+	addedLines := bytes.Count(text, []byte{'\n'})
+	lastLineLength := len(text) - (bytes.LastIndexByte(text, '\n') + 1)
+	return func(p textPosition) textPosition {
+		if p.less(start) {
+			return p
+		}
+		if p.less(end) {
+			return start
+		}
+		if p.line != end.line {
+			p.line += addedLines - (end.line - start.line)
+			return p
+		}
+		column := p.column - end.column + lastLineLength
+		if addedLines == 0 {
+			column += start.column
+		}
+		return textPosition{line: start.line + addedLines, column: column}
+	}
+}
+
+// parseErrorLine splits a line of compiler or tool output like
+//
+//	./main.go:12:5: undefined: x
+//
+// into its parts. The column is optional, it is 0 if missing and the line and
+// column are 1-indexed like in the output. Prefixes like "vet: " are skipped.
+func parseErrorLine(text string) (path string, line, column int, message string, ok bool) {
+	text = strings.TrimSpace(text)
+	// the path ends at the first ".go:" so that Windows drive letters and
+	// colons in the message do not confuse the parser
+	end := strings.Index(text, ".go:")
+	if end == -1 {
+		return "", 0, 0, "", false
+	}
+	path = text[:end+3]
+	if colon := strings.LastIndex(path, ": "); colon != -1 {
+		path = path[colon+2:]
+	}
+	rest := text[end+4:]
+	numbers := make([]int, 0, 2)
+	for len(numbers) < 2 {
+		colon := strings.IndexByte(rest, ':')
+		if colon == -1 {
+			break
+		}
+		n, err := strconv.Atoi(rest[:colon])
+		if err != nil {
+			break
+		}
+		numbers = append(numbers, n)
+		rest = rest[colon+1:]
+	}
+	if len(numbers) == 0 {
+		return "", 0, 0, "", false
+	}
+	line = numbers[0]
+	if len(numbers) == 2 {
+		column = numbers[1]
+	}
+	return path, line, column, strings.TrimSpace(rest), true
+}
+
+// goVet runs go vet on the package in dir and returns what it found. Errors
+// that keep vet from running at all, e.g. a missing go command, are returned
+// as well.
+func goVet(dir string) ([]diagnostic, error) {
+	cmd := exec.Command("go", "vet", ".")
+	cmd.Dir = dir
+	hideProcessWindow(cmd)
+	output, err := cmd.CombinedOutput()
+	if _, ok := err.(*exec.ExitError); !ok && err != nil {
+		return nil, makeErr("go vet", err)
+	}
+	var list []diagnostic
+	for _, text := range strings.Split(string(output), "\n") {
+		path, line, column, message, ok := parseErrorLine(text)
+		if !ok {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		pos := textPosition{line: line - 1, column: max(0, column-1)}
+		list = append(list, diagnostic{
+			path:     path,
+			start:    pos,
+			end:      pos,
+			severity: severityWarning,
+			message:  message,
+		})
+	}
+	widenDiagnostics(list, ioutil.ReadFile)
+	return list, nil
+}
+
+// widenDiagnostics gives the diagnostics in list that only have a position
+// the width of the Go token there. read returns the content of a file, each
+// file is read once.
+func widenDiagnostics(list []diagnostic, read func(path string) ([]byte, error)) {
+	files := make(map[string][]byte)
+	for i := range list {
+		d := &list[i]
+		if d.end != d.start {
+			continue
+		}
+		src, ok := files[d.path]
+		if !ok {
+			src, _ = read(d.path)
+			files[d.path] = src
+		}
+		d.end = tokenEnd(src, d.start)
+	}
+}
+
+// tokenEnd returns the end of the Go token that starts at pos in src. If no
+// token starts there, e.g. at the end of a line, it returns pos.
+func tokenEnd(src []byte, pos textPosition) textPosition {
+	for i := 0; i < pos.line; i++ {
+		n := bytes.IndexByte(src, '\n')
+		if n == -1 {
+			return pos
+		}
+		src = src[n+1:]
+	}
+	// tokens that continue in the next line end with this one
+	if n := bytes.IndexByte(src, '\n'); n != -1 {
+		src = src[:n]
+	}
+	if pos.column >= len(src) {
+		return pos
+	}
+	rest := src[pos.column:]
+	file := token.NewFileSet().AddFile("", -1, len(rest))
+	var s scanner.Scanner
+	s.Init(file, rest, nil, scanner.ScanComments)
+	at, tok, lit := s.Scan()
+	if tok == token.EOF || file.Offset(at) != 0 {
+		return pos
+	}
+	n := len(lit)
+	if lit == "" {
+		n = len(tok.String())
+	}
+	return textPosition{line: pos.line, column: pos.column + min(n, len(rest))}
+}
+
+// vetRunner runs go vet in the background. The app calls update
+// periodically while it is busy.
+type vetRunner struct {
+	vet func(dir string) ([]diagnostic, error)
+	// running is true while vet runs, its result arrives in done. If another
+	// run was requested in the mean time, pending is its directory.
+	running bool
+	pending string
+	done    chan vetResult
+}
+
+type vetResult struct {
+	diagnostics []diagnostic
+	err         error
+}
+
+func newVetRunner(vet func(dir string) ([]diagnostic, error)) *vetRunner {
+	return &vetRunner{vet: vet, done: make(chan vetResult, 1)}
+}
+
+// run vets the package in dir, after the current run if there is one.
+func (v *vetRunner) run(dir string) {
+	if v.running {
+		v.pending = dir
+		return
+	}
+	v.running = true
+	go func() {
+		list, err := v.vet(dir)
+		v.done <- vetResult{diagnostics: list, err: err}
+	}()
+}
+
+// update returns the result of a finished run. busy is true while vet is
+// still running or another run was started.
+func (v *vetRunner) update() (result *vetResult, busy bool) {
+	if !v.running {
+		return nil, false
+	}
+	select {
+	case r := <-v.done:
+		v.running = false
+		if v.pending != "" {
+			dir := v.pending
+			v.pending = ""
+			v.run(dir)
+		}
+		return &r, v.running
+	default:
+		return nil, true
+	}
+}
+
+const (
+	editorGutterWidth = 16
+	gutterColor       = 0xFFF3F3F3
+	// gutterMarkerSize is the edge length of the square that marks lines
+	// with diagnostics
+	gutterMarkerSize = 8
+)
+
+// diagnosticOffsets returns the byte range that d underlines. A diagnostic
+// without extent covers the word at its start or a single character.
+func diagnosticOffsets(doc *document, d diagnostic) (start, end int) {
+	start = doc.lineColToOffset(d.start.line, d.start.column)
+	end = doc.lineColToOffset(d.end.line, d.end.column)
+	if end > start {
+		return start, end
+	}
+	r, size := runeAt(doc, start)
+	if size == 0 || charClassOf(r) == lineBreakClass {
+		return start, start
+	}
+	if charClassOf(r) != wordClass {
+		return start, start + size
+	}
+	return start, scanForward(doc, start, func(_ int, r rune) bool {
+		return charClassOf(r) == wordClass
+	})
+}
+
+// drawDiagnostics underlines the diagnostics in the visible lines with
+// squiggles and marks their lines in the gutter with the color of the most
+// severe one.
+func (e *editor) drawDiagnostics(g graphics, lastLine int) {
+	lineHeight := g.lineHeight()
+	markers := make(map[int]severity)
+	for _, d := range e.diagnostics {
+		if d.end.line < e.topLine || d.start.line > lastLine {
+			continue
+		}
+		start, end := diagnosticOffsets(e.doc, d)
+		first := max(e.topLine, e.doc.lineOf(start))
+		last := min(lastLine, e.doc.lineOf(end))
+		if s, ok := markers[first]; !ok || d.severity < s {
+			markers[first] = d.severity
+		}
+		for line := first; line <= last; line++ {
+			lineStart, lineEnd := e.doc.lineStart(line), e.doc.lineEnd(line)
+			from, to := max(start, lineStart), min(end, lineEnd)
+			x0 := e.area.x + e.textWidth(g, lineStart, from)
+			x1 := e.area.x + e.textWidth(g, lineStart, to)
+			if x1 <= x0 {
+				// nothing to underline, e.g. at the end of a line
+				space, _ := g.textExtent([]byte{' '})
+				x1 = x0 + space
+			}
+			y := e.area.y + (line-e.topLine+1)*lineHeight - 3
+			drawSquiggle(g, x0, x1, y, e.area, d.severity.color())
+		}
+	}
+	for line, s := range markers {
+		y := e.area.y + (line-e.topLine)*lineHeight + (lineHeight-gutterMarkerSize)/2
+		x := e.gutter.x + (e.gutter.w-gutterMarkerSize)/2
+		marker := rect(x, y, gutterMarkerSize, gutterMarkerSize)
+		fillRect(g, marker.intersect(e.gutter), s.color())
+	}
+}
+
+// drawSquiggle draws a wavy line from x0 to x1 that is 3 pixels high, y is
+// its top.
+func drawSquiggle(g graphics, x0, x1, y int, clip rectangle, argb uint32) {
+	wave := [4]int{0, 1, 2, 1}
+	for x := x0; x < x1; x += 2 {
+		r := rect(x, y+wave[(x-x0)/2%4], min(2, x1-x), 1)
+		fillRect(g, r.intersect(clip), argb)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTokenEnd(t *testing.T) {
+	src := []byte("package a\n\nvar s = \"a b\" + x // note\n\tf(`raw\nstring`)\n")
+	tests := []struct {
+		start textPosition
+		end   int
+	}{
+		{textPosition{0, 0}, 7},
+		{textPosition{0, 8}, 9},
+		{textPosition{2, 4}, 5},
+		{textPosition{2, 8}, 13},
+		{textPosition{2, 14}, 15},
+		{textPosition{2, 18}, 25},
+		{textPosition{3, 1}, 2},
+		{textPosition{3, 3}, 7},
+		// whitespace, the end of a line and positions outside of the file
+		{textPosition{2, 3}, 3},
+		{textPosition{1, 0}, 0},
+		{textPosition{2, 25}, 25},
+		{textPosition{9, 2}, 2},
+	}
+	for _, tt := range tests {
+		want := textPosition{tt.start.line, tt.end}
+		if end := tokenEnd(src, tt.start); end != want {
+			t.Errorf("the token at %v ends at %v, want %v", tt.start, end, want)
+		}
+	}
+}
+
+func TestWidenDiagnostics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diagnostics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.go")
+	src := []byte("package a\n\nvar x = undefinedName\n")
+	ioutil.WriteFile(path, []byte("package a\n"), 0666)
+
+	s := newSemanticAnalyzer(path)
+	_, list := analyzeGoPackage(path, src, s.fset, s.importer)
+	if len(list) != 1 || list[0].start != (textPosition{2, 8}) || list[0].end != (textPosition{2, 21}) {
+		t.Fatalf("the type errors are %+v", list)
+	}
+	// a range that the tool reported is kept
+	list[0].end = textPosition{2, 9}
+	widenDiagnostics(list, ioutil.ReadFile)
+	if list[0].end != (textPosition{2, 9}) {
+		t.Errorf("the range was changed to end at %v", list[0].end)
+	}
+}
+
+func TestWithoutDuplicates(t *testing.T) {
+	set := newDiagnosticSet()
+	set.setSource("go/types", []diagnostic{
+		{path: "a.go", start: textPosition{1, 2}, severity: severityError, message: "undefined: x"},
+		{path: "a.go", start: textPosition{3, 0}, severity: severityWarning, message: "unused"},
+	})
+	set.setSource("go vet", []diagnostic{
+		{path: "a.go", start: textPosition{5, 0}, severity: severityWarning, message: "old"},
+	})
+	vet := []diagnostic{
+		{path: "a.go", start: textPosition{1, 2}, severity: severityWarning, message: "undefined: x"},
+		{path: "b.go", start: textPosition{1, 2}, severity: severityWarning, message: "in another file"},
+		{path: "a.go", start: textPosition{3, 0}, severity: severityWarning, message: "next to a warning"},
+		{path: "a.go", start: textPosition{5, 0}, severity: severityWarning, message: "reported again"},
+	}
+	kept := set.withoutDuplicates("go vet", vet)
+	if len(kept) != 3 || kept[0].message != "in another file" {
+		t.Errorf("%+v are kept", kept)
+	}
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"io"
+)
+
+// document holds the text of one file as a piece table. The original file
+// content is never copied or modified, all inserted text is appended to a
+// second buffer and the document is described by a sequence of pieces, each
+// referencing a range in one of the two buffers.
+//
+// The pieces are kept in a balanced binary tree (a treap, ordered by position
+// in the document) in which every node knows the byte count and line break
+// count of its sub-tree. This makes inserting, deleting and converting between
+// byte offsets and line numbers O(log n) in the number of pieces.
+type document struct {
+	original *textBuffer
+	added    *textBuffer
+	root     *piece
+	random   uint32
+	// edited, if not nil, is called after every insert and delete with the
+	// first changed line and the number of line breaks that were removed and
+	// added, e.g. to update syntax highlighting from that line on
+	edited func(line, removedLines, addedLines int)
+	// observers are called before every insert and delete, see
+	// observeChanges
+	observers []*changeObserver
+}
+
+type changeObserver struct {
+	changing func(offset, count int, text []byte)
+}
+
+// observeChanges calls changing before every insert and delete, while the
+// document still has the old text. count bytes at offset are replaced by
+// text, either count or text is empty. Call stop to end the observation.
+func (d *document) observeChanges(changing func(offset, count int, text []byte)) (stop func()) {
+	o := &changeObserver{changing: changing}
+	d.observers = append(d.observers, o)
+	return func() {
+		for i := range d.observers {
+			if d.observers[i] == o {
+				d.observers = append(d.observers[:i:i], d.observers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (d *document) notifyObservers(offset, count int, text []byte) {
+	for _, o := range d.observers {
+		o.changing(offset, count, text)
+	}
+}
+
+func newDocument(data []byte) *document {
+	return newDocumentFromBuffer(newTextBuffer(data))
+}
+
+// newDocumentFromBuffer creates a document with the given, already indexed,
+// buffer as its original content.
+func newDocumentFromBuffer(original *textBuffer) *document {
+	d := &document{
+		original: original,
+		added:    newTextBuffer(nil),
+		random:   2463534242,
+	}
+	if len(original.data) > 0 {
+		d.root = d.newPiece(d.original, 0, len(original.data))
+	}
+	return d
+}
+
+// len returns the number of bytes in the document.
+func (d *document) len() int {
+	return totalSize(d.root)
+}
+
+// lineCount returns the number of lines in the document, which is always one
+// more than the number of line breaks. An empty document has one empty line.
+func (d *document) lineCount() int {
+	return totalLineBreaks(d.root) + 1
+}
+
+func (d *document) insert(offset int, text []byte) {
+	if len(text) == 0 {
+		return
+	}
+	offset = clamp(offset, 0, d.len())
+	d.notifyObservers(offset, 0, text)
+
+	start := len(d.added.data)
+	d.added.append(text)
+	lineBreaks := d.added.lineBreaksBefore(start+len(text)) -
+		d.added.lineBreaksBefore(start)
+
+	left, right := split(d.root, offset)
+	if last := rightmost(left); last != nil &&
+		last.buf == d.added && last.start+last.size == start {
+		// when typing, every character is appended to the added buffer right
+		// after the last one, in this case we just grow the piece instead of
+		// creating a new one for every key stroke
+		growRightmost(left, len(text), lineBreaks)
+	} else {
+		left = merge(left, d.newPiece(d.added, start, len(text)))
+	}
+	d.root = merge(left, right)
+
+	if d.edited != nil {
+		d.edited(d.lineOf(offset), 0, lineBreaks)
+	}
+}
+
+func (d *document) delete(offset, count int) {
+	offset = clamp(offset, 0, d.len())
+	count = clamp(count, 0, d.len()-offset)
+	if count == 0 {
+		return
+	}
+	d.notifyObservers(offset, count, nil)
+	var line, lineBreaks int
+	if d.edited != nil {
+		line = d.lineOf(offset)
+		lineBreaks = d.lineOf(offset+count) - line
+	}
+	left, rest := split(d.root, offset)
+	_, right := split(rest, count)
+	d.root = merge(left, right)
+
+	if d.edited != nil {
+		d.edited(line, lineBreaks, 0)
+	}
+}
+
+// readAt copies the document content starting at offset into p and returns
+// the number of bytes copied.
+func (d *document) readAt(p []byte, offset int) int {
+	if offset < 0 || offset >= d.len() {
+		return 0
+	}
+	return readNode(d.root, p, offset)
+}
+
+// slice returns a copy of the bytes in the range [from, to).
+func (d *document) slice(from, to int) []byte {
+	from = clamp(from, 0, d.len())
+	to = clamp(to, from, d.len())
+	buf := make([]byte, to-from)
+	d.readAt(buf, from)
+	return buf
+}
+
+// bytes returns a copy of the whole document. Note that this is expensive for
+// large documents, use readAt or slice for partial access.
+func (d *document) bytes() []byte {
+	return d.slice(0, d.len())
+}
+
+// writeTo writes the whole document to w, piece by piece, without building a
+// copy in memory first.
+func (d *document) writeTo(w io.Writer) error {
+	var err error
+	eachPiece(d.root, func(p *piece) bool {
+		_, err = w.Write(p.buf.data[p.start : p.start+p.size])
+		return err == nil
+	})
+	return err
+}
+
+// find returns the offset of the first occurrence of pattern at or after
+// offset or -1 if there is none. The document is searched in chunks that
+// overlap by the pattern length so matches across chunk borders are found.
+func (d *document) find(pattern []byte, offset int) int {
+	if len(pattern) == 0 {
+		return -1
+	}
+	chunkSize := 64*1024 + len(pattern)
+	buf := make([]byte, chunkSize)
+	for offset = clamp(offset, 0, d.len()); offset+len(pattern) <= d.len(); {
+		n := d.readAt(buf, offset)
+		if i := bytes.Index(buf[:n], pattern); i != -1 {
+			return offset + i
+		}
+		if offset+n >= d.len() {
+			break
+		}
+		offset += n - len(pattern) + 1
+	}
+	return -1
+}
+
+// lineStart returns the byte offset of the first character in the given line.
+// Lines are 0-indexed and clamped to the valid range.
+func (d *document) lineStart(line int) int {
+	if line <= 0 {
+		return 0
+	}
+	if line >= d.lineCount() {
+		line = d.lineCount() - 1
+	}
+	return d.lineBreakOffset(line-1) + 1
+}
+
+// lineEnd returns the byte offset of the line break that ends the given line
+// or the document length for the last line.
+func (d *document) lineEnd(line int) int {
+	if line < 0 {
+		line = 0
+	}
+	if line >= d.lineCount()-1 {
+		return d.len()
+	}
+	return d.lineBreakOffset(line)
+}
+
+// lineOf returns the 0-indexed line that contains the given byte offset.
+func (d *document) lineOf(offset int) int {
+	offset = clamp(offset, 0, d.len())
+	line := 0
+	n := d.root
+	for n != nil {
+		leftSize := totalSize(n.left)
+		if offset < leftSize {
+			n = n.left
+			continue
+		}
+		line += totalLineBreaks(n.left)
+		offset -= leftSize
+		if offset < n.size {
+			line += n.buf.lineBreaksBefore(n.start+offset) -
+				n.buf.lineBreaksBefore(n.start)
+			return line
+		}
+		line += n.lineBreaks
+		offset -= n.size
+		n = n.right
+	}
+	return line
+}
+
+// offsetToLineCol converts a byte offset to a 0-indexed line and a byte
+// column in that line.
+func (d *document) offsetToLineCol(offset int) (line, col int) {
+	offset = clamp(offset, 0, d.len())
+	line = d.lineOf(offset)
+	return line, offset - d.lineStart(line)
+}
+
+// lineColToOffset converts a 0-indexed line and byte column to a byte offset.
+// Both values are clamped to the valid range, a column after the end of the
+// line is placed at the line end.
+func (d *document) lineColToOffset(line, col int) int {
+	line = clamp(line, 0, d.lineCount()-1)
+	start := d.lineStart(line)
+	return start + clamp(col, 0, d.lineEnd(line)-start)
+}
+
+// lineBreakOffset returns the byte offset of the n-th (0-indexed) line break
+// in the document. n must be in the range [0, lineCount-1).
+func (d *document) lineBreakOffset(n int) int {
+	offset := 0
+	node := d.root
+	for node != nil {
+		leftBreaks := totalLineBreaks(node.left)
+		if n < leftBreaks {
+			node = node.left
+			continue
+		}
+		n -= leftBreaks
+		offset += totalSize(node.left)
+		if n < node.lineBreaks {
+			first := node.buf.lineBreaksBefore(node.start)
+			return offset + node.buf.nthLineBreak(first+n) - node.start
+		}
+		n -= node.lineBreaks
+		offset += node.size
+		node = node.right
+	}
+	return d.len()
+}
+
+// lines returns the text of count lines, starting at line first. Every line
+// is cut off after maxLineLength bytes so that very long lines do not have to
+// be copied completely when only their beginning is visible on screen.
+func (d *document) lines(first, count, maxLineLength int) []byte {
+	var buf []byte
+	last := first + count
+	if last > d.lineCount() {
+		last = d.lineCount()
+	}
+	for line := first; line < last; line++ {
+		start, end := d.lineStart(line), d.lineEnd(line)
+		if end-start > maxLineLength {
+			end = start + maxLineLength
+		}
+		buf = append(buf, d.slice(start, end)...)
+		if line+1 < last {
+			buf = append(buf, '\n')
+		}
+	}
+	return buf
+}
+
+func (d *document) newPiece(buf *textBuffer, start, size int) *piece {
+	// xorshift is good enough to keep the treap balanced
+	d.random ^= d.random << 13
+	d.random ^= d.random >> 17
+	d.random ^= d.random << 5
+	p := &piece{
+		buf:      buf,
+		start:    start,
+		size:     size,
+		priority: d.random,
+	}
+	p.lineBreaks = buf.lineBreaksBefore(start+size) - buf.lineBreaksBefore(start)
+	p.update()
+	return p
+}
+
+// piece references size bytes in buf, starting at start. It is also a node in
+// the document's treap.
+type piece struct {
+	buf         *textBuffer
+	start, size int
+	lineBreaks  int
+
+	left, right *piece
+	priority    uint32
+	// subSize and subLineBreaks are the sums over this node and its children
+	subSize, subLineBreaks int
+}
+
+func (p *piece) update() {
+	p.subSize = totalSize(p.left) + p.size + totalSize(p.right)
+	p.subLineBreaks = totalLineBreaks(p.left) + p.lineBreaks +
+		totalLineBreaks(p.right)
+}
+
+func totalSize(p *piece) int {
+	if p == nil {
+		return 0
+	}
+	return p.subSize
+}
+
+func totalLineBreaks(p *piece) int {
+	if p == nil {
+		return 0
+	}
+	return p.subLineBreaks
+}
+
+// merge concatenates the two trees, all pieces in a come before those in b.
+func merge(a, b *piece) *piece {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.priority > b.priority {
+		a.right = merge(a.right, b)
+		a.update()
+		return a
+	}
+	b.left = merge(a, b.left)
+	b.update()
+	return b
+}
+
+// split divides the tree into the first offset bytes and the rest. A piece
+// that straddles the offset is cut in two.
+func split(p *piece, offset int) (left, right *piece) {
+	if p == nil {
+		return nil, nil
+	}
+	leftSize := totalSize(p.left)
+	if offset <= leftSize {
+		l, r := split(p.left, offset)
+		p.left = r
+		p.update()
+		return l, p
+	}
+	if offset >= leftSize+p.size {
+		l, r := split(p.right, offset-leftSize-p.size)
+		p.right = l
+		p.update()
+		return p, r
+	}
+
+	k := offset - leftSize
+	second := &piece{
+		buf:   p.buf,
+		start: p.start + k,
+		size:  p.size - k,
+		// derive the priority from the original piece so the tree does not
+		// need a random source here
+		priority: p.priority*1103515245 + 12345,
+	}
+	firstBreaks := p.buf.lineBreaksBefore(p.start+k) -
+		p.buf.lineBreaksBefore(p.start)
+	second.lineBreaks = p.lineBreaks - firstBreaks
+	second.update()
+	p.size = k
+	p.lineBreaks = firstBreaks
+
+	oldRight := p.right
+	p.right = nil
+	p.update()
+	return p, merge(second, oldRight)
+}
+
+func rightmost(p *piece) *piece {
+	if p == nil {
+		return nil
+	}
+	for p.right != nil {
+		p = p.right
+	}
+	return p
+}
+
+// growRightmost extends the last piece in the tree by size bytes containing
+// lineBreaks line breaks and updates all nodes on the path to it.
+func growRightmost(p *piece, size, lineBreaks int) {
+	for p != nil {
+		p.subSize += size
+		p.subLineBreaks += lineBreaks
+		if p.right == nil {
+			p.size += size
+			p.lineBreaks += lineBreaks
+		}
+		p = p.right
+	}
+}
+
+func readNode(p *piece, buf []byte, offset int) int {
+	if p == nil || len(buf) == 0 {
+		return 0
+	}
+	n := 0
+	leftSize := totalSize(p.left)
+	if offset < leftSize {
+		n += readNode(p.left, buf, offset)
+		offset = leftSize
+	}
+	if n < len(buf) && offset < leftSize+p.size {
+		from := p.start + offset - leftSize
+		n += copy(buf[n:], p.buf.data[from:p.start+p.size])
+		offset = leftSize + p.size
+	}
+	if n < len(buf) {
+		n += readNode(p.right, buf[n:], offset-leftSize-p.size)
+	}
+	return n
+}
+
+// eachPiece calls f for all pieces in document order until f returns false.
+func eachPiece(p *piece, f func(*piece) bool) bool {
+	if p == nil {
+		return true
+	}
+	return eachPiece(p.left, f) && f(p) && eachPiece(p.right, f)
+}
+
+// textBufferBlockSize is the granularity of the line break index. Finding a
+// line break inside a buffer scans at most one block.
+const textBufferBlockSize = 64 * 1024
+
+// textBuffer is one of the two backing buffers of a document. Alongside the
+// data it keeps the number of line breaks before every block boundary.
+type textBuffer struct {
+	data []byte
+	// blockLineBreaks[i] is the number of line breaks in
+	// data[:i*textBufferBlockSize], it has an entry for every complete block
+	// plus the one at offset 0
+	blockLineBreaks []int
+}
+
+// newTextBuffer uses data without copying it, the caller must not modify it
+// afterwards.
+func newTextBuffer(data []byte) *textBuffer {
+	b := &textBuffer{data: data, blockLineBreaks: []int{0}}
+	b.indexNewBlocks()
+	return b
+}
+
+func (b *textBuffer) append(data []byte) {
+	b.data = append(b.data, data...)
+	b.indexNewBlocks()
+}
+
+func (b *textBuffer) indexNewBlocks() {
+	for b.indexNextBlock() {
+	}
+}
+
+// indexNextBlock adds the line break count for the next complete block to the
+// index. It returns false if there is no complete block left to index.
+func (b *textBuffer) indexNextBlock() bool {
+	indexed := len(b.blockLineBreaks) - 1
+	from := indexed * textBufferBlockSize
+	to := from + textBufferBlockSize
+	if to > len(b.data) {
+		return false
+	}
+	b.blockLineBreaks = append(
+		b.blockLineBreaks,
+		b.blockLineBreaks[indexed]+bytes.Count(b.data[from:to], newline),
+	)
+	return true
+}
+
+// lineBreaksBefore returns the number of line breaks in data[:offset].
+func (b *textBuffer) lineBreaksBefore(offset int) int {
+	block := offset / textBufferBlockSize
+	from := block * textBufferBlockSize
+	return b.blockLineBreaks[block] + bytes.Count(b.data[from:offset], newline)
+}
+
+// nthLineBreak returns the offset of the n-th (0-indexed) line break in data.
+func (b *textBuffer) nthLineBreak(n int) int {
+	// find the last block that starts with at most n line breaks before it
+	lo, hi := 0, len(b.blockLineBreaks)-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if b.blockLineBreaks[mid] <= n {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	offset := lo * textBufferBlockSize
+	n -= b.blockLineBreaks[lo]
+	for {
+		i := bytes.IndexByte(b.data[offset:], '\n')
+		if i == -1 {
+			return len(b.data)
+		}
+		if n == 0 {
+			return offset + i
+		}
+		n--
+		offset += i + 1
+	}
+}
+
+var newline = []byte{'\n'}
+
+func clamp(x, min, max int) int {
+	if x < min {
+		return min
+	}
+	if x > max {
+		return max
+	}
+	return x
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestDocumentEdits(t *testing.T) {
+	type edit struct {
+		insert bool
+		offset int
+		count  int
+		text   string
+	}
+	tests := []struct {
+		name     string
+		original string
+		edits    []edit
+		want     string
+	}{
+		{"empty", "", nil, ""},
+		{"insert into empty", "", []edit{{insert: true, text: "abc"}}, "abc"},
+		{"insert at start", "world", []edit{{true, 0, 0, "hello "}}, "hello world"},
+		{"insert at end", "hello", []edit{{true, 5, 0, " world"}}, "hello world"},
+		{"insert in the middle", "held", []edit{{true, 2, 0, "llo wor"}}, "hello world"},
+		{"typing grows one piece", "", []edit{{true, 0, 0, "a"}, {true, 1, 0, "b"}, {true, 2, 0, "c"}}, "abc"},
+		{"insert clamps the offset", "ab", []edit{{true, 10, 0, "c"}, {true, -5, 0, "_"}}, "_abc"},
+		{"delete at start", "hello world", []edit{{false, 0, 6, ""}}, "world"},
+		{"delete at end", "hello world", []edit{{false, 5, 6, ""}}, "hello"},
+		{"delete across pieces", "ad", []edit{{true, 1, 0, "bc"}, {false, 0, 3, ""}}, "d"},
+		{"delete clamps the count", "abc", []edit{{false, 1, 100, ""}}, "a"},
+		{"delete nothing", "abc", []edit{{false, 1, 0, ""}, {false, 3, 2, ""}}, "abc"},
+		{"replace everything", "old", []edit{{false, 0, 3, ""}, {true, 0, 0, "new"}}, "new"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDocument([]byte(tt.original))
+			for _, e := range tt.edits {
+				if e.insert {
+					d.insert(e.offset, []byte(e.text))
+				} else {
+					d.delete(e.offset, e.count)
+				}
+			}
+			if got := string(d.bytes()); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if d.len() != len(tt.want) {
+				t.Errorf("len is %d, want %d", d.len(), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestDocumentLineIndex(t *testing.T) {
+	tests := []struct {
+		text   string
+		starts []int
+		ends   []int
+	}{
+		{"", []int{0}, []int{0}},
+		{"abc", []int{0}, []int{3}},
+		{"\n", []int{0, 1}, []int{0, 1}},
+		{"a\nbc\n", []int{0, 2, 5}, []int{1, 4, 5}},
+		{"\n\n\nx", []int{0, 1, 2, 3}, []int{0, 1, 2, 4}},
+	}
+	for _, tt := range tests {
+		d := newDocument([]byte(tt.text))
+		if d.lineCount() != len(tt.starts) {
+			t.Errorf("%q has %d lines, want %d", tt.text, d.lineCount(), len(tt.starts))
+			continue
+		}
+		for line := range tt.starts {
+			if start := d.lineStart(line); start != tt.starts[line] {
+				t.Errorf("%q line %d starts at %d, want %d", tt.text, line, start, tt.starts[line])
+			}
+			if end := d.lineEnd(line); end != tt.ends[line] {
+				t.Errorf("%q line %d ends at %d, want %d", tt.text, line, end, tt.ends[line])
+			}
+		}
+		// lines out of range are clamped
+		if d.lineStart(-1) != 0 || d.lineEnd(len(tt.starts)) != len(tt.text) {
+			t.Errorf("%q does not clamp lines", tt.text)
+		}
+	}
+}
+
+func TestDocumentLineColumn(t *testing.T) {
+	d := newDocument([]byte("ab\ncde\n\nf"))
+	tests := []struct {
+		offset, line, col int
+	}{
+		{0, 0, 0},
+		{2, 0, 2},
+		{3, 1, 0},
+		{6, 1, 3},
+		{7, 2, 0},
+		{8, 3, 0},
+		{9, 3, 1},
+	}
+	for _, tt := range tests {
+		if line, col := d.offsetToLineCol(tt.offset); line != tt.line || col != tt.col {
+			t.Errorf("offset %d is at %d:%d, want %d:%d", tt.offset, line, col, tt.line, tt.col)
+		}
+		if offset := d.lineColToOffset(tt.line, tt.col); offset != tt.offset {
+			t.Errorf("%d:%d is at offset %d, want %d", tt.line, tt.col, offset, tt.offset)
+		}
+	}
+	clamped := []struct {
+		line, col, offset int
+	}{
+		{0, 10, 2},
+		{-1, 1, 1},
+		{10, 0, 8},
+		{1, -3, 3},
+	}
+	for _, tt := range clamped {
+		if offset := d.lineColToOffset(tt.line, tt.col); offset != tt.offset {
+			t.Errorf("%d:%d is at offset %d, want %d", tt.line, tt.col, offset, tt.offset)
+		}
+	}
+}
+
+// TestDocumentMatchesReference makes random edits to a document and a plain
+// byte slice and compares their contents and line indexes.
+func TestDocumentMatchesReference(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	randomText := func(n int) []byte {
+		text := make([]byte, n)
+		for i := range text {
+			if random.Intn(10) == 0 {
+				text[i] = '\n'
+			} else {
+				text[i] = 'a' + byte(random.Intn(26))
+			}
+		}
+		return text
+	}
+	reference := randomText(20000)
+	d := newDocument(append([]byte(nil), reference...))
+	for i := 0; i < 2000; i++ {
+		offset := random.Intn(len(reference) + 1)
+		if random.Intn(3) > 0 {
+			text := randomText(random.Intn(20))
+			if random.Intn(100) == 0 {
+				text = bytes.Repeat([]byte("ab\n"), 1000)
+			}
+			d.insert(offset, text)
+			reference = append(reference[:offset:offset], append(text, reference[offset:]...)...)
+		} else {
+			count := random.Intn(50)
+			if count > len(reference)-offset {
+				count = len(reference) - offset
+			}
+			d.delete(offset, count)
+			reference = append(reference[:offset:offset], reference[offset+count:]...)
+		}
+		if i%100 == 0 {
+			compareWithReference(t, d, reference, false)
+		}
+	}
+	compareWithReference(t, d, reference, true)
+}
+
+func compareWithReference(t *testing.T, d *document, reference []byte, allLines bool) {
+	t.Helper()
+	if !bytes.Equal(d.bytes(), reference) {
+		t.Fatal("the content differs from the reference")
+	}
+	lines := bytes.Split(reference, []byte("\n"))
+	if d.lineCount() != len(lines) {
+		t.Fatalf("%d lines, want %d", d.lineCount(), len(lines))
+	}
+	// every line is compared after the last edit, before that a sample
+	step := 1
+	if !allLines {
+		step = 13
+	}
+	start := 0
+	for i, line := range lines {
+		end := start + len(line)
+		if i%step != 0 && i != len(lines)-1 {
+			start = end + 1
+			continue
+		}
+		if d.lineStart(i) != start || d.lineEnd(i) != end {
+			t.Fatalf("line %d is [%d, %d), want [%d, %d)", i, d.lineStart(i), d.lineEnd(i), start, end)
+		}
+		if got := d.lineOf(start); got != i {
+			t.Fatalf("offset %d is in line %d, want %d", start, got, i)
+		}
+		if l, col := d.offsetToLineCol(end); l != i || col != len(line) {
+			t.Fatalf("offset %d is at %d:%d, want %d:%d", end, l, col, i, len(line))
+		}
+		start = end + 1
+	}
+	if from, to := len(reference)/3, len(reference)/2; !bytes.Equal(d.slice(from, to), reference[from:to]) {
+		t.Fatal("the slice differs from the reference")
+	}
+}
@@ -0,0 +1,738 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// editor is the view of one document. It owns the cursors and the undo
+// history and knows which part of the document is visible.
+type editor struct {
+	doc     *document
+	history *history
+	// cursors are sorted by their position in the document and never overlap,
+	// there is always at least one
+	cursors []cursor
+	// primary is the index of the cursor that was placed last, the view
+	// follows it and it is the one that stays when going back to one cursor
+	primary int
+	// topLine is the first line that is visible on screen
+	topLine int
+	// visibleLines is the number of lines that fit on screen, area is the
+	// screen rectangle of the text and gutter the one left of it, they are
+	// updated when drawing
+	visibleLines int
+	area         rectangle
+	gutter       rectangle
+	// drag is the state of the mouse while the left button is held down
+	drag mouseDrag
+	// invalidate, if not nil, is called with the editor's screen area when
+	// the editor needs to be redrawn
+	invalidate func(rectangle)
+	// now tells the time for grouping undo steps, it can be replaced by a
+	// fake clock
+	now func() time.Time
+	// focused is false while the window is in the background, the carets are
+	// hidden then
+	focused bool
+	// highlighter colors the text, it is nil for plain text
+	highlighter *goHighlighter
+	// problem is shown until the text changes, it is nil if there is none
+	problem *problem
+	// diagnostics are the sorted problems that tools found in the document,
+	// they are underlined and marked in the gutter
+	diagnostics []diagnostic
+	// complete, if not nil, finds the completions for the popup, which is
+	// open while completion is not nil. snippet is the inserted snippet whose
+	// placeholders are visited with Tab.
+	complete   completionSource
+	completion *completionPopup
+	snippet    *snippetSession
+	// testMarkers, if not nil, finds the tests in the given lines, they are
+	// marked in the gutter
+	testMarkers func(doc *document, first, last int) []testMarker
+	// coverage are the blocks of the last coverage run, their background is
+	// tinted
+	coverage []coverBlock
+	// breakpoints are the debugger's breakpoints in the document, sorted by
+	// line, they are marked in the gutter. executionLine is the line where
+	// the debugged program stopped, it is -1 if it did not stop in the
+	// document.
+	breakpoints   []breakpoint
+	executionLine int
+	// overlay is the screen rectangle of the popups that were drawn outside
+	// of the editor area
+	overlay rectangle
+}
+
+// mouseDrag remembers where a mouse drag started. For box selections the
+// start is kept as line and visual column since it can lie past the end of a
+// line.
+type mouseDrag struct {
+	active       bool
+	box          bool
+	startLine    int
+	startColumn  int
+	cursorsSoFar []cursor
+}
+
+const (
+	editorBackgroundColor = 0xFFFFFFFF
+	editorTextColor       = 0xFF000000
+	editorSelectionColor  = 0xFFADD6FF
+	editorCaretColor      = 0xFF000000
+	editorCaretWidth      = 2
+	// maxVisibleLineLength is the number of bytes per line that are handed to
+	// the renderer, there is no point in measuring text far outside the
+	// window
+	maxVisibleLineLength = 1000
+)
+
+func newEditor(doc *document) *editor {
+	return &editor{
+		doc:           doc,
+		history:       newHistory(doc),
+		cursors:       []cursor{newCursor(0)},
+		visibleLines:  1,
+		now:           time.Now,
+		focused:       true,
+		executionLine: -1,
+	}
+}
+
+func (e *editor) primaryCursor() *cursor {
+	return &e.cursors[e.primary]
+}
+
+func (e *editor) selections() []selection {
+	s := make([]selection, len(e.cursors))
+	for i := range e.cursors {
+		s[i] = e.cursors[i].selection
+	}
+	return s
+}
+
+func (e *editor) setSelections(s []selection) {
+	if len(s) == 0 {
+		return
+	}
+	e.cursors = e.cursors[:0]
+	for _, sel := range s {
+		e.cursors = append(e.cursors, cursor{selection: sel, column: -1})
+	}
+	e.primary = clamp(e.primary, 0, len(e.cursors)-1)
+	e.normalizeCursors()
+	e.scrollToCaret()
+	e.changed()
+}
+
+// changed schedules a redraw of the editor.
+func (e *editor) changed() {
+	if e.invalidate != nil {
+		e.invalidate(e.area.union(e.gutter).union(e.overlay))
+	}
+}
+
+// normalizeCursors sorts the cursors and merges the ones that overlap. The
+// primary cursor is kept track of.
+func (e *editor) normalizeCursors() {
+	primary := e.cursors[e.primary]
+	sort.SliceStable(e.cursors, func(i, j int) bool {
+		return e.cursors[i].start() < e.cursors[j].start()
+	})
+	merged := e.cursors[:1]
+	for _, c := range e.cursors[1:] {
+		last := &merged[len(merged)-1]
+		if c.start() < last.end() || c.start() == last.start() {
+			start, end := last.start(), c.end()
+			if last.end() > end {
+				end = last.end()
+			}
+			forward := last.caret >= last.anchor
+			if forward {
+				last.anchor, last.caret = start, end
+			} else {
+				last.anchor, last.caret = end, start
+			}
+			last.column = -1
+		} else {
+			merged = append(merged, c)
+		}
+	}
+	e.cursors = merged
+	e.primary = 0
+	for i, c := range e.cursors {
+		if c.start() <= primary.caret && primary.caret <= c.end() {
+			e.primary = i
+			break
+		}
+	}
+}
+
+// textRange is the range [start, end) in a document.
+type textRange struct {
+	start, end int
+}
+
+// replaceRanges replaces ranges, one for each cursor in order, with text and
+// places every caret after its inserted text. All replacements are one undo
+// step.
+func (e *editor) replaceRanges(kind editKind, ranges []textRange, text []byte, now time.Time) {
+	// ranges of neighboring cursors might overlap, e.g. when deleting the
+	// character left of a caret that directly follows a selection
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i].start < ranges[i-1].end {
+			ranges[i].start = ranges[i-1].end
+		}
+		if ranges[i].end < ranges[i].start {
+			ranges[i].end = ranges[i].start
+		}
+	}
+
+	// the replacements are applied back to front so the offsets of the ones
+	// that are not yet applied stay valid
+	changes := make([]replacement, len(ranges))
+	after := make([]selection, len(ranges))
+	shift := 0
+	for i, r := range ranges {
+		changes[len(ranges)-1-i] = replacement{
+			offset: r.start,
+			count:  r.end - r.start,
+			text:   text,
+		}
+		caret := r.start + shift + len(text)
+		after[i] = selection{anchor: caret, caret: caret}
+		shift += len(text) - (r.end - r.start)
+	}
+
+	e.problem = nil
+	e.history.change(kind, changes, e.selections(), after, now)
+	e.setSelections(after)
+}
+
+// applyReplacements applies the changes, which must be sorted by offset and
+// must not overlap, as one undo step. The cursors move along with the text
+// around them.
+func (e *editor) applyReplacements(kind editKind, changes []replacement, now time.Time) {
+	if len(changes) == 0 {
+		return
+	}
+	after := make([]selection, len(e.cursors))
+	for i, c := range e.cursors {
+		after[i] = selection{
+			anchor: mapOffset(c.anchor, changes),
+			caret:  mapOffset(c.caret, changes),
+		}
+	}
+	backToFront := make([]replacement, len(changes))
+	for i := range changes {
+		backToFront[len(changes)-1-i] = changes[i]
+	}
+	e.problem = nil
+	e.history.change(kind, backToFront, e.selections(), after, now)
+	e.setSelections(after)
+}
+
+// mapOffset returns where the text at offset ends up after applying the
+// sorted changes. Offsets inside a replaced range move to its end.
+func mapOffset(offset int, changes []replacement) int {
+	shift := 0
+	for _, c := range changes {
+		if c.offset > offset {
+			break
+		}
+		if offset < c.offset+c.count {
+			return c.offset + shift + len(c.text)
+		}
+		shift += len(c.text) - c.count
+	}
+	return offset + shift
+}
+
+// commentLines puts a Go line comment in front of every line that a cursor
+// touches or, if comment is false, removes it from these lines. The comment
+// is placed after the indentation, blank lines are left alone.
+func (e *editor) commentLines(comment bool, now time.Time) {
+	var changes []replacement
+	lastLine := -1
+	for _, c := range e.cursors {
+		first, last := e.doc.lineOf(c.start()), e.doc.lineOf(c.end())
+		if last > first && e.doc.lineStart(last) == c.end() {
+			// a selection that ends at the start of a line does not include
+			// that line
+			last--
+		}
+		if first <= lastLine {
+			first = lastLine + 1
+		}
+		for line := first; line <= last; line++ {
+			start, end := e.doc.lineStart(line), lineEnd(e.doc, e.doc.lineStart(line))
+			indent := scanForward(e.doc, start, func(at int, r rune) bool {
+				return at < end && charClassOf(r) == spaceClass
+			})
+			if indent == end {
+				continue
+			}
+			if comment {
+				changes = append(changes, replacement{offset: indent, text: []byte("// ")})
+			} else {
+				rest := e.doc.slice(indent, min(indent+3, end))
+				if len(rest) >= 2 && rest[0] == '/' && rest[1] == '/' {
+					count := 2
+					if len(rest) == 3 && rest[2] == ' ' {
+						count = 3
+					}
+					changes = append(changes, replacement{offset: indent, count: count})
+				}
+			}
+		}
+		lastLine = last
+	}
+	e.applyReplacements(otherEdit, changes, now)
+}
+
+func (e *editor) selectedRanges() []textRange {
+	ranges := make([]textRange, len(e.cursors))
+	for i, c := range e.cursors {
+		ranges[i] = textRange{start: c.start(), end: c.end()}
+	}
+	return ranges
+}
+
+// insertText replaces the selected text of every cursor with text and places
+// the carets after it.
+func (e *editor) insertText(text []byte, kind editKind, now time.Time) {
+	e.replaceRanges(kind, e.selectedRanges(), text, now)
+}
+
+// deleteBackward deletes the selected text or, for cursors without a
+// selection, the character left of the caret.
+func (e *editor) deleteBackward(now time.Time) {
+	e.deleteAround(runeLeft, now)
+}
+
+// deleteForward deletes the selected text or, for cursors without a
+// selection, the character right of the caret.
+func (e *editor) deleteForward(now time.Time) {
+	e.deleteAround(runeRight, now)
+}
+
+// deleteAround deletes the selected text of all cursors. Empty cursors delete
+// the text between their caret and the position that m moves them to.
+func (e *editor) deleteAround(m motion, now time.Time) {
+	ranges := e.selectedRanges()
+	empty := true
+	for i, c := range e.cursors {
+		if c.empty() {
+			to := m(e.doc, c.caret)
+			ranges[i] = textRange{start: min(c.caret, to), end: max(c.caret, to)}
+		}
+		if ranges[i].start != ranges[i].end {
+			empty = false
+		}
+	}
+	if !empty {
+		e.replaceRanges(deletingEdit, ranges, nil, now)
+	}
+}
+
+func (e *editor) undo() {
+	if s, ok := e.history.undo(); ok {
+		e.problem = nil
+		e.setSelections(s)
+	}
+}
+
+func (e *editor) redo() {
+	if s, ok := e.history.redo(); ok {
+		e.problem = nil
+		e.setSelections(s)
+	}
+}
+
+// moveCaret moves all carets with the given motion, extending their
+// selections if extend is true.
+func (e *editor) moveCaret(m motion, extend bool) {
+	for i := range e.cursors {
+		c := &e.cursors[i]
+		c.moveTo(m(e.doc, c.caret), extend)
+	}
+	e.afterMove()
+}
+
+// moveLeft moves all carets one character left. Cursors with a selection that
+// is not to be extended are collapsed to its start instead.
+func (e *editor) moveLeft(extend bool) {
+	for i := range e.cursors {
+		c := &e.cursors[i]
+		if !extend && !c.empty() {
+			c.moveTo(c.start(), false)
+		} else {
+			c.moveTo(runeLeft(e.doc, c.caret), extend)
+		}
+	}
+	e.afterMove()
+}
+
+// moveRight moves all carets one character right. Cursors with a selection
+// that is not to be extended are collapsed to its end instead.
+func (e *editor) moveRight(extend bool) {
+	for i := range e.cursors {
+		c := &e.cursors[i]
+		if !extend && !c.empty() {
+			c.moveTo(c.end(), false)
+		} else {
+			c.moveTo(runeRight(e.doc, c.caret), extend)
+		}
+	}
+	e.afterMove()
+}
+
+// moveLines moves all carets up (negative) or down (positive).
+func (e *editor) moveLines(lines int, extend bool) {
+	for i := range e.cursors {
+		e.cursors[i].moveVertically(e.doc, lines, extend)
+	}
+	e.afterMove()
+}
+
+// movePages moves the carets and the view by whole screens.
+func (e *editor) movePages(pages int, extend bool) {
+	lines := pages * e.visibleLines
+	e.topLine = clamp(e.topLine+lines, 0, e.doc.lineCount()-1)
+	e.moveLines(lines, extend)
+}
+
+func (e *editor) afterMove() {
+	e.normalizeCursors()
+	e.history.closeStep()
+	e.scrollToCaret()
+	e.changed()
+}
+
+func (e *editor) selectAll() {
+	c := newCursor(0)
+	c.moveTo(e.doc.len(), true)
+	e.cursors = []cursor{c}
+	e.primary = 0
+	e.afterMove()
+}
+
+// singleCursor removes all but the primary cursor.
+func (e *editor) singleCursor() {
+	e.cursors = []cursor{*e.primaryCursor()}
+	e.primary = 0
+	e.afterMove()
+}
+
+// addCursorVertically adds a cursor one line above the first cursor (for a
+// negative direction) or below the last cursor (positive direction), in the
+// same visual column.
+func (e *editor) addCursorVertically(direction int) {
+	from := e.cursors[0]
+	if direction > 0 {
+		from = e.cursors[len(e.cursors)-1]
+	}
+	line := e.doc.lineOf(from.caret) + direction
+	if line < 0 || line >= e.doc.lineCount() {
+		return
+	}
+	column := from.column
+	if column == -1 {
+		column = visualColumn(e.doc, from.caret)
+	}
+	c := newCursor(offsetAtColumn(e.doc, line, column))
+	c.column = column
+	e.cursors = append(e.cursors, c)
+	e.primary = len(e.cursors) - 1
+	e.afterMove()
+}
+
+// addNextOccurrence selects the word under the primary caret if nothing is
+// selected. Otherwise it adds a cursor that selects the next occurrence of the
+// primary selection after the last cursor, wrapping around at the document
+// end.
+func (e *editor) addNextOccurrence() {
+	p := e.primaryCursor()
+	if p.empty() {
+		start := scanBackward(e.doc, p.caret, func(_ int, r rune) bool {
+			return charClassOf(r) == wordClass
+		})
+		end := scanForward(e.doc, p.caret, func(_ int, r rune) bool {
+			return charClassOf(r) == wordClass
+		})
+		p.anchor = start
+		p.moveTo(end, true)
+		e.afterMove()
+		return
+	}
+
+	pattern := e.doc.slice(p.start(), p.end())
+	last := e.cursors[len(e.cursors)-1]
+	at := e.doc.find(pattern, last.end())
+	if at == -1 {
+		at = e.doc.find(pattern, 0)
+	}
+	for _, c := range e.cursors {
+		if c.start() == at {
+			// all occurrences are selected already
+			return
+		}
+	}
+	if at != -1 {
+		c := newCursor(at)
+		c.moveTo(at+len(pattern), true)
+		e.cursors = append(e.cursors, c)
+		e.primary = len(e.cursors) - 1
+		e.afterMove()
+	}
+}
+
+// scrollToCaret changes the view so that the primary caret is visible.
+func (e *editor) scrollToCaret() {
+	e.scrollToLine(e.doc.lineOf(e.primaryCursor().caret))
+}
+
+// scrollToLine changes the view so that the line is visible.
+func (e *editor) scrollToLine(line int) {
+	if line < e.topLine {
+		e.topLine = line
+	}
+	if line >= e.topLine+e.visibleLines {
+		e.topLine = line - e.visibleLines + 1
+	}
+}
+
+// mouseDown places the caret at the clicked position. With shift the primary
+// selection is extended, with ctrl a new cursor is added and with alt a box
+// selection is started which is then extended by mouseMove.
+func (e *editor) mouseDown(g graphics, x, y int, shift, ctrl, alt bool) {
+	e.closeCompletion()
+	line, column := e.lineColumnAt(g, x, y)
+	offset := offsetAtColumn(e.doc, line, column)
+	e.drag = mouseDrag{
+		active:      true,
+		box:         alt,
+		startLine:   line,
+		startColumn: column,
+	}
+	switch {
+	case alt:
+		if ctrl {
+			e.drag.cursorsSoFar = append([]cursor(nil), e.cursors...)
+		}
+		e.boxSelect(line, column)
+		return
+	case shift:
+		e.cursors = []cursor{*e.primaryCursor()}
+		e.cursors[0].moveTo(offset, true)
+	case ctrl:
+		e.cursors = append(e.cursors, newCursor(offset))
+	default:
+		e.cursors = []cursor{newCursor(offset)}
+	}
+	e.primary = len(e.cursors) - 1
+	e.afterMove()
+}
+
+// mouseMove extends the selection of the primary cursor or the box selection
+// while dragging.
+func (e *editor) mouseMove(g graphics, x, y int) {
+	if !e.drag.active {
+		return
+	}
+	line, column := e.lineColumnAt(g, x, y)
+	if e.drag.box {
+		e.boxSelect(line, column)
+		return
+	}
+	e.primaryCursor().moveTo(offsetAtColumn(e.doc, line, column), true)
+	e.afterMove()
+}
+
+func (e *editor) mouseUp() {
+	e.drag = mouseDrag{}
+}
+
+// boxSelect creates one cursor per line from the drag start to the given line
+// and column. Lines that are too short to reach the box get an empty cursor
+// at their end.
+func (e *editor) boxSelect(line, column int) {
+	e.cursors = append(e.cursors[:0], e.drag.cursorsSoFar...)
+	first, last := e.drag.startLine, line
+	step := 1
+	if last < first {
+		step = -1
+	}
+	for l := first; ; l += step {
+		c := newCursor(offsetAtColumn(e.doc, l, e.drag.startColumn))
+		c.moveTo(offsetAtColumn(e.doc, l, column), true)
+		c.column = column
+		e.cursors = append(e.cursors, c)
+		if l == last {
+			break
+		}
+	}
+	e.primary = len(e.cursors) - 1
+	e.afterMove()
+}
+
+// lineColumnAt converts a screen position to a line and visual column. The
+// column is not limited to the line length so box selections can extend
+// past the end of short lines.
+func (e *editor) lineColumnAt(g graphics, x, y int) (line, column int) {
+	line = e.topLine + (y-e.area.y)/g.lineHeight()
+	if y < e.area.y {
+		line = e.topLine - 1
+	}
+	line = clamp(line, 0, e.doc.lineCount()-1)
+
+	x -= e.area.x
+	space, _ := g.textExtent([]byte{' '})
+	start, end := e.doc.lineStart(line), e.doc.lineEnd(line)
+	width := 0
+	end = scanForward(e.doc, start, func(at int, r rune) bool {
+		if at >= end || at-start >= maxVisibleLineLength {
+			return false
+		}
+		w, _ := g.textExtent(runeBytes(r, 1))
+		if width+w/2 > x {
+			return false
+		}
+		width += w
+		column += columnWidth(r)
+		return true
+	})
+	if end == e.doc.lineEnd(line) && x > width && space > 0 {
+		// past the end of the line, continue in space-sized columns
+		column += (x - width + space/2) / space
+	}
+	return line, column
+}
+
+func (e *editor) draw(g graphics, area rectangle) {
+	e.gutter = rect(area.x, area.y, editorGutterWidth, area.h)
+	area = rect(area.x+editorGutterWidth, area.y, area.w-editorGutterWidth, area.h)
+	e.area = area
+	lineHeight := g.lineHeight()
+	e.visibleLines = area.h / lineHeight
+	if e.visibleLines < 1 {
+		e.visibleLines = 1
+	}
+
+	g.rect(e.gutter.x, e.gutter.y, e.gutter.w, e.gutter.h, gutterColor)
+	g.rect(area.x, area.y, area.w, area.h, editorBackgroundColor)
+
+	// the last line might only be partially visible, draw it as well
+	lastLine := e.topLine + e.visibleLines
+	if lastLine >= e.doc.lineCount() {
+		lastLine = e.doc.lineCount() - 1
+	}
+	firstVisible := e.doc.lineStart(e.topLine)
+	lastVisible := e.doc.lineEnd(lastLine)
+
+	e.drawCoverage(g, lastLine)
+	e.drawExecutionLine(g, lastLine)
+	// selections are drawn behind the text
+	for _, c := range e.cursors {
+		if c.empty() || c.end() < firstVisible || c.start() > lastVisible {
+			continue
+		}
+		first := max(e.topLine, e.doc.lineOf(c.start()))
+		last := min(lastLine, e.doc.lineOf(c.end()))
+		for line := first; line <= last; line++ {
+			e.drawSelection(g, c.selection, line)
+		}
+	}
+
+	text := e.doc.lines(e.topLine, lastLine-e.topLine+1, maxVisibleLineLength)
+	if e.highlighter != nil {
+		g.coloredText(text, area.x, area.y, area, e.colorRuns(text))
+	} else {
+		g.text(text, area.x, area.y, area, editorTextColor)
+	}
+	if e.testMarkers != nil {
+		e.drawTestMarkers(g, lastLine)
+	}
+	e.drawDiagnostics(g, lastLine)
+	e.drawBreakpoints(g, lastLine)
+
+	for _, c := range e.cursors {
+		if !e.focused || c.caret < firstVisible || c.caret > lastVisible {
+			continue
+		}
+		line := e.doc.lineOf(c.caret)
+		x := area.x + e.textWidth(g, e.doc.lineStart(line), c.caret)
+		y := area.y + (line-e.topLine)*lineHeight
+		caret := rect(x-editorCaretWidth/2, y, editorCaretWidth, lineHeight)
+		fillRect(g, caret.intersect(area), editorCaretColor)
+	}
+
+	if e.problem != nil {
+		e.drawProblem(g, lastLine)
+	}
+}
+
+// colorRuns returns the syntax colors for the visible lines, text is the
+// visible part of them as returned by document.lines.
+func (e *editor) colorRuns(text []byte) []colorRun {
+	var runs []colorRun
+	line := e.topLine
+	for {
+		length := bytes.IndexByte(text, '\n')
+		if length == -1 {
+			length = len(text)
+		}
+		for _, r := range e.highlighter.colorRuns(line, length) {
+			runs = appendColorRun(runs, r.length, r.argb)
+		}
+		if length == len(text) {
+			return runs
+		}
+		// the line break between the lines
+		runs = appendColorRun(runs, 1, editorTextColor)
+		text = text[length+1:]
+		line++
+	}
+}
+
+func (e *editor) drawSelection(g graphics, sel selection, line int) {
+	start, end := e.doc.lineStart(line), e.doc.lineEnd(line)
+	from, to := max(sel.start(), start), min(sel.end(), end)
+	y := e.area.y + (line-e.topLine)*g.lineHeight()
+	x0 := e.area.x + e.textWidth(g, start, from)
+	x1 := e.area.x + e.textWidth(g, start, to)
+	if sel.end() > end {
+		// the line break is selected as well, show it as one space
+		space, _ := g.textExtent([]byte{' '})
+		x1 += space
+	}
+	fillRect(
+		g,
+		rect(x0, y, x1-x0, g.lineHeight()).intersect(e.area),
+		editorSelectionColor,
+	)
+}
+
+// textWidth measures the text between the two offsets as it is drawn on
+// screen.
+func (e *editor) textWidth(g graphics, from, to int) int {
+	if to-from > maxVisibleLineLength {
+		to = from + maxVisibleLineLength
+	}
+	w, _ := g.textExtent(e.doc.slice(from, to))
+	return w
+}
+
+// runeBytes returns the UTF-8 encoding of r repeated count times.
+func runeBytes(r rune, count int) []byte {
+	var buf [utf8.UTFMax]byte
+	n := utf8.EncodeRune(buf[:], r)
+	text := make([]byte, 0, n*count)
+	for i := 0; i < count; i++ {
+		text = append(text, buf[:n]...)
+	}
+	return text
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNormalizeCursors(t *testing.T) {
+	tests := []struct {
+		name    string
+		cursors []selection
+		primary int
+		want    []selection
+		// wantPrimary is the index of the primary cursor afterwards
+		wantPrimary int
+	}{
+		{
+			name:        "sorted",
+			cursors:     []selection{{5, 5}, {1, 1}},
+			want:        []selection{{1, 1}, {5, 5}},
+			wantPrimary: 1,
+		},
+		{
+			name:    "overlapping",
+			cursors: []selection{{0, 3}, {2, 6}},
+			primary: 1,
+			want:    []selection{{0, 6}},
+		},
+		{
+			name:    "backwards selections stay backwards",
+			cursors: []selection{{3, 0}, {6, 2}},
+			want:    []selection{{6, 0}},
+		},
+		{
+			name:    "a caret inside a selection",
+			cursors: []selection{{0, 4}, {2, 2}},
+			primary: 1,
+			want:    []selection{{0, 4}},
+		},
+		{
+			name:    "the same caret twice",
+			cursors: []selection{{2, 2}, {2, 2}},
+			want:    []selection{{2, 2}},
+		},
+		{
+			name:        "touching selections",
+			cursors:     []selection{{0, 2}, {2, 4}},
+			primary:     1,
+			want:        []selection{{0, 2}, {2, 4}},
+			wantPrimary: 1,
+		},
+	}
+	for _, tt := range tests {
+		e := newEditor(newDocument([]byte("0123456789")))
+		e.cursors = nil
+		for _, s := range tt.cursors {
+			e.cursors = append(e.cursors, cursor{selection: s, column: -1})
+		}
+		e.primary = tt.primary
+		e.normalizeCursors()
+		if got := e.selections(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: the cursors are %v, want %v", tt.name, got, tt.want)
+		}
+		if e.primary != tt.wantPrimary {
+			t.Errorf("%s: the primary cursor is %d, want %d", tt.name, e.primary, tt.wantPrimary)
+		}
+	}
+}
+
+// carets lists the caret offsets of all cursors.
+func carets(e *editor) []int {
+	var list []int
+	for _, c := range e.cursors {
+		list = append(list, c.caret)
+	}
+	return list
+}
+
+func TestAddCursorVertically(t *testing.T) {
+	now := time.Unix(0, 0)
+	e := newEditor(newDocument([]byte("abcdef\nab\nabcdef")))
+	e.cursors[0].moveTo(5, false)
+	// the new cursors keep the column through the short line
+	e.addCursorVertically(1)
+	e.addCursorVertically(1)
+	e.addCursorVertically(1)
+	if got := carets(e); !reflect.DeepEqual(got, []int{5, 9, 15}) || e.primary != 2 {
+		t.Fatalf("the carets are %v with the primary %d", got, e.primary)
+	}
+
+	// typing and deleting happens at all carets, each in one undo step
+	e.insertText([]byte("X"), typingEdit, now)
+	if got := string(e.doc.bytes()); got != "abcdeXf\nabX\nabcdeXf" {
+		t.Fatalf("typing gives %q", got)
+	}
+	if got := carets(e); !reflect.DeepEqual(got, []int{6, 11, 18}) {
+		t.Errorf("after typing the carets are %v", got)
+	}
+	e.moveLeft(false)
+	e.deleteBackward(now)
+	if got := string(e.doc.bytes()); got != "abcdXf\naX\nabcdXf" {
+		t.Fatalf("deleting gives %q", got)
+	}
+	e.undo()
+	if got := string(e.doc.bytes()); got != "abcdeXf\nabX\nabcdeXf" || len(e.cursors) != 3 {
+		t.Errorf("undoing the deletion gives %q with %d cursors", got, len(e.cursors))
+	}
+	e.undo()
+	if got := string(e.doc.bytes()); got != "abcdef\nab\nabcdef" {
+		t.Errorf("undoing the typing gives %q", got)
+	}
+
+	e.singleCursor()
+	if len(e.cursors) != 1 {
+		t.Errorf("there are still %d cursors", len(e.cursors))
+	}
+	// there is no line above the first
+	e.cursors[0].moveTo(2, false)
+	e.addCursorVertically(-1)
+	if len(e.cursors) != 1 {
+		t.Errorf("adding above the first line gives the carets %v", carets(e))
+	}
+}
+
+func TestAddNextOccurrence(t *testing.T) {
+	e := newEditor(newDocument([]byte("ab\nab cd\nab")))
+	e.cursors[0].moveTo(1, false)
+	// the first time selects the word at the caret, then the next occurrences
+	// are added until all of them are selected
+	for i := 0; i < 4; i++ {
+		e.addNextOccurrence()
+	}
+	want := []selection{{0, 2}, {3, 5}, {9, 11}}
+	if got := e.selections(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("the selections are %v, want %v", e.selections(), want)
+	}
+	e.insertText([]byte("Q"), typingEdit, time.Unix(0, 0))
+	if got := string(e.doc.bytes()); got != "Q\nQ cd\nQ" {
+		t.Errorf("typing over the selections gives %q", got)
+	}
+
+	// the search wraps around at the document end
+	e = newEditor(newDocument([]byte("x y x")))
+	e.cursors[0].moveTo(4, false)
+	e.addNextOccurrence()
+	e.addNextOccurrence()
+	if got := e.selections(); len(got) != 2 || got[0] != (selection{0, 1}) || e.primary != 0 {
+		t.Errorf("the wrapped selections are %v with the primary %d", got, e.primary)
+	}
+}
+
+func TestBoxSelection(t *testing.T) {
+	e := newEditor(newDocument([]byte("abc\nabcdef\nab\nabc")))
+	g := newRecordingGraphics(fixedWidthFont{10, 20})
+	e.draw(g, rect(0, 0, 500, 500))
+	x := editorGutterWidth
+
+	// Alt+drag from column 2 in the first line to column 5 in the last, the
+	// short lines get an empty cursor at their end
+	e.mouseDown(g, x+15, 5, false, false, true)
+	e.mouseMove(g, x+45, 65)
+	e.mouseUp()
+	want := []selection{{2, 3}, {6, 9}, {13, 13}, {16, 17}}
+	if got := e.selections(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("the box selects %v, want %v", got, want)
+	}
+	// the carets are drawn in every line
+	g = newRecordingGraphics(fixedWidthFont{10, 20})
+	e.draw(g, rect(0, 0, 500, 500))
+	caretCount := 0
+	for _, c := range g.displayList() {
+		if c.op == rectOp && c.color == editorCaretColor {
+			caretCount++
+		}
+	}
+	if caretCount != 4 {
+		t.Errorf("%d carets are drawn", caretCount)
+	}
+
+	e.insertText(nil, deletingEdit, time.Unix(0, 0))
+	if got := string(e.doc.bytes()); got != "ab\nabf\nab\nab" {
+		t.Errorf("deleting the box gives %q", got)
+	}
+	e.undo()
+	if got := string(e.doc.bytes()); got != "abc\nabcdef\nab\nabc" {
+		t.Errorf("undoing the deletion gives %q", got)
+	}
+
+	// dragging up works as well and Ctrl+Alt keeps the other cursors
+	e.singleCursor()
+	e.cursors[0].moveTo(0, false)
+	e.mouseDown(g, x+10, 25, false, true, true)
+	e.mouseMove(g, x+10, 5)
+	e.mouseUp()
+	if got := carets(e); !reflect.DeepEqual(got, []int{0, 1, 5}) {
+		t.Errorf("the carets are %v", got)
+	}
+}
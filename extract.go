@@ -0,0 +1,1397 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"go/ast"
+	"go/constant"
+	"go/format"
+	"go/token"
+	"go/types"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// extraction is the selected code of an extract refactoring, together with
+// the type-checked package that contains it.
+type extraction struct {
+	l      *moduleLoader
+	pkg    *loadedPackage
+	file   *ast.File
+	tokens *token.File
+	src    []byte
+	// start and end enclose the selection without surrounding white space
+	start, end token.Pos
+	// path leads from the file to the innermost node that contains the
+	// selection
+	path []ast.Node
+	// decl is the top-level declaration that contains the selection, an
+	// extracted function is placed after it
+	decl ast.Decl
+	// fn is the innermost function whose body contains the selection
+	fn ast.Node
+}
+
+// planExtractFunction moves the selected statements or expression of the Go
+// file at path, with src as its current content, into a new function called
+// name and replaces them with a call. The selection's variables that are
+// declared outside of it become parameters, the ones that the code after it
+// needs are returned. The edits apply to src.
+func planExtractFunction(path string, src []byte, start, end int, name string) ([]replacement, error) {
+	if err := checkNewName(name); err != nil {
+		return nil, err
+	}
+	x, err := newExtraction(path, src, start, end)
+	if err != nil {
+		return nil, err
+	}
+	stmts, block, err := x.statements()
+	if err != nil {
+		return nil, err
+	}
+	if stmts != nil {
+		return x.extractStatements(stmts, block, name)
+	}
+	e, index := x.expression()
+	if e == nil {
+		return nil, errors.New("select complete statements or a single expression")
+	}
+	return x.extractExpression(e, index, name)
+}
+
+// planExtractVariable declares a new variable called name for the selected
+// expression, in front of the statement that contains it, and puts the name
+// in the expression's place.
+func planExtractVariable(path string, src []byte, start, end int, name string) ([]replacement, error) {
+	if err := checkNewName(name); err != nil {
+		return nil, err
+	}
+	x, err := newExtraction(path, src, start, end)
+	if err != nil {
+		return nil, err
+	}
+	e, index := x.expression()
+	if e == nil {
+		if stmts, _, err := x.statements(); err != nil {
+			return nil, err
+		} else if stmts != nil {
+			return nil, errors.New("the selection is a statement, select an expression")
+		}
+		return nil, errors.New("select a single expression")
+	}
+	return x.extractVariable(e, index, name)
+}
+
+func checkNewName(name string) error {
+	if !token.IsIdentifier(name) {
+		return errors.New(strconv.Quote(name) + " is not a valid Go identifier")
+	}
+	if name == "_" || name == "init" {
+		return errors.New(name + " cannot be used as a name")
+	}
+	return nil
+}
+
+func newExtraction(path string, src []byte, start, end int) (*extraction, error) {
+	start, end = clamp(start, 0, len(src)), clamp(end, 0, len(src))
+	for start < end && isSpaceByte(src[start]) {
+		start++
+	}
+	for end > start && isSpaceByte(src[end-1]) {
+		end--
+	}
+	if start == end {
+		return nil, errors.New("select the code to extract first")
+	}
+	path = diagnosticPath(path)
+	l := newModuleLoader(filepath.Dir(path), map[string][]byte{path: src})
+	pkg, f := l.packageOf(path)
+	if f == nil {
+		return nil, errors.New(path + " does not belong to a Go package")
+	}
+	tokens := l.fset.File(f.Pos())
+	if end > tokens.Size() {
+		return nil, errors.New(path + " changed while it was analyzed")
+	}
+	x := &extraction{
+		l:      l,
+		pkg:    pkg,
+		file:   f,
+		tokens: tokens,
+		src:    src,
+		start:  tokens.Pos(start),
+		end:    tokens.Pos(end),
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		if n == nil || n.Pos() > x.start || n.End() < x.end {
+			return false
+		}
+		x.path = append(x.path, n)
+		return true
+	})
+	for _, d := range f.Decls {
+		if d.Pos() <= x.start && x.end <= d.End() {
+			x.decl = d
+		}
+	}
+	for _, n := range x.path {
+		var body *ast.BlockStmt
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			body = n.Body
+		case *ast.FuncLit:
+			body = n.Body
+		}
+		if body != nil && body.Lbrace < x.start && x.end <= body.Rbrace {
+			x.fn = n
+		}
+	}
+	if x.decl == nil || x.fn == nil {
+		return nil, errors.New("the selection is not inside a function")
+	}
+	return x, nil
+}
+
+func isSpaceByte(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
+
+func (x *extraction) offset(pos token.Pos) int {
+	return x.tokens.Offset(pos)
+}
+
+func (x *extraction) text(from, to token.Pos) string {
+	return string(x.src[x.offset(from):x.offset(to)])
+}
+
+// line is the 1-based line number of pos.
+func (x *extraction) line(pos token.Pos) string {
+	return strconv.Itoa(x.tokens.Line(pos))
+}
+
+// inSelection tells if pos is inside the selected code.
+func (x *extraction) inSelection(pos token.Pos) bool {
+	return x.start <= pos && pos < x.end
+}
+
+// statements returns the selected statements if the selection covers
+// complete statements of one block, the block is the node that lists them.
+// It is an error if a statement is only partly selected.
+func (x *extraction) statements() (stmts []ast.Stmt, block ast.Node, err error) {
+	var list []ast.Stmt
+	for _, n := range x.path {
+		switch n := n.(type) {
+		case *ast.BlockStmt:
+			if n.Lbrace < x.start && x.end <= n.Rbrace {
+				list, block = n.List, n
+			}
+		case *ast.CaseClause:
+			if n.Colon < x.start {
+				list, block = n.Body, n
+			}
+		case *ast.CommClause:
+			if n.Colon < x.start {
+				list, block = n.Body, n
+			}
+		}
+	}
+	first, last := -1, -1
+	for i, s := range list {
+		if s.Pos() == x.start {
+			first = i
+		}
+		if s.End() == x.end {
+			last = i
+		}
+		contains := s.Pos() <= x.start && x.end <= s.End()
+		inside := x.start <= s.Pos() && s.End() <= x.end
+		if s.Pos() < x.end && x.start < s.End() && !contains && !inside {
+			return nil, nil, errors.New("the selection covers only part of the statement in line " +
+				x.line(s.Pos()) + ", select complete statements or a single expression")
+		}
+	}
+	if first == -1 || last < first {
+		return nil, nil, nil
+	}
+	return list[first : last+1], block, nil
+}
+
+// expression returns the selected expression and its index in the path. Of
+// nested expressions with the same extent, e.g. in parentheses, the outermost
+// one is used.
+func (x *extraction) expression() (ast.Expr, int) {
+	for i, n := range x.path {
+		if e, ok := n.(ast.Expr); ok && e.Pos() == x.start && e.End() == x.end {
+			return e, i
+		}
+	}
+	return nil, -1
+}
+
+// selectionVars are the local variables that the selected code shares with
+// the rest of its function.
+type selectionVars struct {
+	// params are declared before the selection and used in it, in the order
+	// of their first use
+	params []*types.Var
+	// results are needed after the selection, because it declares or
+	// changes them
+	results []*types.Var
+	// declared tells which results are declared in the selection
+	declared map[*types.Var]bool
+	// receiver is the method's receiver if the selection uses it, the
+	// extracted function becomes a method then
+	receiver *types.Var
+}
+
+// variables finds the local variables of the selected nodes. If canChange is
+// false, the selection must not change any variable that is declared
+// outside of it.
+func (x *extraction) variables(nodes []ast.Node, canChange bool) (*selectionVars, error) {
+	info := x.pkg.info
+	var receiver *types.Var
+	if f, ok := x.decl.(*ast.FuncDecl); ok && f.Recv != nil && len(f.Recv.List[0].Names) > 0 {
+		receiver, _ = info.Defs[f.Recv.List[0].Names[0]].(*types.Var)
+	}
+	inDecl := func(obj types.Object) bool {
+		return x.decl.Pos() <= obj.Pos() && obj.Pos() < x.decl.End()
+	}
+	changed := x.changedVars(nodes)
+	vars := &selectionVars{declared: make(map[*types.Var]bool)}
+	var order []*types.Var
+	seen := make(map[*types.Var]bool)
+	var err error
+	for _, n := range nodes {
+		ast.Inspect(n, func(n ast.Node) bool {
+			id, ok := n.(*ast.Ident)
+			if !ok || err != nil {
+				return err == nil
+			}
+			if obj, ok := info.Defs[id].(*types.Var); ok && !obj.IsField() && !seen[obj] {
+				seen[obj] = true
+				order = append(order, obj)
+			}
+			switch obj := info.Uses[id].(type) {
+			case *types.Var:
+				if obj.IsField() || !inDecl(obj) || x.inSelection(obj.Pos()) || seen[obj] {
+					break
+				}
+				seen[obj] = true
+				order = append(order, obj)
+				if obj == receiver {
+					vars.receiver = obj
+				} else {
+					vars.params = append(vars.params, obj)
+				}
+				if changed[obj] && !canChange {
+					err = errors.New("the selection changes " + obj.Name() + ", which is declared outside of it")
+				}
+			case *types.TypeName, *types.Const:
+				if inDecl(obj) && !x.inSelection(obj.Pos()) {
+					err = errors.New("the selection uses " + obj.Name() +
+						", which is declared in the function, move the declaration out of it first")
+				}
+			}
+			return true
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// everything that the code after the selection sees
+	after := make(map[types.Object]bool)
+	ast.Inspect(x.decl, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok || x.inSelection(id.Pos()) {
+			return true
+		}
+		if obj := info.Uses[id]; obj != nil && x.usedAfter(obj, id.Pos()) {
+			after[obj] = true
+		}
+		return true
+	})
+	for _, v := range order {
+		declared := x.inSelection(v.Pos())
+		if after[v] && (declared || changed[v]) {
+			vars.results = append(vars.results, v)
+			vars.declared[v] = declared
+		}
+	}
+	for _, n := range nodes {
+		ast.Inspect(n, func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok && err == nil {
+				switch obj := info.Defs[id].(type) {
+				case *types.TypeName, *types.Const, *types.Label:
+					if after[obj] {
+						err = errors.New(obj.Name() + " is declared in the selection and used after it")
+					}
+				}
+			}
+			return err == nil
+		})
+	}
+	return vars, err
+}
+
+// usedAfter tells if a use of obj at pos, outside the selection, can see a
+// value that the selection assigned. That is the case for uses after the
+// selection and in a loop around it.
+func (x *extraction) usedAfter(obj types.Object, pos token.Pos) bool {
+	if pos >= x.end {
+		return true
+	}
+	if _, ok := obj.(*types.Label); ok {
+		return true
+	}
+	for _, n := range x.path {
+		switch n.(type) {
+		case *ast.ForStmt, *ast.RangeStmt:
+			if n.Pos() <= pos && obj.Pos() < n.Pos() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// changedVars finds the variables that the nodes assign to or take the
+// address of, including calls of methods with pointer receivers.
+func (x *extraction) changedVars(nodes []ast.Node) map[*types.Var]bool {
+	info := x.pkg.info
+	changed := make(map[*types.Var]bool)
+	var mark func(e ast.Expr)
+	mark = func(e ast.Expr) {
+		switch e := e.(type) {
+		case *ast.Ident:
+			if v, ok := info.Uses[e].(*types.Var); ok {
+				changed[v] = true
+			}
+		case *ast.ParenExpr:
+			mark(e.X)
+		case *ast.SelectorExpr:
+			if sel := info.Selections[e]; sel != nil && sel.Kind() == types.FieldVal && !sel.Indirect() {
+				if _, ok := info.TypeOf(e.X).Underlying().(*types.Pointer); !ok {
+					mark(e.X)
+				}
+			}
+		case *ast.IndexExpr:
+			if t := info.TypeOf(e.X); t != nil {
+				if _, ok := t.Underlying().(*types.Array); ok {
+					mark(e.X)
+				}
+			}
+		}
+	}
+	for _, n := range nodes {
+		ast.Inspect(n, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.AssignStmt:
+				for _, e := range n.Lhs {
+					mark(e)
+				}
+			case *ast.IncDecStmt:
+				mark(n.X)
+			case *ast.RangeStmt:
+				if n.Tok == token.ASSIGN {
+					if n.Key != nil {
+						mark(n.Key)
+					}
+					if n.Value != nil {
+						mark(n.Value)
+					}
+				}
+			case *ast.UnaryExpr:
+				if n.Op == token.AND {
+					mark(n.X)
+				}
+			case *ast.SelectorExpr:
+				sel := info.Selections[n]
+				if sel == nil || sel.Kind() != types.MethodVal {
+					break
+				}
+				recv := sel.Obj().Type().(*types.Signature).Recv()
+				if recv == nil {
+					break
+				}
+				if _, ok := recv.Type().(*types.Pointer); !ok {
+					break
+				}
+				if t := info.TypeOf(n.X); t != nil {
+					if _, ok := t.Underlying().(*types.Pointer); !ok {
+						mark(n.X)
+					}
+				}
+			}
+			return true
+		})
+	}
+	return changed
+}
+
+// controlFlow checks that the statements do not jump out of the selection,
+// other than by returning. It counts the returns, errorReturns are the ones
+// that return zero values and an error that is not nil.
+func (x *extraction) controlFlow(stmts []ast.Stmt) (returns []*ast.ReturnStmt, errorReturns int, err error) {
+	info := x.pkg.info
+	for _, s := range stmts {
+		var stack []ast.Node
+		ast.Inspect(s, func(n ast.Node) bool {
+			if err != nil {
+				return false
+			}
+			if n == nil {
+				stack = stack[:len(stack)-1]
+				return true
+			}
+			if _, ok := n.(*ast.FuncLit); ok {
+				return false
+			}
+			switch n := n.(type) {
+			case *ast.ReturnStmt:
+				returns = append(returns, n)
+				if x.isErrorReturn(n, stack) {
+					errorReturns++
+				}
+			case *ast.DeferStmt:
+				err = errors.New("the selection contains a defer statement in line " +
+					x.line(n.Pos()) + ", which would run when the new function returns")
+			case *ast.BranchStmt:
+				if n.Label != nil {
+					if obj := info.Uses[n.Label]; obj != nil && !x.inSelection(obj.Pos()) {
+						err = errors.New("the " + n.Tok.String() + " in line " + x.line(n.Pos()) +
+							" leaves the selection")
+					}
+					break
+				}
+				found := false
+				for _, outer := range stack {
+					switch outer.(type) {
+					case *ast.ForStmt, *ast.RangeStmt:
+						found = true
+					case *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+						found = found || n.Tok == token.BREAK
+					case *ast.CaseClause:
+						found = found || n.Tok == token.FALLTHROUGH
+					}
+				}
+				if !found {
+					err = errors.New("the " + n.Tok.String() + " in line " + x.line(n.Pos()) +
+						" leaves the selection")
+				}
+			}
+			stack = append(stack, n)
+			return true
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return returns, errorReturns, nil
+}
+
+// isErrorReturn tells if ret returns zero values and an error that is known
+// not to be nil: a new error or a variable that was just checked. stack
+// holds the nodes around ret.
+func (x *extraction) isErrorReturn(ret *ast.ReturnStmt, stack []ast.Node) bool {
+	info := x.pkg.info
+	sig := x.signature()
+	if sig == nil || sig.Results().Len() == 0 || len(ret.Results) != sig.Results().Len() ||
+		!isErrorType(sig.Results().At(sig.Results().Len()-1).Type()) {
+		return false
+	}
+	for _, e := range ret.Results[:len(ret.Results)-1] {
+		if !isZeroValue(info, e) {
+			return false
+		}
+	}
+	switch e := unparen(ret.Results[len(ret.Results)-1]).(type) {
+	case *ast.CallExpr:
+		var id *ast.Ident
+		switch fun := e.Fun.(type) {
+		case *ast.SelectorExpr:
+			id = fun.Sel
+		case *ast.Ident:
+			id = fun
+		}
+		if f, ok := info.Uses[id].(*types.Func); ok && f.Pkg() != nil {
+			name := f.Pkg().Path() + "." + f.Name()
+			return name == "errors.New" || name == "fmt.Errorf"
+		}
+	case *ast.UnaryExpr:
+		return e.Op == token.AND
+	case *ast.Ident:
+		v := info.Uses[e]
+		for i := len(stack) - 1; i >= 0; i-- {
+			s, ok := stack[i].(*ast.IfStmt)
+			if !ok || !(s.Body.Pos() <= ret.Pos() && ret.End() <= s.Body.End()) {
+				continue
+			}
+			cond, ok := s.Cond.(*ast.BinaryExpr)
+			if !ok || cond.Op != token.NEQ {
+				continue
+			}
+			if id, ok := cond.X.(*ast.Ident); ok && v != nil && info.Uses[id] == v && info.Types[cond.Y].IsNil() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isErrorType(t types.Type) bool {
+	return types.Identical(t, types.Universe.Lookup("error").Type())
+}
+
+// isZeroValue tells if e is written as the zero value of its type.
+func isZeroValue(info *types.Info, e ast.Expr) bool {
+	tv := info.Types[e]
+	if tv.IsNil() {
+		return true
+	}
+	if tv.Value != nil {
+		switch tv.Value.Kind() {
+		case constant.Bool:
+			return !constant.BoolVal(tv.Value)
+		case constant.String:
+			return constant.StringVal(tv.Value) == ""
+		case constant.Int, constant.Float, constant.Complex:
+			return constant.Sign(tv.Value) == 0
+		}
+	}
+	lit, ok := unparen(e).(*ast.CompositeLit)
+	return ok && len(lit.Elts) == 0
+}
+
+func unparen(e ast.Expr) ast.Expr {
+	for {
+		p, ok := e.(*ast.ParenExpr)
+		if !ok {
+			return e
+		}
+		e = p.X
+	}
+}
+
+// signature is the type of the innermost function around the selection.
+func (x *extraction) signature() *types.Signature {
+	var t types.Type
+	switch fn := x.fn.(type) {
+	case *ast.FuncDecl:
+		if obj := x.pkg.info.Defs[fn.Name]; obj != nil {
+			t = obj.Type()
+		}
+	case *ast.FuncLit:
+		t = x.pkg.info.TypeOf(fn)
+	}
+	sig, _ := t.(*types.Signature)
+	return sig
+}
+
+// scope returns the scope of a block, case clause or function body.
+func (x *extraction) scope(block ast.Node) *types.Scope {
+	if s := x.pkg.info.Scopes[block]; s != nil {
+		return s
+	}
+	// a function body shares the scope of the parameters
+	for _, n := range x.path {
+		var ft *ast.FuncType
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			if n.Body == block {
+				ft = n.Type
+			}
+		case *ast.FuncLit:
+			if n.Body == block {
+				ft = n.Type
+			}
+		}
+		if ft != nil {
+			return x.pkg.info.Scopes[ft]
+		}
+	}
+	return x.pkg.types.Scope().Innermost(block.Pos())
+}
+
+// typeString writes t the way the selection's file refers to it. Types from
+// packages that the file does not import and types that are declared in the
+// function cannot be written.
+func (x *extraction) typeString(t types.Type) (string, error) {
+	if b, ok := t.(*types.Basic); ok {
+		if b.Kind() == types.Invalid {
+			return "", errors.New("the selection has type errors, fix them first")
+		}
+		t = types.Default(t)
+	}
+	missing := ""
+	s := types.TypeString(t, func(p *types.Package) string {
+		if p == x.pkg.types {
+			return ""
+		}
+		for _, spec := range x.file.Imports {
+			if importPath(spec) != p.Path() {
+				continue
+			}
+			if spec.Name == nil {
+				return p.Name()
+			}
+			if spec.Name.Name == "." {
+				return ""
+			}
+			if spec.Name.Name != "_" {
+				return spec.Name.Name
+			}
+		}
+		missing = p.Path()
+		return p.Name()
+	})
+	if missing != "" {
+		return "", errors.New("the type " + s + " is from package " + missing + ", which " +
+			filepath.Base(x.tokens.Name()) + " does not import")
+	}
+	if name := x.localType(t); name != "" {
+		return "", errors.New("the type " + name + " is declared in the function, move it out of it first")
+	}
+	return s, nil
+}
+
+// localType returns the name of a type in t that is declared inside the
+// selection's declaration, or "" if there is none.
+func (x *extraction) localType(t types.Type) string {
+	switch t := t.(type) {
+	case interface{ Elem() types.Type }:
+		if m, ok := t.(*types.Map); ok {
+			if name := x.localType(m.Key()); name != "" {
+				return name
+			}
+		}
+		return x.localType(t.Elem())
+	case *types.Struct:
+		for i := 0; i < t.NumFields(); i++ {
+			if name := x.localType(t.Field(i).Type()); name != "" {
+				return name
+			}
+		}
+	case *types.Signature:
+		for _, tuple := range []*types.Tuple{t.Params(), t.Results()} {
+			for i := 0; i < tuple.Len(); i++ {
+				if name := x.localType(tuple.At(i).Type()); name != "" {
+					return name
+				}
+			}
+		}
+	case interface{ Obj() *types.TypeName }:
+		if obj := t.Obj(); x.decl.Pos() <= obj.Pos() && obj.Pos() < x.decl.End() {
+			return obj.Name()
+		}
+	}
+	return ""
+}
+
+// zeroValue writes the zero value of t.
+func (x *extraction) zeroValue(t types.Type) (string, error) {
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		switch {
+		case u.Info()&types.IsBoolean != 0:
+			return "false", nil
+		case u.Info()&types.IsString != 0:
+			return `""`, nil
+		case u.Info()&types.IsNumeric != 0:
+			return "0", nil
+		}
+	case *types.Struct, *types.Array:
+		s, err := x.typeString(t)
+		return s + "{}", err
+	}
+	return "nil", nil
+}
+
+// newFunction is the declaration of an extracted function.
+type newFunction struct {
+	name string
+	// receiver is the method's receiver as written in the source, e.g.
+	// "(s *server)", it is empty for a function
+	receiver string
+	recvName string
+	params   []*types.Var
+	results  []types.Type
+	// body holds the statements, indented by one tab
+	body string
+}
+
+// function prepares the declaration of the function called name that takes
+// the selection's variables. The name must not be in use where the call is.
+func (x *extraction) function(name string, vars *selectionVars, block ast.Node) (*newFunction, error) {
+	f := &newFunction{name: name, params: vars.params}
+	if types.Universe.Lookup(name) != nil {
+		return nil, errors.New(name + " is predeclared in Go, choose another name")
+	}
+	if recv := vars.receiver; recv != nil {
+		decl := x.decl.(*ast.FuncDecl)
+		f.receiver = x.text(decl.Recv.Pos(), decl.Recv.End())
+		f.recvName = recv.Name()
+		if obj, _, _ := types.LookupFieldOrMethod(recv.Type(), true, x.pkg.types, name); obj != nil {
+			return nil, errors.New(types.TypeString(recv.Type(), types.RelativeTo(x.pkg.types)) +
+				" already has a field or method " + name)
+		}
+		return f, nil
+	}
+	if x.pkg.types.Scope().Lookup(name) != nil {
+		return nil, errors.New(name + " is already declared in package " + x.pkg.types.Name())
+	}
+	for _, file := range x.pkg.files {
+		for _, spec := range file.Imports {
+			imported := path.Base(importPath(spec))
+			if spec.Name != nil {
+				imported = spec.Name.Name
+			} else {
+				for _, p := range x.pkg.types.Imports() {
+					if p.Path() == importPath(spec) {
+						imported = p.Name()
+					}
+				}
+			}
+			if imported == name {
+				return nil, errors.New(name + " is the name of an imported package")
+			}
+		}
+	}
+	inner := x.pkg.types.Scope().Innermost(x.start)
+	if block != nil {
+		inner = x.scope(block)
+	}
+	if inner != nil {
+		if s, _ := inner.LookupParent(name, x.start); s != nil && s != x.pkg.types.Scope() && s != types.Universe {
+			return nil, errors.New(name + " is already declared where the function would be called")
+		}
+	}
+	return f, nil
+}
+
+// declaration writes the function, gofmt-formatted.
+func (x *extraction) declaration(f *newFunction) (string, error) {
+	var b strings.Builder
+	b.WriteString("func ")
+	if f.receiver != "" {
+		b.WriteString(f.receiver + " ")
+	}
+	b.WriteString(f.name + "(")
+	for i, p := range f.params {
+		t, err := x.typeString(p.Type())
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(p.Name())
+		if i+1 < len(f.params) && types.Identical(p.Type(), f.params[i+1].Type()) {
+			b.WriteString(", ")
+			continue
+		}
+		b.WriteString(" " + t)
+		if i+1 < len(f.params) {
+			b.WriteString(", ")
+		}
+	}
+	b.WriteString(")")
+	var results []string
+	for _, r := range f.results {
+		t, err := x.typeString(r)
+		if err != nil {
+			return "", err
+		}
+		results = append(results, t)
+	}
+	if len(results) == 1 {
+		b.WriteString(" " + results[0])
+	} else if len(results) > 1 {
+		b.WriteString(" (" + strings.Join(results, ", ") + ")")
+	}
+	b.WriteString(" {\n" + f.body + "}")
+	if formatted, err := format.Source([]byte(b.String())); err == nil {
+		return string(formatted), nil
+	}
+	return b.String(), nil
+}
+
+// call writes the call of f with the selection's variables.
+func (f *newFunction) call() string {
+	var args []string
+	for _, p := range f.params {
+		args = append(args, p.Name())
+	}
+	call := f.name + "(" + strings.Join(args, ", ") + ")"
+	if f.recvName != "" {
+		call = f.recvName + "." + call
+	}
+	return call
+}
+
+// insertion is the edit that places the declaration after the selection's
+// top-level declaration, behind a comment that might end its line.
+func (x *extraction) insertion(decl string) replacement {
+	at := x.offset(x.decl.End())
+	if i := bytes.IndexByte(x.src[at:], '\n'); i != -1 {
+		at += i
+	} else {
+		at = len(x.src)
+	}
+	return replacement{offset: at, text: []byte("\n\n" + decl)}
+}
+
+// indentation is the white space at the start of the line that contains pos.
+func (x *extraction) indentation(pos token.Pos) string {
+	offset := x.offset(pos)
+	start := bytes.LastIndexByte(x.src[:offset], '\n') + 1
+	end := start
+	for end < offset && (x.src[end] == ' ' || x.src[end] == '\t') {
+		end++
+	}
+	return string(x.src[start:end])
+}
+
+// body moves the selected statements one tab deep and applies the edits,
+// which are relative to the source. Lines in raw strings are kept.
+func (x *extraction) body(stmts []ast.Stmt, edits []replacement) string {
+	from, to := x.offset(x.start), x.offset(x.end)
+	indent := x.indentation(x.start)
+	var raw [][2]int
+	for _, s := range stmts {
+		ast.Inspect(s, func(n ast.Node) bool {
+			if lit, ok := n.(*ast.BasicLit); ok && strings.HasPrefix(lit.Value, "`") {
+				raw = append(raw, [2]int{x.offset(lit.Pos()), x.offset(lit.End())})
+			}
+			return true
+		})
+	}
+	inRaw := func(offset int) bool {
+		for _, r := range raw {
+			if r[0] < offset && offset < r[1] {
+				return true
+			}
+		}
+		return false
+	}
+	inEdit := func(offset int) bool {
+		for _, e := range edits {
+			if e.offset <= offset && offset < e.offset+e.count {
+				return true
+			}
+		}
+		return false
+	}
+	all := []replacement{{offset: from, text: []byte("\t")}}
+	for i := from; i < to; i++ {
+		if x.src[i] != '\n' || inRaw(i+1) || inEdit(i+1) {
+			continue
+		}
+		line := i + 1
+		end := line
+		for end < to && (x.src[end] == ' ' || x.src[end] == '\t') {
+			end++
+		}
+		switch {
+		case end == to || x.src[end] == '\n' || x.src[end] == '\r':
+			all = append(all, replacement{offset: line, count: end - line})
+		case strings.HasPrefix(string(x.src[line:end]), indent):
+			all = append(all, replacement{offset: line, count: len(indent), text: []byte("\t")})
+		default:
+			all = append(all, replacement{offset: line, text: []byte("\t")})
+		}
+	}
+	for _, e := range edits {
+		i := len(all)
+		for i > 0 && all[i-1].offset > e.offset {
+			i--
+		}
+		all = append(all[:i], append([]replacement{e}, all[i:]...)...)
+	}
+	for i := range all {
+		all[i].offset -= from
+	}
+	return string(applyEdits(x.src[from:to], all)) + "\n"
+}
+
+// assignment writes the statements that assign the results of call to the
+// variables names, declaring the new ones.
+func (x *extraction) assignment(names []string, isNew []bool, list []types.Type, call string) ([]string, error) {
+	newCount := 0
+	for _, n := range isNew {
+		if n {
+			newCount++
+		}
+	}
+	lhs := strings.Join(names, ", ")
+	switch newCount {
+	case 0:
+		return []string{lhs + " = " + call}, nil
+	case len(names):
+		return []string{lhs + " := " + call}, nil
+	}
+	var lines []string
+	for i, name := range names {
+		if isNew[i] {
+			t, err := x.typeString(list[i])
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, "var "+name+" "+t)
+		}
+	}
+	return append(lines, lhs+" = "+call), nil
+}
+
+// extractStatements moves the statements into a new function. If they
+// return, they must either end the function, or only return errors, which
+// the call then checks.
+func (x *extraction) extractStatements(stmts []ast.Stmt, block ast.Node, name string) ([]replacement, error) {
+	returns, errorReturns, err := x.controlFlow(stmts)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []ast.Node
+	for _, s := range stmts {
+		nodes = append(nodes, s)
+	}
+	vars, err := x.variables(nodes, true)
+	if err != nil {
+		return nil, err
+	}
+	f, err := x.function(name, vars, block)
+	if err != nil {
+		return nil, err
+	}
+	sig := x.signature()
+	if sig == nil {
+		return nil, errors.New("the selection has type errors, fix them first")
+	}
+	endsFunction := false
+	switch fn := x.fn.(type) {
+	case *ast.FuncDecl:
+		endsFunction = fn.Body == block && fn.Body.List[len(fn.Body.List)-1] == stmts[len(stmts)-1]
+	case *ast.FuncLit:
+		endsFunction = fn.Body == block && fn.Body.List[len(fn.Body.List)-1] == stmts[len(stmts)-1]
+	}
+	indent := x.indentation(x.start)
+	var calls []string
+
+	switch {
+	case len(returns) == 0:
+		for _, v := range vars.results {
+			f.results = append(f.results, v.Type())
+		}
+		f.body = x.body(stmts, nil)
+		if len(vars.results) == 0 {
+			calls = []string{f.call()}
+			break
+		}
+		var names []string
+		var isNew []bool
+		for _, v := range vars.results {
+			names = append(names, v.Name())
+			isNew = append(isNew, vars.declared[v])
+		}
+		f.body += "\treturn " + strings.Join(names, ", ") + "\n"
+		if calls, err = x.assignment(names, isNew, f.results, f.call()); err != nil {
+			return nil, err
+		}
+
+	case endsFunction:
+		// the call's results are returned as they are
+		for _, r := range returns {
+			if len(r.Results) == 0 && sig.Results().Len() > 0 {
+				return nil, errors.New("the return in line " + x.line(r.Pos()) +
+					" has no values, name the results to extract it")
+			}
+		}
+		for i := 0; i < sig.Results().Len(); i++ {
+			f.results = append(f.results, sig.Results().At(i).Type())
+		}
+		f.body = x.body(stmts, nil)
+		calls = []string{f.call()}
+		if len(f.results) > 0 {
+			calls[0] = "return " + calls[0]
+		}
+
+	case errorReturns == len(returns):
+		// the new function returns the results and an error, every return
+		// of the selection returns the error with zero results
+		var zeros []string
+		for _, v := range vars.results {
+			f.results = append(f.results, v.Type())
+			zero, err := x.zeroValue(v.Type())
+			if err != nil {
+				return nil, err
+			}
+			zeros = append(zeros, zero)
+		}
+		f.results = append(f.results, types.Universe.Lookup("error").Type())
+		var edits []replacement
+		for _, r := range returns {
+			last := r.Results[len(r.Results)-1]
+			text := strings.Join(zeros, ", ")
+			if text != "" {
+				text += ", "
+			}
+			edits = append(edits, replacement{
+				offset: x.offset(r.Results[0].Pos()),
+				count:  x.offset(last.Pos()) - x.offset(r.Results[0].Pos()),
+				text:   []byte(text),
+			})
+		}
+		f.body = x.body(stmts, edits)
+		first := returns[0]
+		outerZeros := ""
+		for _, e := range first.Results[:len(first.Results)-1] {
+			outerZeros += x.text(e.Pos(), e.End()) + ", "
+		}
+		var names []string
+		var isNew []bool
+		taken := make(map[string]bool)
+		for _, v := range vars.results {
+			names = append(names, v.Name())
+			isNew = append(isNew, vars.declared[v])
+			taken[v.Name()] = true
+		}
+		errName := "err"
+		for i := 2; taken[errName]; i++ {
+			errName = "err" + strconv.Itoa(i)
+		}
+		if _, isReturn := stmts[len(stmts)-1].(*ast.ReturnStmt); !isReturn {
+			f.body += "\treturn " + strings.Join(append(names, "nil"), ", ") + "\n"
+		}
+		check := []string{
+			"if " + errName + " != nil {",
+			"\treturn " + outerZeros + errName,
+			"}",
+		}
+		if len(names) == 0 {
+			check[0] = "if " + errName + " := " + f.call() + "; " + errName + " != nil {"
+			calls = check
+			break
+		}
+		// an err of the same block is assigned, unless it is declared after
+		// the selection, where it must not exist yet
+		scope := x.scope(block)
+		s, obj := scope.LookupParent(errName, x.start)
+		exists := s == scope && obj != nil
+		later := func() bool {
+			obj := scope.Lookup(errName)
+			return obj != nil && obj.Pos() >= x.end
+		}
+		for i := 2; !exists && later(); i++ {
+			errName = "err" + strconv.Itoa(i)
+			check = []string{
+				"if " + errName + " != nil {",
+				"\treturn " + outerZeros + errName,
+				"}",
+			}
+		}
+		calls, err = x.assignment(append(names, errName), append(isNew, !exists), f.results, f.call())
+		if err != nil {
+			return nil, err
+		}
+		calls = append(calls, check...)
+
+	default:
+		return nil, errors.New("the return in line " + x.line(returns[0].Pos()) +
+			" can only be extracted if it returns an error or if the selection ends the function")
+	}
+
+	decl, err := x.declaration(f)
+	if err != nil {
+		return nil, err
+	}
+	return []replacement{
+		{
+			offset: x.offset(x.start),
+			count:  x.offset(x.end) - x.offset(x.start),
+			text:   []byte(strings.Join(calls, "\n"+indent)),
+		},
+		x.insertion(decl),
+	}, nil
+}
+
+// valueTypes checks that the expression at path[index] is a value that can be
+// replaced by a call or a variable and returns its types, there are several
+// for a call with multiple results.
+func (x *extraction) valueTypes(e ast.Expr, index int) ([]types.Type, error) {
+	tv, ok := x.pkg.info.Types[e]
+	switch {
+	case !ok || tv.Type == nil:
+		return nil, errors.New("the selection is not a value")
+	case tv.IsType():
+		return nil, errors.New("the selection is a type, not a value")
+	case tv.IsVoid() || !tv.IsValue():
+		return nil, errors.New("the selection has no value")
+	case tv.IsNil():
+		return nil, errors.New("nil cannot be extracted, it has no type")
+	}
+	if lit, ok := e.(*ast.CompositeLit); ok && lit.Type == nil {
+		return nil, errors.New("the composite literal has no type, select the surrounding one")
+	}
+	if a, ok := e.(*ast.TypeAssertExpr); ok && a.Type == nil {
+		return nil, errors.New("the type switch guard cannot be extracted")
+	}
+	for i := index - 1; i >= 0; i-- {
+		child := x.path[i+1]
+		switch n := x.path[i].(type) {
+		case *ast.GenDecl:
+			if n.Tok == token.CONST {
+				return nil, errors.New("constant declarations can only use constants")
+			}
+		case *ast.ArrayType:
+			if n.Len == child {
+				return nil, errors.New("array lengths can only use constants")
+			}
+		}
+	}
+	commaOk := func(lhs int, rhs []ast.Expr) error {
+		if lhs == 2 && len(rhs) == 1 && rhs[0] == e && tv.HasOk() {
+			return errors.New("the selection is used with two results")
+		}
+		return nil
+	}
+	switch parent := x.path[index-1].(type) {
+	case *ast.AssignStmt:
+		for _, l := range parent.Lhs {
+			if l == e {
+				return nil, errors.New("the selection is assigned to")
+			}
+		}
+		if err := commaOk(len(parent.Lhs), parent.Rhs); err != nil {
+			return nil, err
+		}
+	case *ast.ValueSpec:
+		if err := commaOk(len(parent.Names), parent.Values); err != nil {
+			return nil, err
+		}
+	case *ast.IncDecStmt:
+		return nil, errors.New("the selection is assigned to")
+	case *ast.RangeStmt:
+		if parent.Key == e || parent.Value == e {
+			return nil, errors.New("the selection is assigned to")
+		}
+	case *ast.UnaryExpr:
+		if parent.Op == token.AND {
+			return nil, errors.New("the address of the selection is taken")
+		}
+	}
+	if tuple, ok := tv.Type.(*types.Tuple); ok {
+		var list []types.Type
+		for i := 0; i < tuple.Len(); i++ {
+			list = append(list, tuple.At(i).Type())
+		}
+		return list, nil
+	}
+	return []types.Type{tv.Type}, nil
+}
+
+// extractExpression moves the expression into a new function that returns
+// its value.
+func (x *extraction) extractExpression(e ast.Expr, index int, name string) ([]replacement, error) {
+	results, err := x.valueTypes(e, index)
+	if err != nil {
+		return nil, err
+	}
+	vars, err := x.variables([]ast.Node{e}, false)
+	if err != nil {
+		return nil, err
+	}
+	f, err := x.function(name, vars, nil)
+	if err != nil {
+		return nil, err
+	}
+	f.results = results
+	f.body = "\treturn " + x.text(x.start, x.end) + "\n"
+	decl, err := x.declaration(f)
+	if err != nil {
+		return nil, err
+	}
+	return []replacement{
+		{
+			offset: x.offset(x.start),
+			count:  x.offset(x.end) - x.offset(x.start),
+			text:   []byte(f.call()),
+		},
+		x.insertion(decl),
+	}, nil
+}
+
+// extractVariable declares the variable in front of the statement that
+// contains the expression. The expression must be evaluated exactly once by
+// the statement, the same as by the variable declaration.
+func (x *extraction) extractVariable(e ast.Expr, index int, name string) ([]replacement, error) {
+	results, err := x.valueTypes(e, index)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) > 1 {
+		return nil, errors.New("the selection has " + strconv.Itoa(len(results)) + " values")
+	}
+	if _, ok := x.path[index-1].(*ast.ExprStmt); ok {
+		return nil, errors.New("the selection is a statement, its value is not used")
+	}
+	var stmt ast.Stmt
+	var block ast.Node
+	for i := index - 1; i >= 0 && stmt == nil; i-- {
+		child := x.path[i+1]
+		switch n := x.path[i].(type) {
+		case *ast.BinaryExpr:
+			if (n.Op == token.LAND || n.Op == token.LOR) && n.Y == child {
+				return nil, errors.New("the selection is only evaluated depending on the left side of " +
+					n.Op.String() + ", select the whole condition")
+			}
+		case *ast.ForStmt:
+			if n.Cond == child || n.Post == child {
+				return nil, errors.New("the selection is evaluated in every iteration of the loop")
+			}
+		case *ast.IfStmt:
+			if n.Else == child {
+				return nil, errors.New("the selection is evaluated only if the condition in line " +
+					x.line(n.Pos()) + " is false")
+			}
+		case *ast.GoStmt:
+			if n.Call == child {
+				return nil, errors.New("the selection is the call of a go statement")
+			}
+		case *ast.DeferStmt:
+			if n.Call == child {
+				return nil, errors.New("the selection is the call of a defer statement")
+			}
+		case *ast.CaseClause:
+			if !containsStmt(n.Body, child) {
+				return nil, errors.New("the selection is evaluated only if the cases before it do not match")
+			}
+			stmt, block = child.(ast.Stmt), n
+		case *ast.CommClause:
+			if !containsStmt(n.Body, child) {
+				return nil, errors.New("the selection is evaluated only if the cases before it are not ready")
+			}
+			stmt, block = child.(ast.Stmt), n
+		case *ast.BlockStmt:
+			stmt, block = child.(ast.Stmt), n
+		}
+	}
+	if stmt == nil {
+		return nil, errors.New("the selection is not inside a statement")
+	}
+
+	info := x.pkg.info
+	err = nil
+	ast.Inspect(e, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && err == nil {
+			if v, ok := info.Uses[id].(*types.Var); ok && stmt.Pos() <= v.Pos() && v.Pos() < x.start {
+				err = errors.New("the selection uses " + v.Name() + ", which is declared in the statement in line " +
+					x.line(stmt.Pos()))
+			}
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if scope := x.scope(block); scope != nil && scope.Lookup(name) != nil {
+		return nil, errors.New(name + " is already declared in this block")
+	}
+	// selected fields, methods and qualified names cannot be hidden
+	selectors := make(map[*ast.Ident]bool)
+	ast.Inspect(block, func(n ast.Node) bool {
+		if s, ok := n.(*ast.SelectorExpr); ok {
+			selectors[s.Sel] = true
+		}
+		return true
+	})
+	ast.Inspect(block, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok || err != nil || id.Name != name || id.Pos() < stmt.Pos() || selectors[id] {
+			return err == nil
+		}
+		if v, ok := info.Uses[id].(*types.Var); ok && v.IsField() {
+			return true
+		}
+		if obj := info.Uses[id]; obj != nil && !(stmt.Pos() <= obj.Pos() && obj.Pos() < block.End()) {
+			err = errors.New("the new variable would hide the " + name + " used in line " + x.line(id.Pos()))
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// an untyped constant gets the type of its use, which may not be the one
+	// that it has on its own
+	declaration := name + " := " + x.text(x.start, x.end)
+	alone, err := types.Eval(x.l.fset, x.pkg.types, x.start, x.text(x.start, x.end))
+	if err != nil || !types.Identical(results[0], types.Default(alone.Type)) {
+		t, err := x.typeString(results[0])
+		if err != nil {
+			return nil, err
+		}
+		declaration = "var " + name + " " + t + " = " + x.text(x.start, x.end)
+	}
+	return []replacement{
+		{
+			offset: x.offset(stmt.Pos()),
+			text:   []byte(declaration + "\n" + x.indentation(stmt.Pos())),
+		},
+		{
+			offset: x.offset(x.start),
+			count:  x.offset(x.end) - x.offset(x.start),
+			text:   []byte(name),
+		},
+	}, nil
+}
+
+func containsStmt(list []ast.Stmt, n ast.Node) bool {
+	for _, s := range list {
+		if s == n {
+			return true
+		}
+	}
+	return false
+}
+
+// registerExtractCommands registers the commands that extract the selection
+// of the app's editor.
+func registerExtractCommands(r *commandRegistry, a *app) {
+	r.register("editor.extractFunction", func(*editor) {
+		a.startExtract("Function name: ", "extracted", planExtractFunction)
+	})
+	r.register("editor.extractVariable", func(*editor) {
+		a.startExtract("Variable name: ", "value", planExtractVariable)
+	})
+}
+
+// startExtract asks for the name of the new function or variable and plans
+// the extraction in the background. Its edits are applied as one undo step.
+func (a *app) startExtract(label, name string, plan func(path string, src []byte, start, end int, name string) ([]replacement, error)) {
+	e := a.editor
+	if e == nil || !isGoFile(a.path) || a.extracting.running {
+		return
+	}
+	selected := e.primaryCursor().selection
+	if selected.empty() {
+		a.platform.showError("Extract", "select the code to extract first")
+		return
+	}
+	path := a.path
+	src := e.doc.bytes()
+	a.showPrompt(label, name, func(name string) {
+		a.extracting.start(func() func() {
+			edits, err := plan(path, src, selected.start(), selected.end(), name)
+			return func() {
+				if err == nil && (a.editor == nil || a.path != path || !bytes.Equal(a.editor.doc.bytes(), src)) {
+					err = errors.New(filepath.Base(path) + " was changed, please extract again")
+				}
+				if err != nil {
+					a.platform.showError("Extract", err.Error())
+					return
+				}
+				a.editor.applyReplacements(otherEdit, edits, a.platform.now())
+			}
+		})
+		a.platform.startTimer(extractTimer, extractPoll)
+	})
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// selectionMarkers removes the markers « and » from src and returns the
+// offsets of the selection between them.
+func selectionMarkers(src string) (string, int, int) {
+	start := strings.Index(src, "«")
+	src = strings.Replace(src, "«", "", 1)
+	end := strings.Index(src, "»")
+	src = strings.Replace(src, "»", "", 1)
+	return src, start, end
+}
+
+// writeExtractModule creates a module for the file ex.go and returns the
+// file's path. The tests write the file before each extraction.
+func writeExtractModule(t *testing.T) (path string, cleanUp func()) {
+	dir, err := ioutil.TempDir("", "extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/ex\n"), 0666)
+	return filepath.Join(dir, "ex.go"), func() { os.RemoveAll(dir) }
+}
+
+func TestExtractFunction(t *testing.T) {
+	path, cleanUp := writeExtractModule(t)
+	defer cleanUp()
+	tests := []struct {
+		name string
+		src  string
+		// newName is the name of the new function
+		newName string
+		want    string
+	}{
+		{
+			name: "free variables become parameters",
+			src: `package ex
+
+func f(a, b int) int {
+	c := 1
+	«println(a + c)
+	println(b)»
+	return c
+}
+`,
+			newName: "show",
+			want: `package ex
+
+func f(a, b int) int {
+	c := 1
+	show(a, c, b)
+	return c
+}
+
+func show(a, c, b int) {
+	println(a + c)
+	println(b)
+}
+`,
+		},
+		{
+			name: "variables used later are returned",
+			src: `package ex
+
+func sum(list []int) int {
+	«total := 0
+	count := 0
+	for _, v := range list {
+		total += v
+		count++
+	}»
+	return total / count
+}
+`,
+			newName: "add",
+			want: `package ex
+
+func sum(list []int) int {
+	total, count := add(list)
+	return total / count
+}
+
+func add(list []int) (int, int) {
+	total := 0
+	count := 0
+	for _, v := range list {
+		total += v
+		count++
+	}
+	return total, count
+}
+`,
+		},
+		{
+			name: "changed variables are assigned",
+			src: `package ex
+
+func grow() int {
+	x := 1
+	«x *= 2
+	x++»
+	return x
+}
+`,
+			newName: "double",
+			want: `package ex
+
+func grow() int {
+	x := 1
+	x = double(x)
+	return x
+}
+
+func double(x int) int {
+	x *= 2
+	x++
+	return x
+}
+`,
+		},
+		{
+			name: "a method's receiver",
+			src: `package ex
+
+type counter struct{ n int }
+
+func (c *counter) add(d int) { c.n += d }
+
+func (c *counter) twice(d int) {
+	«c.add(d)
+	c.add(d)»
+}
+`,
+			newName: "both",
+			want: `package ex
+
+type counter struct{ n int }
+
+func (c *counter) add(d int) { c.n += d }
+
+func (c *counter) twice(d int) {
+	c.both(d)
+}
+
+func (c *counter) both(d int) {
+	c.add(d)
+	c.add(d)
+}
+`,
+		},
+		{
+			name: "error returns inside the selection",
+			src: `package ex
+
+import "errors"
+
+func check(a, b int) error {
+	«if a < 0 {
+		return errors.New("a")
+	}
+	if b < 0 {
+		return errors.New("b")
+	}»
+	return nil
+}
+`,
+			newName: "validate",
+			want: `package ex
+
+import "errors"
+
+func check(a, b int) error {
+	if err := validate(a, b); err != nil {
+		return err
+	}
+	return nil
+}
+
+func validate(a, b int) error {
+	if a < 0 {
+		return errors.New("a")
+	}
+	if b < 0 {
+		return errors.New("b")
+	}
+	return nil
+}
+`,
+		},
+		{
+			name: "error returns and a result",
+			src: `package ex
+
+import "strconv"
+
+func load(s string) (int, error) {
+	«n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}»
+	return n * 2, nil
+}
+`,
+			newName: "parse",
+			want: `package ex
+
+import "strconv"
+
+func load(s string) (int, error) {
+	n, err := parse(s)
+	if err != nil {
+		return 0, err
+	}
+	return n * 2, nil
+}
+
+func parse(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+`,
+		},
+		{
+			name: "the selection ends with the function's return",
+			src: `package ex
+
+func sign(x int) string {
+	if x == 0 {
+		return "zero"
+	}
+	«if x < 0 {
+		return "neg"
+	}
+	return "pos"»
+}
+`,
+			newName: "nonZero",
+			want: `package ex
+
+func sign(x int) string {
+	if x == 0 {
+		return "zero"
+	}
+	return nonZero(x)
+}
+
+func nonZero(x int) string {
+	if x < 0 {
+		return "neg"
+	}
+	return "pos"
+}
+`,
+		},
+		{
+			name: "an expression",
+			src: `package ex
+
+import "strconv"
+
+func label(n int) string {
+	return «strconv.Itoa(n*2) + "!"»
+}
+`,
+			newName: "text",
+			want: `package ex
+
+import "strconv"
+
+func label(n int) string {
+	return text(n)
+}
+
+func text(n int) string {
+	return strconv.Itoa(n*2) + "!"
+}
+`,
+		},
+	}
+	for _, tt := range tests {
+		src, start, end := selectionMarkers(tt.src)
+		ioutil.WriteFile(path, []byte(src), 0666)
+		edits, err := planExtractFunction(path, []byte(src), start, end, tt.newName)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := string(applyEdits([]byte(src), edits)); got != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExtractFunctionErrors(t *testing.T) {
+	path, cleanUp := writeExtractModule(t)
+	defer cleanUp()
+	tests := []struct {
+		name    string
+		src     string
+		newName string
+		err     string
+	}{
+		{
+			name: "a selection that cuts across statements",
+			src: `package ex
+
+func grow() int {
+	x := 1
+	«x *= 2
+	x»++
+	return x
+}
+`,
+			newName: "double",
+			err:     "covers only part of the statement in line 6",
+		},
+		{
+			name: "a return that is not an error return",
+			src: `package ex
+
+func sign(x int) string {
+	«if x < 0 {
+		return "neg"
+	}»
+	return "pos"
+}
+`,
+			newName: "negative",
+			err:     "can only be extracted if it returns an error",
+		},
+		{
+			name: "a break out of the selection",
+			src: `package ex
+
+func loop() {
+	for i := 0; i < 10; i++ {
+		«if i > 3 {
+			break
+		}»
+	}
+}
+`,
+			newName: "stop",
+			err:     "the break in line 6 leaves the selection",
+		},
+		{
+			name: "a name that is taken",
+			src: `package ex
+
+func f() {
+	«println()»
+}
+`,
+			newName: "f",
+			err:     "already declared in package ex",
+		},
+		{
+			name: "an invalid name",
+			src: `package ex
+
+func f() {
+	«println()»
+}
+`,
+			newName: "2x",
+			err:     "not a valid Go identifier",
+		},
+		{
+			name: "nothing selected",
+			src: `package ex
+
+func f() {
+	«»println()
+}
+`,
+			newName: "g",
+			err:     "select the code to extract first",
+		},
+		{
+			name: "outside of a function",
+			src: `package ex
+
+var «x» = 1
+`,
+			newName: "g",
+			err:     "not inside a function",
+		},
+	}
+	for _, tt := range tests {
+		src, start, end := selectionMarkers(tt.src)
+		ioutil.WriteFile(path, []byte(src), 0666)
+		_, err := planExtractFunction(path, []byte(src), start, end, tt.newName)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: the error is %v, want one with %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestExtractVariable(t *testing.T) {
+	path, cleanUp := writeExtractModule(t)
+	defer cleanUp()
+	tests := []struct {
+		name    string
+		src     string
+		newName string
+		want    string
+		err     string
+	}{
+		{
+			name: "an expression in a call",
+			src: `package ex
+
+func f(total, avg int) {
+	println(«total*2» + avg)
+}
+`,
+			newName: "doubled",
+			want: `package ex
+
+func f(total, avg int) {
+	doubled := total*2
+	println(doubled + avg)
+}
+`,
+		},
+		{
+			name: "an untyped constant keeps the expression's type",
+			src: `package ex
+
+func f() float64 {
+	x := 1.5
+	return x * «2»
+}
+`,
+			newName: "two",
+			want: `package ex
+
+func f() float64 {
+	x := 1.5
+	var two float64 = 2
+	return x * two
+}
+`,
+		},
+		{
+			name: "a case clause",
+			src: `package ex
+
+func f(n int) {
+	switch n {
+	case 1:
+		println(«n+1»)
+	}
+}
+`,
+			newName: "next",
+			want: `package ex
+
+func f(n int) {
+	switch n {
+	case 1:
+		next := n+1
+		println(next)
+	}
+}
+`,
+		},
+		{
+			name: "a condition of a loop",
+			src: `package ex
+
+func f(s string) {
+	for i := 0; i < «len(s)»; i++ {
+	}
+}
+`,
+			newName: "n",
+			err:     "every iteration",
+		},
+		{
+			name: "the right side of &&",
+			src: `package ex
+
+type counter struct{ n int }
+
+func f(p *counter) bool {
+	return p != nil && «p.n > 0»
+}
+`,
+			newName: "positive",
+			err:     "depending on the left side of &&",
+		},
+		{
+			name: "a statement",
+			src: `package ex
+
+func f() int {
+	«x := 1»
+	return x
+}
+`,
+			newName: "y",
+			err:     "the selection is a statement",
+		},
+	}
+	for _, tt := range tests {
+		src, start, end := selectionMarkers(tt.src)
+		ioutil.WriteFile(path, []byte(src), 0666)
+		edits, err := planExtractVariable(path, []byte(src), start, end, tt.newName)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: the error is %v, want one with %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := string(applyEdits([]byte(src), edits)); got != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
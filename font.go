@@ -0,0 +1,446 @@
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gonutz/binpacker"
+	"github.com/gonutz/truetype"
+)
+
+// fontAtlas renders the glyphs of a font on demand and packs them into one
+// gray image. It does not depend on any graphics API, the graphics
+// implementations copy the glyphs from it to the screen.
+type fontAtlas struct {
+	// source renders the glyphs, usually of a TrueType font
+	source glyphSource
+	// gray is a size-by-size gray image containing all glyphs in one image,
+	// packed by the packer. It is stored as a flat array.
+	// version is incremented whenever gray changes so users of the atlas can
+	// tell if they need to update their copies of it, e.g. in a texture.
+	gray    []byte
+	size    int
+	packer  *binpacker.Packer
+	version int
+	// ascend, descend and lineGap are the vertical metrics of the font
+	// - ascend : height above the baseline to which the font can extend
+	// - descend: height below the baseline to which the font can extend
+	// - lineGap: additional space between two lines
+	// ascend and lineGap are >= 0 and descend is <= 0
+	//
+	// here is an illustration with the letters: A p
+	//
+	// line -> -----------------------   ---
+	// start        xx                    |
+	//             x  x                   |
+	//             x  x                   |
+	//            x    x                  | ascend
+	//            xxxxxx     xxxxx        |
+	//           x      x    x    x       |
+	// base      x      x    x    x       |
+	// line -> -x--------x---xxxx-----   ---
+	//                       x            |
+	//                       x            | descend
+	//                       x            |
+	//         -----------------------   ---
+	// next                               | line gap
+	// line -> -----------------------   ---
+	// start
+	ascend, descend, lineGap int
+	// glyphs grows depending on demanded glyphs, it is indexed with the values
+	// from runeToGlyphIndex
+	glyphs           []glyph
+	runeToGlyphIndex map[rune]int
+}
+
+type glyph struct {
+	// x, y, width and height are the glyph's pixels in the atlas image
+	x, y, width, height int
+	// advance is the distance to the right that the cursor needs to be advanced
+	// after this glyph
+	advance int
+	// xOffset and yOffset are the offset to render this glyph, relative to the
+	// current cursor position
+	xOffset, yOffset int
+}
+
+// glyphSource provides the glyphs of a font at one size, all measures are in
+// pixels.
+type glyphSource interface {
+	verticalMetrics() (ascend, descend, lineGap int)
+	// glyphIndex returns the font-internal index of the rune's glyph, 0 if
+	// the font does not have one
+	glyphIndex(r rune) int
+	// renderGlyph returns the glyph's gray image of width by height pixels
+	// and how it is placed relative to the cursor
+	renderGlyph(index int) (pixels []byte, width, height, advance, xOffset, yOffset int)
+	// kerning is the extra space between the two characters
+	kerning(a, b rune) int
+}
+
+// truetypeGlyphs is a TrueType font scaled to a pixel height.
+type truetypeGlyphs struct {
+	info  *truetype.FontInfo
+	scale float64
+}
+
+func (t truetypeGlyphs) verticalMetrics() (ascend, descend, lineGap int) {
+	a, d, g := t.info.GetFontVMetrics()
+	return round(float64(a) * t.scale), round(float64(d) * t.scale), round(float64(g) * t.scale)
+}
+
+func (t truetypeGlyphs) glyphIndex(r rune) int {
+	return t.info.FindGlyphIndex(int(r))
+}
+
+func (t truetypeGlyphs) renderGlyph(index int) (pixels []byte, width, height, advance, xOffset, yOffset int) {
+	pixels, width, height = t.info.GetGlyphBitmapSubpixel(
+		0, t.scale, 0, 0, index, 0, 0,
+	)
+	unscaledAdvance, _ := t.info.GetGlyphHMetrics(index)
+	xOffset, yOffset, _, _ = t.info.GetGlyphBitmapBox(index, t.scale, t.scale)
+	return pixels, width, height, round(float64(unscaledAdvance) * t.scale), xOffset, yOffset
+}
+
+func (t truetypeGlyphs) kerning(a, b rune) int {
+	return round(t.scale * float64(t.info.GetCodepointKernAdvance(int(a), int(b))))
+}
+
+func newFontAtlas(ttf []byte, heightPix int) (*fontAtlas, error) {
+	info, err := truetype.InitFont(ttf, 0)
+	if err != nil {
+		return nil, makeErr("unable to decode TTF font data", err)
+	}
+	scale := info.ScaleForPixelHeight(float64(heightPix))
+	return newFontAtlasFrom(truetypeGlyphs{info: info, scale: scale})
+}
+
+// newFontAtlasFrom creates an atlas for the glyphs of source.
+func newFontAtlasFrom(source glyphSource) (*fontAtlas, error) {
+	const initialSize = 128
+	f := &fontAtlas{
+		source:           source,
+		packer:           binpacker.New(initialSize, initialSize),
+		gray:             make([]byte, initialSize*initialSize),
+		size:             initialSize,
+		runeToGlyphIndex: make(map[rune]int),
+	}
+	f.ascend, f.descend, f.lineGap = source.verticalMetrics()
+
+	// glyph 0 is the font's replacement for missing characters
+	if _, err := f.addGlyph(0); err != nil {
+		return nil, makeErr("add nil glyph", err)
+	}
+
+	return f, nil
+}
+
+// addGlyph renders the glyph with the given font-internal index into the
+// atlas and returns its index in f.glyphs.
+func (f *fontAtlas) addGlyph(glyphIndex int) (int, error) {
+	pixels, width, height, advance, xOffset, yOffset := f.source.renderGlyph(glyphIndex)
+
+	rect, err := f.packer.Insert(width, height)
+	for err == binpacker.ErrNoMoreSpace {
+		f.resize(f.size * 2)
+		rect, err = f.packer.Insert(width, height)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			f.gray[rect.X+x+(rect.Y+y)*f.size] = pixels[x+y*width]
+		}
+	}
+	f.version++
+
+	f.glyphs = append(f.glyphs, glyph{
+		x:       rect.X,
+		y:       rect.Y,
+		width:   rect.Width,
+		height:  rect.Height,
+		advance: advance,
+		xOffset: xOffset,
+		yOffset: yOffset,
+	})
+	return len(f.glyphs) - 1, nil
+}
+
+func (f *fontAtlas) resize(newSize int) {
+	oldSize := f.size
+
+	if newSize <= oldSize {
+		return
+	}
+
+	// copy over the old gray image line by line, the glyphs keep their pixel
+	// positions
+	oldGray := f.gray
+	newGray := make([]byte, newSize*newSize)
+	for y := 0; y < oldSize; y++ {
+		copy(
+			newGray[y*newSize:],
+			oldGray[y*oldSize:(y+1)*oldSize],
+		)
+	}
+
+	// update packer so that it knows the new size
+	err := f.packer.Enlarge(newSize, newSize)
+	if err != nil {
+		// this is expected to never happen
+		panic(err)
+	}
+
+	f.size = newSize
+	f.gray = newGray
+	f.version++
+}
+
+func (f *fontAtlas) getGlyph(r rune) *glyph {
+	if i, ok := f.runeToGlyphIndex[r]; ok {
+		return &f.glyphs[i]
+	}
+
+	// add the glyph
+
+	glyphIndex := f.source.glyphIndex(r)
+	if glyphIndex == 0 {
+		f.runeToGlyphIndex[r] = 0
+		return &f.glyphs[0]
+	}
+
+	index, err := f.addGlyph(glyphIndex)
+	if err != nil {
+		// this is never expected to happen
+		panic("cannot resize bin packer")
+	}
+	f.runeToGlyphIndex[r] = index
+
+	return &f.glyphs[index]
+}
+
+func (f *fontAtlas) xSpaceBetween(a, b rune) int {
+	return f.source.kerning(a, b)
+}
+
+func (f *fontAtlas) lineHeight() int {
+	return f.ascend - f.descend + f.lineGap
+}
+
+func (f *fontAtlas) textHeight() int {
+	return f.ascend - f.descend
+}
+
+// singleLineExtend is for text input that is known to be only one line, the
+// calculation can then ignore all vertical offsets
+func (f *fontAtlas) singleLineExtent(text []byte) (width, height int) {
+	if len(text) == 0 {
+		return
+	}
+
+	x := 0
+	var last rune
+
+	i := 0
+	for i < len(text) {
+		character, size := utf8.DecodeRune(text[i:])
+		i += size
+
+		if character == ' ' || character == '\t' {
+			glyph := f.getGlyph(character)
+			if character == '\t' {
+				x += glyph.advance * 4
+			} else {
+				x += glyph.advance
+			}
+			last = 0
+			continue
+		}
+
+		if unicode.IsControl(character) {
+			last = 0
+			continue
+		}
+
+		glyph := f.getGlyph(character)
+
+		if last != 0 {
+			x += f.xSpaceBetween(last, character)
+		}
+
+		x += glyph.advance
+		last = character
+	}
+
+	width = x
+	height = f.ascend - f.descend
+
+	return
+}
+
+func (f *fontAtlas) extent(text []byte) (width, height int) {
+	if len(text) == 0 {
+		return
+	}
+
+	x := 0
+	var last rune
+	lineCount := 1
+
+	i := 0
+	for i < len(text) {
+		character, size := utf8.DecodeRune(text[i:])
+		i += size
+
+		if character == '\n' {
+			if x > width {
+				width = x
+			}
+			lineCount++
+			last = 0
+			x = 0
+			continue
+		}
+
+		if character == ' ' || character == '\t' {
+			glyph := f.getGlyph(character)
+			if character == '\t' {
+				x += glyph.advance * 4
+			} else {
+				x += glyph.advance
+			}
+			last = 0
+			continue
+		}
+
+		if unicode.IsControl(character) {
+			last = 0
+			continue
+		}
+
+		glyph := f.getGlyph(character)
+
+		if last != 0 {
+			x += f.xSpaceBetween(last, character)
+		}
+
+		x += glyph.advance
+		last = character
+	}
+	// handle the last line
+	if x > width {
+		width = x
+	}
+
+	height = lineCount*f.lineHeight() - f.lineGap
+
+	return
+}
+
+// glyphQuad is a glyph placed on the screen. It covers the screen rectangle
+// dest and shows the atlas pixels of the same size starting at srcX, srcY.
+// offset is the byte offset of the glyph's character in the text.
+type glyphQuad struct {
+	dest       rectangle
+	srcX, srcY int
+	offset     int
+}
+
+// layoutText places the glyphs of text, starting at textX, textY, and calls
+// draw for every glyph that is visible inside clip. The quads are already
+// clipped. All graphics implementations lay out text this way so they put the
+// same glyphs at the same pixels.
+func (f *fontAtlas) layoutText(text []byte, textX, textY int, clip rectangle, draw func(q glyphQuad)) {
+	x, y := textX, textY
+	right, bottom := clip.x+clip.w, clip.y+clip.h
+	var last rune
+
+	i := 0
+
+	// first skip all lines that are not visible
+	lineHeight := f.lineHeight()
+	maxInvisibleY := clip.y - lineHeight
+	for i < len(text) && y < maxInvisibleY {
+		for i < len(text) {
+			character, size := utf8.DecodeRune(text[i:])
+			i += size
+			if character == '\n' {
+				y += lineHeight
+				break
+			}
+		}
+	}
+
+	for i < len(text) {
+		offset := i
+		character, size := utf8.DecodeRune(text[i:])
+		i += size
+
+		if character == '\n' {
+			x = textX
+			y += lineHeight
+			last = 0
+			continue
+		}
+
+		if character == ' ' || character == '\t' {
+			glyph := f.getGlyph(character)
+			if character == '\t' {
+				x += glyph.advance * 4
+			} else {
+				x += glyph.advance
+			}
+			last = 0
+			continue
+		}
+
+		if unicode.IsControl(character) {
+			last = 0
+			continue
+		}
+
+		glyph := f.getGlyph(character)
+
+		if last != 0 {
+			x += f.xSpaceBetween(last, character)
+		}
+		x += glyph.xOffset
+		y := y + f.ascend + glyph.yOffset
+
+		// clip partially visible glyphs
+		q := glyphQuad{
+			dest:   rect(x, y, glyph.width, glyph.height).intersect(clip),
+			srcX:   glyph.x,
+			srcY:   glyph.y,
+			offset: offset,
+		}
+		if q.dest.w > 0 && q.dest.h > 0 {
+			q.srcX += q.dest.x - x
+			q.srcY += q.dest.y - y
+			draw(q)
+		}
+
+		if y-f.ascend > bottom {
+			// if we are already below the given screen rectangle we can stop
+			break
+		}
+
+		if x > right {
+			// we are right of the given screen rectangle so skip the rest of
+			// the line
+			for i < len(text) && character != '\n' {
+				character, size = utf8.DecodeRune(text[i:])
+				i += size
+			}
+			if i >= len(text) {
+				break
+			}
+			i -= size // give the line break back for the next processing step
+		}
+
+		x += glyph.advance - glyph.xOffset
+		last = character
+	}
+}
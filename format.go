@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"go/format"
+	"go/scanner"
+	"strconv"
+	"unicode/utf8"
+)
+
+// problem is an error in the document that the editor shows until the next
+// edit, e.g. a syntax error found while formatting. offset is the byte offset
+// of the error or -1 if it has no location.
+type problem struct {
+	offset  int
+	message string
+}
+
+const (
+	problemColor     = 0xFFE51400
+	problemTextColor = 0xFFFFFFFF
+)
+
+// format formats the document with go/format and applies the result as one
+// undo step. Only the text that gofmt changes is replaced so the cursors stay
+// where they are relative to the text around them. If the source cannot be
+// parsed, the error is shown in the editor and returned.
+func (e *editor) format() error {
+	src := e.doc.bytes()
+	formatted, err := format.Source(src)
+	if err != nil {
+		e.showProblem(problemFromError(e.doc, err))
+		return err
+	}
+	e.applyReplacements(otherEdit, minimalReplacements(src, formatted), e.now())
+	return nil
+}
+
+// problemFromError places the first error of a scanner.ErrorList in the
+// document. Other errors have no location.
+func problemFromError(doc *document, err error) problem {
+	list, ok := err.(scanner.ErrorList)
+	if !ok || len(list) == 0 {
+		return problem{offset: -1, message: err.Error()}
+	}
+	first := list[0]
+	return problem{
+		offset: doc.lineColToOffset(first.Pos.Line-1, first.Pos.Column-1),
+		message: strconv.Itoa(first.Pos.Line) + ":" +
+			strconv.Itoa(first.Pos.Column) + ": " + first.Msg,
+	}
+}
+
+// showProblem shows p in the editor and scrolls to its location.
+func (e *editor) showProblem(p problem) {
+	e.problem = &p
+	if p.offset >= 0 {
+		e.scrollToLine(e.doc.lineOf(p.offset))
+	}
+	e.changed()
+}
+
+// drawProblem frames the character at the problem location and shows the
+// message in a bar at the bottom of the editor.
+func (e *editor) drawProblem(g graphics, lastLine int) {
+	p := e.problem
+	lineHeight := g.lineHeight()
+	line := e.doc.lineOf(max(0, p.offset))
+	if p.offset >= 0 && e.topLine <= line && line <= lastLine {
+		start := e.doc.lineStart(line)
+		x := e.area.x + e.textWidth(g, start, p.offset)
+		y := e.area.y + (line-e.topLine)*lineHeight
+		end := min(p.offset+runeLengthAt(e.doc, p.offset), e.doc.lineEnd(line))
+		w := e.textWidth(g, p.offset, end)
+		if w == 0 {
+			// at the end of the line, frame a space-sized box
+			w, _ = g.textExtent([]byte{' '})
+		}
+		box := rect(x, y, w, lineHeight)
+		for _, r := range []rectangle{
+			rect(box.x-1, box.y, box.w+2, 1),
+			rect(box.x-1, box.y+box.h-1, box.w+2, 1),
+			rect(box.x-1, box.y, 1, box.h),
+			rect(box.x+box.w, box.y, 1, box.h),
+		} {
+			fillRect(g, r.intersect(e.area), problemColor)
+		}
+	}
+	bar := rect(e.area.x, e.area.y+e.area.h-lineHeight, e.area.w, lineHeight)
+	bar = bar.intersect(e.area)
+	fillRect(g, bar, problemColor)
+	g.text([]byte(p.message), bar.x+4, bar.y, bar, problemTextColor)
+}
+
+// runeLengthAt returns the byte length of the character at offset.
+func runeLengthAt(doc *document, offset int) int {
+	var buf [utf8.UTFMax]byte
+	n := doc.readAt(buf[:], offset)
+	_, size := utf8.DecodeRune(buf[:n])
+	return size
+}
+
+// minimalReplacements returns the changes that turn old into new, sorted by
+// offset. Lines are compared first, then every changed block of lines is
+// narrowed down to the bytes that actually differ.
+func minimalReplacements(old, new []byte) []replacement {
+	a, b := splitLines(old), splitLines(new)
+	oldOffsets, newOffsets := lineOffsets(a), lineOffsets(b)
+	var changes []replacement
+	for _, h := range diffLines(a, b) {
+		oldOffset, newOffset := oldOffsets[h.oldStart], newOffsets[h.newStart]
+		from := old[oldOffset:oldOffsets[h.oldEnd]]
+		to := new[newOffset:newOffsets[h.newEnd]]
+		prefix := commonPrefix(from, to)
+		from, to = from[prefix:], to[prefix:]
+		suffix := commonSuffix(from, to)
+		from, to = from[:len(from)-suffix], to[:len(to)-suffix]
+		changes = append(changes, replacement{
+			offset: oldOffset + prefix,
+			count:  len(from),
+			text:   append([]byte(nil), to...),
+		})
+	}
+	return changes
+}
+
+// splitLines splits text after every line break, the lines keep their line
+// breaks.
+func splitLines(text []byte) [][]byte {
+	var lines [][]byte
+	for len(text) > 0 {
+		end := bytes.IndexByte(text, '\n') + 1
+		if end == 0 {
+			end = len(text)
+		}
+		lines = append(lines, text[:end])
+		text = text[end:]
+	}
+	return lines
+}
+
+// lineOffsets returns the start offset of every line and, as the last entry,
+// the end of the text.
+func lineOffsets(lines [][]byte) []int {
+	offsets := make([]int, len(lines)+1)
+	for i, line := range lines {
+		offsets[i+1] = offsets[i] + len(line)
+	}
+	return offsets
+}
+
+func commonPrefix(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+func commonSuffix(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[len(a)-1-n] == b[len(b)-1-n] {
+		n++
+	}
+	return n
+}
+
+// diffHunk says that the old lines [oldStart, oldEnd) are replaced by the new
+// lines [newStart, newEnd).
+type diffHunk struct {
+	oldStart, oldEnd int
+	newStart, newEnd int
+}
+
+// maxDiffEdits limits the work of diffLines. Texts that differ in more lines
+// than this are treated as one big change.
+const maxDiffEdits = 2000
+
+// diffLines finds the hunks of a shortest edit script from a to b with
+// Myers' algorithm. Equal lines at the start and end are skipped first since
+// formatting usually changes only a few places in a file.
+func diffLines(a, b [][]byte) []diffHunk {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && bytes.Equal(a[prefix], b[prefix]) {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		bytes.Equal(a[len(a)-1-suffix], b[len(b)-1-suffix]) {
+		suffix++
+	}
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	n, m := len(a), len(b)
+	if n == 0 && m == 0 {
+		return nil
+	}
+	everything := []diffHunk{{prefix, prefix + n, prefix, prefix + m}}
+
+	// v[k] is the furthest x reached on diagonal k = x-y. trace[d] is a copy
+	// of v[-d-1..d+1] before step d, these are the entries that step d reads.
+	maxEdits := min(n+m, maxDiffEdits)
+	v := make([]int, 2*maxEdits+3)
+	at := func(v []int, base, k int) int { return v[k-base] }
+	var trace [][]int
+	found := false
+	for d := 0; d <= maxEdits && !found; d++ {
+		trace = append(trace, append([]int(nil), v[maxEdits-d:maxEdits+d+3]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[maxEdits+1+k-1] < v[maxEdits+1+k+1] {
+				x = v[maxEdits+1+k+1] // down, an insertion
+			} else {
+				x = v[maxEdits+1+k-1] + 1 // right, a deletion
+			}
+			y := x - k
+			for x < n && y < m && bytes.Equal(a[x], b[y]) {
+				x++
+				y++
+			}
+			v[maxEdits+1+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return everything
+	}
+
+	// walk back from the end to mark the lines that are kept
+	keptA := make([]bool, n)
+	keptB := make([]bool, m)
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		snapshot, base := trace[d], -d-1
+		k := x - y
+		prevK := k - 1
+		if k == -d || k != d && at(snapshot, base, k-1) < at(snapshot, base, k+1) {
+			prevK = k + 1
+		}
+		prevX := at(snapshot, base, prevK)
+		prevY := prevX - prevK
+		if d == 0 {
+			prevX, prevY = 0, 0
+		}
+		for x > prevX && y > prevY {
+			x--
+			y--
+			keptA[x] = true
+			keptB[y] = true
+		}
+		x, y = prevX, prevY
+	}
+
+	// consecutive changed lines form one hunk
+	var hunks []diffHunk
+	i, j := 0, 0
+	for i < n || j < m {
+		if i < n && j < m && keptA[i] && keptB[j] {
+			i++
+			j++
+			continue
+		}
+		h := diffHunk{oldStart: prefix + i, newStart: prefix + j}
+		for i < n && !keptA[i] {
+			i++
+		}
+		for j < m && !keptB[j] {
+			j++
+		}
+		h.oldEnd, h.newEnd = prefix+i, prefix+j
+		hunks = append(hunks, h)
+	}
+	return hunks
+}
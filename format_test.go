@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMinimalReplacements(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		want     []replacement
+	}{
+		{"equal", "a\nb\n", "a\nb\n", nil},
+		{"empty", "", "", nil},
+		{"within a line", "a\nb  := 1\nc\n", "a\nb := 1\nc\n",
+			[]replacement{{offset: 4, count: 1, text: []byte{}}}},
+		{"a new line", "a\nc\n", "a\nb\nc\n",
+			[]replacement{{offset: 2, count: 0, text: []byte("b\n")}}},
+		{"a removed line", "a\nb\nc\n", "a\nc\n",
+			[]replacement{{offset: 2, count: 2, text: []byte{}}}},
+		{"two places", "x:=1\ny\nz:=2\n", "x := 1\ny\nz := 2\n", []replacement{
+			{offset: 1, count: 2, text: []byte(" := ")},
+			{offset: 8, count: 2, text: []byte(" := ")},
+		}},
+		{"the end of the text", "a\nb", "a\nb\n",
+			[]replacement{{offset: 3, count: 0, text: []byte("\n")}}},
+	}
+	for _, tt := range tests {
+		changes := minimalReplacements([]byte(tt.old), []byte(tt.new))
+		if len(changes) != len(tt.want) {
+			t.Errorf("%s: the replacements are %+v, want %+v", tt.name, changes, tt.want)
+			continue
+		}
+		for i, c := range changes {
+			w := tt.want[i]
+			if c.offset != w.offset || c.count != w.count || !bytes.Equal(c.text, w.text) {
+				t.Errorf("%s: replacement %d is %+v, want %+v", tt.name, i, c, w)
+			}
+		}
+		if got := string(applyEdits([]byte(tt.old), changes)); got != tt.new {
+			t.Errorf("%s: the replacements give %q", tt.name, got)
+		}
+	}
+}
+
+func TestMinimalReplacementsReproduceTheText(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	pieces := []string{"a\n", "b\n", "c", "\n", "xy\n", "\t", " "}
+	random := func() []byte {
+		var b []byte
+		for i := r.Intn(30); i > 0; i-- {
+			b = append(b, pieces[r.Intn(len(pieces))]...)
+		}
+		return b
+	}
+	for i := 0; i < 5000; i++ {
+		old, new := random(), random()
+		changes := minimalReplacements(old, new)
+		for j := 1; j < len(changes); j++ {
+			if changes[j].offset < changes[j-1].offset+changes[j-1].count {
+				t.Fatalf("the replacements of %q -> %q overlap: %+v", old, new, changes)
+			}
+		}
+		if got := applyEdits(old, changes); !bytes.Equal(got, new) {
+			t.Fatalf("%q -> %q gives %q", old, new, got)
+		}
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	lines := func(s string) [][]byte { return splitLines([]byte(s)) }
+	tests := []struct {
+		a, b string
+		want []diffHunk
+	}{
+		{"a\nb\nc\n", "a\nb\nc\n", nil},
+		{"a\nb\nc\n", "a\nx\nc\n", []diffHunk{{1, 2, 1, 2}}},
+		{"a\nb\nc\nd\n", "b\nc\nd\ne\n", []diffHunk{{0, 1, 0, 0}, {4, 4, 3, 4}}},
+		{"a\nb\n", "", []diffHunk{{0, 2, 0, 0}}},
+		{"", "a\n", []diffHunk{{0, 0, 0, 1}}},
+	}
+	for _, tt := range tests {
+		got := diffLines(lines(tt.a), lines(tt.b))
+		if len(got) != len(tt.want) {
+			t.Errorf("%q -> %q gives the hunks %v, want %v", tt.a, tt.b, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%q -> %q gives the hunks %v, want %v", tt.a, tt.b, got, tt.want)
+				break
+			}
+		}
+	}
+
+	// too many differences are one big change
+	var a, b strings.Builder
+	for i := 0; i < maxDiffEdits; i++ {
+		a.WriteString("a\n")
+		b.WriteString("b\n")
+	}
+	got := diffLines(lines(a.String()), lines(b.String()))
+	if len(got) != 1 || got[0] != (diffHunk{0, maxDiffEdits, 0, maxDiffEdits}) {
+		t.Errorf("completely different texts give the hunks %v", got)
+	}
+}
+
+func TestFormatKeepsTheCursor(t *testing.T) {
+	src := "package p\nfunc f( ) {\nx:=1\n_ = x\n}\n"
+	e := newEditor(newDocument([]byte(src)))
+	caret := strings.Index(src, "_ =")
+	e.setSelections([]selection{{anchor: caret, caret: caret}})
+	if err := e.format(); err != nil {
+		t.Fatal(err)
+	}
+	want := "package p\n\nfunc f() {\n\tx := 1\n\t_ = x\n}\n"
+	if got := string(e.doc.bytes()); got != want {
+		t.Fatalf("the formatted text is %q", got)
+	}
+	if c := e.primaryCursor().caret; c != strings.Index(want, "_ =") {
+		t.Errorf("the caret moved to %d", c)
+	}
+	// formatting is one undo step
+	e.undo()
+	if got := string(e.doc.bytes()); got != src {
+		t.Errorf("undo gives %q", got)
+	}
+}
+
+func TestFormatSyntaxError(t *testing.T) {
+	src := "package p\nfunc f() {\n\tx := \n}\n"
+	e := newEditor(newDocument([]byte(src)))
+	if err := e.format(); err == nil {
+		t.Fatal("the syntax error was formatted")
+	}
+	if e.problem == nil || e.problem.offset != strings.Index(src, "}") ||
+		!strings.HasPrefix(e.problem.message, "4:1:") {
+		t.Fatalf("the problem is %+v", e.problem)
+	}
+	if string(e.doc.bytes()) != src {
+		t.Error("the text changed")
+	}
+	// the next edit hides the problem
+	e.insertText([]byte("1"), typingEdit, time.Unix(0, 0))
+	if e.problem != nil {
+		t.Error("the problem stays after an edit")
+	}
+}
+
+func TestFormatOnSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "format")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.go")
+	ioutil.WriteFile(path, []byte("package a\nvar  x = 1\nvar y = x\n"), 0666)
+
+	s := newScenario(t)
+	d := s.driver
+	d.app.settings.FormatOnSave = true
+	s.openFile(path)
+	// the caret is in front of y, which moves with the formatting
+	d.keys("Down Down Right Right Right Right")
+	d.keys("Ctrl+S")
+	want := "package a\n\nvar x = 1\nvar y = x\n"
+	if got := s.fileContent(path); got != want {
+		t.Fatalf("the saved file is %q", got)
+	}
+	e := d.editor()
+	if c := e.primaryCursor().caret; c != strings.Index(want, "y =") {
+		t.Errorf("the caret moved to %d", c)
+	}
+	if e.history.isModified() {
+		t.Error("the formatted file is modified")
+	}
+
+	// a syntax error saves the file as it is
+	d.typeText("(")
+	d.keys("Ctrl+S")
+	if got := s.fileContent(path); got != "package a\n\nvar x = 1\nvar (y = x\n" || e.problem == nil {
+		t.Errorf("the file with the syntax error is saved as %q", got)
+	}
+}
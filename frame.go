@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// frameScheduler collects the screen regions that need to be redrawn. Nothing
+// is drawn unless something was invalidated, so an idle editor does not use
+// any CPU. Every invalidated region is passed to request so the platform can
+// schedule a frame.
+type frameScheduler struct {
+	// dirty is the union of all invalidated regions, it is empty if nothing
+	// needs to be drawn
+	dirty   rectangle
+	request func(r rectangle)
+	// showFrameTime toggles an overlay with the time it took to draw the last
+	// frame and the number of frames drawn so far. If the frame count does
+	// not increase while nothing happens, the editor is truly idle.
+	showFrameTime bool
+	frameTime     time.Duration
+	frameCount    int
+}
+
+func newFrameScheduler() *frameScheduler {
+	return &frameScheduler{}
+}
+
+// invalidate marks r as needing a redraw.
+func (s *frameScheduler) invalidate(r rectangle) {
+	if r.w <= 0 || r.h <= 0 {
+		return
+	}
+	s.dirty = s.dirty.union(r)
+	if s.request != nil {
+		s.request(r)
+	}
+}
+
+// invalidateAll marks the whole screen as dirty, e.g. after a resize.
+func (s *frameScheduler) invalidateAll() {
+	s.invalidate(rect(-1<<20, -1<<20, 1<<21, 1<<21))
+}
+
+func (s *frameScheduler) hasDirty() bool {
+	return s.dirty.w > 0 && s.dirty.h > 0
+}
+
+// drawFrame calls draw, which renders the whole scene, if anything is dirty
+// and then presents the dirty part of the screen.
+func (s *frameScheduler) drawFrame(g graphics, screen rectangle, draw func()) error {
+	if !s.hasDirty() {
+		return nil
+	}
+	start := time.Now()
+	dirty := s.dirty.intersect(screen)
+	s.dirty = rectangle{}
+
+	draw()
+	if s.showFrameTime {
+		s.drawFrameTime(g, screen)
+		// the overlay changes every frame, make sure it is presented
+		dirty = screen
+	}
+	err := g.present(dirty)
+
+	s.frameTime = time.Since(start)
+	s.frameCount++
+	return err
+}
+
+func (s *frameScheduler) drawFrameTime(g graphics, screen rectangle) {
+	text := []byte(
+		strconv.FormatFloat(s.frameTime.Seconds()*1000, 'f', 2, 64) + " ms, " +
+			strconv.Itoa(s.frameCount) + " frames",
+	)
+	w, h := g.textExtent(text)
+	x, y := screen.x+screen.w-w-8, screen.y+4
+	g.rect(x-4, y-2, w+8, h+4, 0xC0000000)
+	g.text(text, x, y, rect(x, y, w, h), 0xFFFFFF00)
+}
+
+// registerViewCommands registers commands that change the way the screen is
+// drawn.
+func registerViewCommands(r *commandRegistry, frames *frameScheduler) {
+	r.register("view.toggleFrameTime", func(*editor) {
+		frames.showFrameTime = !frames.showFrameTime
+		frames.invalidateAll()
+	})
+}
@@ -3,7 +3,14 @@ package main
 type graphics interface {
 	rect(x, y, w, h int, argb8 uint32)
 	text(utf8 []byte, x, y int, clip rectangle, argb uint32)
-	present() error
+	// coloredText is like text but the colors are given by the runs, one
+	// after the other. Bytes after the last run keep its color.
+	coloredText(utf8 []byte, x, y int, clip rectangle, runs []colorRun)
+	textExtent(utf8 []byte) (width, height int)
+	lineHeight() int
+	// present shows what was drawn since the last call to present. Only the
+	// given region of the screen is updated.
+	present(region rectangle) error
 }
 
 type rectangle struct {
@@ -13,3 +20,84 @@ type rectangle struct {
 func rect(x, y, w, h int) rectangle {
 	return rectangle{x: x, y: y, w: w, h: h}
 }
+
+func (r rectangle) intersect(other rectangle) rectangle {
+	x0, y0 := max(r.x, other.x), max(r.y, other.y)
+	x1, y1 := min(r.x+r.w, other.x+other.w), min(r.y+r.h, other.y+other.h)
+	if x1 < x0 {
+		x1 = x0
+	}
+	if y1 < y0 {
+		y1 = y0
+	}
+	return rect(x0, y0, x1-x0, y1-y0)
+}
+
+// union returns the smallest rectangle that contains both rectangles. Empty
+// rectangles are ignored.
+func (r rectangle) union(other rectangle) rectangle {
+	if r.w <= 0 || r.h <= 0 {
+		return other
+	}
+	if other.w <= 0 || other.h <= 0 {
+		return r
+	}
+	x0, y0 := min(r.x, other.x), min(r.y, other.y)
+	x1, y1 := max(r.x+r.w, other.x+other.w), max(r.y+r.h, other.y+other.h)
+	return rect(x0, y0, x1-x0, y1-y0)
+}
+
+func (r rectangle) contains(x, y int) bool {
+	return r.x <= x && x < r.x+r.w && r.y <= y && y < r.y+r.h
+}
+
+// fillRect draws r if it is not empty.
+func fillRect(g graphics, r rectangle, argb uint32) {
+	if r.w > 0 && r.h > 0 {
+		g.rect(r.x, r.y, r.w, r.h, argb)
+	}
+}
+
+// colorRun gives the next length bytes of a text the color argb.
+type colorRun struct {
+	length int
+	argb   uint32
+}
+
+// appendColorRun adds a run, it is merged into the last one if they have the
+// same color.
+func appendColorRun(runs []colorRun, length int, argb uint32) []colorRun {
+	if n := len(runs); n > 0 && runs[n-1].argb == argb {
+		runs[n-1].length += length
+		return runs
+	}
+	return append(runs, colorRun{length: length, argb: argb})
+}
+
+// runColors looks up the color of bytes in a text with color runs. The
+// offsets passed to at must not decrease.
+type runColors struct {
+	runs []colorRun
+	i    int
+	// end is the offset after the current run
+	end int
+}
+
+func newRunColors(runs []colorRun) *runColors {
+	c := &runColors{runs: runs}
+	if len(runs) > 0 {
+		c.end = runs[0].length
+	}
+	return c
+}
+
+func (c *runColors) at(offset int) uint32 {
+	if len(c.runs) == 0 {
+		return 0
+	}
+	for offset >= c.end && c.i < len(c.runs)-1 {
+		c.i++
+		c.end += c.runs[c.i].length
+	}
+	return c.runs[c.i].argb
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"unsafe"
+
+	"github.com/gonutz/ide/w32"
+)
+
+// gdiGraphics is the fallback for machines without Direct3D 9. It renders on
+// the CPU and copies the presented region to the window with GDI.
+type gdiGraphics struct {
+	*softwareGraphics
+	window uintptr
+	// bgra holds the presented region in the byte order that GDI expects
+	bgra []byte
+}
+
+func newGDIGraphics(window uintptr, ttfFontData []byte, fontHeightPix int) (*gdiGraphics, error) {
+	r, ok := w32.GetClientRect(window)
+	if !ok {
+		return nil, errors.New("unable to query window size")
+	}
+	soft, err := newSoftwareGraphics(
+		int(r.Right-r.Left), int(r.Bottom-r.Top),
+		ttfFontData, fontHeightPix,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &gdiGraphics{softwareGraphics: soft, window: window}, nil
+}
+
+func (g *gdiGraphics) present(region rectangle) error {
+	if err := g.softwareGraphics.present(region); err != nil {
+		return err
+	}
+
+	r, ok := w32.GetClientRect(g.window)
+	if !ok {
+		return errors.New("unable to query window size")
+	}
+	windowW, windowH := int(r.Right-r.Left), int(r.Bottom-r.Top)
+	if b := g.bounds(); b.w != windowW || b.h != windowH {
+		// this frame was drawn for the old window size, start over with
+		// buffers that fit the window
+		g.resize(windowW, windowH)
+		w32.InvalidateRect(g.window, nil, false)
+		return nil
+	}
+
+	region = region.intersect(g.bounds())
+	if region.w <= 0 || region.h <= 0 {
+		return nil
+	}
+
+	size := region.w * region.h * 4
+	if cap(g.bgra) < size {
+		g.bgra = make([]byte, size)
+	}
+	g.bgra = g.bgra[:size]
+	front := g.image()
+	dest := 0
+	for y := region.y; y < region.y+region.h; y++ {
+		src := front.PixOffset(region.x, y)
+		for x := 0; x < region.w; x++ {
+			g.bgra[dest+0] = front.Pix[src+2]
+			g.bgra[dest+1] = front.Pix[src+1]
+			g.bgra[dest+2] = front.Pix[src+0]
+			g.bgra[dest+3] = front.Pix[src+3]
+			dest += 4
+			src += 4
+		}
+	}
+
+	header := w32.BITMAPINFOHEADER{
+		Width: int32(region.w),
+		// a negative height makes the bitmap top-down like image.RGBA
+		Height:      -int32(region.h),
+		Planes:      1,
+		BitCount:    32,
+		Compression: w32.BI_RGB,
+	}
+	header.Size = uint32(unsafe.Sizeof(header))
+
+	dc := w32.GetDC(g.window)
+	if dc == 0 {
+		return errors.New("GetDC failed")
+	}
+	defer w32.ReleaseDC(g.window, dc)
+	lines := w32.SetDIBitsToDevice(
+		dc,
+		region.x, region.y, region.w, region.h,
+		0, 0, 0, region.h,
+		unsafe.Pointer(&g.bgra[0]),
+		&header,
+		w32.DIB_RGB_COLORS,
+	)
+	if lines == 0 {
+		return errors.New("SetDIBitsToDevice failed")
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// recordingGraphics does not draw anything, it records all calls into a
+// display list instead. This way the layout of the UI can be inspected
+// without pixels and recorded frames can be replayed later on a real graphics
+// implementation.
+type recordingGraphics struct {
+	metrics textMetrics
+	list    displayList
+}
+
+// textMetrics measures text for recordingGraphics, which has no font itself.
+type textMetrics interface {
+	textExtent(utf8 []byte) (width, height int)
+	lineHeight() int
+}
+
+// newRecordingGraphics measures text with the given metrics, e.g. a
+// softwareGraphics for real font metrics or a fixedWidthFont.
+func newRecordingGraphics(metrics textMetrics) *recordingGraphics {
+	return &recordingGraphics{metrics: metrics}
+}
+
+func (g *recordingGraphics) rect(x, y, w, h int, argb uint32) {
+	g.list = append(g.list, drawCommand{
+		op:    rectOp,
+		area:  rect(x, y, w, h),
+		color: argb,
+	})
+}
+
+func (g *recordingGraphics) text(text []byte, x, y int, clip rectangle, argb uint32) {
+	g.list = append(g.list, drawCommand{
+		op:    textOp,
+		area:  clip,
+		x:     x,
+		y:     y,
+		color: argb,
+		text:  string(text),
+	})
+}
+
+func (g *recordingGraphics) coloredText(text []byte, x, y int, clip rectangle, runs []colorRun) {
+	g.list = append(g.list, drawCommand{
+		op:   coloredTextOp,
+		area: clip,
+		x:    x,
+		y:    y,
+		runs: formatColorRuns(runs),
+		text: string(text),
+	})
+}
+
+func (g *recordingGraphics) textExtent(text []byte) (width, height int) {
+	return g.metrics.textExtent(text)
+}
+
+func (g *recordingGraphics) lineHeight() int {
+	return g.metrics.lineHeight()
+}
+
+func (g *recordingGraphics) present(region rectangle) error {
+	g.list = append(g.list, drawCommand{op: presentOp, area: region})
+	return nil
+}
+
+// displayList returns everything recorded so far.
+func (g *recordingGraphics) displayList() displayList {
+	return g.list
+}
+
+// reset clears the recorded display list.
+func (g *recordingGraphics) reset() {
+	g.list = nil
+}
+
+// fixedWidthFont measures text as if every character had the same width. Tabs
+// and control characters are handled like in fontAtlas.
+type fixedWidthFont struct {
+	charWidth, charHeight int
+}
+
+func (f fixedWidthFont) textExtent(text []byte) (width, height int) {
+	if len(text) == 0 {
+		return
+	}
+	x, lineCount := 0, 1
+	for len(text) > 0 {
+		r, size := utf8.DecodeRune(text)
+		text = text[size:]
+		if r == '\n' {
+			width = max(width, x)
+			x = 0
+			lineCount++
+		} else if r == '\t' {
+			x += tabWidth * f.charWidth
+		} else if !unicode.IsControl(r) {
+			x += f.charWidth
+		}
+	}
+	return max(width, x), lineCount * f.charHeight
+}
+
+func (f fixedWidthFont) lineHeight() int {
+	return f.charHeight
+}
+
+type drawOp int
+
+const (
+	rectOp drawOp = iota
+	textOp
+	presentOp
+	coloredTextOp
+)
+
+var drawOpNames = []string{"rect", "text", "present", "colored"}
+
+// drawCommand is one recorded call to a graphics. area is the rectangle for
+// rect, the clip rectangle for text and the region for present. The color
+// runs of colored text are kept in their text form, see formatColorRuns, so
+// commands can be compared with ==.
+type drawCommand struct {
+	op    drawOp
+	area  rectangle
+	x, y  int
+	color uint32
+	runs  string
+	text  string
+}
+
+// String formats the command as one line, in the format that
+// parseDrawCommand reads:
+//
+//	rect X Y W H AARRGGBB
+//	text X Y CLIPX CLIPY CLIPW CLIPH AARRGGBB "quoted text"
+//	colored X Y CLIPX CLIPY CLIPW CLIPH LENGTH:AARRGGBB,... "quoted text"
+//	present X Y W H
+func (c drawCommand) String() string {
+	a := c.area
+	switch c.op {
+	case rectOp:
+		return fmt.Sprintf("rect %d %d %d %d %08X", a.x, a.y, a.w, a.h, c.color)
+	case textOp:
+		return fmt.Sprintf(
+			"text %d %d %d %d %d %d %08X %s",
+			c.x, c.y, a.x, a.y, a.w, a.h, c.color, strconv.Quote(c.text),
+		)
+	case coloredTextOp:
+		return fmt.Sprintf(
+			"colored %d %d %d %d %d %d %s %s",
+			c.x, c.y, a.x, a.y, a.w, a.h, c.runs, strconv.Quote(c.text),
+		)
+	case presentOp:
+		return fmt.Sprintf("present %d %d %d %d", a.x, a.y, a.w, a.h)
+	default:
+		return "unknown"
+	}
+}
+
+func parseDrawCommand(line string) (drawCommand, error) {
+	var c drawCommand
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 9)
+	op := -1
+	for i, name := range drawOpNames {
+		if fields[0] == name {
+			op = i
+		}
+	}
+	c.op = drawOp(op)
+
+	var numbers []int
+	parse := func(s []string, hexColor bool) error {
+		for i, f := range s {
+			if hexColor && i == len(s)-1 {
+				color, err := strconv.ParseUint(f, 16, 32)
+				if err != nil {
+					return err
+				}
+				c.color = uint32(color)
+				continue
+			}
+			n, err := strconv.Atoi(f)
+			if err != nil {
+				return err
+			}
+			numbers = append(numbers, n)
+		}
+		return nil
+	}
+
+	var err error
+	switch {
+	case c.op == rectOp && len(fields) == 6:
+		err = parse(fields[1:], true)
+		if err == nil {
+			c.area = rect(numbers[0], numbers[1], numbers[2], numbers[3])
+		}
+	case c.op == textOp && len(fields) == 9:
+		err = parse(fields[1:8], true)
+		if err == nil {
+			c.x, c.y = numbers[0], numbers[1]
+			c.area = rect(numbers[2], numbers[3], numbers[4], numbers[5])
+			c.text, err = strconv.Unquote(fields[8])
+		}
+	case c.op == coloredTextOp && len(fields) == 9:
+		err = parse(fields[1:7], false)
+		if err == nil {
+			c.x, c.y = numbers[0], numbers[1]
+			c.area = rect(numbers[2], numbers[3], numbers[4], numbers[5])
+			c.runs = fields[7]
+			_, err = parseColorRuns(c.runs)
+		}
+		if err == nil {
+			c.text, err = strconv.Unquote(fields[8])
+		}
+	case c.op == presentOp && len(fields) == 5:
+		err = parse(fields[1:], false)
+		if err == nil {
+			c.area = rect(numbers[0], numbers[1], numbers[2], numbers[3])
+		}
+	default:
+		err = errors.New("unknown command")
+	}
+	if err != nil {
+		return c, makeErr("invalid draw command '"+line+"'", err)
+	}
+	return c, nil
+}
+
+// formatColorRuns writes the runs as comma-separated LENGTH:AARRGGBB pairs.
+func formatColorRuns(runs []colorRun) string {
+	s := make([]string, len(runs))
+	for i, r := range runs {
+		s[i] = fmt.Sprintf("%d:%08X", r.length, r.argb)
+	}
+	return strings.Join(s, ",")
+}
+
+func parseColorRuns(s string) ([]colorRun, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var runs []colorRun
+	for _, run := range strings.Split(s, ",") {
+		parts := strings.Split(run, ":")
+		if len(parts) != 2 {
+			return nil, errors.New("invalid color run '" + run + "'")
+		}
+		length, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		color, err := strconv.ParseUint(parts[1], 16, 32)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, colorRun{length: length, argb: uint32(color)})
+	}
+	return runs, nil
+}
+
+// displayList is a sequence of recorded draw commands. Each present command
+// ends a frame.
+type displayList []drawCommand
+
+// String formats the list with one command per line so recordings can be
+// saved, diffed and attached to bug reports.
+func (l displayList) String() string {
+	var b strings.Builder
+	for _, c := range l {
+		b.WriteString(c.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// parseDisplayList reads the format written by displayList.String. Empty
+// lines and lines starting with # are ignored.
+func parseDisplayList(s string) (displayList, error) {
+	var l displayList
+	for i, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		c, err := parseDrawCommand(line)
+		if err != nil {
+			return nil, makeErr("line "+strconv.Itoa(i+1), err)
+		}
+		l = append(l, c)
+	}
+	return l, nil
+}
+
+// frames splits the list after each present command. Commands after the last
+// present form an unfinished last frame.
+func (l displayList) frames() []displayList {
+	var frames []displayList
+	start := 0
+	for i, c := range l {
+		if c.op == presentOp {
+			frames = append(frames, l[start:i+1])
+			start = i + 1
+		}
+	}
+	if start < len(l) {
+		frames = append(frames, l[start:])
+	}
+	return frames
+}
+
+// replay draws the list on g.
+func (l displayList) replay(g graphics) error {
+	for _, c := range l {
+		switch c.op {
+		case rectOp:
+			g.rect(c.area.x, c.area.y, c.area.w, c.area.h, c.color)
+		case textOp:
+			g.text([]byte(c.text), c.x, c.y, c.area, c.color)
+		case coloredTextOp:
+			// the runs were checked when parsing or come from formatColorRuns
+			runs, _ := parseColorRuns(c.runs)
+			g.coloredText([]byte(c.text), c.x, c.y, c.area, runs)
+		case presentOp:
+			if err := g.present(c.area); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// diff compares the lists command by command and describes each difference
+// in one line. It returns nothing if the lists are equal.
+func (l displayList) diff(other displayList) []string {
+	var diffs []string
+	for i := 0; i < len(l) || i < len(other); i++ {
+		prefix := "command " + strconv.Itoa(i+1) + ": "
+		switch {
+		case i >= len(other):
+			diffs = append(diffs, prefix+"missing "+l[i].String())
+		case i >= len(l):
+			diffs = append(diffs, prefix+"extra "+other[i].String())
+		case l[i] != other[i]:
+			diffs = append(diffs, prefix+l[i].String()+" became "+other[i].String())
+		}
+	}
+	return diffs
+}
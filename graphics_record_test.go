@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// recordEditorFrame records an editor with some text and one more frame with
+// every kind of command.
+func recordEditorFrame() displayList {
+	g := newRecordingGraphics(fixedWidthFont{10, 20})
+	e := newEditor(newDocument([]byte("a b\n\tc \"quoted\"\n")))
+	e.draw(g, rect(0, 0, 300, 100))
+	g.present(rect(0, 0, 300, 100))
+	g.rect(1, 2, 3, 4, 0x80FF0000)
+	g.text([]byte("with  spaces\n"), 5, 6, rect(0, 0, 50, 20), 0xFF000000)
+	g.coloredText([]byte("runs"), 7, 8, rect(1, 1, 40, 20), []colorRun{{1, 0xFF112233}, {3, 0x80445566}})
+	g.present(rect(0, 0, 10, 10))
+	return g.displayList()
+}
+
+func TestDisplayListRoundTrip(t *testing.T) {
+	recorded := recordEditorFrame()
+	parsed, err := parseDisplayList("# a recorded frame\n\n" + recorded.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := recorded.diff(parsed); len(d) != 0 {
+		t.Fatal(d)
+	}
+	if !reflect.DeepEqual(recorded, parsed) {
+		t.Fatal("the parsed list differs")
+	}
+
+	replayed := newRecordingGraphics(fixedWidthFont{10, 20})
+	if err := parsed.replay(replayed); err != nil {
+		t.Fatal(err)
+	}
+	if d := recorded.diff(replayed.displayList()); len(d) != 0 {
+		t.Fatal(d)
+	}
+}
+
+func TestReplayDrawsTheSamePixels(t *testing.T) {
+	direct := newTestSoftwareGraphics(t, 300, 100)
+	e := newEditor(newDocument([]byte("func f() {\n\treturn\n}")))
+	e.draw(direct, rect(0, 0, 300, 100))
+	direct.present(rect(0, 0, 300, 100))
+
+	recorder := newRecordingGraphics(direct)
+	e.draw(recorder, rect(0, 0, 300, 100))
+	recorder.present(rect(0, 0, 300, 100))
+	parsed, err := parseDisplayList(recorder.displayList().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := newTestSoftwareGraphics(t, 300, 100)
+	if err := parsed.replay(replayed); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(direct.image().Pix, replayed.image().Pix) {
+		t.Error("the replayed frame differs from the one drawn directly")
+	}
+}
+
+func TestParseDrawCommand(t *testing.T) {
+	valid := []struct {
+		line string
+		want drawCommand
+	}{
+		{"rect 1 -2 3 4 80FF0000", drawCommand{op: rectOp, area: rect(1, -2, 3, 4), color: 0x80FF0000}},
+		{"present 0 0 10 20", drawCommand{op: presentOp, area: rect(0, 0, 10, 20)}},
+		{
+			`text 5 6 0 0 50 20 FF000000 "a  b\t\"c\""`,
+			drawCommand{op: textOp, x: 5, y: 6, area: rect(0, 0, 50, 20), color: 0xFF000000, text: "a  b\t\"c\""},
+		},
+		{
+			`colored 7 8 1 1 40 20 1:FF112233,3:80445566 "runs"`,
+			drawCommand{op: coloredTextOp, x: 7, y: 8, area: rect(1, 1, 40, 20), runs: "1:FF112233,3:80445566", text: "runs"},
+		},
+	}
+	for _, tt := range valid {
+		c, err := parseDrawCommand(tt.line)
+		if err != nil {
+			t.Errorf("%s: %v", tt.line, err)
+			continue
+		}
+		if c != tt.want {
+			t.Errorf("%s: got %v", tt.line, c)
+		}
+		if c.String() != tt.line {
+			t.Errorf("%s is formatted as %s", tt.line, c.String())
+		}
+	}
+
+	invalid := []string{
+		"",
+		"circle 1 2 3",
+		"rect 1 2 3",
+		"rect 1 2 3 4 notacolor",
+		"rect 1 2 x 4 FF000000",
+		`text 1 2 3 4 5 6 FF000000 unquoted`,
+		`colored 1 2 3 4 5 6 1-FF000000 "runs"`,
+		`colored 1 2 3 4 5 6 x:FF000000 "runs"`,
+		"present 1 2 3 4 5",
+	}
+	for _, line := range invalid {
+		if c, err := parseDrawCommand(line); err == nil {
+			t.Errorf("%q is parsed as %v", line, c)
+		}
+	}
+	if _, err := parseDisplayList("present 0 0 1 1\nrect 1 2 3\n"); err == nil || !strings.HasPrefix(err.Error(), "line 2") {
+		t.Errorf("the error does not name the line: %v", err)
+	}
+}
+
+func TestDisplayListDiff(t *testing.T) {
+	list := recordEditorFrame()
+	changed := append(displayList(nil), list...)
+	changed[0].color++
+	changed = changed[:len(changed)-1]
+	diffs := list.diff(changed)
+	if len(diffs) != 2 {
+		t.Fatalf("%d differences: %v", len(diffs), diffs)
+	}
+	if diffs[1] != "command "+strconv.Itoa(len(list))+": missing present 0 0 10 10" {
+		t.Error(diffs[1])
+	}
+	if diffs := changed.diff(list); len(diffs) != 2 || !strings.HasSuffix(diffs[1], ": extra present 0 0 10 10") {
+		t.Error(diffs)
+	}
+}
+
+func TestDisplayListFrames(t *testing.T) {
+	list := append(recordEditorFrame(), drawCommand{op: rectOp, area: rect(0, 0, 1, 1)})
+	frames := list.frames()
+	if len(frames) != 3 {
+		t.Fatalf("%d frames", len(frames))
+	}
+	if last := frames[0][len(frames[0])-1]; last.op != presentOp || last.area != rect(0, 0, 300, 100) {
+		t.Errorf("the first frame ends with %v", last)
+	}
+	if len(frames[1]) != 4 || len(frames[2]) != 1 {
+		t.Errorf("the frames have %d and %d commands", len(frames[1]), len(frames[2]))
+	}
+}
+
+func TestFixedWidthFont(t *testing.T) {
+	f := fixedWidthFont{10, 20}
+	tests := []struct {
+		text          string
+		width, height int
+	}{
+		{"", 0, 0},
+		{"abc", 30, 20},
+		{"ab\n\tc\x01", 10*tabWidth + 10, 40},
+		{"世界", 20, 20},
+		{"a\n", 10, 40},
+	}
+	for _, tt := range tests {
+		if w, h := f.textExtent([]byte(tt.text)); w != tt.width || h != tt.height {
+			t.Errorf("%q is %dx%d, want %dx%d", tt.text, w, h, tt.width, tt.height)
+		}
+	}
+}
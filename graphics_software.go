@@ -0,0 +1,116 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+)
+
+// softwareGraphics renders into an image.RGBA on the CPU. It uses the same
+// font atlas and text layout as the Direct3D implementation. Drawing goes to a
+// back buffer and present copies the presented region to the front buffer,
+// just like a swap chain that copies instead of discarding.
+type softwareGraphics struct {
+	font  *fontAtlas
+	back  *image.RGBA
+	front *image.RGBA
+}
+
+func newSoftwareGraphics(width, height int, ttfFontData []byte, fontHeightPix int) (*softwareGraphics, error) {
+	font, err := newFontAtlas(ttfFontData, fontHeightPix)
+	if err != nil {
+		return nil, makeErr("create font", err)
+	}
+	g := &softwareGraphics{font: font}
+	g.resize(width, height)
+	return g, nil
+}
+
+// resize changes the size of the screen. The buffers are cleared to opaque
+// black.
+func (g *softwareGraphics) resize(width, height int) {
+	g.back = image.NewRGBA(image.Rect(0, 0, width, height))
+	g.front = image.NewRGBA(image.Rect(0, 0, width, height))
+	for _, img := range []*image.RGBA{g.back, g.front} {
+		for i := 3; i < len(img.Pix); i += 4 {
+			img.Pix[i] = 0xFF
+		}
+	}
+}
+
+// image is what was presented so far.
+func (g *softwareGraphics) image() *image.RGBA {
+	return g.front
+}
+
+func (g *softwareGraphics) bounds() rectangle {
+	b := g.back.Bounds()
+	return rect(b.Min.X, b.Min.Y, b.Dx(), b.Dy())
+}
+
+func (g *softwareGraphics) rect(x, y, w, h int, argb uint32) {
+	r := rect(x, y, w, h).intersect(g.bounds())
+	for y := r.y; y < r.y+r.h; y++ {
+		i := g.back.PixOffset(r.x, y)
+		for x := 0; x < r.w; x++ {
+			blendPixel(g.back.Pix[i:i+4], argb, 0xFF)
+			i += 4
+		}
+	}
+}
+
+func (g *softwareGraphics) text(text []byte, textX, textY int, clip rectangle, argb uint32) {
+	g.coloredText(text, textX, textY, clip, []colorRun{{len(text), argb}})
+}
+
+func (g *softwareGraphics) coloredText(text []byte, textX, textY int, clip rectangle, runs []colorRun) {
+	if len(text) == 0 {
+		return
+	}
+	clip = clip.intersect(g.bounds())
+	atlas := g.font
+	colors := newRunColors(runs)
+	atlas.layoutText(text, textX, textY, clip, func(q glyphQuad) {
+		argb := colors.at(q.offset)
+		for y := 0; y < q.dest.h; y++ {
+			dest := g.back.PixOffset(q.dest.x, q.dest.y+y)
+			src := q.srcX + (q.srcY+y)*atlas.size
+			for x := 0; x < q.dest.w; x++ {
+				if coverage := atlas.gray[src+x]; coverage != 0 {
+					blendPixel(g.back.Pix[dest:dest+4], argb, coverage)
+				}
+				dest += 4
+			}
+		}
+	})
+}
+
+// blendPixel draws the color argb over the RGBA pixel, the color's alpha is
+// multiplied by coverage, which is in [0..255]. This is the same blending that
+// the Direct3D implementation sets up in setRenderState.
+func blendPixel(pixel []byte, argb uint32, coverage byte) {
+	a := (argb >> 24) * uint32(coverage) / 255
+	if a == 0 {
+		return
+	}
+	r, g, b := (argb>>16)&0xFF, (argb>>8)&0xFF, argb&0xFF
+	inv := 255 - a
+	pixel[0] = byte((r*a + uint32(pixel[0])*inv + 127) / 255)
+	pixel[1] = byte((g*a + uint32(pixel[1])*inv + 127) / 255)
+	pixel[2] = byte((b*a + uint32(pixel[2])*inv + 127) / 255)
+	pixel[3] = byte((a*255 + uint32(pixel[3])*inv + 127) / 255)
+}
+
+func (g *softwareGraphics) textExtent(text []byte) (width, height int) {
+	return g.font.extent(text)
+}
+
+func (g *softwareGraphics) lineHeight() int {
+	return g.font.lineHeight()
+}
+
+func (g *softwareGraphics) present(region rectangle) error {
+	region = region.intersect(g.bounds())
+	r := image.Rect(region.x, region.y, region.x+region.w, region.y+region.h)
+	draw.Draw(g.front, r, g.back, r.Min, draw.Src)
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden images in testdata/golden")
+
+// testGlyphs is a synthetic font for golden images. Unlike a TrueType font it
+// renders the same pixels everywhere, no matter which version of the
+// rasterizer is installed. Every glyph is a 5 by 8 pattern derived from its
+// rune, with half covered pixels at the edges to test blending.
+type testGlyphs struct{}
+
+func (testGlyphs) verticalMetrics() (ascend, descend, lineGap int) {
+	return 9, -3, 2
+}
+
+func (testGlyphs) glyphIndex(r rune) int {
+	if r > 0x2FFF {
+		return 0
+	}
+	return int(r)
+}
+
+func (testGlyphs) renderGlyph(index int) (pixels []byte, width, height, advance, xOffset, yOffset int) {
+	if index == ' ' || index == '\t' {
+		return nil, 0, 0, 7, 0, 0
+	}
+	const w, h = 5, 8
+	pixels = make([]byte, w*h)
+	bits := uint32(index) * 2654435761
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			switch {
+			case index == 0 && (x == 0 || y == 0 || x == w-1 || y == h-1):
+				// the replacement glyph is a box
+				pixels[x+y*w] = 0xFF
+			case index != 0 && bits>>uint((x+y*w)%32)&1 == 1:
+				pixels[x+y*w] = 0xFF
+			case index != 0 && (x == 0 || x == w-1):
+				pixels[x+y*w] = 0x80
+			}
+		}
+	}
+	return pixels, w, h, 7, 1, -8
+}
+
+func (testGlyphs) kerning(a, b rune) int {
+	if a == 'A' && b == 'V' {
+		return -2
+	}
+	return 0
+}
+
+func newTestSoftwareGraphics(t *testing.T, width, height int) *softwareGraphics {
+	font, err := newFontAtlasFrom(testGlyphs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &softwareGraphics{font: font}
+	g.resize(width, height)
+	return g
+}
+
+// compareGolden compares img with testdata/golden/name.png pixel by pixel.
+// With -update the golden image is written instead.
+func compareGolden(t *testing.T, name string, img *image.RGBA) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden", name+".png")
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		writePNG(t, path, img)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err, "(run the test with -update to create it)")
+	}
+	defer f.Close()
+	golden, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if golden.Bounds() != img.Bounds() {
+		t.Fatalf("the image is %v, the golden image %v", img.Bounds(), golden.Bounds())
+	}
+	diffs, first := 0, image.Point{-1, -1}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r1, g1, b1, a1 := img.At(x, y).RGBA()
+			r2, g2, b2, a2 := golden.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				if diffs == 0 {
+					first = image.Point{x, y}
+				}
+				diffs++
+			}
+		}
+	}
+	if diffs > 0 {
+		actual := filepath.Join(os.TempDir(), name+".png")
+		writePNG(t, actual, img)
+		t.Errorf("%d pixels differ from %s, the first at %v, the image is in %s", diffs, path, first, actual)
+	}
+}
+
+func writePNG(t *testing.T, path string, img image.Image) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoldenRects(t *testing.T) {
+	g := newTestSoftwareGraphics(t, 64, 48)
+	g.rect(0, 0, 64, 48, 0xFF202020)
+	// opaque, translucent over it and clipped by the screen
+	g.rect(8, 8, 24, 16, 0xFFE51400)
+	g.rect(20, 16, 24, 16, 0x800070F0)
+	g.rect(-10, 36, 30, 30, 0xFF40C040)
+	g.rect(56, -4, 20, 12, 0x40FFFFFF)
+	g.present(rect(0, 0, 64, 48))
+	// only the presented part of the back buffer shows
+	g.rect(0, 0, 64, 48, 0xFFFFFFFF)
+	g.present(rect(48, 32, 8, 8))
+	compareGolden(t, "rects", g.image())
+}
+
+func TestGoldenText(t *testing.T) {
+	g := newTestSoftwareGraphics(t, 120, 64)
+	g.rect(0, 0, 120, 64, 0xFF1E1E1E)
+	// tabs, kerning between A and V, a missing glyph and a second line
+	g.text([]byte("AV\tx世y\nab c"), 2, 2, rect(0, 0, 120, 64), 0xFFFFFFFF)
+	// glyphs are cut at the clip rectangle
+	clip := rect(10, 34, 30, 10)
+	g.rect(clip.x, clip.y, clip.w, clip.h, 0xFF303060)
+	g.text([]byte("clipped"), 6, 33, clip, 0xFFFFFF00)
+	// every run has its own color, the text is translucent
+	g.coloredText([]byte("runs"), 60, 40, rect(0, 0, 120, 64), []colorRun{
+		{2, 0xFFFF4040},
+		{2, 0x8040FF40},
+	})
+	g.present(rect(0, 0, 120, 64))
+	compareGolden(t, "text", g.image())
+}
+
+func TestGoldenEditor(t *testing.T) {
+	g := newTestSoftwareGraphics(t, 320, 200)
+	d := newHeadlessDriver(g, 320, 200, time.Unix(0, 0))
+	d.typeText("package main\n\nfunc main() {\n\tprintln(\"hi\")\n}\n")
+	d.keys("Ctrl+Home Down Down Shift+End")
+	d.app.frames.invalidateAll()
+	if err := d.paint(); err != nil {
+		t.Fatal(err)
+	}
+	compareGolden(t, "editor", g.image())
+}
@@ -2,8 +2,6 @@ package main
 
 import (
 	"errors"
-	"unicode"
-	"unicode/utf8"
 	"unsafe"
 
 	"github.com/gonutz/ide/w32"
@@ -62,10 +60,12 @@ func newD3d9Graphics(window uintptr, ttfFontData []byte, fontHeightPix int) (*d3
 		}
 	}
 
+	// copying the back buffer (instead of discarding it) allows presenting
+	// only the part of the screen that changed
 	pp := d3d9.PRESENT_PARAMETERS{
 		Windowed:         1,
 		HDeviceWindow:    d3d9.HWND(window),
-		SwapEffect:       d3d9.SWAPEFFECT_DISCARD,
+		SwapEffect:       d3d9.SWAPEFFECT_COPY,
 		BackBufferWidth:  backBufW,
 		BackBufferHeight: backBufH,
 		BackBufferFormat: d3d9.FMT_A8R8G8B8,
@@ -178,145 +178,61 @@ func (g *d3d9Graphics) addJob(kind renderJobKind, count uint) {
 }
 
 func (g *d3d9Graphics) text(text []byte, textX, textY int, clip rectangle, argb8 uint32) {
+	g.coloredText(text, textX, textY, clip, []colorRun{{len(text), argb8}})
+}
+
+func (g *d3d9Graphics) coloredText(text []byte, textX, textY int, clip rectangle, runs []colorRun) {
 	if len(text) == 0 {
 		return
 	}
 
-	x, y := textX, textY
-	right, bottom := clip.x+clip.w, clip.y+clip.h
-	var col float32 = *(*float32)(unsafe.Pointer(&argb8))
-	var last rune
 	var glyphCount uint
-
-	i := 0
-
-	// first skip all lines that are not visible
-	lineHeight := g.font.lineHeight()
-	maxInvisibleY := clip.y - lineHeight
-	for i < len(text) && y < maxInvisibleY {
-		for i < len(text) {
-			character, size := utf8.DecodeRune(text[i:])
-			i += size
-			if character == '\n' {
-				y += lineHeight
-				break
-			}
-		}
-	}
-
-	for i < len(text) {
-		character, size := utf8.DecodeRune(text[i:])
-		i += size
-
-		if character == '\n' {
-			x = textX
-			y += lineHeight
-			last = 0
-			continue
-		}
-
-		if character == ' ' || character == '\t' {
-			glyph := g.font.getGlyph(character)
-			if character == '\t' {
-				x += glyph.advance * 4
-			} else {
-				x += glyph.advance
-			}
-			last = 0
-			continue
-		}
-
-		if unicode.IsControl(character) {
-			last = 0
-			continue
-		}
-
-		glyph := g.font.getGlyph(character)
-		w := round(float64(glyph.u1-glyph.u0) * float64(g.font.textureSize))
-		h := round(float64(glyph.v1-glyph.v0) * float64(g.font.textureSize))
-
-		if last != 0 {
-			x += g.font.xSpaceBetween(last, character)
-		}
-		x += glyph.xOffset
-		y := y + g.font.ascend + glyph.yOffset
-
-		if x+w >= clip.x && x < right && y+h >= clip.y && y < bottom {
-			// clip partially visible glyphs
-			x, y := x, y
-			u0, u1, v0, v1 := glyph.u0, glyph.u1, glyph.v0, glyph.v1
-			if x+w > right {
-				xFraction := float32(right-x) / float32(w)
-				w = right - x
-				u1 = u0 + (u1-u0)*xFraction
-			}
-			if y+h > bottom {
-				yFraction := float32(bottom-y) / float32(h)
-				h = bottom - y
-				v1 = v0 + (v1-v0)*yFraction
-			}
-			if x < clip.x {
-				xFraction := float32(x+w-clip.x) / float32(w)
-				w = x + w - clip.x
-				x = clip.x
-				u0 = u1 - (u1-u0)*xFraction
-			}
-			if y < clip.y {
-				yFraction := float32(y+h-clip.y) / float32(h)
-				h = y + h - clip.y
-				y = clip.y
-				v0 = v1 - (v1-v0)*yFraction
-			}
-
-			// correct x,y by 0.5 so texels align with pixels, see
-			// https://msdn.microsoft.com/en-us/library/windows/desktop/bb219690(v=vs.85).aspx
-			x0 := float32(x) - 0.5
-			y0 := float32(y) - 0.5
-			x1 := x0 + float32(w)
-			y1 := y0 + float32(h)
-			g.vertexData = append(
-				g.vertexData,
-				x0, y0, 0, 1, col, u0, v0,
-				x1, y1, 0, 1, col, u1, v1,
-				x0, y1, 0, 1, col, u0, v1,
-
-				x0, y0, 0, 1, col, u0, v0,
-				x1, y0, 0, 1, col, u1, v0,
-				x1, y1, 0, 1, col, u1, v1,
-			)
-			glyphCount++
-		}
-
-		if y-g.font.ascend > bottom {
-			// if we are already below the given screen rectangle we can stop
-			break
-		}
-
-		if x > right {
-			// we are right of the given screen rectangle so skip the rest of
-			// the line
-			for i < len(text) && character != '\n' {
-				character, size = utf8.DecodeRune(text[i:])
-				i += size
-			}
-			if i >= len(text) {
-				break
-			}
-			i -= size // give the line break back for the next processing step
-		}
-
-		x += glyph.advance - glyph.xOffset
-		last = character
-	}
+	colors := newRunColors(runs)
+
+	g.font.layoutText(text, textX, textY, clip, func(q glyphQuad) {
+		argb := colors.at(q.offset)
+		var col float32 = *(*float32)(unsafe.Pointer(&argb))
+
+		// the texture coordinates are stored in atlas pixels, the atlas might
+		// still grow during this frame, they are scaled to UV space in present
+		u0 := float32(q.srcX)
+		v0 := float32(q.srcY)
+		u1 := u0 + float32(q.dest.w)
+		v1 := v0 + float32(q.dest.h)
+
+		// correct x,y by 0.5 so texels align with pixels, see
+		// https://msdn.microsoft.com/en-us/library/windows/desktop/bb219690(v=vs.85).aspx
+		x0 := float32(q.dest.x) - 0.5
+		y0 := float32(q.dest.y) - 0.5
+		x1 := x0 + float32(q.dest.w)
+		y1 := y0 + float32(q.dest.h)
+		g.vertexData = append(
+			g.vertexData,
+			x0, y0, 0, 1, col, u0, v0,
+			x1, y1, 0, 1, col, u1, v1,
+			x0, y1, 0, 1, col, u0, v1,
+
+			x0, y0, 0, 1, col, u0, v0,
+			x1, y0, 0, 1, col, u1, v0,
+			x1, y1, 0, 1, col, u1, v1,
+		)
+		glyphCount++
+	})
 
 	if glyphCount > 0 {
 		g.addJob(textTriangles, glyphCount*2)
 	}
+}
 
-	return
+func (g *d3d9Graphics) textExtent(text []byte) (width, height int) {
+	return g.font.extent(text)
 }
 
-func (g *d3d9Graphics) present() error {
+func (g *d3d9Graphics) lineHeight() int {
+	return g.font.lineHeight()
+}
+
+func (g *d3d9Graphics) present(region rectangle) error {
 	const (
 		vertexFmt       = d3d9.FVF_XYZRHW | d3d9.FVF_DIFFUSE | d3d9.FVF_TEX1
 		floatsPerVertex = 7
@@ -396,6 +312,21 @@ func (g *d3d9Graphics) present() error {
 	g.vertexData = g.vertexData[0:0]
 	g.jobs = g.jobs[0:0]
 
+	// now that the atlas is final for this frame, turn the text vertices'
+	// atlas pixel positions into texture coordinates
+	uvScale := g.font.uvScale()
+	rest := vertexData
+	for _, job := range jobs {
+		n := int(job.count) * 3 * floatsPerVertex
+		if job.kind == textTriangles {
+			for i := 5; i < n; i += floatsPerVertex {
+				rest[i] *= uvScale
+				rest[i+1] *= uvScale
+			}
+		}
+		rest = rest[n:]
+	}
+
 	for _, job := range jobs {
 		if job.kind == triangles {
 			if err := g.device.SetTexture(0, nil); err != nil {
@@ -434,10 +365,17 @@ func (g *d3d9Graphics) present() error {
 		return err
 	}
 
-	presentErr := g.device.Present(
-		&d3d9.RECT{0, 0, int32(windowW), int32(windowH)},
-		nil, 0, nil,
-	)
+	region = region.intersect(rect(0, 0, int(windowW), int(windowH)))
+	if region.w <= 0 || region.h <= 0 {
+		return nil
+	}
+	presentRect := &d3d9.RECT{
+		Left:   int32(region.x),
+		Top:    int32(region.y),
+		Right:  int32(region.x + region.w),
+		Bottom: int32(region.y + region.h),
+	}
+	presentErr := g.device.Present(presentRect, presentRect, 0, nil)
 	if presentErr != nil {
 		if presentErr.Code() == d3d9.ERR_DEVICELOST {
 			g.deviceIsLost = true
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// headlessPlatform is a platform without a window. Time only moves when the
+// driver advances its fake clock.
+type headlessPlatform struct {
+	clock  time.Time
+	timers map[int]*headlessTimer
+	// invalidated is the union of all regions invalidated since the last
+	// paint
+	invalidated rectangle
+	quitted     bool
+	// errors are the messages of all showError calls
+	errors []string
+	// woken are the timer ids passed to wake from any goroutine, the driver
+	// sends their events when it advances the clock
+	wakeMutex sync.Mutex
+	woken     []int
+}
+
+type headlessTimer struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func (p *headlessPlatform) invalidate(r rectangle) {
+	p.invalidated = p.invalidated.union(r)
+}
+
+func (p *headlessPlatform) startTimer(id int, interval time.Duration) {
+	p.timers[id] = &headlessTimer{interval: interval, next: p.clock.Add(interval)}
+}
+
+func (p *headlessPlatform) stopTimer(id int) {
+	delete(p.timers, id)
+}
+
+func (p *headlessPlatform) wake(id int) {
+	p.wakeMutex.Lock()
+	p.woken = append(p.woken, id)
+	p.wakeMutex.Unlock()
+}
+
+func (p *headlessPlatform) now() time.Time {
+	return p.clock
+}
+
+func (p *headlessPlatform) quit() {
+	p.quitted = true
+}
+
+func (p *headlessPlatform) showError(title, message string) {
+	p.errors = append(p.errors, title+": "+message)
+}
+
+// headlessDriver runs the app without a window, for scripted end-to-end
+// scenarios. After every event it paints, like the message loop of a real
+// window would.
+type headlessDriver struct {
+	platform *headlessPlatform
+	app      *app
+}
+
+// newHeadlessDriver creates an app with the default key bindings and an empty
+// document that draws to g. The screen is width by height pixels and the fake
+// clock starts at start.
+func newHeadlessDriver(g graphics, width, height int, start time.Time) *headlessDriver {
+	p := &headlessPlatform{
+		clock:  start,
+		timers: make(map[int]*headlessTimer),
+	}
+	commands := newCommandRegistry()
+	registerEditorCommands(commands)
+	a := newApp(p, g, newDefaultKeymap(), commands)
+	a.setEditor(newEditor(newDocument(nil)))
+	d := &headlessDriver{platform: p, app: a}
+	d.send(resizeEvent{width: width, height: height})
+	return d
+}
+
+// send passes the events to the app one after the other and paints after each
+// one. It returns false if an event was not handled or painting failed.
+func (d *headlessDriver) send(events ...event) bool {
+	ok := true
+	for _, ev := range events {
+		if !d.app.handle(ev) {
+			ok = false
+		}
+		if err := d.paint(); err != nil {
+			ok = false
+		}
+	}
+	return ok
+}
+
+func (d *headlessDriver) paint() error {
+	update := d.platform.invalidated
+	d.platform.invalidated = rectangle{}
+	return d.app.paint(update)
+}
+
+// keys presses the space-separated key chords, e.g. "Ctrl+K Ctrl+C". Like
+// on a real keyboard, every key press is followed by the character it
+// generates, if any.
+func (d *headlessDriver) keys(sequence string) error {
+	keys, err := parseKeySequence(sequence)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		d.send(keyDownEvent{key: k})
+		if r, ok := keyChar(k); ok {
+			d.send(charEvent{char: r, repeatCount: 1})
+		} else {
+			// the key generates no character, typeText sends characters
+			// without key presses so nothing would reset this otherwise
+			d.app.keyboard.swallowChar = false
+		}
+	}
+	return nil
+}
+
+// keyChar returns the character that a US keyboard generates for the key
+// chord. Ctrl with a letter generates a control character.
+func keyChar(k keyChord) (rune, bool) {
+	switch k.key {
+	case "Enter":
+		return '\r', true
+	case "Tab":
+		return '\t', true
+	case "Backspace":
+		return '\b', true
+	case "Escape":
+		return 0x1B, true
+	case "Space":
+		return ' ', true
+	}
+	if len(k.key) != 1 || k.modifiers&altKey != 0 {
+		return 0, false
+	}
+	r := rune(k.key[0])
+	isLetter := 'A' <= r && r <= 'Z'
+	if k.modifiers&ctrlKey != 0 {
+		if isLetter {
+			return r - 'A' + 1, true
+		}
+		return 0, false
+	}
+	if isLetter && k.modifiers&shiftKey == 0 {
+		r += 'a' - 'A'
+	}
+	return r, true
+}
+
+// typeText types the text one character at a time. Line breaks and tabs are
+// sent as key presses, like a keyboard would.
+func (d *headlessDriver) typeText(text string) {
+	for _, r := range text {
+		switch r {
+		case '\n':
+			d.keys("Enter")
+		case '\t':
+			d.keys("Tab")
+		default:
+			d.send(charEvent{char: r, repeatCount: 1})
+		}
+	}
+}
+
+// advance moves the fake clock forward and fires all timers that are due, in
+// the order of their due times. Wake-ups are sent before the timers.
+func (d *headlessDriver) advance(duration time.Duration) {
+	end := d.platform.clock.Add(duration)
+	for {
+		if d.sendWakeUps() {
+			continue
+		}
+		id, due := d.nextTimer()
+		if id == 0 || due.After(end) {
+			break
+		}
+		d.platform.clock = due
+		d.platform.timers[id].next = due.Add(d.platform.timers[id].interval)
+		d.send(timerEvent{id: id})
+	}
+	d.platform.clock = end
+}
+
+// sendWakeUps sends the timer events of all wake calls so far and returns
+// true if there were any.
+func (d *headlessDriver) sendWakeUps() bool {
+	p := d.platform
+	p.wakeMutex.Lock()
+	woken := p.woken
+	p.woken = nil
+	p.wakeMutex.Unlock()
+	for _, id := range woken {
+		d.send(timerEvent{id: id})
+	}
+	return len(woken) > 0
+}
+
+// nextTimer returns the id and due time of the timer that fires next, or id 0
+// if there are no timers.
+func (d *headlessDriver) nextTimer() (int, time.Time) {
+	ids := make([]int, 0, len(d.platform.timers))
+	for id := range d.platform.timers {
+		ids = append(ids, id)
+	}
+	// timers that are due at the same time fire in the order of their ids
+	sort.Ints(ids)
+	nextID, next := 0, time.Time{}
+	for _, id := range ids {
+		t := d.platform.timers[id]
+		if nextID == 0 || t.next.Before(next) {
+			nextID, next = id, t.next
+		}
+	}
+	return nextID, next
+}
+
+// editor returns the app's editor, it is nil while a file is loading.
+func (d *headlessDriver) editor() *editor {
+	return d.app.editor
+}
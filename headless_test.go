@@ -0,0 +1,381 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scenario drives the app through named steps and records everything it
+// draws. The recording is compared with testdata/scenarios/name.txt.
+type scenario struct {
+	t        *testing.T
+	graphics *recordingGraphics
+	driver   *headlessDriver
+	recorded string
+}
+
+func newScenario(t *testing.T) *scenario {
+	g := newRecordingGraphics(fixedWidthFont{10, 20})
+	return &scenario{
+		t:        t,
+		graphics: g,
+		driver:   newHeadlessDriver(g, 320, 200, time.Unix(0, 0)),
+	}
+}
+
+// openFile opens the file and waits until it is loaded. Loading takes real
+// time, the frames drawn meanwhile are not recorded.
+func (s *scenario) openFile(path string) {
+	s.t.Helper()
+	if err := s.driver.app.openFile(path); err != nil {
+		s.t.Fatal(err)
+	}
+	s.waitForEditor()
+}
+
+// waitForEditor waits until the file that is being opened is loaded.
+func (s *scenario) waitForEditor() {
+	s.t.Helper()
+	d := s.driver
+	for i := 0; d.editor() == nil; i++ {
+		if i > 10000 {
+			s.t.Fatal("the file did not load")
+		}
+		time.Sleep(time.Millisecond)
+		d.advance(100 * time.Millisecond)
+	}
+	s.graphics.reset()
+}
+
+// step runs do and records the frames drawn by it under the step's name.
+func (s *scenario) step(name string, do func()) {
+	s.graphics.reset()
+	do()
+	s.recorded += "# " + name + "\n" + s.graphics.displayList().String()
+}
+
+// compare compares the recording with the one in the testdata. With -update
+// the recording is written instead.
+func (s *scenario) compare(name string) {
+	s.t.Helper()
+	path := filepath.Join("testdata", "scenarios", name+".txt")
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			s.t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(s.recorded), 0666); err != nil {
+			s.t.Fatal(err)
+		}
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		s.t.Fatal(err, "(run the test with -update to create it)")
+	}
+	want, err := parseDisplayList(string(data))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	got, err := parseDisplayList(s.recorded)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if diffs := want.diff(got); len(diffs) > 0 {
+		actual := filepath.Join(os.TempDir(), name+".txt")
+		ioutil.WriteFile(actual, []byte(s.recorded), 0666)
+		if len(diffs) > 10 {
+			diffs = append(diffs[:10], "...")
+		}
+		s.t.Errorf("the frames differ from %s, the recording is in %s:\n%s", path, actual, strings.Join(diffs, "\n"))
+	}
+}
+
+func (s *scenario) text() string {
+	return string(s.driver.editor().doc.bytes())
+}
+
+func (s *scenario) fileContent(path string) string {
+	s.t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestScenarioOpenTypeSaveUndo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scenario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notes.txt")
+	ioutil.WriteFile(path, []byte("first line\nsecond line\n"), 0666)
+
+	s := newScenario(t)
+	d := s.driver
+	s.openFile(path)
+	s.step("open", func() {
+		d.app.frames.invalidateAll()
+		d.paint()
+	})
+	s.step("type", func() {
+		d.keys("Ctrl+End")
+		d.typeText("third\tline")
+	})
+	if s.text() != "first line\nsecond line\nthird\tline" {
+		t.Fatalf("typing gives %q", s.text())
+	}
+	s.step("save", func() {
+		d.keys("Ctrl+S")
+	})
+	if content := s.fileContent(path); content != s.text() {
+		t.Fatalf("the saved file contains %q", content)
+	}
+	if d.editor().history.isModified() {
+		t.Error("the document is modified after saving")
+	}
+	s.step("undo", func() {
+		d.keys("Ctrl+Z")
+	})
+	if s.text() != "first line\nsecond line\n" || !d.editor().history.isModified() {
+		t.Fatalf("undo gives %q", s.text())
+	}
+	s.step("select and delete", func() {
+		d.keys("Ctrl+Home Shift+Down Delete")
+	})
+	if s.text() != "second line\n" {
+		t.Fatalf("deleting the first line gives %q", s.text())
+	}
+	s.step("save again", func() {
+		d.keys("Ctrl+S")
+	})
+	if content := s.fileContent(path); content != "second line\n" {
+		t.Fatalf("the saved file contains %q", content)
+	}
+	s.step("undo and redo", func() {
+		d.keys("Ctrl+Z")
+		if s.text() != "first line\nsecond line\n" {
+			t.Fatalf("undo gives %q", s.text())
+		}
+		d.keys("Ctrl+Y")
+	})
+	if s.text() != "second line\n" || d.editor().history.isModified() {
+		t.Fatalf("redo gives %q", s.text())
+	}
+	if len(d.platform.errors) > 0 {
+		t.Fatal(d.platform.errors)
+	}
+	s.compare("open-type-save-undo")
+}
+
+func TestScenarioIdleDrawsNothing(t *testing.T) {
+	s := newScenario(t)
+	d := s.driver
+	d.typeText("hello")
+	s.graphics.reset()
+	d.advance(time.Hour)
+	if l := s.graphics.displayList(); len(l) != 0 {
+		t.Fatalf("%d commands drawn while idle, the first is %v", len(l), l[0])
+	}
+	if len(d.platform.timers) != 0 {
+		t.Errorf("%d timers run while idle", len(d.platform.timers))
+	}
+}
+
+func TestHeadlessEditing(t *testing.T) {
+	s := newScenario(t)
+	d := s.driver
+	d.typeText("hello\n\tworld")
+	if s.text() != "hello\n\tworld" {
+		t.Fatalf("typing gives %q", s.text())
+	}
+	if err := d.keys("Ctrl+A Backspace"); err != nil {
+		t.Fatal(err)
+	}
+	if s.text() != "" {
+		t.Fatalf("deleting everything leaves %q", s.text())
+	}
+	d.keys("Ctrl+Z")
+	if s.text() != "hello\n\tworld" {
+		t.Fatalf("undo gives %q", s.text())
+	}
+	// a pause while typing starts a new undo step
+	d.keys("Ctrl+End")
+	d.typeText("a")
+	d.advance(2 * undoGroupTimeout)
+	d.typeText("b")
+	d.keys("Ctrl+Z")
+	if s.text() != "hello\n\tworlda" {
+		t.Fatalf("undo after a pause gives %q", s.text())
+	}
+	// losing the focus redraws the carets
+	s.graphics.reset()
+	d.send(focusEvent{false})
+	if l := s.graphics.displayList(); len(l) == 0 || l[len(l)-1].op != presentOp {
+		t.Fatalf("losing the focus draws %v", l)
+	}
+	// a click puts the caret in the first line
+	d.send(
+		focusEvent{true},
+		mouseDownEvent{x: windowMargin + editorGutterWidth + 25, y: windowMargin + 5},
+		mouseUpEvent{},
+	)
+	if caret := d.editor().primaryCursor().caret; caret != 3 {
+		t.Errorf("the click puts the caret at %d", caret)
+	}
+	if err := d.keys("Ctrl+Nonsense"); err == nil {
+		t.Error("an unknown key was pressed")
+	}
+	d.send(closeEvent{})
+	if !d.platform.quitted {
+		t.Error("the app did not quit")
+	}
+}
+
+func TestHeadlessLoading(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scenario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "long.txt")
+	ioutil.WriteFile(path, []byte(strings.Repeat("line\n", 100000)), 0666)
+
+	s := newScenario(t)
+	s.openFile(path)
+	if n := s.driver.editor().doc.lineCount(); n != 100001 {
+		t.Errorf("the document has %d lines", n)
+	}
+	if n := len(s.driver.platform.timers); n != 0 {
+		t.Errorf("%d timers run after loading", n)
+	}
+}
+
+func TestHeadlessOpenFileAtAsksToSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scenario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "b.txt")
+	ioutil.WriteFile(a, []byte("a\n"), 0666)
+	ioutil.WriteFile(b, []byte("b\n"), 0666)
+
+	s := newScenario(t)
+	d := s.driver
+	s.openFile(a)
+	// an unmodified file is left right away
+	d.app.openFileAt(b, textPosition{1, 0})
+	if d.app.prompt != nil || d.app.path != b {
+		t.Fatal("the unmodified file was not left")
+	}
+	s.waitForEditor()
+
+	// cancelling keeps the modified file open
+	d.typeText("1")
+	d.app.openFileAt(a, textPosition{0, 0})
+	if d.app.prompt == nil {
+		t.Fatal("leaving the modified file does not ask")
+	}
+	d.keys("Escape")
+	if d.app.path != b || s.text() != "b\n1" {
+		t.Fatalf("cancelling leaves %s with %q", d.app.path, s.text())
+	}
+
+	// no discards the changes
+	d.app.openFileAt(a, textPosition{0, 0})
+	d.typeText("no")
+	d.keys("Enter")
+	if d.app.path != a || s.fileContent(b) != "b\n" {
+		t.Fatalf("the changes were not discarded, %s is open", d.app.path)
+	}
+	s.waitForEditor()
+
+	// yes saves them
+	d.typeText("2")
+	d.app.openFileAt(b, textPosition{0, 0})
+	d.keys("Enter")
+	if d.app.path != b || s.fileContent(a) != "2a\n" {
+		t.Fatalf("the changes were not saved, %s is open", d.app.path)
+	}
+	if len(d.platform.errors) > 0 {
+		t.Fatal(d.platform.errors)
+	}
+}
+
+func TestHeadlessCloseAsksToSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scenario")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.txt")
+	ioutil.WriteFile(path, []byte("a\n"), 0666)
+
+	s := newScenario(t)
+	d := s.driver
+	s.openFile(path)
+	d.typeText("1")
+	// closing the window with pending edits asks first
+	d.send(closeEvent{})
+	if d.platform.quitted || d.app.prompt == nil {
+		t.Fatal("the app quit without asking")
+	}
+	d.keys("Escape")
+	if d.platform.quitted || s.text() != "1a\n" {
+		t.Fatalf("cancelling quits or changes the text to %q", s.text())
+	}
+	// an answer that is neither yes nor no keeps the app open
+	d.send(closeEvent{})
+	d.typeText("maybe")
+	d.keys("Enter")
+	if d.platform.quitted || len(d.platform.errors) != 1 {
+		t.Fatalf("the answer maybe quits with the errors %v", d.platform.errors)
+	}
+	d.platform.errors = nil
+
+	d.send(closeEvent{})
+	d.keys("Enter")
+	if !d.platform.quitted || s.fileContent(path) != "1a\n" {
+		t.Fatalf("yes does not save and quit, the file has %q", s.fileContent(path))
+	}
+	if d.app.file != nil {
+		t.Error("the file is not released")
+	}
+	if len(d.platform.errors) > 0 {
+		t.Fatal(d.platform.errors)
+	}
+}
+
+func TestKeyChar(t *testing.T) {
+	tests := []struct {
+		chord string
+		char  rune
+		ok    bool
+	}{
+		{"A", 'a', true},
+		{"Shift+A", 'A', true},
+		{"Ctrl+C", 3, true},
+		{"Enter", '\r', true},
+		{"Space", ' ', true},
+		{"1", '1', true},
+		{"Alt+A", 0, false},
+		{"Ctrl+1", 0, false},
+		{"Left", 0, false},
+	}
+	for _, tt := range tests {
+		keys, err := parseKeySequence(tt.chord)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if char, ok := keyChar(keys[0]); char != tt.char || ok != tt.ok {
+			t.Errorf("%s gives %q %v, want %q %v", tt.chord, char, ok, tt.char, tt.ok)
+		}
+	}
+}
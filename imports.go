@@ -0,0 +1,724 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// organizeImports runs fixImports on the document, which is the Go file at
+// path, and applies the changes as one undo step. A syntax error is shown in
+// the editor and returned.
+func (e *editor) organizeImports(path string) error {
+	src := e.doc.bytes()
+	fixed, err := fixImports(path, src)
+	if err != nil {
+		e.showProblem(problemFromError(e.doc, err))
+		return err
+	}
+	e.applyReplacements(otherEdit, minimalReplacements(src, fixed), e.now())
+	return nil
+}
+
+// fixImports works like goimports. It adds imports for packages that the Go
+// file at path uses but does not import and removes the imports that are not
+// used. The imports are then grouped into standard library and other packages
+// and the result is formatted. src is the file's current content, if nothing
+// needs to change it is returned as is.
+//
+// Packages are looked up on disk only: in GOROOT, in the module that the file
+// belongs to, in vendor directories and in the module cache.
+func fixImports(path string, src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range file.Imports {
+		if importPath(spec) == "C" {
+			// the import of "C" must stay right after its preamble comment,
+			// cgo files are left alone
+			return src, nil
+		}
+	}
+
+	// refs are the selectors used with every identifier that might be a
+	// package, e.g. fmt.Println gives refs["fmt"]["Println"]
+	unresolved := make(map[*ast.Ident]bool)
+	for _, id := range file.Unresolved {
+		unresolved[id] = true
+	}
+	declared := packageLevelNames(path, file.Name.Name)
+	refs := make(map[string]map[string]bool)
+	ast.Inspect(file, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		x, ok := sel.X.(*ast.Ident)
+		if ok && unresolved[x] && !declared[x.Name] {
+			if refs[x.Name] == nil {
+				refs[x.Name] = make(map[string]bool)
+			}
+			refs[x.Name][sel.Sel.Name] = true
+		}
+		return true
+	})
+
+	index := newPackageIndex(filepath.Dir(path))
+	var kept []*ast.ImportSpec
+	imported := make(map[string]bool)
+	removed := false
+	for _, spec := range file.Imports {
+		name := index.importName(spec)
+		if name == "_" || name == "." || refs[name] != nil {
+			kept = append(kept, spec)
+			imported[name] = true
+		} else {
+			removed = true
+		}
+	}
+	var added []string
+	for name, symbols := range refs {
+		if imported[name] {
+			continue
+		}
+		if p, ok := index.find(name, symbols); ok {
+			added = append(added, p)
+		}
+	}
+	if !removed && len(added) == 0 {
+		return src, nil
+	}
+
+	// the import declarations are replaced by one new declaration at the
+	// place of the first one
+	var specs []string
+	for _, spec := range kept {
+		start, end := spec.Pos(), spec.End()
+		if spec.Doc != nil {
+			start = spec.Doc.Pos()
+		}
+		if spec.Comment != nil {
+			end = spec.Comment.End()
+		}
+		specs = append(specs, string(src[fset.Position(start).Offset:fset.Position(end).Offset]))
+	}
+	for _, p := range added {
+		specs = append(specs, strconv.Quote(p))
+	}
+	decl := formatImportDecl(specs)
+
+	var buf bytes.Buffer
+	var imports []ast.Decl
+	for _, d := range file.Decls {
+		if g, ok := d.(*ast.GenDecl); ok && g.Tok == token.IMPORT {
+			imports = append(imports, d)
+		}
+	}
+	if len(imports) == 0 {
+		end := fset.Position(file.Name.End()).Offset
+		buf.Write(src[:end])
+		buf.WriteString("\n\n" + decl)
+		buf.Write(src[end:])
+	} else {
+		// a doc comment of the first declaration stays in place
+		start := imports[0].Pos()
+		end := imports[len(imports)-1].End()
+		buf.Write(src[:fset.Position(start).Offset])
+		buf.WriteString(decl)
+		buf.Write(src[fset.Position(end).Offset:])
+	}
+	return format.Source(buf.Bytes())
+}
+
+// formatImportDecl creates an import declaration from the import specs, which
+// are the source text of single imports. Standard library imports come first,
+// the others follow in a separate group, both are sorted by path.
+func formatImportDecl(specs []string) string {
+	if len(specs) == 0 {
+		return ""
+	}
+	if len(specs) == 1 && !strings.HasPrefix(specs[0], "/") {
+		return "import " + specs[0]
+	}
+	var std, other []string
+	for _, s := range specs {
+		if isStandardImport(specImportPath(s)) {
+			std = append(std, s)
+		} else {
+			other = append(other, s)
+		}
+	}
+	byPath := func(list []string) func(i, j int) bool {
+		return func(i, j int) bool {
+			return specImportPath(list[i]) < specImportPath(list[j])
+		}
+	}
+	sort.SliceStable(std, byPath(std))
+	sort.SliceStable(other, byPath(other))
+	var b strings.Builder
+	b.WriteString("import (\n")
+	for _, s := range std {
+		b.WriteString("\t" + s + "\n")
+	}
+	if len(std) > 0 && len(other) > 0 {
+		b.WriteString("\n")
+	}
+	for _, s := range other {
+		b.WriteString("\t" + s + "\n")
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// specImportPath finds the quoted import path in the source text of an import
+// spec, it might be preceded by a name and a doc comment.
+func specImportPath(spec string) string {
+	for _, line := range strings.Split(spec, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "//") || strings.HasPrefix(line, "/*") {
+			continue
+		}
+		start := strings.IndexAny(line, "\"`")
+		if start == -1 {
+			continue
+		}
+		end := strings.IndexByte(line[start+1:], line[start])
+		if end != -1 {
+			return line[start+1 : start+1+end]
+		}
+	}
+	return ""
+}
+
+// isStandardImport tells standard library packages from others by the first
+// path element, which contains a dot for all others, e.g. "github.com".
+func isStandardImport(path string) bool {
+	first := strings.SplitN(path, "/", 2)[0]
+	return !strings.Contains(first, ".")
+}
+
+func importPath(spec *ast.ImportSpec) string {
+	p, _ := strconv.Unquote(spec.Path.Value)
+	return p
+}
+
+// packageLevelNames returns the names that the other files of the package in
+// the directory of path declare at package level. The parser cannot resolve
+// them so they look like unknown package names.
+func packageLevelNames(path, pkg string) map[string]bool {
+	names := make(map[string]bool)
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	infos, _ := ioutil.ReadDir(dir)
+	fset := token.NewFileSet()
+	for _, info := range infos {
+		other := info.Name()
+		if other == name || info.IsDir() || !strings.HasSuffix(other, ".go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(dir, other), nil, 0)
+		if err != nil || f.Name.Name != pkg {
+			continue
+		}
+		for n := range declaredNames(f, false) {
+			names[n] = true
+		}
+	}
+	return names
+}
+
+// declaredNames returns the package-level names that f declares, only the
+// exported ones if exportedOnly is true. Methods are not included.
+func declaredNames(f *ast.File, exportedOnly bool) map[string]bool {
+	names := make(map[string]bool)
+	add := func(id *ast.Ident) {
+		if !exportedOnly || id.IsExported() {
+			names[id.Name] = true
+		}
+	}
+	for _, d := range f.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			if d.Recv == nil {
+				add(d.Name)
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					add(s.Name)
+				case *ast.ValueSpec:
+					for _, id := range s.Names {
+						add(id)
+					}
+				}
+			}
+		}
+	}
+	return names
+}
+
+// importCandidate is a package that can be imported.
+type importCandidate struct {
+	path string
+	dir  string
+	name string
+	// rank orders candidates of the same name, lower is better, see the
+	// constants below
+	rank int
+}
+
+const (
+	// packages of the file's own module and vendored packages are preferred
+	localPackage = iota
+	standardPackage
+	modulePackage
+)
+
+// packageIndex finds packages by their names. The candidates are also
+// indexed by path to find the names of imported packages.
+type packageIndex struct {
+	local        map[string][]importCandidate
+	localByPath  map[string]importCandidate
+	global       map[string][]importCandidate
+	globalByPath map[string]importCandidate
+}
+
+// newPackageIndex creates an index for a Go file in dir. The packages in
+// GOROOT and the module cache are scanned once and shared. The packages of
+// the file's module or GOPATH and of its vendor directories change while
+// working on them, see localPackages.
+func newPackageIndex(dir string) *packageIndex {
+	global, globalByPath := globalPackages()
+	local := localPackages(dir)
+	return &packageIndex{
+		local:        local.byName,
+		localByPath:  local.byPath,
+		global:       global,
+		globalByPath: globalByPath,
+	}
+}
+
+// localPackageScan holds the packages that the files of a directory can
+// import besides the global ones. It is not changed after the scan, a refresh
+// replaces it.
+type localPackageScan struct {
+	byName     map[string][]importCandidate
+	byPath     map[string]importCandidate
+	refreshing bool
+}
+
+var (
+	localPackagesMutex sync.Mutex
+	localPackagesCache = make(map[string]*localPackageScan)
+	// localPackageScans counts the refreshes in the background, tests wait
+	// for them
+	localPackageScans sync.WaitGroup
+)
+
+// localPackages returns the packages of the module or GOPATH that contains
+// dir and of its vendor directories. Walking a large GOPATH takes a while so
+// only the first call for a directory waits for the scan. Later calls return
+// the last scan right away and refresh it in the background for the next
+// time.
+func localPackages(dir string) *localPackageScan {
+	dir, _ = filepath.Abs(dir)
+	localPackagesMutex.Lock()
+	scan, ok := localPackagesCache[dir]
+	if ok && !scan.refreshing {
+		scan.refreshing = true
+		localPackageScans.Add(1)
+		go func() {
+			defer localPackageScans.Done()
+			fresh := scanLocalPackages(dir)
+			localPackagesMutex.Lock()
+			localPackagesCache[dir] = fresh
+			localPackagesMutex.Unlock()
+		}()
+	}
+	localPackagesMutex.Unlock()
+	if ok {
+		return scan
+	}
+	scan = scanLocalPackages(dir)
+	localPackagesMutex.Lock()
+	localPackagesCache[dir] = scan
+	localPackagesMutex.Unlock()
+	return scan
+}
+
+func scanLocalPackages(dir string) *localPackageScan {
+	scan := &localPackageScan{
+		byName: make(map[string][]importCandidate),
+		byPath: make(map[string]importCandidate),
+	}
+	add := func(c importCandidate) {
+		if _, ok := scan.byPath[c.path]; ok {
+			// a vendored copy shadows the package further out
+			return
+		}
+		scan.byName[c.name] = append(scan.byName[c.name], c)
+		scan.byPath[c.path] = c
+	}
+	// vendor directories of all parent directories apply, like in GOPATH
+	// mode, the innermost one comes first
+	for d := dir; ; d = filepath.Dir(d) {
+		scanPackages(filepath.Join(d, "vendor"), "", localPackage, add)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	if root, module, ok := findModule(dir); ok {
+		scanPackages(root, module, localPackage, add)
+	} else if src, ok := gopathSrc(dir); ok {
+		// without a module, packages are imported relative to GOPATH/src
+		scanPackages(src, "", localPackage, add)
+	}
+	return scan
+}
+
+var (
+	globalPackagesOnce   sync.Once
+	globalPackagesByName map[string][]importCandidate
+	globalPackagesByPath map[string]importCandidate
+)
+
+// globalPackages scans GOROOT and the module cache on the first call. It can
+// be called in the background early on to have the index ready when it is
+// needed.
+func globalPackages() (byName map[string][]importCandidate, byPath map[string]importCandidate) {
+	globalPackagesOnce.Do(func() {
+		globalPackagesByName = make(map[string][]importCandidate)
+		globalPackagesByPath = make(map[string]importCandidate)
+		add := func(c importCandidate) {
+			if _, ok := globalPackagesByPath[c.path]; ok {
+				// another version of the same module
+				return
+			}
+			globalPackagesByName[c.name] = append(globalPackagesByName[c.name], c)
+			globalPackagesByPath[c.path] = c
+		}
+		scanPackages(filepath.Join(build.Default.GOROOT, "src"), "", standardPackage, add)
+		scanPackages(moduleCacheDir(), "", modulePackage, add)
+	})
+	return globalPackagesByName, globalPackagesByPath
+}
+
+func moduleCacheDir() string {
+	if dir := os.Getenv("GOMODCACHE"); dir != "" {
+		return dir
+	}
+	gopath := filepath.SplitList(build.Default.GOPATH)
+	if len(gopath) == 0 {
+		return ""
+	}
+	return filepath.Join(gopath[0], "pkg", "mod")
+}
+
+// findModule looks for the go.mod file in dir and its parents and returns the
+// module's root directory and path.
+func findModule(dir string) (root, module string, ok bool) {
+	for {
+		f, err := os.Open(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			defer f.Close()
+			s := bufio.NewScanner(f)
+			for s.Scan() {
+				fields := strings.Fields(s.Text())
+				if len(fields) >= 2 && fields[0] == "module" {
+					module, _ = strconv.Unquote(fields[1])
+					if module == "" {
+						module = fields[1]
+					}
+					return dir, module, true
+				}
+			}
+			return "", "", false
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", false
+		}
+		dir = parent
+	}
+}
+
+// gopathSrc returns the src directory of the GOPATH entry that contains dir.
+func gopathSrc(dir string) (string, bool) {
+	for _, gopath := range filepath.SplitList(build.Default.GOPATH) {
+		src := filepath.Join(gopath, "src")
+		if rel, err := filepath.Rel(src, dir); err == nil &&
+			rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return src, true
+		}
+	}
+	return "", false
+}
+
+// scanPackages calls add for every package under root. The import path is
+// the path relative to root, prefixed with prefix. Directories that cannot
+// be imported from outside, like testdata and internal packages, are
+// skipped. Module cache directories like example.com/!some/mod@v1.2.3 are
+// decoded to the module path.
+func scanPackages(root, prefix string, rank int, add func(importCandidate)) {
+	if root == "" {
+		return
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return
+	}
+	filepath.Walk(root, func(dir string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, dir)
+		rel = filepath.ToSlash(rel)
+		base := info.Name()
+		ownModule := rank == localPackage && prefix != ""
+		if dir != root {
+			// vendor directories are scanned on their own, internal packages
+			// can only be imported from within the same module
+			if base == "testdata" || base == "vendor" ||
+				base == "internal" && !ownModule ||
+				strings.HasPrefix(base, ".") || strings.HasPrefix(base, "_") {
+				return filepath.SkipDir
+			}
+		}
+		if rank == standardPackage && rel == "cmd" {
+			return filepath.SkipDir
+		}
+		if rank == modulePackage &&
+			(rel == "cache" || strings.HasPrefix(rel, "golang.org/toolchain@")) {
+			// the downloaded Go toolchains contain another GOROOT
+			return filepath.SkipDir
+		}
+		if ownModule && dir != root {
+			// a nested module is not part of this one
+			if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+		}
+		name := packageNameInDir(dir)
+		if name == "" || name == "main" {
+			return nil
+		}
+		path := rel
+		if rank == modulePackage {
+			path = decodeModulePath(rel)
+		}
+		if prefix != "" {
+			if rel == "." {
+				path = prefix
+			} else {
+				path = prefix + "/" + rel
+			}
+		}
+		if path == "." || path == "" {
+			return nil
+		}
+		add(importCandidate{path: path, dir: dir, name: name, rank: rank})
+		return nil
+	})
+}
+
+// packageNameInDir reads the package clause of the first Go file in dir that
+// is part of the package. It returns "" if there is none.
+func packageNameInDir(dir string) string {
+	fset := token.NewFileSet()
+	for _, path := range packageFiles(dir) {
+		f, err := parser.ParseFile(fset, path, nil, parser.PackageClauseOnly)
+		if err == nil && f.Name.Name != "documentation" {
+			return f.Name.Name
+		}
+	}
+	return ""
+}
+
+// packageFiles returns the Go files in dir that are built for the current
+// platform, without tests. Packages that are not built for this platform at
+// all, e.g. Windows-only packages, use all their files instead so they can
+// still be found.
+func packageFiles(dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var all, matching []string
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, ".go") ||
+			strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		all = append(all, filepath.Join(dir, name))
+		if match, err := build.Default.MatchFile(dir, name); err == nil && match {
+			matching = append(matching, filepath.Join(dir, name))
+		}
+	}
+	if len(matching) > 0 {
+		return matching
+	}
+	// files that are never built, like generators, are package main
+	var other []string
+	fset := token.NewFileSet()
+	for _, path := range all {
+		f, err := parser.ParseFile(fset, path, nil, parser.PackageClauseOnly)
+		if err == nil && f.Name.Name != "main" {
+			other = append(other, path)
+		}
+	}
+	return other
+}
+
+// decodeModulePath converts a directory in the module cache to an import
+// path. The version is removed and upper case letters, which are stored as
+// ! followed by the lower case letter, are restored.
+func decodeModulePath(rel string) string {
+	parts := strings.Split(rel, "/")
+	for i, part := range parts {
+		if at := strings.IndexByte(part, '@'); at != -1 {
+			parts[i] = part[:at]
+		}
+		var b strings.Builder
+		upper := false
+		for _, r := range parts[i] {
+			if r == '!' {
+				upper = true
+				continue
+			}
+			if upper {
+				r = unicode.ToUpper(r)
+				upper = false
+			}
+			b.WriteRune(r)
+		}
+		parts[i] = b.String()
+	}
+	return strings.Join(parts, "/")
+}
+
+// importName returns the name under which the import is used in the file.
+func (index *packageIndex) importName(spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	p := importPath(spec)
+	if c, ok := index.localByPath[p]; ok {
+		return c.name
+	}
+	if c, ok := index.globalByPath[p]; ok {
+		return c.name
+	}
+	// the package is not on disk, guess the name from the path, e.g.
+	// "gopkg.in/yaml.v2" is package yaml
+	name := p[strings.LastIndex(p, "/")+1:]
+	if dot := strings.IndexByte(name, '.'); dot != -1 {
+		name = name[:dot]
+	}
+	return strings.TrimPrefix(name, "go-")
+}
+
+// find returns the import path of the best package with the given name that
+// exports all the symbols.
+func (index *packageIndex) find(name string, symbols map[string]bool) (string, bool) {
+	candidates := append(
+		append([]importCandidate(nil), index.local[name]...),
+		index.global[name]...,
+	)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.rank != b.rank {
+			return a.rank < b.rank
+		}
+		if len(a.path) != len(b.path) {
+			return len(a.path) < len(b.path)
+		}
+		return a.path < b.path
+	})
+	for _, c := range candidates {
+		exports := packageExports(c.dir, c.rank == localPackage)
+		all := true
+		for s := range symbols {
+			if !exports[s] {
+				all = false
+				break
+			}
+		}
+		if all {
+			return c.path, true
+		}
+	}
+	return "", false
+}
+
+type packageExportsEntry struct {
+	names    map[string]bool
+	modified time.Time
+}
+
+var (
+	exportsMutex sync.Mutex
+	exportsCache = make(map[string]packageExportsEntry)
+)
+
+// packageExports returns the exported package-level names of the package in
+// dir, see packageFiles. The names are cached. Local packages are parsed
+// again when their files were modified, GOROOT and the module cache do not
+// change.
+func packageExports(dir string, local bool) map[string]bool {
+	var modified time.Time
+	if local {
+		modified = lastModified(dir)
+	}
+	exportsMutex.Lock()
+	defer exportsMutex.Unlock()
+	if e, ok := exportsCache[dir]; ok && e.modified.Equal(modified) {
+		return e.names
+	}
+	exports := make(map[string]bool)
+	fset := token.NewFileSet()
+	for _, path := range packageFiles(dir) {
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			continue
+		}
+		for n := range declaredNames(f, true) {
+			exports[n] = true
+		}
+	}
+	exportsCache[dir] = packageExportsEntry{names: exports, modified: modified}
+	return exports
+}
+
+// lastModified returns the latest modification time of dir and its Go files.
+// Adding or removing a file changes the directory's time.
+func lastModified(dir string) time.Time {
+	var last time.Time
+	if info, err := os.Stat(dir); err == nil {
+		last = info.ModTime()
+	}
+	infos, _ := ioutil.ReadDir(dir)
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), ".go") && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTree creates the files, given by their slash-separated paths
+// relative to dir, with their content.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFixImports(t *testing.T) {
+	// the global packages are scanned with the real GOPATH, before the tests
+	// change it
+	globalPackages()
+	localPackageScans.Wait()
+	gopath := build.Default.GOPATH
+	defer func() { build.Default.GOPATH = gopath }()
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		// path is the fixed file, relative to the test directory
+		path   string
+		gopath bool
+		src    string
+		want   string
+	}{
+		{
+			name: "add a missing import",
+			path: "p/a.go",
+			src:  "package p\n\nfunc f() { fmt.Println() }\n",
+			want: "package p\n\nimport \"fmt\"\n\nfunc f() { fmt.Println() }\n",
+		},
+		{
+			name: "remove an unused import",
+			path: "p/a.go",
+			src:  "package p\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nfunc f() { fmt.Println() }\n",
+			want: "package p\n\nimport \"fmt\"\n\nfunc f() { fmt.Println() }\n",
+		},
+		{
+			name: "keep names of the package",
+			files: map[string]string{
+				"p/b.go": "package p\n\nvar fmt = struct{ Println func() }{}\n",
+			},
+			path: "p/a.go",
+			src:  "package p\n\nfunc f() { fmt.Println() }\n",
+			want: "package p\n\nfunc f() { fmt.Println() }\n",
+		},
+		{
+			name: "group standard and other packages",
+			files: map[string]string{
+				"go.mod":         "module example.com/m\n",
+				"util/util.go":   "package util\n\nfunc Do() {}\n",
+				"internal/x.go":  "package internal\n\nfunc X() {}\n",
+				"testdata/t.go":  "package util\n\nfunc Test() {}\n",
+				"cmd/main/m.go":  "package main\n\nfunc Main() {}\n",
+				"nested/go.mod":  "module example.com/nested\n",
+				"nested/util.go": "package util\n\nfunc Nested() {}\n",
+			},
+			path: "a.go",
+			src:  "package m\n\nfunc f() {\n\tutil.Do()\n\tstrings.ToUpper(\"\")\n}\n",
+			want: "package m\n\nimport (\n\t\"strings\"\n\n\t\"example.com/m/util\"\n)\n\nfunc f() {\n\tutil.Do()\n\tstrings.ToUpper(\"\")\n}\n",
+		},
+		{
+			name: "prefer the module's package to the standard library",
+			files: map[string]string{
+				"go.mod":             "module example.com/m\n",
+				"strings/strings.go": "package strings\n\nfunc Reverse(s string) string { return s }\n",
+			},
+			path: "a.go",
+			src:  "package m\n\nvar _ = strings.Reverse\n",
+			want: "package m\n\nimport \"example.com/m/strings\"\n\nvar _ = strings.Reverse\n",
+		},
+		{
+			name: "use the standard library if the module's package lacks the name",
+			files: map[string]string{
+				"go.mod":             "module example.com/m\n",
+				"strings/strings.go": "package strings\n\nfunc Reverse(s string) string { return s }\n",
+			},
+			path: "a.go",
+			src:  "package m\n\nvar _ = strings.ToUpper\n",
+			want: "package m\n\nimport \"strings\"\n\nvar _ = strings.ToUpper\n",
+		},
+		{
+			name: "prefer a vendored package to GOPATH",
+			files: map[string]string{
+				"src/example.com/lib/lib.go":                        "package lib\n\nfunc Old() {}\n",
+				"src/example.com/app/vendor/example.com/lib/lib.go": "package lib\n\nfunc New() {}\n",
+			},
+			path:   "src/example.com/app/main.go",
+			gopath: true,
+			src:    "package main\n\nfunc main() { lib.New() }\n",
+			want:   "package main\n\nimport \"example.com/lib\"\n\nfunc main() { lib.New() }\n",
+		},
+		{
+			name: "find packages in GOPATH",
+			files: map[string]string{
+				"src/example.com/lib/lib.go": "package lib\n\nfunc Old() {}\n",
+			},
+			path:   "src/example.com/app/main.go",
+			gopath: true,
+			src:    "package main\n\nfunc main() { lib.Old() }\n",
+			want:   "package main\n\nimport \"example.com/lib\"\n\nfunc main() { lib.Old() }\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "imports")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			// the background scans read GOPATH
+			defer localPackageScans.Wait()
+			writeTree(t, dir, tt.files)
+			build.Default.GOPATH = gopath
+			if tt.gopath {
+				build.Default.GOPATH = dir
+			}
+			path := filepath.Join(dir, filepath.FromSlash(tt.path))
+			os.MkdirAll(filepath.Dir(path), 0777)
+
+			got, err := fixImports(path, []byte(tt.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+			// the result needs no more changes
+			if again, _ := fixImports(path, got); string(again) != string(got) {
+				t.Errorf("fixing again gives\n%s", again)
+			}
+		})
+	}
+}
+
+func TestFixImportsSeesChangedLocalPackages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, map[string]string{
+		"go.mod":       "module example.com/m\n",
+		"util/util.go": "package util\n\nfunc Old() {}\n",
+	})
+	path := filepath.Join(dir, "a.go")
+	src := []byte("package m\n\nvar _ = util.New\n")
+	if got, _ := fixImports(path, src); string(got) != string(src) {
+		t.Fatalf("util.New was found in\n%s", got)
+	}
+
+	// the package gets the function, the file's time is set explicitly to
+	// not depend on the file system's time resolution
+	util := filepath.Join(dir, "util", "util.go")
+	ioutil.WriteFile(util, []byte("package util\n\nfunc Old() {}\n\nfunc New() {}\n"), 0666)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(util, later, later)
+	want := "package m\n\nimport \"example.com/m/util\"\n\nvar _ = util.New\n"
+	if got, _ := fixImports(path, src); string(got) != want {
+		t.Errorf("after adding util.New the file is\n%s", got)
+	}
+}
+
+func TestLocalPackagesRefreshInTheBackground(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, map[string]string{"go.mod": "module example.com/m\n"})
+
+	if scan := localPackages(dir); len(scan.byPath) != 0 {
+		t.Fatalf("the empty module has the packages %v", scan.byPath)
+	}
+	writeTree(t, dir, map[string]string{"util/util.go": "package util\n"})
+	// the next call has the old scan and starts a new one
+	if scan := localPackages(dir); len(scan.byPath) != 0 {
+		t.Fatalf("the cached scan has the packages %v", scan.byPath)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := localPackages(dir).byPath["example.com/m/util"]; ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the new package was not found")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPackageIndexRanking(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, map[string]string{
+		"errors/errors.go": "package errors\n\nfunc New(string) error { return nil }\n\nfunc Wrap(error, string) error { return nil }\n",
+		"long/errors/e.go": "package errors\n\nfunc New(string) error { return nil }\n\nfunc Wrap(error, string) error { return nil }\n",
+	})
+	std := importCandidate{
+		path: "errors",
+		dir:  filepath.Join(build.Default.GOROOT, "src", "errors"),
+		name: "errors",
+		rank: standardPackage,
+	}
+	pkg := importCandidate{
+		path: "github.com/pkg/errors",
+		dir:  filepath.Join(dir, "errors"),
+		name: "errors",
+		rank: modulePackage,
+	}
+	short := importCandidate{
+		path: "a.io/errors",
+		dir:  filepath.Join(dir, "long", "errors"),
+		name: "errors",
+		rank: modulePackage,
+	}
+	index := &packageIndex{
+		global: map[string][]importCandidate{"errors": {pkg, short, std}},
+	}
+	tests := []struct {
+		symbols []string
+		want    string
+	}{
+		{[]string{"New"}, "errors"},
+		{[]string{"Is", "New"}, "errors"},
+		// the shorter path of equal ranks comes first
+		{[]string{"Wrap"}, "a.io/errors"},
+		{[]string{"New", "Wrap"}, "a.io/errors"},
+		{[]string{"Missing"}, ""},
+	}
+	for _, tt := range tests {
+		symbols := make(map[string]bool)
+		for _, s := range tt.symbols {
+			symbols[s] = true
+		}
+		got, ok := index.find("errors", symbols)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("errors with %v is %q, want %q", tt.symbols, got, tt.want)
+		}
+	}
+}
+
+func TestFindModule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "module")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, map[string]string{
+		"plain/go.mod":            "module example.com/plain\n\ngo 1.16\n",
+		"plain/a/b/b.go":          "package b\n",
+		"quoted/go.mod":           "// the module\nmodule \"example.com/quoted\"\n",
+		"nested/go.mod":           "module example.com/outer\n",
+		"nested/inner/go.mod":     "module example.com/inner\n",
+		"nested/inner/pkg/pkg.go": "package pkg\n",
+		"broken/go.mod":           "go 1.16\n",
+		"broken/sub/sub.go":       "package sub\n",
+	})
+	tests := []struct {
+		dir          string
+		root, module string
+		ok           bool
+	}{
+		{"plain", "plain", "example.com/plain", true},
+		{"plain/a/b", "plain", "example.com/plain", true},
+		{"quoted", "quoted", "example.com/quoted", true},
+		// the closest go.mod counts
+		{"nested/inner/pkg", "nested/inner", "example.com/inner", true},
+		{"nested", "nested", "example.com/outer", true},
+		// a go.mod without a module line ends the search
+		{"broken/sub", "", "", false},
+	}
+	for _, tt := range tests {
+		root, module, ok := findModule(filepath.Join(dir, filepath.FromSlash(tt.dir)))
+		wantRoot := ""
+		if tt.ok {
+			wantRoot = filepath.Join(dir, filepath.FromSlash(tt.root))
+		}
+		if root != wantRoot || module != tt.module || ok != tt.ok {
+			t.Errorf("%s is in %q %q %v, want %q %q %v", tt.dir, root, module, ok, wantRoot, tt.module, tt.ok)
+		}
+	}
+}
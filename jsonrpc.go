@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// jsonrpcConn is a JSON-RPC 2.0 connection with the framing of the Language
+// Server Protocol: every message is preceded by a Content-Length header.
+// Messages are read in a background goroutine, responses and incoming
+// messages are handed to callbacks on that goroutine.
+type jsonrpcConn struct {
+	writeMutex sync.Mutex
+	w          io.Writer
+
+	mutex  sync.Mutex
+	nextID int
+	calls  map[int]func(result json.RawMessage, err error)
+	closed error
+
+	// handle is called for requests and notifications from the other side.
+	// For requests the result is sent back, for notifications it is ignored.
+	handle func(method string, params json.RawMessage) (interface{}, error)
+	// done is closed when the reader stopped
+	done chan bool
+}
+
+type jsonrpcMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *jsonrpcError    `json:"error,omitempty"`
+}
+
+// jsonrpcError is an error response.
+type jsonrpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *jsonrpcError) Error() string {
+	return e.Message + " (" + strconv.Itoa(e.Code) + ")"
+}
+
+const jsonrpcMethodNotFound = -32601
+
+var errConnectionClosed = errors.New("connection closed")
+
+func newJSONRPCConn(r io.Reader, w io.Writer, handle func(method string, params json.RawMessage) (interface{}, error)) *jsonrpcConn {
+	c := &jsonrpcConn{
+		w:      w,
+		calls:  make(map[int]func(json.RawMessage, error)),
+		handle: handle,
+		done:   make(chan bool),
+	}
+	go c.read(bufio.NewReader(r))
+	return c
+}
+
+// call sends a request. done is called with the result once the response
+// arrives, on the reader goroutine.
+func (c *jsonrpcConn) call(method string, params interface{}, done func(result json.RawMessage, err error)) {
+	c.mutex.Lock()
+	if c.closed != nil {
+		err := c.closed
+		c.mutex.Unlock()
+		done(nil, err)
+		return
+	}
+	c.nextID++
+	id := c.nextID
+	c.calls[id] = done
+	c.mutex.Unlock()
+
+	rawID := json.RawMessage(strconv.Itoa(id))
+	if err := c.send(method, &rawID, params); err != nil {
+		c.mutex.Lock()
+		delete(c.calls, id)
+		c.mutex.Unlock()
+		done(nil, err)
+	}
+}
+
+// notify sends a notification, which has no response.
+func (c *jsonrpcConn) notify(method string, params interface{}) error {
+	return c.send(method, nil, params)
+}
+
+func (c *jsonrpcConn) send(method string, id *json.RawMessage, params interface{}) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return makeErr("encode "+method, err)
+	}
+	return c.write(jsonrpcMessage{ID: id, Method: method, Params: data})
+}
+
+func (c *jsonrpcConn) write(msg jsonrpcMessage) error {
+	msg.JSONRPC = "2.0"
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return writeFramedMessage(c.w, data)
+}
+
+// writeFramedMessage writes data with a Content-Length header, the framing
+// that the Language Server and the Debug Adapter Protocol share.
+func writeFramedMessage(w io.Writer, data []byte) error {
+	header := "Content-Length: " + strconv.Itoa(len(data)) + "\r\n\r\n"
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// read handles incoming messages until the connection breaks. Then all calls
+// that are still waiting fail.
+func (c *jsonrpcConn) read(r *bufio.Reader) {
+	var err error
+	for err == nil {
+		var msg jsonrpcMessage
+		msg, err = readJSONRPCMessage(r)
+		if err == nil {
+			c.receive(msg)
+		}
+	}
+	if err == io.EOF {
+		err = errConnectionClosed
+	}
+	c.mutex.Lock()
+	c.closed = err
+	calls := c.calls
+	c.calls = nil
+	c.mutex.Unlock()
+	for _, done := range calls {
+		done(nil, err)
+	}
+	close(c.done)
+}
+
+func (c *jsonrpcConn) receive(msg jsonrpcMessage) {
+	if msg.Method == "" {
+		// a response to one of our calls
+		id, _ := strconv.Atoi(string(*msg.ID))
+		c.mutex.Lock()
+		done := c.calls[id]
+		delete(c.calls, id)
+		c.mutex.Unlock()
+		if done == nil {
+			return
+		}
+		if msg.Error != nil {
+			done(nil, msg.Error)
+		} else {
+			done(msg.Result, nil)
+		}
+		return
+	}
+	result, err := c.handle(msg.Method, msg.Params)
+	if msg.ID == nil {
+		return
+	}
+	response := jsonrpcMessage{ID: msg.ID}
+	if err != nil {
+		response.Error = &jsonrpcError{Message: err.Error()}
+		if rpcErr, ok := err.(*jsonrpcError); ok {
+			response.Error = rpcErr
+		}
+	} else if response.Result, err = json.Marshal(result); err != nil {
+		response.Error = &jsonrpcError{Message: err.Error()}
+	}
+	c.write(response)
+}
+
+// readJSONRPCMessage reads the headers and the content of one message.
+func readJSONRPCMessage(r *bufio.Reader) (jsonrpcMessage, error) {
+	var msg jsonrpcMessage
+	data, err := readFramedMessage(r)
+	if err != nil {
+		return msg, err
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return msg, makeErr("invalid JSON-RPC message", err)
+	}
+	if msg.Method == "" && msg.ID == nil {
+		return msg, errors.New("JSON-RPC message without method and id")
+	}
+	return msg, nil
+}
+
+// readFramedMessage reads the headers of a message and returns its content.
+func readFramedMessage(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon != -1 && strings.EqualFold(line[:colon], "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(line[colon+1:]))
+			if err != nil {
+				return nil, makeErr("invalid Content-Length", err)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("message without Content-Length")
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
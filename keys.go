@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// keyChord is a key together with the modifier keys that were held down when
+// it was pressed. Keys are identified by their names as listed in keyNames,
+// e.g. "A", "F5" or "PageUp".
+type keyChord struct {
+	key       string
+	modifiers modifiers
+}
+
+type modifiers int
+
+const (
+	ctrlKey modifiers = 1 << iota
+	shiftKey
+	altKey
+)
+
+// keyNames are all valid key names. The platform layer translates its key
+// codes to these.
+var keyNames = []string{
+	"A", "B", "C", "D", "E", "F", "G", "H", "I", "J", "K", "L", "M", "N",
+	"O", "P", "Q", "R", "S", "T", "U", "V", "W", "X", "Y", "Z",
+	"0", "1", "2", "3", "4", "5", "6", "7", "8", "9",
+	"F1", "F2", "F3", "F4", "F5", "F6", "F7", "F8", "F9", "F10", "F11", "F12",
+	"Left", "Right", "Up", "Down", "Home", "End", "PageUp", "PageDown",
+	"Insert", "Delete", "Backspace", "Tab", "Enter", "Escape", "Space",
+	",", ".", "-", "=", ";", "/", "`", "[", "\\", "]", "'",
+}
+
+// canonicalKeyNames maps lower case key names to their canonical spelling.
+var canonicalKeyNames = func() map[string]string {
+	m := make(map[string]string)
+	for _, name := range keyNames {
+		m[strings.ToLower(name)] = name
+	}
+	return m
+}()
+
+func (k keyChord) String() string {
+	s := ""
+	if k.modifiers&ctrlKey != 0 {
+		s += "Ctrl+"
+	}
+	if k.modifiers&shiftKey != 0 {
+		s += "Shift+"
+	}
+	if k.modifiers&altKey != 0 {
+		s += "Alt+"
+	}
+	return s + k.key
+}
+
+// parseKeyChord parses a key with modifiers, like "Ctrl+Shift+K". Case is
+// ignored and the modifiers can be in any order.
+func parseKeyChord(s string) (keyChord, error) {
+	var k keyChord
+	parts := strings.Split(s, "+")
+	if strings.HasSuffix(s, "++") || s == "+" {
+		// the plus key is called "=" (which is on the same key on US
+		// keyboards) but a trailing "+" would result in an empty part
+		return k, errors.New("invalid key chord '" + s + "', use '=' for the plus key")
+	}
+	for i, part := range parts {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if i < len(parts)-1 {
+			switch part {
+			case "ctrl", "control":
+				k.modifiers |= ctrlKey
+			case "shift":
+				k.modifiers |= shiftKey
+			case "alt":
+				k.modifiers |= altKey
+			default:
+				return k, errors.New("unknown modifier '" + part + "' in '" + s + "'")
+			}
+		} else {
+			name, ok := canonicalKeyNames[part]
+			if !ok {
+				return k, errors.New("unknown key '" + part + "' in '" + s + "'")
+			}
+			k.key = name
+		}
+	}
+	return k, nil
+}
+
+// parseKeySequence parses space-separated key chords, e.g. "Ctrl+K Ctrl+C".
+func parseKeySequence(s string) ([]keyChord, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, errors.New("empty key sequence")
+	}
+	keys := make([]keyChord, len(fields))
+	for i, f := range fields {
+		k, err := parseKeyChord(f)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = k
+	}
+	return keys, nil
+}
+
+func keySequenceString(keys []keyChord) string {
+	s := make([]string, len(keys))
+	for i := range keys {
+		s[i] = keys[i].String()
+	}
+	return strings.Join(s, " ")
+}
+
+// keymap maps key sequences to command names. A sequence can consist of
+// several chords, like "Ctrl+K Ctrl+C", in which case the keymap remembers the
+// keys pressed so far until the sequence is complete.
+type keymap struct {
+	// bindings maps key sequences, as returned by keySequenceString, to
+	// command names
+	bindings map[string]string
+	// prefixes contains all proper prefixes of bound sequences
+	prefixes map[string]bool
+	pending  []keyChord
+}
+
+func newKeymap() *keymap {
+	return &keymap{
+		bindings: make(map[string]string),
+		prefixes: make(map[string]bool),
+	}
+}
+
+// bind maps the key sequence to the command, replacing an existing binding.
+// An empty command removes the binding.
+func (m *keymap) bind(sequence string, command string) error {
+	keys, err := parseKeySequence(sequence)
+	if err != nil {
+		return err
+	}
+	if command == "" {
+		delete(m.bindings, keySequenceString(keys))
+	} else {
+		m.bindings[keySequenceString(keys)] = command
+	}
+	m.updatePrefixes()
+	return nil
+}
+
+func (m *keymap) updatePrefixes() {
+	m.prefixes = make(map[string]bool)
+	for sequence := range m.bindings {
+		keys, _ := parseKeySequence(sequence)
+		for i := 1; i < len(keys); i++ {
+			m.prefixes[keySequenceString(keys[:i])] = true
+		}
+	}
+}
+
+// keyResult tells what a key press did in the keymap.
+type keyResult int
+
+const (
+	// keyUnbound means the key is not part of any binding
+	keyUnbound keyResult = iota
+	// keyPending means the key started or continued a multi-chord sequence
+	keyPending
+	// keyCommand means the key completed a binding
+	keyCommand
+	// keyCancelled means a pending sequence was ended with a key that does
+	// not complete any binding
+	keyCancelled
+)
+
+// press feeds the next key to the keymap. If it completes a binding, the
+// bound command name is returned.
+func (m *keymap) press(k keyChord) (string, keyResult) {
+	hadPending := len(m.pending) > 0
+	m.pending = append(m.pending, k)
+	sequence := keySequenceString(m.pending)
+	if command, ok := m.bindings[sequence]; ok {
+		m.pending = nil
+		return command, keyCommand
+	}
+	if m.prefixes[sequence] {
+		return "", keyPending
+	}
+	m.pending = nil
+	if hadPending {
+		return "", keyCancelled
+	}
+	return "", keyUnbound
+}
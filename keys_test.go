@@ -0,0 +1,135 @@
+package main
+
+import "testing"
+
+func TestParseKeyChord(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"A", "A"},
+		{"ctrl+k", "Ctrl+K"},
+		{"Shift+Ctrl+pageup", "Ctrl+Shift+PageUp"},
+		{"alt+shift+control+f12", "Ctrl+Shift+Alt+F12"},
+		{" Ctrl + Space ", "Ctrl+Space"},
+		{"Ctrl+=", "Ctrl+="},
+		{"Ctrl+.", "Ctrl+."},
+	}
+	for _, tt := range tests {
+		k, err := parseKeyChord(tt.s)
+		if err != nil {
+			t.Errorf("%q: %v", tt.s, err)
+			continue
+		}
+		if k.String() != tt.want {
+			t.Errorf("%q is %s, want %s", tt.s, k, tt.want)
+		}
+	}
+	for _, s := range []string{"", "Ctrl+", "Ctrl++", "+", "Ctrl+Foo", "Super+A", "Ctrl+Shift"} {
+		if k, err := parseKeyChord(s); err == nil {
+			t.Errorf("%q is the key chord %s", s, k)
+		}
+	}
+}
+
+func TestParseKeySequence(t *testing.T) {
+	keys, err := parseKeySequence("ctrl+k  ctrl+shift+o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := keySequenceString(keys); s != "Ctrl+K Ctrl+Shift+O" {
+		t.Errorf("the sequence is %s", s)
+	}
+	for _, s := range []string{"", "  ", "Ctrl+K Ctrl+Nope"} {
+		if _, err := parseKeySequence(s); err == nil {
+			t.Errorf("%q is a key sequence", s)
+		}
+	}
+}
+
+func TestKeymapPress(t *testing.T) {
+	m := newKeymap()
+	m.bind("Ctrl+K Ctrl+C", "comment")
+	m.bind("Ctrl+K Ctrl+K Ctrl+K", "triple")
+	m.bind("Ctrl+S", "save")
+	press := func(chord string) (string, keyResult) {
+		t.Helper()
+		k, err := parseKeyChord(chord)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.press(k)
+	}
+	type step struct {
+		key     string
+		command string
+		result  keyResult
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"single chord", []step{{"Ctrl+S", "save", keyCommand}}},
+		{"unbound", []step{{"Ctrl+Q", "", keyUnbound}}},
+		{"two chords", []step{
+			{"Ctrl+K", "", keyPending},
+			{"Ctrl+C", "comment", keyCommand},
+		}},
+		{"three chords", []step{
+			{"Ctrl+K", "", keyPending},
+			{"Ctrl+K", "", keyPending},
+			{"Ctrl+K", "triple", keyCommand},
+		}},
+		// a key that ends no sequence resets it, the next key starts over
+		{"reset", []step{
+			{"Ctrl+K", "", keyPending},
+			{"Ctrl+S", "", keyCancelled},
+			{"Ctrl+S", "save", keyCommand},
+		}},
+		{"reset after two chords", []step{
+			{"Ctrl+K", "", keyPending},
+			{"Ctrl+K", "", keyPending},
+			{"Ctrl+C", "", keyCancelled},
+			{"Ctrl+K", "", keyPending},
+			{"Ctrl+C", "comment", keyCommand},
+		}},
+		{"modifiers count", []step{
+			{"Ctrl+K", "", keyPending},
+			{"C", "", keyCancelled},
+		}},
+	}
+	for _, tt := range tests {
+		for i, s := range tt.steps {
+			command, result := press(s.key)
+			if command != s.command || result != s.result {
+				t.Errorf("%s: key %d %s gives %q %v, want %q %v",
+					tt.name, i, s.key, command, result, s.command, s.result)
+			}
+		}
+		if len(m.pending) != 0 {
+			t.Errorf("%s: the keys %v are still pending", tt.name, m.pending)
+		}
+	}
+}
+
+func TestKeymapBind(t *testing.T) {
+	m := newKeymap()
+	if err := m.bind("Ctrl+K Ctrl+C", "comment"); err != nil {
+		t.Fatal(err)
+	}
+	if !m.prefixes["Ctrl+K"] {
+		t.Error("Ctrl+K is not a prefix")
+	}
+	// another command replaces the binding, an empty one removes it
+	m.bind("ctrl+k ctrl+c", "other")
+	if c := m.bindings["Ctrl+K Ctrl+C"]; c != "other" {
+		t.Errorf("the sequence is bound to %q", c)
+	}
+	m.bind("Ctrl+K Ctrl+C", "")
+	if len(m.bindings) != 0 || len(m.prefixes) != 0 {
+		t.Errorf("after the removal the bindings are %v with the prefixes %v", m.bindings, m.prefixes)
+	}
+	if err := m.bind("Ctrl+Nope", "comment"); err == nil {
+		t.Error("an invalid key was bound")
+	}
+}
@@ -0,0 +1,78 @@
+//+build windows
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/gonutz/ide/w32"
+)
+
+// win32KeyNames maps virtual key codes to the platform-neutral key names
+// used in key bindings. Letters and digits are added in init since their
+// virtual key codes are their ASCII values.
+var win32KeyNames = map[uintptr]string{
+	w32.VK_LEFT:       "Left",
+	w32.VK_RIGHT:      "Right",
+	w32.VK_UP:         "Up",
+	w32.VK_DOWN:       "Down",
+	w32.VK_HOME:       "Home",
+	w32.VK_END:        "End",
+	w32.VK_PRIOR:      "PageUp",
+	w32.VK_NEXT:       "PageDown",
+	w32.VK_INSERT:     "Insert",
+	w32.VK_DELETE:     "Delete",
+	w32.VK_BACK:       "Backspace",
+	w32.VK_TAB:        "Tab",
+	w32.VK_RETURN:     "Enter",
+	w32.VK_ESCAPE:     "Escape",
+	w32.VK_SPACE:      "Space",
+	w32.VK_OEM_COMMA:  ",",
+	w32.VK_OEM_PERIOD: ".",
+	w32.VK_OEM_MINUS:  "-",
+	w32.VK_OEM_PLUS:   "=",
+	w32.VK_OEM_1:      ";",
+	w32.VK_OEM_2:      "/",
+	w32.VK_OEM_3:      "`",
+	w32.VK_OEM_4:      "[",
+	w32.VK_OEM_5:      "\\",
+	w32.VK_OEM_6:      "]",
+	w32.VK_OEM_7:      "'",
+}
+
+func init() {
+	for c := 'A'; c <= 'Z'; c++ {
+		win32KeyNames[uintptr(c)] = string(c)
+	}
+	for c := '0'; c <= '9'; c++ {
+		win32KeyNames[uintptr(c)] = string(c)
+	}
+	for i := 0; i < 12; i++ {
+		win32KeyNames[w32.VK_F1+uintptr(i)] = "F" + strconv.Itoa(i+1)
+	}
+}
+
+// win32KeyChord translates a WM_KEYDOWN or WM_SYSKEYDOWN virtual key into a
+// key chord, reading the current modifier key state. It returns false for keys
+// that cannot be bound, like the modifier keys themselves.
+func win32KeyChord(vk uintptr) (keyChord, bool) {
+	name, ok := win32KeyNames[vk]
+	if !ok {
+		return keyChord{}, false
+	}
+	k := keyChord{key: name}
+	if isKeyDown(w32.VK_CONTROL) {
+		k.modifiers |= ctrlKey
+	}
+	if isKeyDown(w32.VK_SHIFT) {
+		k.modifiers |= shiftKey
+	}
+	if isKeyDown(w32.VK_MENU) {
+		k.modifiers |= altKey
+	}
+	return k, true
+}
+
+func isKeyDown(key uintptr) bool {
+	return w32.GetKeyState(key)&(1<<15) != 0
+}
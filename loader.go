@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// fileLoad is a file that is being opened. The file content is mapped into
+// memory right away so the first lines can be displayed immediately while the
+// line break index over the whole content is built in the background. Once
+// that is done, the document can be created without further work.
+type fileLoad struct {
+	path  string
+	data  []byte
+	unmap func() error
+	// indexed is the number of bytes that the background indexer has
+	// processed so far, it is accessed atomically
+	indexed int64
+	buffer  *textBuffer
+	done    chan bool
+	// notify, if not nil, is called from the indexing goroutine whenever
+	// progress is made and once when indexing is finished
+	notify func()
+}
+
+// loadFile maps the file at path into memory and starts indexing it in the
+// background. The file must not be modified by other programs while it is
+// open. Call close when the document is not needed anymore to release the
+// mapping.
+func loadFile(path string, notify func()) (*fileLoad, error) {
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, makeErr("load file "+path, err)
+	}
+	l := &fileLoad{
+		path:   path,
+		data:   data,
+		unmap:  unmap,
+		done:   make(chan bool),
+		notify: notify,
+	}
+	go l.index()
+	return l, nil
+}
+
+// index builds the line break index for the mapped data block by block,
+// the same way newTextBuffer does, but it reports progress in between.
+func (l *fileLoad) index() {
+	b := &textBuffer{data: l.data, blockLineBreaks: []int{0}}
+	const reportEvery = 256
+	for i := 1; b.indexNextBlock(); i++ {
+		if i%reportEvery == 0 {
+			atomic.StoreInt64(&l.indexed, int64(i*textBufferBlockSize))
+			if l.notify != nil {
+				l.notify()
+			}
+		}
+	}
+	atomic.StoreInt64(&l.indexed, int64(len(l.data)))
+	l.buffer = b
+	close(l.done)
+	if l.notify != nil {
+		l.notify()
+	}
+}
+
+// isDone returns true once the background indexing is finished and document
+// can be called without blocking.
+func (l *fileLoad) isDone() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// progress returns a value in [0..1] that tells how much of the file was
+// indexed already.
+func (l *fileLoad) progress() float64 {
+	if len(l.data) == 0 {
+		return 1
+	}
+	return float64(atomic.LoadInt64(&l.indexed)) / float64(len(l.data))
+}
+
+// document waits for the indexing to finish and returns the loaded document.
+func (l *fileLoad) document() *document {
+	<-l.done
+	return newDocumentFromBuffer(l.buffer)
+}
+
+// preview returns the first count lines of the file without using the line
+// break index, it can be called while indexing is still in progress. Lines
+// are cut off after maxLineLength bytes like in document.lines.
+func (l *fileLoad) preview(count, maxLineLength int) []byte {
+	var buf []byte
+	data := l.data
+	for line := 0; line < count && len(data) > 0; line++ {
+		end := bytes.IndexByte(data, '\n')
+		if end == -1 {
+			end = len(data)
+		}
+		if end > maxLineLength {
+			buf = append(buf, data[:maxLineLength]...)
+		} else {
+			buf = append(buf, data[:end]...)
+		}
+		if end < len(data) {
+			end++ // skip the line break
+			if line+1 < count {
+				buf = append(buf, '\n')
+			}
+		}
+		data = data[end:]
+	}
+	return buf
+}
+
+// close releases the file mapping. Neither the document nor any of its copies
+// may be used afterwards.
+func (l *fileLoad) close() error {
+	<-l.done
+	return l.unmap()
+}
+
+// detach copies the mapped file content into memory and releases the mapping.
+// The document and its copies stay valid. This is necessary before the file
+// can be overwritten, the mapped content would change with it and Windows
+// does not allow replacing a mapped file at all.
+func (l *fileLoad) detach() error {
+	<-l.done
+	data := append([]byte(nil), l.data...)
+	if err := l.unmap(); err != nil {
+		return makeErr("release file mapping", err)
+	}
+	l.data = data
+	l.buffer.data = data
+	l.unmap = func() error { return nil }
+	return nil
+}
+
+// writeDocument saves the document to the file at path. It is written to a
+// temporary file first which then replaces the original so a failure does not
+// leave a half-written file behind.
+func writeDocument(path string, doc *document) error {
+	temp, err := writeTempFile(path, doc.writeTo)
+	if err == nil {
+		err = os.Rename(temp, path)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return makeErr("save "+path, err)
+	}
+	return nil
+}
+
+// writeFiles replaces the contents of several files. All of them are written
+// to temporary files before the first one is replaced, so an error, e.g. a
+// full disk, leaves all files unchanged.
+func writeFiles(contents map[string][]byte) error {
+	temps := make(map[string]string)
+	removeTemps := func() {
+		for _, temp := range temps {
+			os.Remove(temp)
+		}
+	}
+	for path, data := range contents {
+		data := data
+		temp, err := writeTempFile(path, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+		if err != nil {
+			os.Remove(temp)
+			removeTemps()
+			return makeErr("save "+path, err)
+		}
+		temps[path] = temp
+	}
+	for path, temp := range temps {
+		if err := os.Rename(temp, path); err != nil {
+			removeTemps()
+			return makeErr("save "+path, err)
+		}
+		delete(temps, path)
+	}
+	return nil
+}
+
+// writeTempFile writes a temporary file next to path, with the mode of the
+// file at path, and returns its name. The file is left behind on errors, the
+// caller removes it.
+func writeTempFile(path string, write func(io.Writer) error) (string, error) {
+	mode := os.FileMode(0666)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode()
+	}
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(f)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), mode)
+	}
+	return f.Name(), err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := bytes.Repeat([]byte("hello world\nsecond line\n"), 100000)
+	path := filepath.Join(dir, "big.txt")
+	if err := ioutil.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := loadFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := string(l.preview(3, 5)); p != "hello\nsecon\nhello" {
+		t.Errorf("preview is %q", p)
+	}
+	d := l.document()
+	if !l.isDone() || l.progress() != 1 {
+		t.Errorf("not done after document, progress %v", l.progress())
+	}
+	if !bytes.Equal(d.bytes(), data) || d.lineCount() != 200001 {
+		t.Errorf("the document has %d lines", d.lineCount())
+	}
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadFile(filepath.Join(dir, "missing.txt"), nil); err == nil {
+		t.Error("a missing file loaded")
+	}
+}
+
+func TestOpenFileReleasesThePreviousFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	first, second := filepath.Join(dir, "first.txt"), filepath.Join(dir, "second.txt")
+	ioutil.WriteFile(first, []byte("first"), 0666)
+	ioutil.WriteFile(second, []byte("second"), 0666)
+
+	d := newHeadlessDriver(newRecordingGraphics(fixedWidthFont{10, 20}), 800, 600, time.Unix(0, 0))
+	released := make(chan string, 2)
+	open := func(path string) {
+		if err := d.app.openFile(path); err != nil {
+			t.Fatal(err)
+		}
+		l := d.app.file
+		unmap := l.unmap
+		l.unmap = func() error {
+			released <- l.path
+			return unmap()
+		}
+	}
+	open(first)
+	open(second)
+	select {
+	case path := <-released:
+		if path != first {
+			t.Errorf("%s was released instead of %s", path, first)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the first file was not released")
+	}
+	d.send(closeEvent{})
+	select {
+	case path := <-released:
+		if path != second {
+			t.Errorf("%s was released instead of %s", path, second)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the second file was not released on exit")
+	}
+}
@@ -0,0 +1,982 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// The types below are the parts of the Language Server Protocol that the
+// client uses, the JSON names are the ones from the specification.
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+// lspWorkspaceEdit contains text edits for several files, servers use either
+// Changes or DocumentChanges.
+type lspWorkspaceEdit struct {
+	Changes         map[string][]lspTextEdit `json:"changes,omitempty"`
+	DocumentChanges []lspTextDocumentEdit    `json:"documentChanges,omitempty"`
+}
+
+type lspTextDocumentEdit struct {
+	TextDocument lspVersionedDocument `json:"textDocument"`
+	Edits        []lspTextEdit        `json:"edits"`
+}
+
+type lspVersionedDocument struct {
+	URI     string `json:"uri"`
+	Version int    `json:"version"`
+}
+
+// fileEdits returns the edits of a workspace edit by file URI.
+func (e *lspWorkspaceEdit) fileEdits() map[string][]lspTextEdit {
+	edits := make(map[string][]lspTextEdit)
+	for uri, list := range e.Changes {
+		edits[uri] = append(edits[uri], list...)
+	}
+	for _, d := range e.DocumentChanges {
+		edits[d.TextDocument.URI] = append(edits[d.TextDocument.URI], d.Edits...)
+	}
+	return edits
+}
+
+const (
+	lspError       = 1
+	lspWarning     = 2
+	lspInformation = 3
+	lspHint        = 4
+)
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity,omitempty"`
+	Source   string   `json:"source,omitempty"`
+	Message  string   `json:"message"`
+}
+
+type lspCompletionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	// Documentation is a string or a markup content
+	Documentation    json.RawMessage `json:"documentation,omitempty"`
+	SortText         string          `json:"sortText,omitempty"`
+	FilterText       string          `json:"filterText,omitempty"`
+	InsertText       string          `json:"insertText,omitempty"`
+	InsertTextFormat int             `json:"insertTextFormat,omitempty"`
+	TextEdit         *lspTextEdit    `json:"textEdit,omitempty"`
+}
+
+// lspSnippetFormat is the InsertTextFormat of completions with placeholders
+// like ${1:name}.
+const lspSnippetFormat = 2
+
+type lspCommand struct {
+	Title     string            `json:"title"`
+	Command   string            `json:"command"`
+	Arguments []json.RawMessage `json:"arguments,omitempty"`
+}
+
+type lspCodeAction struct {
+	Title       string            `json:"title"`
+	Kind        string            `json:"kind,omitempty"`
+	Diagnostics []lspDiagnostic   `json:"diagnostics,omitempty"`
+	Edit        *lspWorkspaceEdit `json:"edit,omitempty"`
+	Command     *lspCommand       `json:"command,omitempty"`
+}
+
+type lspDocumentID struct {
+	URI string `json:"uri"`
+}
+
+type lspDocumentPosition struct {
+	TextDocument lspDocumentID `json:"textDocument"`
+	Position     lspPosition   `json:"position"`
+}
+
+// lspContentChange is an incremental change of a document.
+type lspContentChange struct {
+	Range *lspRange `json:"range,omitempty"`
+	Text  string    `json:"text"`
+}
+
+// pathToURI converts a file path to a file URI, e.g. C:\a b\x.go becomes
+// file:///C:/a%20b/x.go.
+func pathToURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	u := url.URL{Scheme: "file", Path: path}
+	return u.String()
+}
+
+// uriToPath converts a file URI to a file path.
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	path := u.Path
+	if len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+		// a Windows path like /C:/x.go
+		path = path[1:]
+	}
+	return filepath.FromSlash(path)
+}
+
+// lspPositionAt converts a byte offset in doc to a position. With utf8 the
+// character is the byte column, otherwise it counts UTF-16 code units, which
+// is the protocol's default.
+func lspPositionAt(doc *document, offset int, utf8Columns bool) lspPosition {
+	line, col := doc.offsetToLineCol(offset)
+	if !utf8Columns {
+		col = utf16Length(doc.slice(doc.lineStart(line), offset))
+	}
+	return lspPosition{Line: line, Character: col}
+}
+
+// lspOffset converts a position to a byte offset in doc, positions outside
+// the document are clamped.
+func lspOffset(doc *document, p lspPosition, utf8Columns bool) int {
+	if p.Line >= doc.lineCount() {
+		return doc.len()
+	}
+	if p.Line < 0 {
+		return 0
+	}
+	start, end := doc.lineStart(p.Line), doc.lineEnd(p.Line)
+	if utf8Columns {
+		return start + clamp(p.Character, 0, end-start)
+	}
+	line := doc.slice(start, end)
+	units := 0
+	for i := 0; i < len(line); {
+		if units >= p.Character {
+			return start + i
+		}
+		r, size := utf8.DecodeRune(line[i:])
+		units += utf16Length([]byte(string(r)))
+		i += size
+	}
+	return end
+}
+
+// utf16Length returns the number of UTF-16 code units of the UTF-8 text.
+func utf16Length(text []byte) int {
+	n := 0
+	for len(text) > 0 {
+		r, size := utf8.DecodeRune(text)
+		text = text[size:]
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// lspClient talks to a language server. Requests are sent right away, their
+// results and the messages from the server are collected in the background
+// and handed to the callbacks when poll is called, on the caller's goroutine.
+// This way the editor never waits for the server and all callbacks run on the
+// UI thread.
+type lspClient struct {
+	conn   *jsonrpcConn
+	closer io.Closer
+	// rootURI is the workspace folder
+	rootURI string
+	// ready is true once the initialize handshake is done, before that,
+	// documents are only remembered
+	ready bool
+	// utf8 is true if the server counts characters in bytes instead of
+	// UTF-16 code units
+	utf8 bool
+	docs map[string]*lspDocument
+
+	// queue holds the callbacks that poll still has to run, it is filled
+	// from the reader goroutine
+	mutex sync.Mutex
+	queue []func()
+	// wake, if not nil, is called when a callback is queued or a document
+	// changes, so poll is only called when there is something to do
+	wake func()
+	// waiting is the number of requests whose callbacks did not run yet
+	waiting int
+	// err is set when the connection is broken
+	err error
+
+	// diagnostics are the latest ones per file URI
+	diagnostics map[string][]lspDiagnostic
+	// diagnosticsChanged, if not nil, is called from poll when new
+	// diagnostics for the file arrive
+	diagnosticsChanged func(path string, diagnostics []lspDiagnostic)
+	// applyEdit, if not nil, is called from poll when the server asks for an
+	// edit, usually while it executes the command of a code action
+	applyEdit func(edit *lspWorkspaceEdit)
+}
+
+// lspDocument is a document that is open on the server.
+type lspDocument struct {
+	uri     string
+	doc     *document
+	version int
+	opened  bool
+	// changes are sent with the next flush
+	changes []lspContentChange
+	// stopObserving ends the recording of changes
+	stopObserving func()
+}
+
+// startLanguageServer starts the command, e.g. gopls, in dir and talks to it
+// over its stdin and stdout.
+func startLanguageServer(command string, dir string) (*lspClient, error) {
+	cmd := exec.Command(command)
+	cmd.Dir = dir
+	hideProcessWindow(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, makeErr("start "+command, err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, makeErr("start "+command, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, makeErr("start "+command, err)
+	}
+	c := newLSPClient(stdout, stdin, processCloser{cmd, stdin})
+	c.initialize(dir)
+	return c, nil
+}
+
+// processCloser ends a language server process, which exits by itself after
+// the exit notification when its stdin is closed.
+type processCloser struct {
+	cmd   *exec.Cmd
+	stdin io.Closer
+}
+
+func (p processCloser) Close() error {
+	p.stdin.Close()
+	return p.cmd.Wait()
+}
+
+// newLSPClient creates a client that reads the server's messages from r and
+// writes to w. Call initialize before using it.
+func newLSPClient(r io.Reader, w io.Writer, closer io.Closer) *lspClient {
+	c := &lspClient{
+		closer:      closer,
+		docs:        make(map[string]*lspDocument),
+		diagnostics: make(map[string][]lspDiagnostic),
+	}
+	c.conn = newJSONRPCConn(r, w, c.handle)
+	go func() {
+		// poll reports a broken connection, make sure it is called
+		<-c.conn.done
+		c.enqueue(func() {})
+	}()
+	return c
+}
+
+// initialize starts the handshake with the server for the workspace folder
+// dir. Documents opened in the mean time are sent once it is done.
+func (c *lspClient) initialize(dir string) {
+	c.rootURI = pathToURI(dir)
+	params := map[string]interface{}{
+		"processId": nil,
+		"rootUri":   c.rootURI,
+		"workspaceFolders": []map[string]string{
+			{"uri": c.rootURI, "name": filepath.Base(dir)},
+		},
+		"capabilities": map[string]interface{}{
+			"general": map[string]interface{}{
+				"positionEncodings": []string{"utf-8", "utf-16"},
+			},
+			"textDocument": map[string]interface{}{
+				"synchronization": map[string]interface{}{"didSave": true},
+				"completion": map[string]interface{}{
+					"completionItem": map[string]interface{}{
+						"snippetSupport":          true,
+						"documentationFormat":     []string{"plaintext"},
+						"insertReplaceSupport":    false,
+						"labelDetailsSupport":     false,
+						"deprecatedSupport":       false,
+						"commitCharactersSupport": false,
+					},
+				},
+				"hover": map[string]interface{}{
+					"contentFormat": []string{"plaintext"},
+				},
+				"publishDiagnostics": map[string]interface{}{},
+				"codeAction": map[string]interface{}{
+					"codeActionLiteralSupport": map[string]interface{}{
+						"codeActionKind": map[string]interface{}{
+							"valueSet": []string{"quickfix", "refactor", "source"},
+						},
+					},
+				},
+				"rename": map[string]interface{}{},
+			},
+			"workspace": map[string]interface{}{
+				"workspaceFolders": true,
+				"configuration":    true,
+			},
+		},
+	}
+	c.request("initialize", params, func(result json.RawMessage, err error) {
+		if err != nil {
+			c.err = makeErr("initialize language server", err)
+			return
+		}
+		var r struct {
+			Capabilities struct {
+				PositionEncoding string `json:"positionEncoding"`
+			} `json:"capabilities"`
+		}
+		json.Unmarshal(result, &r)
+		c.utf8 = r.Capabilities.PositionEncoding == "utf-8"
+		c.conn.notify("initialized", struct{}{})
+		c.ready = true
+		for _, d := range c.docs {
+			c.sendOpen(d)
+		}
+	})
+}
+
+// request sends a request and queues done for poll.
+func (c *lspClient) request(method string, params interface{}, done func(result json.RawMessage, err error)) {
+	c.flush()
+	c.waiting++
+	c.conn.call(method, params, func(result json.RawMessage, err error) {
+		if len(result) == 0 {
+			result = json.RawMessage("null")
+		}
+		c.enqueue(func() {
+			c.waiting--
+			done(result, err)
+		})
+	})
+}
+
+func (c *lspClient) enqueue(f func()) {
+	c.mutex.Lock()
+	c.queue = append(c.queue, f)
+	c.mutex.Unlock()
+	c.wakeUp()
+}
+
+func (c *lspClient) wakeUp() {
+	c.mutex.Lock()
+	wake := c.wake
+	c.mutex.Unlock()
+	if wake != nil {
+		wake()
+	}
+}
+
+// setWake sets the function that asks for a call of poll, it must be safe to
+// call from any goroutine. It is called right away for what was queued
+// before.
+func (c *lspClient) setWake(wake func()) {
+	c.mutex.Lock()
+	c.wake = wake
+	queued := len(c.queue) > 0
+	c.mutex.Unlock()
+	if queued && wake != nil {
+		wake()
+	}
+}
+
+// handle is called on the reader goroutine for messages from the server.
+func (c *lspClient) handle(method string, params json.RawMessage) (interface{}, error) {
+	switch method {
+	case "textDocument/publishDiagnostics":
+		var p struct {
+			URI         string          `json:"uri"`
+			Diagnostics []lspDiagnostic `json:"diagnostics"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		c.enqueue(func() {
+			c.diagnostics[p.URI] = p.Diagnostics
+			if c.diagnosticsChanged != nil {
+				c.diagnosticsChanged(uriToPath(p.URI), p.Diagnostics)
+			}
+		})
+		return nil, nil
+	case "workspace/configuration":
+		// there are no settings for the server, it uses its defaults
+		var p struct {
+			Items []json.RawMessage `json:"items"`
+		}
+		json.Unmarshal(params, &p)
+		return make([]interface{}, len(p.Items)), nil
+	case "workspace/workspaceFolders":
+		return []map[string]string{{"uri": c.rootURI, "name": "root"}}, nil
+	case "window/workDoneProgress/create", "client/registerCapability",
+		"client/unregisterCapability":
+		return nil, nil
+	case "workspace/applyEdit":
+		var p struct {
+			Edit lspWorkspaceEdit `json:"edit"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		// the edit is made later, on the UI thread, the server is told that
+		// it worked
+		c.enqueue(func() {
+			if c.applyEdit != nil {
+				c.applyEdit(&p.Edit)
+			}
+		})
+		return map[string]bool{"applied": true}, nil
+	}
+	if strings.HasPrefix(method, "$/") || strings.HasPrefix(method, "window/") {
+		// progress, log and show message notifications
+		return nil, nil
+	}
+	return nil, &jsonrpcError{Code: jsonrpcMethodNotFound, Message: "unknown method " + method}
+}
+
+// poll runs the callbacks of all requests that are done and of the messages
+// that the server sent. It returns an error if the connection broke.
+func (c *lspClient) poll() error {
+	c.flush()
+	c.mutex.Lock()
+	queue := c.queue
+	c.queue = nil
+	c.mutex.Unlock()
+	for _, f := range queue {
+		f()
+	}
+	if c.err == nil {
+		select {
+		case <-c.conn.done:
+			c.err = c.conn.closed
+		default:
+		}
+	}
+	return c.err
+}
+
+// busy returns true while requests are waiting for their responses.
+func (c *lspClient) busy() bool {
+	return c.waiting > 0
+}
+
+// open tells the server that the file at path is shown in the editor. From
+// now on all edits of doc are sent to the server.
+func (c *lspClient) open(path string, doc *document) {
+	d := &lspDocument{uri: pathToURI(path), doc: doc}
+	c.docs[d.uri] = d
+	d.stopObserving = doc.observeChanges(func(offset, count int, text []byte) {
+		c.changing(d, offset, count, text)
+	})
+	if c.ready {
+		c.sendOpen(d)
+	}
+}
+
+func (c *lspClient) sendOpen(d *lspDocument) {
+	d.opened = true
+	d.changes = nil
+	d.version++
+	c.conn.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{
+			"uri":        d.uri,
+			"languageId": "go",
+			"version":    d.version,
+			"text":       string(d.doc.bytes()),
+		},
+	})
+}
+
+// changing records an edit of the document, it is called before the edit is
+// made so the range can be computed on the text that the server knows.
+func (c *lspClient) changing(d *lspDocument, offset, count int, text []byte) {
+	if !d.opened {
+		return
+	}
+	if len(d.changes) == 0 {
+		// poll sends the changes, all edits until then go in one message
+		c.wakeUp()
+	}
+	d.changes = append(d.changes, lspContentChange{
+		Range: &lspRange{
+			Start: lspPositionAt(d.doc, offset, c.utf8),
+			End:   lspPositionAt(d.doc, offset+count, c.utf8),
+		},
+		Text: string(text),
+	})
+}
+
+// flush sends the recorded edits of all documents. This happens before every
+// request so the server answers for the current text.
+func (c *lspClient) flush() {
+	for _, d := range c.docs {
+		if len(d.changes) == 0 {
+			continue
+		}
+		d.version++
+		c.conn.notify("textDocument/didChange", map[string]interface{}{
+			"textDocument":   lspVersionedDocument{URI: d.uri, Version: d.version},
+			"contentChanges": d.changes,
+		})
+		d.changes = nil
+	}
+}
+
+// close tells the server that the file is not shown anymore.
+func (c *lspClient) close(path string) {
+	uri := pathToURI(path)
+	d, ok := c.docs[uri]
+	if !ok {
+		return
+	}
+	d.stopObserving()
+	delete(c.docs, uri)
+	if d.opened {
+		c.conn.notify("textDocument/didClose", map[string]interface{}{
+			"textDocument": lspDocumentID{URI: uri},
+		})
+	}
+}
+
+// saved tells the server that the file was written to disk.
+func (c *lspClient) saved(path string) {
+	if d, ok := c.docs[pathToURI(path)]; ok && d.opened {
+		c.flush()
+		c.conn.notify("textDocument/didSave", map[string]interface{}{
+			"textDocument": lspDocumentID{URI: d.uri},
+		})
+	}
+}
+
+// document returns the open document with the given URI or nil.
+func (c *lspClient) document(uri string) *document {
+	if d, ok := c.docs[uri]; ok {
+		return d.doc
+	}
+	return nil
+}
+
+// convertDiagnostics turns the server's diagnostics for the file at path into
+// the editor's. The characters of open documents are converted to byte
+// columns, for other files they are taken as bytes, which is right for ASCII
+// lines.
+func (c *lspClient) convertDiagnostics(path string, list []lspDiagnostic) []diagnostic {
+	doc := c.document(pathToURI(path))
+	position := func(p lspPosition) textPosition {
+		if doc == nil {
+			return textPosition{line: p.Line, column: p.Character}
+		}
+		line, column := doc.offsetToLineCol(lspOffset(doc, p, c.utf8))
+		return textPosition{line: line, column: column}
+	}
+	converted := make([]diagnostic, len(list))
+	for i, d := range list {
+		converted[i] = diagnostic{
+			path:     path,
+			start:    position(d.Range.Start),
+			end:      position(d.Range.End),
+			severity: severity(d.Severity),
+			message:  d.Message,
+			source:   d.Source,
+		}
+		if converted[i].severity == 0 {
+			// the client decides, errors are the safe guess
+			converted[i].severity = severityError
+		}
+	}
+	return converted
+}
+
+// positionParams creates the parameters for a request at offset in the file
+// at path. The file must be open.
+func (c *lspClient) positionParams(path string, offset int) (lspDocumentPosition, error) {
+	d, ok := c.docs[pathToURI(path)]
+	if !ok {
+		return lspDocumentPosition{}, errors.New(path + " is not open in the language server")
+	}
+	if !c.ready {
+		return lspDocumentPosition{}, errors.New("the language server is not ready yet")
+	}
+	return lspDocumentPosition{
+		TextDocument: lspDocumentID{URI: d.uri},
+		Position:     lspPositionAt(d.doc, offset, c.utf8),
+	}, nil
+}
+
+// completion asks for the completions at offset in the file at path.
+func (c *lspClient) completion(path string, offset int, done func([]lspCompletionItem, error)) {
+	params, err := c.positionParams(path, offset)
+	if err != nil {
+		done(nil, err)
+		return
+	}
+	c.request("textDocument/completion", params, func(result json.RawMessage, err error) {
+		if err != nil {
+			done(nil, err)
+			return
+		}
+		// the result is either a list of items or a completion list
+		var items []lspCompletionItem
+		if json.Unmarshal(result, &items) != nil {
+			var list struct {
+				Items []lspCompletionItem `json:"items"`
+			}
+			err = json.Unmarshal(result, &list)
+			items = list.Items
+		}
+		done(items, err)
+	})
+}
+
+// lspCompletionKinds maps the protocol's completion item kinds to the
+// editor's.
+var lspCompletionKinds = map[int]completionKind{
+	2:  completionMethod,
+	3:  completionFunction,
+	4:  completionFunction,
+	5:  completionField,
+	6:  completionVariable,
+	7:  completionType,
+	8:  completionType,
+	9:  completionPackage,
+	10: completionField,
+	12: completionConstant,
+	13: completionType,
+	14: completionKeyword,
+	20: completionConstant,
+	21: completionConstant,
+	22: completionType,
+	25: completionType,
+}
+
+// lspCompletionItems converts the server's completions, in the order of their
+// sort texts. The range of text edits is ignored, the items replace the word
+// before the caret.
+func lspCompletionItems(list []lspCompletionItem) []completionItem {
+	sorted := append([]lspCompletionItem(nil), list...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sortText(sorted[i]) < sortText(sorted[j])
+	})
+	items := make([]completionItem, len(sorted))
+	for i, c := range sorted {
+		insert := c.InsertText
+		if c.TextEdit != nil {
+			insert = c.TextEdit.NewText
+		}
+		if insert == "" {
+			insert = c.Label
+		}
+		items[i] = completionItem{
+			label:         c.Label,
+			kind:          lspCompletionKinds[c.Kind],
+			detail:        c.Detail,
+			documentation: lspMarkupText(c.Documentation),
+			insertText:    insert,
+			snippet:       c.InsertTextFormat == lspSnippetFormat,
+		}
+	}
+	return items
+}
+
+func sortText(c lspCompletionItem) string {
+	if c.SortText != "" {
+		return c.SortText
+	}
+	return c.Label
+}
+
+// hover asks for the information about the symbol at offset, as plain text.
+func (c *lspClient) hover(path string, offset int, done func(string, error)) {
+	params, err := c.positionParams(path, offset)
+	if err != nil {
+		done("", err)
+		return
+	}
+	c.request("textDocument/hover", params, func(result json.RawMessage, err error) {
+		if err != nil {
+			done("", err)
+			return
+		}
+		var h struct {
+			Contents json.RawMessage `json:"contents"`
+		}
+		json.Unmarshal(result, &h)
+		done(lspMarkupText(h.Contents), nil)
+	})
+}
+
+// lspMarkupText extracts the text of a markup content, a marked string or a
+// list of marked strings.
+func lspMarkupText(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var list []json.RawMessage
+	if json.Unmarshal(raw, &list) == nil {
+		var parts []string
+		for _, item := range list {
+			parts = append(parts, lspMarkupText(item))
+		}
+		return strings.Join(parts, "\n")
+	}
+	var markup struct {
+		Value string `json:"value"`
+	}
+	json.Unmarshal(raw, &markup)
+	return markup.Value
+}
+
+// definition asks where the symbol at offset is defined.
+func (c *lspClient) definition(path string, offset int, done func([]lspLocation, error)) {
+	c.locations("textDocument/definition", path, offset, nil, done)
+}
+
+// references asks for all uses of the symbol at offset, including its
+// declaration.
+func (c *lspClient) references(path string, offset int, done func([]lspLocation, error)) {
+	c.locations("textDocument/references", path, offset, map[string]interface{}{
+		"context": map[string]bool{"includeDeclaration": true},
+	}, done)
+}
+
+// locations sends a request at a position that results in locations. extra
+// are additional parameters.
+func (c *lspClient) locations(method, path string, offset int, extra map[string]interface{}, done func([]lspLocation, error)) {
+	pos, err := c.positionParams(path, offset)
+	if err != nil {
+		done(nil, err)
+		return
+	}
+	params := map[string]interface{}{
+		"textDocument": pos.TextDocument,
+		"position":     pos.Position,
+	}
+	for k, v := range extra {
+		params[k] = v
+	}
+	c.request(method, params, func(result json.RawMessage, err error) {
+		if err != nil {
+			done(nil, err)
+			return
+		}
+		done(parseLSPLocations(result), nil)
+	})
+}
+
+// parseLSPLocations reads a location, a list of locations or a list of
+// location links.
+func parseLSPLocations(raw json.RawMessage) []lspLocation {
+	var one lspLocation
+	if json.Unmarshal(raw, &one) == nil && one.URI != "" {
+		return []lspLocation{one}
+	}
+	var list []struct {
+		lspLocation
+		TargetURI            string   `json:"targetUri"`
+		TargetSelectionRange lspRange `json:"targetSelectionRange"`
+	}
+	json.Unmarshal(raw, &list)
+	var locations []lspLocation
+	for _, l := range list {
+		if l.TargetURI != "" {
+			locations = append(locations, lspLocation{URI: l.TargetURI, Range: l.TargetSelectionRange})
+		} else {
+			locations = append(locations, l.lspLocation)
+		}
+	}
+	return locations
+}
+
+// codeLocations converts the server's locations to the editor's. As with the
+// diagnostics, characters are converted to byte columns for open documents
+// and taken as bytes in other files.
+func (c *lspClient) codeLocations(list []lspLocation) []codeLocation {
+	locations := make([]codeLocation, len(list))
+	for i, l := range list {
+		loc := codeLocation{
+			path: diagnosticPath(uriToPath(l.URI)),
+			pos:  textPosition{line: l.Range.Start.Line, column: l.Range.Start.Character},
+		}
+		doc := c.document(l.URI)
+		if doc != nil {
+			loc.pos.line, loc.pos.column = doc.offsetToLineCol(lspOffset(doc, l.Range.Start, c.utf8))
+		} else if data, err := ioutil.ReadFile(loc.path); err == nil {
+			doc = newDocument(data)
+		}
+		if doc != nil && loc.pos.line < doc.lineCount() {
+			line := doc.slice(doc.lineStart(loc.pos.line), doc.lineEnd(loc.pos.line))
+			loc.text = strings.TrimSpace(string(line))
+		}
+		locations[i] = loc
+	}
+	return locations
+}
+
+// rename asks for the edits that rename the symbol at offset to newName.
+func (c *lspClient) rename(path string, offset int, newName string, done func(*lspWorkspaceEdit, error)) {
+	pos, err := c.positionParams(path, offset)
+	if err != nil {
+		done(nil, err)
+		return
+	}
+	params := map[string]interface{}{
+		"textDocument": pos.TextDocument,
+		"position":     pos.Position,
+		"newName":      newName,
+	}
+	c.request("textDocument/rename", params, func(result json.RawMessage, err error) {
+		if err != nil {
+			done(nil, err)
+			return
+		}
+		var edit lspWorkspaceEdit
+		err = json.Unmarshal(result, &edit)
+		done(&edit, err)
+	})
+}
+
+// codeActions asks for the code actions for the range [start, end) in the
+// file at path, e.g. quick fixes for the diagnostics there.
+func (c *lspClient) codeActions(path string, start, end int, done func([]lspCodeAction, error)) {
+	uri := pathToURI(path)
+	d, ok := c.docs[uri]
+	if !ok || !c.ready {
+		done(nil, errors.New(path+" is not open in the language server"))
+		return
+	}
+	r := lspRange{
+		Start: lspPositionAt(d.doc, start, c.utf8),
+		End:   lspPositionAt(d.doc, end, c.utf8),
+	}
+	var diagnostics []lspDiagnostic
+	for _, diag := range c.diagnostics[uri] {
+		if !lspPositionLess(diag.Range.End, r.Start) && !lspPositionLess(r.End, diag.Range.Start) {
+			diagnostics = append(diagnostics, diag)
+		}
+	}
+	params := map[string]interface{}{
+		"textDocument": lspDocumentID{URI: uri},
+		"range":        r,
+		"context": map[string]interface{}{
+			"diagnostics": append([]lspDiagnostic{}, diagnostics...),
+		},
+	}
+	c.request("textDocument/codeAction", params, func(result json.RawMessage, err error) {
+		if err != nil {
+			done(nil, err)
+			return
+		}
+		// commands without an edit are listed as plain commands
+		var raw []json.RawMessage
+		json.Unmarshal(result, &raw)
+		var actions []lspCodeAction
+		for _, item := range raw {
+			var a lspCodeAction
+			json.Unmarshal(item, &a)
+			if a.Command == nil && a.Edit == nil {
+				var cmd lspCommand
+				if json.Unmarshal(item, &cmd) == nil && cmd.Command != "" {
+					a = lspCodeAction{Title: cmd.Title, Command: &cmd}
+				}
+			}
+			actions = append(actions, a)
+		}
+		done(actions, nil)
+	})
+}
+
+// executeCommand runs a command of a code action on the server. The server
+// usually answers with a workspace/applyEdit request.
+func (c *lspClient) executeCommand(cmd lspCommand, done func(error)) {
+	c.request("workspace/executeCommand", map[string]interface{}{
+		"command":   cmd.Command,
+		"arguments": cmd.Arguments,
+	}, func(_ json.RawMessage, err error) {
+		done(err)
+	})
+}
+
+func lspPositionLess(a, b lspPosition) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Character < b.Character
+}
+
+// shutdown asks the server to exit and closes the connection.
+func (c *lspClient) shutdown() {
+	for _, d := range c.docs {
+		d.stopObserving()
+	}
+	c.conn.call("shutdown", nil, func(json.RawMessage, error) {
+		c.conn.notify("exit", nil)
+		if c.closer != nil {
+			c.closer.Close()
+		}
+	})
+}
+
+// abort ends a client whose connection broke. The edits of the documents are
+// not recorded anymore and the server process is ended, without waiting for
+// it since it might not answer anymore.
+func (c *lspClient) abort() {
+	for _, d := range c.docs {
+		d.stopObserving()
+	}
+	if c.closer != nil {
+		go c.closer.Close()
+	}
+}
+
+// lspReplacements converts text edits for doc to replacements sorted by
+// offset, as needed by editor.applyReplacements.
+func lspReplacements(doc *document, edits []lspTextEdit, utf8Columns bool) []replacement {
+	changes := make([]replacement, len(edits))
+	for i, e := range edits {
+		start := lspOffset(doc, e.Range.Start, utf8Columns)
+		end := lspOffset(doc, e.Range.End, utf8Columns)
+		changes[i] = replacement{offset: start, count: end - start, text: []byte(e.NewText)}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].offset < changes[j].offset
+	})
+	return changes
+}
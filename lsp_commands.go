@@ -0,0 +1,232 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// hoverPopup shows what the language server knows about the identifier at
+// offset. It closes with the next key press or click.
+type hoverPopup struct {
+	offset int
+	text   string
+}
+
+// codeActionsPanel lists the code actions at the caret, e.g. the quick fixes
+// for a problem there, until one is applied or the list is closed.
+type codeActionsPanel struct {
+	listPanel
+	actions []lspCodeAction
+}
+
+func newCodeActionsPanel() codeActionsPanel {
+	return codeActionsPanel{listPanel: listPanel{title: "Code Actions", selected: -1}}
+}
+
+func (p *codeActionsPanel) setActions(actions []lspCodeAction) {
+	p.actions = actions
+	p.top = 0
+	p.setRows(len(actions))
+	p.selected = -1
+	if len(actions) > 0 {
+		p.selected = 0
+	}
+}
+
+func (p *codeActionsPanel) draw(g graphics, area rectangle) {
+	p.listPanel.draw(g, area, func(i int, row rectangle) {
+		action := p.actions[i]
+		g.text([]byte(action.Title), row.x+4, row.y, row, editorTextColor)
+		if action.Kind != "" {
+			w, _ := g.textExtent([]byte(action.Title + "   "))
+			kind := rect(row.x+4+w, row.y, row.w-4-w, row.h).intersect(row)
+			g.text([]byte(action.Kind), kind.x, kind.y, kind, completionDetailColor)
+		}
+	})
+}
+
+// registerLanguageServerCommands registers the commands that need a language
+// server, they do nothing without one.
+func registerLanguageServerCommands(r *commandRegistry, a *app) {
+	r.register("editor.hover", func(*editor) {
+		a.showHover()
+	})
+	r.register("editor.codeActions", func(*editor) {
+		a.findCodeActions()
+	})
+	r.register("codeActions.apply", func(*editor) {
+		p := &a.codeActions
+		a.closeCodeActions()
+		if p.selected != -1 {
+			a.applyCodeAction(p.actions[p.selected])
+		}
+	})
+	r.register("codeActions.cancel", func(*editor) {
+		a.closeCodeActions()
+	})
+	r.register("codeActions.next", func(*editor) {
+		a.selectCodeAction(1)
+	})
+	r.register("codeActions.previous", func(*editor) {
+		a.selectCodeAction(-1)
+	})
+}
+
+// showHover asks the language server about the identifier at the caret. The
+// answer is dropped if the caret moved in the mean time.
+func (a *app) showHover() {
+	e := a.editor
+	if e == nil || a.lsp == nil {
+		return
+	}
+	caret := e.primaryCursor().caret
+	a.lsp.hover(a.path, caret, func(text string, err error) {
+		if err != nil {
+			a.platform.showError("Hover", err.Error())
+			return
+		}
+		text = strings.TrimSpace(text)
+		if text == "" || a.editor != e || e.primaryCursor().caret != caret {
+			return
+		}
+		a.hover = &hoverPopup{offset: caret, text: text}
+		a.frames.invalidateAll()
+	})
+}
+
+func (a *app) closeHover() {
+	if a.hover != nil {
+		a.hover = nil
+		a.frames.invalidateAll()
+	}
+}
+
+// drawHover shows the hover text in a box below the line of its identifier,
+// or above it if there is not enough space below.
+func (a *app) drawHover(g graphics, e *editor, window rectangle) {
+	h := a.hover
+	line := e.doc.lineOf(h.offset)
+	if line < e.topLine || line >= e.topLine+e.visibleLines {
+		return
+	}
+	lineHeight := g.lineHeight()
+	lines := wrapText(g, h.text, completionDocWidth-2*completionPadding)
+	if len(lines) > completionDocMaxLines {
+		lines = append(lines[:completionDocMaxLines-1], "…")
+	}
+	x := e.area.x + e.textWidth(g, e.doc.lineStart(line), h.offset)
+	lineTop := e.area.y + (line-e.topLine)*lineHeight
+	box := rect(x, lineTop+lineHeight, completionDocWidth, len(lines)*lineHeight+2*completionPadding)
+	if box.y+box.h > window.y+window.h && lineTop-box.h >= window.y {
+		box.y = lineTop - box.h
+	}
+	if box.x+box.w > window.x+window.w {
+		box.x = window.x + window.w - box.w
+	}
+	box.x = max(box.x, window.x)
+	box = box.intersect(window)
+	fillRect(g, box, completionBorderColor)
+	inner := rect(box.x+1, box.y+1, box.w-2, box.h-2).intersect(box)
+	fillRect(g, inner, completionDocBackground)
+	g.text(
+		[]byte(strings.Join(lines, "\n")),
+		inner.x+completionPadding-1, inner.y+completionPadding-1,
+		inner,
+		editorTextColor,
+	)
+}
+
+// findCodeActions asks the language server for the code actions for the
+// selection and lists them.
+func (a *app) findCodeActions() {
+	e := a.editor
+	if e == nil || a.lsp == nil {
+		return
+	}
+	sel := e.primaryCursor()
+	a.lsp.codeActions(a.path, sel.start(), sel.end(), func(actions []lspCodeAction, err error) {
+		if err != nil {
+			a.platform.showError("Code Actions", err.Error())
+			return
+		}
+		if a.editor != e {
+			return
+		}
+		a.codeActions.setActions(actions)
+		a.codeActions.visible = true
+		a.keyboard.mode = &keyMode{keys: a.codeActionKeys, exclusive: true}
+		a.frames.invalidateAll()
+	})
+}
+
+func (a *app) closeCodeActions() {
+	if a.codeActions.visible {
+		a.codeActions.visible = false
+		a.keyboard.mode = nil
+		a.frames.invalidateAll()
+	}
+}
+
+// selectCodeAction highlights the next (step 1) or previous (step -1) code
+// action, it wraps around at the ends.
+func (a *app) selectCodeAction(step int) {
+	n := len(a.codeActions.actions)
+	if n == 0 {
+		return
+	}
+	a.codeActions.selectRow((a.codeActions.selected + step + n) % n)
+	a.frames.invalidateAll()
+}
+
+// applyCodeAction makes the action's edit and then runs its command. The
+// server sends the edits of the command back, they arrive in
+// applyWorkspaceEdit.
+func (a *app) applyCodeAction(action lspCodeAction) {
+	lsp := a.lsp
+	if lsp == nil {
+		return
+	}
+	if action.Edit != nil {
+		if err := a.applyWorkspaceEdit(action.Edit, lsp.utf8); err != nil {
+			a.platform.showError("Code Actions", err.Error())
+			return
+		}
+	}
+	if action.Command != nil {
+		lsp.executeCommand(*action.Command, func(err error) {
+			if err != nil {
+				a.platform.showError("Code Actions", err.Error())
+			}
+		})
+	}
+}
+
+// applyWorkspaceEdit changes the files of the edit. The file in the editor is
+// changed in the document instead, as one undo step.
+func (a *app) applyWorkspaceEdit(edit *lspWorkspaceEdit, utf8Columns bool) error {
+	current := ""
+	if a.editor != nil && a.path != "" {
+		current = diagnosticPath(a.path)
+	}
+	contents := make(map[string][]byte)
+	var inEditor []replacement
+	for uri, edits := range edit.fileEdits() {
+		path := diagnosticPath(uriToPath(uri))
+		if path == current {
+			inEditor = lspReplacements(a.editor.doc, edits, utf8Columns)
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return makeErr("apply edit", err)
+		}
+		contents[path] = applyEdits(data, lspReplacements(newDocument(data), edits, utf8Columns))
+	}
+	if err := writeFiles(contents); err != nil {
+		return err
+	}
+	if len(inEditor) > 0 {
+		a.editor.applyReplacements(otherEdit, inEditor, a.platform.now())
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// fakeLanguageServer is a small language server that runs in the same
+// process. It understands words instead of Go code, which is enough to drive
+// the client through the whole protocol without gopls installed:
+//
+//   - completion lists the words of the document that start with the word
+//     before the position
+//   - hover describes the word at the position
+//   - definition is the first occurrence of that word, references are all
+//     occurrences and rename replaces all of them
+//   - every occurrence of errorWord is reported as an error, the code action
+//     for it removes it and the command of another code action removes all
+//     of them in the file
+type fakeLanguageServer struct {
+	conn *jsonrpcConn
+	// utf8 makes the server count characters in bytes, otherwise it uses
+	// UTF-16 code units like most servers
+	utf8      bool
+	errorWord string
+
+	// mutex guards docs and received, the methods of all messages from the
+	// client
+	mutex    sync.Mutex
+	docs     map[string]*document
+	received []string
+	// exited is closed after the exit notification, then the connection to
+	// the client is closed as well
+	exited chan bool
+	closer io.Closer
+}
+
+// newFakeLanguageServer connects a client to a new fake server. The client is
+// initialized with dir as the workspace.
+func newFakeLanguageServer(dir string, utf8Columns bool) (*fakeLanguageServer, *lspClient) {
+	toServer, fromClient := io.Pipe()
+	toClient, fromServer := io.Pipe()
+	s := &fakeLanguageServer{
+		utf8:      utf8Columns,
+		errorWord: "bug",
+		docs:      make(map[string]*document),
+		exited:    make(chan bool),
+		closer:    fromServer,
+	}
+	s.conn = newJSONRPCConn(toServer, fromServer, s.handle)
+	c := newLSPClient(toClient, fromClient, fromClient)
+	c.initialize(dir)
+	return s, c
+}
+
+// receivedMethods returns the methods of all messages that the server got so
+// far.
+func (s *fakeLanguageServer) receivedMethods() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.received...)
+}
+
+// text returns the server's copy of the document at uri.
+func (s *fakeLanguageServer) text(uri string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	doc, ok := s.docs[uri]
+	if !ok {
+		return "", false
+	}
+	return string(doc.bytes()), true
+}
+
+func (s *fakeLanguageServer) handle(method string, params json.RawMessage) (interface{}, error) {
+	// the tests read the documents while the server changes them
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.received = append(s.received, method)
+
+	var p struct {
+		TextDocument struct {
+			URI  string `json:"uri"`
+			Text string `json:"text"`
+		} `json:"textDocument"`
+		Position       lspPosition        `json:"position"`
+		Command        string             `json:"command"`
+		Arguments      []string           `json:"arguments"`
+		ContentChanges []lspContentChange `json:"contentChanges"`
+		NewName        string             `json:"newName"`
+		Context        struct {
+			Diagnostics []lspDiagnostic `json:"diagnostics"`
+		} `json:"context"`
+	}
+	if len(params) > 0 {
+		json.Unmarshal(params, &p)
+	}
+	uri := p.TextDocument.URI
+	doc := s.docs[uri]
+	offset := 0
+	if doc != nil {
+		offset = lspOffset(doc, p.Position, s.utf8)
+	}
+
+	switch method {
+	case "initialize":
+		encoding := "utf-16"
+		if s.utf8 {
+			encoding = "utf-8"
+		}
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"positionEncoding": encoding,
+				"textDocumentSync": 2, // incremental
+			},
+		}, nil
+	case "initialized", "textDocument/didSave":
+		return nil, nil
+	case "textDocument/didOpen":
+		s.docs[uri] = newDocument([]byte(p.TextDocument.Text))
+		s.publishDiagnostics(uri)
+		return nil, nil
+	case "textDocument/didChange":
+		if doc == nil {
+			return nil, nil
+		}
+		for _, change := range p.ContentChanges {
+			if change.Range == nil {
+				s.docs[uri] = newDocument([]byte(change.Text))
+				doc = s.docs[uri]
+				continue
+			}
+			start := lspOffset(doc, change.Range.Start, s.utf8)
+			end := lspOffset(doc, change.Range.End, s.utf8)
+			doc.delete(start, end-start)
+			doc.insert(start, []byte(change.Text))
+		}
+		s.publishDiagnostics(uri)
+		return nil, nil
+	case "textDocument/didClose":
+		delete(s.docs, uri)
+		return nil, nil
+	case "textDocument/completion":
+		if doc == nil {
+			return nil, nil
+		}
+		text := string(doc.bytes())
+		start, _ := wordAround(text, offset)
+		prefix := text[start:offset]
+		seen := make(map[string]bool)
+		var items []lspCompletionItem
+		for _, w := range fakeWords(text) {
+			word := text[w[0]:w[1]]
+			if strings.HasPrefix(word, prefix) && word != prefix && !seen[word] {
+				seen[word] = true
+				items = append(items, lspCompletionItem{Label: word, Kind: 6})
+			}
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+		return map[string]interface{}{"isIncomplete": false, "items": items}, nil
+	case "textDocument/hover":
+		if word := s.wordAt(doc, offset); word != "" {
+			return map[string]interface{}{
+				"contents": map[string]string{"kind": "plaintext", "value": "word " + word},
+			}, nil
+		}
+		return nil, nil
+	case "textDocument/definition", "textDocument/references":
+		locations := s.occurrences(uri, doc, offset)
+		if method == "textDocument/definition" && len(locations) > 0 {
+			return locations[0], nil
+		}
+		return locations, nil
+	case "textDocument/rename":
+		var edits []lspTextEdit
+		for _, l := range s.occurrences(uri, doc, offset) {
+			edits = append(edits, lspTextEdit{Range: l.Range, NewText: p.NewName})
+		}
+		return lspWorkspaceEdit{Changes: map[string][]lspTextEdit{uri: edits}}, nil
+	case "textDocument/codeAction":
+		actions := []lspCodeAction{}
+		for _, d := range p.Context.Diagnostics {
+			actions = append(actions, lspCodeAction{
+				Title:       "Remove " + s.errorWord,
+				Kind:        "quickfix",
+				Diagnostics: []lspDiagnostic{d},
+				Edit: &lspWorkspaceEdit{Changes: map[string][]lspTextEdit{
+					uri: {{Range: d.Range, NewText: ""}},
+				}},
+			})
+		}
+		if len(actions) > 0 {
+			arg, _ := json.Marshal(uri)
+			actions = append(actions, lspCodeAction{
+				Title: "Remove all " + s.errorWord + "s",
+				Kind:  "source",
+				Command: &lspCommand{
+					Title:     "Remove all",
+					Command:   "fake.removeAll",
+					Arguments: []json.RawMessage{arg},
+				},
+			})
+		}
+		return actions, nil
+	case "workspace/executeCommand":
+		if p.Command != "fake.removeAll" || len(p.Arguments) != 1 || s.docs[p.Arguments[0]] == nil {
+			return nil, &jsonrpcError{Code: jsonrpcMethodNotFound, Message: "unknown command " + p.Command}
+		}
+		// like gopls, the server asks the client to make the edit
+		uri := p.Arguments[0]
+		doc := s.docs[uri]
+		text := string(doc.bytes())
+		var edits []lspTextEdit
+		for _, w := range fakeWords(text) {
+			if text[w[0]:w[1]] == s.errorWord {
+				edits = append(edits, lspTextEdit{Range: s.rangeOf(doc, w[0], w[1])})
+			}
+		}
+		// the request is sent from another goroutine, the pipes are not
+		// buffered like those of a process and the client may be writing to
+		// the server right now
+		go s.conn.call("workspace/applyEdit", map[string]interface{}{
+			"edit": lspWorkspaceEdit{Changes: map[string][]lspTextEdit{uri: edits}},
+		}, func(json.RawMessage, error) {})
+		return nil, nil
+	case "shutdown":
+		return nil, nil
+	case "exit":
+		close(s.exited)
+		s.closer.Close()
+		return nil, nil
+	}
+	return nil, &jsonrpcError{Code: jsonrpcMethodNotFound, Message: "unknown method " + method}
+}
+
+// publishDiagnostics reports every occurrence of the error word.
+func (s *fakeLanguageServer) publishDiagnostics(uri string) {
+	doc := s.docs[uri]
+	text := string(doc.bytes())
+	diagnostics := []lspDiagnostic{}
+	for _, w := range fakeWords(text) {
+		if text[w[0]:w[1]] == s.errorWord {
+			diagnostics = append(diagnostics, lspDiagnostic{
+				Range:    s.rangeOf(doc, w[0], w[1]),
+				Severity: lspError,
+				Source:   "fake",
+				Message:  "found a " + s.errorWord,
+			})
+		}
+	}
+	s.conn.notify("textDocument/publishDiagnostics", map[string]interface{}{
+		"uri":         uri,
+		"diagnostics": diagnostics,
+	})
+}
+
+func (s *fakeLanguageServer) rangeOf(doc *document, start, end int) lspRange {
+	return lspRange{
+		Start: lspPositionAt(doc, start, s.utf8),
+		End:   lspPositionAt(doc, end, s.utf8),
+	}
+}
+
+func (s *fakeLanguageServer) wordAt(doc *document, offset int) string {
+	if doc == nil {
+		return ""
+	}
+	text := string(doc.bytes())
+	start, end := wordAround(text, offset)
+	return text[start:end]
+}
+
+// occurrences returns the locations of the word at offset in the document.
+func (s *fakeLanguageServer) occurrences(uri string, doc *document, offset int) []lspLocation {
+	word := s.wordAt(doc, offset)
+	if word == "" {
+		return nil
+	}
+	text := string(doc.bytes())
+	var locations []lspLocation
+	for _, w := range fakeWords(text) {
+		if text[w[0]:w[1]] == word {
+			locations = append(locations, lspLocation{URI: uri, Range: s.rangeOf(doc, w[0], w[1])})
+		}
+	}
+	return locations
+}
+
+func isFakeWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// fakeWords returns the start and end offsets of all words in text.
+func fakeWords(text string) [][2]int {
+	var words [][2]int
+	start := -1
+	for i, r := range text + " " {
+		if isFakeWordRune(r) {
+			if start == -1 {
+				start = i
+			}
+		} else if start != -1 {
+			words = append(words, [2]int{start, i})
+			start = -1
+		}
+	}
+	return words
+}
+
+// wordAround returns the word that contains offset or ends at it.
+func wordAround(text string, offset int) (start, end int) {
+	start, end = offset, offset
+	for start > 0 {
+		r, size := utf8.DecodeLastRuneInString(text[:start])
+		if !isFakeWordRune(r) {
+			break
+		}
+		start -= size
+	}
+	for end < len(text) {
+		r, size := utf8.DecodeRuneInString(text[end:])
+		if !isFakeWordRune(r) {
+			break
+		}
+		end += size
+	}
+	return start, end
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pollUntil polls the client until done returns true.
+func pollUntil(t *testing.T, c *lspClient, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if err := c.poll(); err != nil {
+			t.Fatal(err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLSPInitialize(t *testing.T) {
+	for _, utf8Columns := range []bool{false, true} {
+		s, c := newFakeLanguageServer("/work", utf8Columns)
+		// documents opened before the handshake is done are sent afterwards
+		c.open("/work/a.go", newDocument([]byte("package a")))
+		if c.ready {
+			t.Fatal("the client is ready before the server answered")
+		}
+		pollUntil(t, c, func() bool { return c.ready })
+		if c.utf8 != utf8Columns {
+			t.Errorf("the client counts in UTF-8: %v, the server: %v", c.utf8, utf8Columns)
+		}
+		if c.rootURI != pathToURI("/work") {
+			t.Errorf("the workspace is %s", c.rootURI)
+		}
+		pollUntil(t, c, func() bool { return len(s.receivedMethods()) >= 3 })
+		want := "initialize initialized textDocument/didOpen"
+		if got := strings.Join(s.receivedMethods(), " "); got != want {
+			t.Errorf("the server received %s, want %s", got, want)
+		}
+		c.shutdown()
+		<-s.exited
+		pollUntil(t, c, func() bool { return c.poll() != nil })
+	}
+}
+
+func TestLSPDocumentSync(t *testing.T) {
+	for _, utf8Columns := range []bool{false, true} {
+		s, c := newFakeLanguageServer("/work", utf8Columns)
+		path := "/work/a.go"
+		doc := newDocument([]byte("héllo 😀 world\nsecond"))
+		c.open(path, doc)
+		pollUntil(t, c, func() bool { return c.ready })
+
+		// the edits after the emoji need the UTF-16 conversion
+		e := newEditor(doc)
+		e.setSelections([]selection{{doc.len(), doc.len()}})
+		e.insertText([]byte(" line"), typingEdit, time.Unix(0, 0))
+		world := strings.Index(string(doc.bytes()), "world")
+		doc.delete(world, 5)
+		doc.insert(world, []byte("wörld"))
+		doc.insert(0, []byte("\n"))
+		if err := c.poll(); err != nil {
+			t.Fatal(err)
+		}
+		// all edits between two polls are sent in one message
+		changes := 0
+		for _, m := range s.receivedMethods() {
+			if m == "textDocument/didChange" {
+				changes++
+			}
+		}
+		if changes > 1 {
+			t.Errorf("%d didChange messages for one poll", changes)
+		}
+		pollUntil(t, c, func() bool {
+			text, _ := s.text(pathToURI(path))
+			return text == string(doc.bytes())
+		})
+
+		c.close(path)
+		pollUntil(t, c, func() bool {
+			_, open := s.text(pathToURI(path))
+			return !open
+		})
+		// a closed document is not observed anymore
+		doc.insert(0, []byte("x"))
+		c.flush()
+		if m := s.receivedMethods(); m[len(m)-1] != "textDocument/didClose" {
+			t.Errorf("the last message is %s", m[len(m)-1])
+		}
+	}
+}
+
+func TestLSPCompletion(t *testing.T) {
+	_, c := newFakeLanguageServer("/work", false)
+	path := "/work/a.go"
+	doc := newDocument([]byte("apple apricot banana ap"))
+	c.open(path, doc)
+	pollUntil(t, c, func() bool { return c.ready })
+
+	var items []lspCompletionItem
+	done := false
+	c.completion(path, doc.len(), func(list []lspCompletionItem, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		items, done = list, true
+	})
+	if !c.busy() {
+		t.Error("the client is not busy while waiting for completions")
+	}
+	pollUntil(t, c, func() bool { return done })
+	converted := lspCompletionItems(items)
+	if len(converted) != 2 || converted[0].label != "apple" || converted[1].label != "apricot" {
+		t.Fatalf("the completions are %+v", converted)
+	}
+	if converted[0].kind != completionVariable || converted[0].insertText != "apple" {
+		t.Errorf("the first completion is %+v", converted[0])
+	}
+	if c.busy() {
+		t.Error("the client is busy after the answer")
+	}
+	// completion needs an open document
+	c.completion("/work/other.go", 0, func(_ []lspCompletionItem, err error) {
+		if err == nil {
+			t.Error("completion in a file that is not open")
+		}
+	})
+}
+
+func TestLSPDiagnostics(t *testing.T) {
+	_, c := newFakeLanguageServer("/work", false)
+	path := filepath.FromSlash("/work/a.go")
+	doc := newDocument([]byte("x\n😀 bug"))
+	published := make(map[string][]lspDiagnostic)
+	c.diagnosticsChanged = func(path string, list []lspDiagnostic) {
+		published[path] = list
+	}
+	c.open(path, doc)
+	pollUntil(t, c, func() bool { return len(published[path]) == 1 })
+
+	list := c.convertDiagnostics(path, published[path])
+	// the emoji is two UTF-16 code units but four bytes
+	want := diagnostic{
+		path:     path,
+		start:    textPosition{line: 1, column: 5},
+		end:      textPosition{line: 1, column: 8},
+		severity: severityError,
+		message:  "found a bug",
+		source:   "fake",
+	}
+	if len(list) != 1 || list[0] != want {
+		t.Errorf("the diagnostics are %+v, want %+v", list, want)
+	}
+
+	// fixing the problem publishes an empty list
+	doc.delete(doc.len()-3, 3)
+	pollUntil(t, c, func() bool { return len(published[path]) == 0 })
+}
+
+func TestLSPWake(t *testing.T) {
+	s, c := newFakeLanguageServer("/work", false)
+	woken := make(chan bool, 100)
+	c.setWake(func() { woken <- true })
+	wait := func(what string) {
+		t.Helper()
+		select {
+		case <-woken:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no wake-up for " + what)
+		}
+		if err := c.poll(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wait("the initialize response")
+	if !c.ready {
+		t.Fatal("the client is not ready after the wake-up")
+	}
+	doc := newDocument([]byte("text"))
+	c.open("/work/a.go", doc)
+	wait("the diagnostics")
+	for len(woken) > 0 {
+		<-woken
+	}
+	// an edit wakes the UI once, the changes are sent when it polls
+	doc.insert(0, []byte("a"))
+	doc.insert(0, []byte("b"))
+	wait("the edit")
+	if len(woken) > 1 {
+		t.Errorf("%d wake-ups for two edits", len(woken)+1)
+	}
+	// a broken connection wakes the UI so poll can report it
+	s.closer.Close()
+	deadline := time.After(5 * time.Second)
+	for c.poll() == nil {
+		select {
+		case <-woken:
+		case <-deadline:
+			t.Fatal("no wake-up for the broken connection")
+		}
+	}
+}
+
+// closeRecorder is a closer that reports when it is closed.
+type closeRecorder chan bool
+
+func (r closeRecorder) Close() error {
+	r <- true
+	return nil
+}
+
+func TestLSPAbort(t *testing.T) {
+	s, c := newFakeLanguageServer("/work", false)
+	pollUntil(t, c, func() bool { return c.ready })
+	closed := make(closeRecorder, 1)
+	c.closer = closed
+	doc := newDocument([]byte("text"))
+	c.open("/work/a.go", doc)
+
+	s.closer.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.poll() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the broken connection was not reported")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.abort()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server was not ended")
+	}
+	// edits are not recorded for the broken connection anymore
+	doc.insert(0, []byte("a"))
+	if changes := c.docs[pathToURI("/work/a.go")].changes; len(changes) != 0 {
+		t.Errorf("the edit was recorded as %+v", changes)
+	}
+}
+
+func TestLSPRequests(t *testing.T) {
+	for _, utf8Columns := range []bool{false, true} {
+		_, c := newFakeLanguageServer("/work", utf8Columns)
+		path := filepath.FromSlash("/work/a.go")
+		doc := newDocument([]byte("héllo 😀 world\nbug world"))
+		c.open(path, doc)
+		pollUntil(t, c, func() bool { return c.ready })
+		world := strings.Index(string(doc.bytes()), "world")
+
+		var hover string
+		done := false
+		c.hover(path, world+1, func(text string, err error) {
+			hover, done = text, err == nil
+		})
+		pollUntil(t, c, func() bool { return done })
+		if hover != "word world" {
+			t.Errorf("hover gives %q", hover)
+		}
+
+		var locations []lspLocation
+		done = false
+		c.definition(path, doc.len()-1, func(list []lspLocation, err error) {
+			locations, done = list, err == nil
+		})
+		pollUntil(t, c, func() bool { return done })
+		want := codeLocation{path: diagnosticPath(path), pos: textPosition{0, world}, text: "héllo 😀 world"}
+		if l := c.codeLocations(locations); len(l) != 1 || l[0] != want {
+			t.Errorf("the definition is %+v", l)
+		}
+
+		done = false
+		c.references(path, world, func(list []lspLocation, err error) {
+			locations, done = list, err == nil
+		})
+		pollUntil(t, c, func() bool { return done })
+		if l := c.codeLocations(locations); len(l) != 2 || l[1].pos != (textPosition{1, 4}) {
+			t.Errorf("the references are %+v", l)
+		}
+
+		var edit *lspWorkspaceEdit
+		done = false
+		c.rename(path, world, "wörld", func(e *lspWorkspaceEdit, err error) {
+			edit, done = e, err == nil
+		})
+		pollUntil(t, c, func() bool { return done })
+		plan, err := lspRenamePlan("world", "wörld", edit, path, doc.bytes(), c.utf8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plan.edits() != 2 || string(plan.files[0].result()) != "héllo 😀 wörld\nbug wörld" {
+			t.Errorf("the rename gives %q", plan.files[0].result())
+		}
+	}
+}
+
+func TestLSPCodeActions(t *testing.T) {
+	_, c := newFakeLanguageServer("/work", false)
+	path := filepath.FromSlash("/work/a.go")
+	doc := newDocument([]byte("bug 😀 bug"))
+	c.open(path, doc)
+	pollUntil(t, c, func() bool { return len(c.diagnostics[pathToURI(path)]) == 2 })
+
+	var actions []lspCodeAction
+	done := false
+	c.codeActions(path, 0, 1, func(list []lspCodeAction, err error) {
+		actions, done = list, err == nil
+	})
+	pollUntil(t, c, func() bool { return done })
+	if len(actions) != 2 || actions[0].Edit == nil || actions[1].Command == nil {
+		t.Fatalf("the code actions are %+v", actions)
+	}
+	e := newEditor(doc)
+	quickFix := actions[0].Edit.fileEdits()[pathToURI(path)]
+	e.applyReplacements(otherEdit, lspReplacements(doc, quickFix, c.utf8), time.Unix(0, 0))
+	if text := string(doc.bytes()); text != " 😀 bug" {
+		t.Fatalf("the quick fix gives %q", text)
+	}
+
+	// the command's edit comes back as a request from the server
+	var requested *lspWorkspaceEdit
+	c.applyEdit = func(edit *lspWorkspaceEdit) {
+		requested = edit
+	}
+	done = false
+	c.executeCommand(*actions[1].Command, func(err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		done = true
+	})
+	pollUntil(t, c, func() bool { return done && requested != nil })
+	edits := requested.fileEdits()[pathToURI(path)]
+	e.applyReplacements(otherEdit, lspReplacements(doc, edits, c.utf8), time.Unix(0, 0))
+	if text := string(doc.bytes()); text != " 😀 " {
+		t.Errorf("the command gives %q", text)
+	}
+}
+
+func TestURI(t *testing.T) {
+	path := filepath.FromSlash("/a b/x.go")
+	if uri := pathToURI(path); !strings.HasSuffix(uri, "/a%20b/x.go") || uriToPath(uri) != diagnosticPath(path) {
+		t.Errorf("%s is %s", path, uri)
+	}
+	if path := uriToPath("file:///C:/x/y.go"); path != filepath.FromSlash("C:/x/y.go") {
+		t.Errorf("the Windows path is %s", path)
+	}
+	if path := uriToPath("untitled:1"); path != "untitled:1" {
+		t.Errorf("the URI that is not a file is %s", path)
+	}
+}
+
+// languageServerScenario opens a Go file in the headless app with a fake
+// language server.
+func languageServerScenario(t *testing.T, content string) (d *headlessDriver, g *recordingGraphics, path string, cleanUp func()) {
+	dir, err := ioutil.TempDir("", "lsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, "a.go")
+	if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	g = newRecordingGraphics(fixedWidthFont{10, 20})
+	d = newHeadlessDriver(g, 640, 480, time.Unix(0, 0))
+	d.app.languageServer = func(root string) (*lspClient, error) {
+		_, c := newFakeLanguageServer(root, false)
+		return c, nil
+	}
+	if err := d.app.openFile(path); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, d, func() bool { return d.app.lsp != nil && d.app.lsp.ready })
+	return d, g, path, func() {
+		// the documents are modified, quitting does not ask
+		d.app.quit()
+		os.RemoveAll(dir)
+	}
+}
+
+// waitUntil advances the driver's clock in small steps, to deliver what the
+// language server sends, until done returns true.
+func waitUntil(t *testing.T, d *headlessDriver, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond)
+		d.advance(10 * time.Millisecond)
+	}
+}
+
+func drew(g *recordingGraphics, text string) bool {
+	for _, c := range g.displayList() {
+		if strings.Contains(c.text, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHeadlessLanguageServer(t *testing.T) {
+	d, g, path, cleanUp := languageServerScenario(t, "package a\n")
+	defer cleanUp()
+
+	d.keys("Ctrl+End")
+	d.typeText("var bug = 1")
+	waitUntil(t, d, func() bool { return len(d.app.diagnostics.inFile(path)) == 1 })
+	if diag := d.app.diagnostics.inFile(path)[0]; diag.source != "fake" || diag.start != (textPosition{1, 4}) {
+		t.Errorf("the diagnostic is %+v", diag)
+	}
+	// the app sleeps while nothing happens, only the type check of the edit
+	// may still be running
+	waitUntil(t, d, func() bool { return len(d.platform.timers) == 0 })
+	g.reset()
+	d.advance(time.Hour)
+	if n := len(g.displayList()); n != 0 {
+		t.Errorf("%d commands drawn while idle", n)
+	}
+
+	// hover shows a popup until the next key press
+	d.keys("Left Left Left Left Left")
+	g.reset()
+	d.keys("Ctrl+K Ctrl+I")
+	waitUntil(t, d, func() bool { return d.app.hover != nil })
+	d.paint()
+	if !drew(g, "word bug") {
+		t.Error("the hover text was not drawn")
+	}
+	d.keys("Right")
+	if d.app.hover != nil {
+		t.Error("the hover popup is still open")
+	}
+
+	// the code actions are listed, Enter applies the quick fix
+	d.keys("Ctrl+.")
+	waitUntil(t, d, func() bool { return d.app.codeActions.visible })
+	if n := len(d.app.codeActions.actions); n != 2 {
+		t.Fatalf("%d code actions", n)
+	}
+	d.keys("Down Up Enter")
+	if text := string(d.editor().doc.bytes()); text != "package a\nvar  = 1" {
+		t.Fatalf("the quick fix gives %q", text)
+	}
+	waitUntil(t, d, func() bool { return len(d.app.diagnostics.inFile(path)) == 0 })
+	if d.app.codeActions.visible || d.app.keyboard.mode != nil {
+		t.Error("the code actions are still listed")
+	}
+	if len(d.platform.errors) > 0 {
+		t.Fatal(d.platform.errors)
+	}
+}
+
+func TestHeadlessLanguageServerCommand(t *testing.T) {
+	d, _, path, cleanUp := languageServerScenario(t, "package a\n\nvar bug, bug2 = bug, 1\n")
+	defer cleanUp()
+
+	d.keys("Ctrl+End Up End Left Left Left Left")
+	waitUntil(t, d, func() bool { return len(d.app.diagnostics.inFile(path)) == 2 })
+	d.keys("Ctrl+.")
+	waitUntil(t, d, func() bool { return d.app.codeActions.visible })
+	// the second action runs a command, the server sends back the edit
+	d.keys("Down Enter")
+	waitUntil(t, d, func() bool { return len(d.app.diagnostics.inFile(path)) == 0 })
+	if text := string(d.editor().doc.bytes()); text != "package a\n\nvar , bug2 = , 1\n" {
+		t.Errorf("the command gives %q", text)
+	}
+	d.keys("Ctrl+Z")
+	if text := string(d.editor().doc.bytes()); text != "package a\n\nvar bug, bug2 = bug, 1\n" {
+		t.Errorf("undo gives %q", text)
+	}
+	if len(d.platform.errors) > 0 {
+		t.Fatal(d.platform.errors)
+	}
+}
+
+func TestHeadlessLanguageServerNavigation(t *testing.T) {
+	d, _, path, cleanUp := languageServerScenario(t, "package a\n\nvar x = 1\n\nvar y = x + x\n")
+	defer cleanUp()
+
+	d.keys("Ctrl+End Up End Left")
+	d.keys("F12")
+	waitUntil(t, d, func() bool { return d.editor().primaryCursor().caret != d.editor().doc.len()-2 })
+	if line, col := d.editor().doc.offsetToLineCol(d.editor().primaryCursor().caret); line != 2 || col != 4 {
+		t.Errorf("the definition is at %d:%d", line, col)
+	}
+
+	d.keys("Shift+F12")
+	waitUntil(t, d, func() bool { return d.app.locations.visible })
+	if n := len(d.app.locations.list); n != 3 {
+		t.Fatalf("%d references", n)
+	}
+	if loc := d.app.locations.list[2]; loc.path != diagnosticPath(path) || loc.text != "var y = x + x" {
+		t.Errorf("the last reference is %+v", loc)
+	}
+
+	// the rename is shown before it is applied
+	d.keys("F2")
+	d.typeText("value")
+	d.keys("Enter")
+	waitUntil(t, d, func() bool { return d.app.renamePreview != nil })
+	d.keys("Enter")
+	if text := string(d.editor().doc.bytes()); text != "package a\n\nvar value = 1\n\nvar y = value + value\n" {
+		t.Errorf("the rename gives %q", text)
+	}
+	if len(d.platform.errors) > 0 {
+		t.Fatal(d.platform.errors)
+	}
+}
@@ -19,22 +19,76 @@ import (
 	"github.com/gonutz/ide/w32"
 )
 
-var globalGraphics graphics
-
 func main() {
 	defer handlePanics()
 	runtime.LockOSThread()
 	hideConsoleWindow()
+
 	window := createWindow()
 
-	graphics, err := newD3d9Graphics(window, font.TTF, 20)
-	if err != nil {
-		panic(err)
+	var g graphics
+	d3d, err := newD3d9Graphics(window, font.TTF, 20)
+	if err == nil {
+		defer d3d.close()
+		g = d3d
+	} else {
+		// without Direct3D 9 everything is rendered on the CPU
+		gdi, err := newGDIGraphics(window, font.TTF, 20)
+		if err != nil {
+			panic(err)
+		}
+		g = gdi
 	}
-	defer graphics.close()
-	globalGraphics = graphics
 
-	w32.SetTimer(window, 1, 50)
+	commands := newCommandRegistry()
+	registerEditorCommands(commands)
+	theApp = newApp(win32Platform{window: window}, g, newDefaultKeymap(), commands)
+	// the app registers its own commands, the user's bindings are loaded
+	// after that so they can refer to them
+	err = loadKeyBindings(keyBindingsPath(), theApp.keyboard.keys, commands)
+	if err != nil {
+		// a broken configuration should not keep the user from editing, the
+		// default bindings are used instead
+		w32.MessageBox(window, err.Error(), "Key Bindings", w32.MB_OK|w32.MB_ICONERROR)
+		theApp.keyboard.keys = newDefaultKeymap()
+	}
+	theApp.settings, err = loadSettings(settingsPath())
+	if err != nil {
+		w32.MessageBox(window, err.Error(), "Settings", w32.MB_OK|w32.MB_ICONERROR)
+	}
+	if command := theApp.settings.LanguageServer; command != "" {
+		// without the language server installed, the editor works on its own
+		if _, err := exec.LookPath(command); err == nil {
+			theApp.languageServer = func(dir string) (*lspClient, error) {
+				return startLanguageServer(command, dir)
+			}
+		}
+	}
+	if command := theApp.settings.Debugger; command != "" {
+		if _, err := exec.LookPath(command); err == nil {
+			theApp.debugAdapter = func(dir string) (*dapClient, error) {
+				return startDebugAdapter(command, dir)
+			}
+		}
+	}
+	theApp.benchmarkDir = benchmarkPath()
+	runs, err := loadBenchmarkRuns(theApp.benchmarkDir)
+	if err != nil {
+		w32.MessageBox(window, err.Error(), "Benchmarks", w32.MB_OK|w32.MB_ICONERROR)
+	}
+	theApp.benchmarks.setRuns(runs)
+	r, _ := w32.GetClientRect(window)
+	theApp.handle(resizeEvent{
+		width:  int(r.Right - r.Left),
+		height: int(r.Bottom - r.Top),
+	})
+	if len(os.Args) > 1 {
+		if err := theApp.openFile(os.Args[1]); err != nil {
+			panic(err)
+		}
+	} else {
+		theApp.setEditor(newEditor(newDocument(nil)))
+	}
 
 	var msg w32.MSG
 	for w32.GetMessage(&msg, 0, 0, 0) > 0 {
@@ -43,83 +97,158 @@ func main() {
 	}
 }
 
-var text string
+var (
+	// theApp is nil until the window and graphics are created, messages that
+	// arrive before that get the default handling
+	theApp *app
+	// highSurrogate is the first half of a UTF-16 surrogate pair that arrives
+	// in two WM_CHAR messages
+	highSurrogate uint16
+)
+
+// win32Platform implements the app's platform with a Win32 window.
+type win32Platform struct {
+	window uintptr
+}
+
+func (p win32Platform) invalidate(r rectangle) {
+	w32.InvalidateRect(p.window, &w32.RECT{
+		Left:   int32(r.x),
+		Top:    int32(r.y),
+		Right:  int32(r.x + r.w),
+		Bottom: int32(r.y + r.h),
+	}, false)
+}
+
+func (p win32Platform) startTimer(id int, interval time.Duration) {
+	w32.SetTimer(p.window, uintptr(id), uintptr(interval/time.Millisecond))
+}
+
+func (p win32Platform) stopTimer(id int) {
+	w32.KillTimer(p.window, uintptr(id))
+}
+
+func (p win32Platform) wake(id int) {
+	w32.PostMessage(p.window, wakeMessage, uintptr(id), 0)
+}
+
+func (p win32Platform) now() time.Time {
+	return time.Now()
+}
+
+func (p win32Platform) quit() {
+	w32.DestroyWindow(p.window)
+}
+
+func (p win32Platform) showError(title, message string) {
+	w32.MessageBox(p.window, message, title, w32.MB_OK|w32.MB_ICONERROR)
+}
+
+// wakeMessage is posted by win32Platform.wake, its wParam is the timer id.
+const wakeMessage = w32.WM_APP
 
+// handleOSMessage translates Win32 messages to app events.
 func handleOSMessage(window, message, w, l uintptr) uintptr {
+	if theApp == nil {
+		if message == w32.WM_DESTROY {
+			w32.PostQuitMessage(0)
+			return 0
+		}
+		return w32.DefWindowProc(window, message, w, l)
+	}
+
+	var ev event
 	switch message {
-	case w32.WM_TIMER:
-		// TODO for now this is rendering some moving rectangles for redering;
-		// eventually this will update the GUI if re-drawing is necessary
-		globalGraphics.rect(0, 0, 100000, 100000, 0xFF072727)
-		globalGraphics.rect(10, 10, 200, 200, 0xFFFFFFFF)
-		globalGraphics.text(
-			[]byte(text),
-			10, 10,
-			rect(10, 10, 200, 200),
-			0xFF000000,
-		)
-		err := globalGraphics.present()
-		if err != nil {
+	case w32.WM_PAINT:
+		var update rectangle
+		if r, ok := w32.GetUpdateRect(window, false); ok {
+			update = rect(
+				int(r.Left), int(r.Top),
+				int(r.Right-r.Left), int(r.Bottom-r.Top),
+			)
+		}
+		if err := theApp.paint(update); err != nil {
 			panic(err)
 		}
+		// everything is drawn now, this also drops the invalidations made
+		// while painting, otherwise WM_PAINT would keep coming
+		w32.ValidateRect(window, nil)
 		return 0
+	case w32.WM_ERASEBKGND:
+		// the whole window is drawn in WM_PAINT, erasing it first would only
+		// make it flicker
+		return 1
 	case w32.WM_DESTROY:
 		w32.PostQuitMessage(0)
 		return 0
-	case w32.WM_COMMAND:
-		cmd := w & 0xFFFF
-		fmt.Println("            command:", cmd)
-		return 0
-	case w32.WM_SYSCOMMAND:
-		fmt.Printf("WM_SYSCOMMAND %x %x %s\n", w, l, keyState())
-		return w32.DefWindowProc(window, message, w, l)
-	case w32.WM_KEYDOWN:
-		fmt.Printf("WM_KEYDOWN %x(%s) %x %s\n", w, string(rune(w)), l, keyState())
-		return w32.DefWindowProc(window, message, w, l)
+	case w32.WM_CLOSE:
+		ev = closeEvent{}
+	case w32.WM_SIZE:
+		ev = resizeEvent{
+			width:  int(l & 0xFFFF),
+			height: int((l >> 16) & 0xFFFF),
+		}
+	case w32.WM_SETFOCUS, w32.WM_KILLFOCUS:
+		ev = focusEvent{focused: message == w32.WM_SETFOCUS}
+	case w32.WM_TIMER, wakeMessage:
+		ev = timerEvent{id: int(w)}
+	case w32.WM_KEYDOWN, w32.WM_SYSKEYDOWN:
+		if k, ok := win32KeyChord(w); ok {
+			ev = keyDownEvent{key: k}
+		}
+	case w32.WM_LBUTTONDOWN:
+		w32.SetCapture(window)
+		x, y := mousePosition(l)
+		ev = mouseDownEvent{
+			x:     x,
+			y:     y,
+			shift: w&w32.MK_SHIFT != 0,
+			ctrl:  w&w32.MK_CONTROL != 0,
+			alt:   isKeyDown(w32.VK_MENU),
+		}
+	case w32.WM_MOUSEMOVE:
+		x, y := mousePosition(l)
+		ev = mouseMoveEvent{x: x, y: y}
+	case w32.WM_LBUTTONUP:
+		w32.ReleaseCapture()
+		x, y := mousePosition(l)
+		ev = mouseUpEvent{x: x, y: y}
 	case w32.WM_CHAR:
-		r := utf16.Decode([]uint16{uint16(w)})[0]
-		repeatCount := int(l & 0xFFFF)
-		scanCode := int(l&0xFF0000) >> 16
-		extended := l&1<<24 != 0
-		altDown := l&1<<29 != 0
-		wasDownBefore := l&1<<30 != 0
-		beingReleased := l&1<<31 != 0
-		fmt.Printf(`WM_CHAR
-           key  %s (%d)
-  repeat count  %d
-     scan code  %d
-      extended  %v
-      alt down  %v
-  key was down  %v
-   is released  %v
-`,
-			string(r), int(r),
-			repeatCount,
-			scanCode,
-			extended,
-			altDown,
-			wasDownBefore,
-			beingReleased,
-		)
-		return w32.DefWindowProc(window, message, w, l)
-	default:
-		return w32.DefWindowProc(window, message, w, l)
+		r, ok := decodeChar(uint16(w))
+		if !ok {
+			// wait for the second half of the surrogate pair
+			return 0
+		}
+		ev = charEvent{char: r, repeatCount: int(l & 0xFFFF)}
 	}
-}
 
-func keyState() string {
-	result := ""
-	const mask = 1 << 15
-	if w32.GetKeyState(w32.VK_SHIFT)&mask != 0 {
-		result += " shift"
-	}
-	if w32.GetKeyState(w32.VK_CONTROL)&mask != 0 {
-		result += " control"
+	if ev != nil && theApp.handle(ev) {
+		return 0
 	}
-	if w32.GetKeyState(w32.VK_MENU)&mask != 0 {
-		result += " alt"
+	return w32.DefWindowProc(window, message, w, l)
+}
+
+// decodeChar turns the UTF-16 character c from a WM_CHAR message into a rune.
+// Characters outside the Basic Multilingual Plane arrive as two surrogates in
+// two WM_CHAR messages, for the first one decodeChar returns false.
+func decodeChar(c uint16) (rune, bool) {
+	if utf16.IsSurrogate(rune(c)) {
+		if highSurrogate == 0 {
+			highSurrogate = c
+			return 0, false
+		}
+		r := utf16.DecodeRune(rune(highSurrogate), rune(c))
+		highSurrogate = 0
+		return r, true
 	}
-	return result
+	highSurrogate = 0
+	return rune(c), true
+}
+
+// mousePosition extracts the signed client coordinates from the lParam of a
+// mouse message.
+func mousePosition(l uintptr) (x, y int) {
+	return int(int16(l & 0xFFFF)), int(int16((l >> 16) & 0xFFFF))
 }
 
 func handlePanics() {
@@ -0,0 +1,11 @@
+//+build !windows,!linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package main
+
+import "io/ioutil"
+
+// mapFile reads the whole file into memory on platforms without mmap support.
+func mapFile(path string) (data []byte, unmap func() error, err error) {
+	data, err = ioutil.ReadFile(path)
+	return data, func() error { return nil }, err
+}
@@ -0,0 +1,46 @@
+//+build linux darwin freebsd netbsd openbsd
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+// mapFile maps the whole file read-only into memory. If that is not possible
+// the file is read into memory instead.
+func mapFile(path string) (data []byte, unmap func() error, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	size := info.Size()
+	noUnmap := func() error { return nil }
+	if size == 0 {
+		return nil, noUnmap, nil
+	}
+	if int64(int(size)) != size {
+		return nil, nil, errors.New("file is too large for this platform")
+	}
+
+	data, err = syscall.Mmap(
+		int(f.Fd()),
+		0,
+		int(size),
+		syscall.PROT_READ,
+		syscall.MAP_SHARED,
+	)
+	if err != nil {
+		data, err := ioutil.ReadFile(path)
+		return data, noUnmap, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,69 @@
+//+build windows
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"syscall"
+	"unsafe"
+)
+
+// mapFile maps the whole file read-only into memory. If that is not possible,
+// e.g. because a 32 bit process runs out of address space, the file is read
+// into memory instead.
+func mapFile(path string) (data []byte, unmap func() error, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	size := info.Size()
+	noUnmap := func() error { return nil }
+	if size == 0 {
+		return nil, noUnmap, nil
+	}
+	if int64(int(size)) != size {
+		return nil, nil, errors.New("file is too large for this platform")
+	}
+
+	mapping, err := syscall.CreateFileMapping(
+		syscall.Handle(f.Fd()),
+		nil,
+		syscall.PAGE_READONLY,
+		uint32(size>>32),
+		uint32(size),
+		nil,
+	)
+	if err != nil {
+		data, err := ioutil.ReadFile(path)
+		return data, noUnmap, err
+	}
+	// the view keeps a reference to the mapping, we do not need the handle
+	// after creating the view
+	defer syscall.CloseHandle(mapping)
+
+	addr, err := syscall.MapViewOfFile(
+		mapping,
+		syscall.FILE_MAP_READ,
+		0, 0,
+		uintptr(size),
+	)
+	if err != nil {
+		data, err := ioutil.ReadFile(path)
+		return data, noUnmap, err
+	}
+
+	header := (*reflect.SliceHeader)(unsafe.Pointer(&data))
+	header.Data = addr
+	header.Len = int(size)
+	header.Cap = int(size)
+	return data, func() error { return syscall.UnmapViewOfFile(addr) }, nil
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"errors"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// moduleLoader parses and type-checks all packages of a Go module, the way
+// go/packages would, but without running the go command. Packages outside the
+// module are imported from source.
+type moduleLoader struct {
+	fset   *token.FileSet
+	root   string
+	module string
+	// inModule is false for a directory without go.mod, only that directory
+	// is loaded then
+	inModule bool
+	// overlay holds the content of files that differ from the disk, i.e. the
+	// one that is being edited
+	overlay  map[string][]byte
+	fallback types.Importer
+	// packages are the module's packages by import path, a nil entry means
+	// that the package is being checked right now
+	packages map[string]*loadedPackage
+	// tests are the variants of the packages with their test files, they are
+	// never imported
+	tests []*loadedPackage
+}
+
+// loadedPackage is a type-checked package of the module.
+type loadedPackage struct {
+	path  string
+	dir   string
+	files []*ast.File
+	types *types.Package
+	info  *types.Info
+}
+
+// newModuleLoader loads the module that contains the directory dir. A
+// directory outside of any module is loaded on its own.
+func newModuleLoader(dir string, overlay map[string][]byte) *moduleLoader {
+	dir, _ = filepath.Abs(dir)
+	root, module, ok := findModule(dir)
+	if !ok {
+		root, module = dir, "command-line-arguments"
+	}
+	fset := token.NewFileSet()
+	return &moduleLoader{
+		fset:     fset,
+		root:     root,
+		module:   module,
+		inModule: ok,
+		overlay:  overlay,
+		fallback: importer.ForCompiler(fset, "source", nil),
+		packages: make(map[string]*loadedPackage),
+	}
+}
+
+// loadAll checks every package of the module, together with its tests.
+func (l *moduleLoader) loadAll() {
+	filepath.Walk(l.root, func(dir string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		base := info.Name()
+		if dir != l.root {
+			if !l.inModule {
+				return filepath.SkipDir
+			}
+			if base == "testdata" || base == "vendor" ||
+				strings.HasPrefix(base, ".") || strings.HasPrefix(base, "_") {
+				return filepath.SkipDir
+			}
+			// a nested module is not part of this one
+			if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+		}
+		path := l.importPath(dir)
+		l.load(path, dir)
+		l.loadTests(path, dir)
+		return nil
+	})
+}
+
+// importPath is the import path of the package in dir, which is inside the
+// module.
+func (l *moduleLoader) importPath(dir string) string {
+	rel, err := filepath.Rel(l.root, dir)
+	if err != nil || rel == "." {
+		return l.module
+	}
+	return l.module + "/" + filepath.ToSlash(rel)
+}
+
+// Import implements types.Importer, packages of the module are checked by the
+// loader itself so that all of them share the same objects.
+func (l *moduleLoader) Import(path string) (*types.Package, error) {
+	if path == l.module || strings.HasPrefix(path, l.module+"/") {
+		rel := strings.TrimPrefix(strings.TrimPrefix(path, l.module), "/")
+		p := l.load(path, filepath.Join(l.root, filepath.FromSlash(rel)))
+		if p == nil {
+			return nil, errors.New("cannot import " + path)
+		}
+		return p.types, nil
+	}
+	return l.fallback.Import(path)
+}
+
+// load checks the package in dir without its tests. It returns nil if there
+// is no package or if it imports itself.
+func (l *moduleLoader) load(path, dir string) *loadedPackage {
+	if p, ok := l.packages[path]; ok {
+		return p
+	}
+	l.packages[path] = nil
+	files := l.parseFiles(dir, func(name string, f *ast.File) bool {
+		return !strings.HasSuffix(name, "_test.go")
+	})
+	if len(files) == 0 {
+		return nil
+	}
+	p := l.check(path, dir, files)
+	l.packages[path] = p
+	return p
+}
+
+// loadTests checks the package in dir with its internal tests and the
+// external test package, if there are test files.
+func (l *moduleLoader) loadTests(path, dir string) {
+	var internal, external []*ast.File
+	l.parseFiles(dir, func(name string, f *ast.File) bool {
+		if !strings.HasSuffix(name, "_test.go") {
+			return false
+		}
+		if strings.HasSuffix(f.Name.Name, "_test") {
+			external = append(external, f)
+		} else {
+			internal = append(internal, f)
+		}
+		return false
+	})
+	if len(internal) > 0 {
+		files := l.parseFiles(dir, func(name string, f *ast.File) bool {
+			return !strings.HasSuffix(name, "_test.go")
+		})
+		l.tests = append(l.tests, l.check(path, dir, append(files, internal...)))
+	}
+	if len(external) > 0 {
+		l.tests = append(l.tests, l.check(path+"_test", dir, external))
+	}
+}
+
+// parseFiles parses the Go files in dir that are built for the current
+// platform and that keep accepts. All files must belong to the same package
+// as the first one, others are skipped.
+func (l *moduleLoader) parseFiles(dir string, keep func(name string, f *ast.File) bool) []*ast.File {
+	infos, _ := ioutil.ReadDir(dir)
+	var files []*ast.File
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, ".go") {
+			continue
+		}
+		if match, err := build.Default.MatchFile(dir, name); err != nil || !match {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		var src interface{}
+		if data, ok := l.overlay[path]; ok {
+			src = data
+		}
+		f, _ := parser.ParseFile(l.fset, path, src, 0)
+		if f == nil || !keep(name, f) {
+			continue
+		}
+		if len(files) > 0 && f.Name.Name != files[0].Name.Name {
+			continue
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+func (l *moduleLoader) check(path, dir string, files []*ast.File) *loadedPackage {
+	info := &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Defs:  make(map[*ast.Ident]types.Object),
+		Uses:  make(map[*ast.Ident]types.Object),
+
+		Scopes:     make(map[ast.Node]*types.Scope),
+		Selections: make(map[*ast.SelectorExpr]*types.Selection),
+	}
+	conf := types.Config{
+		Importer: l,
+		// whatever can be resolved is good enough for navigation
+		Error: func(error) {},
+	}
+	pkg, _ := conf.Check(path, l.fset, files, info)
+	return &loadedPackage{path: path, dir: dir, files: files, types: pkg, info: info}
+}
+
+// all returns the loaded packages, the ones without tests first, in a fixed
+// order.
+func (l *moduleLoader) all() []*loadedPackage {
+	var list []*loadedPackage
+	for _, p := range l.packages {
+		if p != nil {
+			list = append(list, p)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].path < list[j].path
+	})
+	return append(list, l.tests...)
+}
+
+// packageOf checks the package of the file at path and returns it with the
+// file's syntax tree. Files that are not tests are taken from the package's
+// test variant if there is one, so names in the tests count, too.
+func (l *moduleLoader) packageOf(path string) (*loadedPackage, *ast.File) {
+	path = diagnosticPath(path)
+	dir := filepath.Dir(path)
+	pkgPath := l.importPath(dir)
+	l.load(pkgPath, dir)
+	l.loadTests(pkgPath, dir)
+	list := append([]*loadedPackage{}, l.tests...)
+	if p := l.packages[pkgPath]; p != nil {
+		list = append(list, p)
+	}
+	for _, p := range list {
+		for _, f := range p.files {
+			if l.fset.File(f.Pos()).Name() == path {
+				return p, f
+			}
+		}
+	}
+	return nil, nil
+}
+
+// objectAt returns the object that the identifier at offset in the file at
+// path declares or refers to.
+func (l *moduleLoader) objectAt(path string, offset int) types.Object {
+	path = diagnosticPath(path)
+	for _, p := range l.all() {
+		for _, f := range p.files {
+			tokens := l.fset.File(f.Pos())
+			if tokens.Name() != path || offset > tokens.Size() {
+				continue
+			}
+			pos := tokens.Pos(offset)
+			var found *ast.Ident
+			ast.Inspect(f, func(n ast.Node) bool {
+				if n == nil || found != nil || pos < n.Pos() || pos > n.End() {
+					return false
+				}
+				if id, ok := n.(*ast.Ident); ok {
+					found = id
+				}
+				return true
+			})
+			if found == nil {
+				continue
+			}
+			obj := p.info.Uses[found]
+			if obj == nil {
+				obj = p.info.Defs[found]
+			}
+			if obj != nil {
+				return obj
+			}
+		}
+	}
+	return nil
+}
+
+// objectKey identifies an object by the place of its declaration. The same
+// declaration is checked several times, with and without tests, which creates
+// different objects for it.
+type objectKey struct {
+	path   string
+	offset int
+	name   string
+}
+
+func (l *moduleLoader) keyOf(obj types.Object) objectKey {
+	pos := l.fset.Position(obj.Pos())
+	return objectKey{path: pos.Filename, offset: pos.Offset, name: obj.Name()}
+}
+
+// location converts a position to a code location, the text is the trimmed
+// line that contains it.
+func (l *moduleLoader) location(pos token.Pos) (codeLocation, bool) {
+	if !pos.IsValid() {
+		return codeLocation{}, false
+	}
+	p := l.fset.Position(pos)
+	loc := codeLocation{
+		path: p.Filename,
+		pos:  textPosition{line: p.Line - 1, column: p.Column - 1},
+	}
+	src, ok := l.overlay[p.Filename]
+	if !ok {
+		src, _ = ioutil.ReadFile(p.Filename)
+	}
+	if p.Offset <= len(src) {
+		start := strings.LastIndexByte(string(src[:p.Offset]), '\n') + 1
+		end := len(src)
+		if i := strings.IndexByte(string(src[p.Offset:]), '\n'); i != -1 {
+			end = p.Offset + i
+		}
+		loc.text = strings.TrimSpace(string(src[start:end]))
+	}
+	return loc, true
+}
+
+// navigationKind tells what a navigation query looks for.
+type navigationKind int
+
+const (
+	findDefinition navigationKind = iota
+	findTypeDefinition
+	findReferences
+	findImplementations
+)
+
+var navigationTitles = []string{
+	findDefinition:      "Definition",
+	findTypeDefinition:  "Type Definition",
+	findReferences:      "References",
+	findImplementations: "Implementations",
+}
+
+// findLocations loads the module of the file at path, with src as its current
+// content, and answers the query for the identifier at offset.
+func findLocations(kind navigationKind, path string, src []byte, offset int) ([]codeLocation, error) {
+	path = diagnosticPath(path)
+	l := newModuleLoader(filepath.Dir(path), map[string][]byte{path: src})
+	l.loadAll()
+	obj := l.objectAt(path, offset)
+	if obj == nil {
+		return nil, errors.New("there is no identifier at the cursor")
+	}
+	var list []codeLocation
+	add := func(pos token.Pos) {
+		if loc, ok := l.location(pos); ok {
+			list = append(list, loc)
+		}
+	}
+	switch kind {
+	case findDefinition:
+		add(obj.Pos())
+	case findTypeDefinition:
+		if named := namedTypeOf(obj.Type()); named != nil {
+			add(named.Obj().Pos())
+		}
+	case findReferences:
+		target := l.keyOf(obj)
+		seen := make(map[objectKey]bool)
+		for _, p := range l.all() {
+			for _, uses := range []map[*ast.Ident]types.Object{p.info.Defs, p.info.Uses} {
+				for id, o := range uses {
+					if o == nil || l.keyOf(o) != target {
+						continue
+					}
+					pos := l.fset.Position(id.Pos())
+					key := objectKey{path: pos.Filename, offset: pos.Offset}
+					if !seen[key] {
+						seen[key] = true
+						add(id.Pos())
+					}
+				}
+			}
+		}
+	case findImplementations:
+		for _, o := range l.implementations(obj) {
+			add(o.Pos())
+		}
+	}
+	if len(list) == 0 {
+		return nil, errors.New("no " + strings.ToLower(navigationTitles[kind]) + " found for " + obj.Name())
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return locationLess(list[i].path, list[i].pos, list[j].path, list[j].pos)
+	})
+	return list, nil
+}
+
+// namedTypeOf returns the named type that t is made of, e.g. T for *T or
+// []T, or nil.
+func namedTypeOf(t types.Type) *types.Named {
+	for t != nil {
+		switch u := t.(type) {
+		case *types.Named:
+			return u
+		case *types.Pointer:
+			t = u.Elem()
+		case *types.Slice:
+			t = u.Elem()
+		case *types.Array:
+			t = u.Elem()
+		case *types.Map:
+			t = u.Elem()
+		case *types.Chan:
+			t = u.Elem()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// implementations returns the declarations that implement obj, if it is an
+// interface or one of its methods, or that obj implements, if it is a
+// concrete type or method. Only the types declared in the module, without
+// tests, are considered.
+func (l *moduleLoader) implementations(obj types.Object) []types.Object {
+	var method string
+	var t types.Type
+	switch obj := obj.(type) {
+	case *types.TypeName:
+		t = obj.Type()
+	case *types.Func:
+		sig, ok := obj.Type().(*types.Signature)
+		if !ok || sig.Recv() == nil {
+			return nil
+		}
+		method = obj.Name()
+		t = sig.Recv().Type()
+		if p, ok := t.(*types.Pointer); ok {
+			t = p.Elem()
+		}
+	default:
+		return nil
+	}
+	iface, isInterface := t.Underlying().(*types.Interface)
+
+	var found []types.Object
+	for _, p := range l.packages {
+		if p == nil || p.types == nil {
+			continue
+		}
+		scope := p.types.Scope()
+		for _, name := range scope.Names() {
+			candidate, ok := scope.Lookup(name).(*types.TypeName)
+			if !ok || candidate.IsAlias() || types.Identical(candidate.Type(), t) {
+				continue
+			}
+			other, otherIsInterface := candidate.Type().Underlying().(*types.Interface)
+			if isInterface == otherIsInterface {
+				continue
+			}
+			var matches bool
+			if isInterface {
+				matches = types.Implements(candidate.Type(), iface) ||
+					types.Implements(types.NewPointer(candidate.Type()), iface)
+			} else {
+				matches = other.NumMethods() > 0 &&
+					(types.Implements(t, other) || types.Implements(types.NewPointer(t), other))
+			}
+			if !matches {
+				continue
+			}
+			if method == "" {
+				found = append(found, candidate)
+				continue
+			}
+			m, _, _ := types.LookupFieldOrMethod(candidate.Type(), true, candidate.Pkg(), method)
+			if m != nil {
+				found = append(found, m)
+			}
+		}
+	}
+	return found
+}
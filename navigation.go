@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// codeLocation is a place in a file that the editor can jump to.
+type codeLocation struct {
+	path string
+	pos  textPosition
+	// text is the line at pos, it is shown in the locations panel
+	text string
+}
+
+// navigationHistory remembers where the caret was before each jump, so the
+// user can go back and forward again like in a web browser.
+type navigationHistory struct {
+	back, forward []codeLocation
+}
+
+// maxNavigationHistory is the number of locations that are remembered in each
+// direction.
+const maxNavigationHistory = 100
+
+// jumped records from as the place to go back to. It clears the locations to
+// go forward to.
+func (h *navigationHistory) jumped(from codeLocation) {
+	h.back = pushLocation(h.back, from)
+	h.forward = nil
+}
+
+// goBack returns the last location before current, which becomes the first
+// one to go forward to.
+func (h *navigationHistory) goBack(current codeLocation) (codeLocation, bool) {
+	if len(h.back) == 0 {
+		return codeLocation{}, false
+	}
+	to := h.back[len(h.back)-1]
+	h.back = h.back[:len(h.back)-1]
+	h.forward = pushLocation(h.forward, current)
+	return to, true
+}
+
+// goForward undoes a goBack.
+func (h *navigationHistory) goForward(current codeLocation) (codeLocation, bool) {
+	if len(h.forward) == 0 {
+		return codeLocation{}, false
+	}
+	to := h.forward[len(h.forward)-1]
+	h.forward = h.forward[:len(h.forward)-1]
+	h.back = pushLocation(h.back, current)
+	return to, true
+}
+
+func pushLocation(list []codeLocation, loc codeLocation) []codeLocation {
+	list = append(list, loc)
+	if len(list) > maxNavigationHistory {
+		list = append(list[:0], list[1:]...)
+	}
+	return list
+}
+
+// locationsPanel lists the results of a search for references or
+// implementations, a clicked row jumps to its location.
+type locationsPanel struct {
+	listPanel
+	list []codeLocation
+}
+
+func newLocationsPanel() locationsPanel {
+	return locationsPanel{listPanel: listPanel{selected: -1}}
+}
+
+func (p *locationsPanel) setList(title string, list []codeLocation) {
+	p.title = title
+	p.list = list
+	p.selected = -1
+	p.top = 0
+	p.setRows(len(list))
+}
+
+func (p *locationsPanel) draw(g graphics, area rectangle) {
+	p.listPanel.draw(g, area, func(i int, row rectangle) {
+		loc := p.list[i]
+		text := filepath.Base(loc.path) + ":" +
+			strconv.Itoa(loc.pos.line+1) + ":" +
+			strconv.Itoa(loc.pos.column+1) + ": " +
+			loc.text
+		g.text([]byte(text), row.x+4, row.y, row, editorTextColor)
+	})
+}
+
+// navigator answers navigation queries in the background, since loading a
+// module takes a while. The app calls update periodically while it is busy.
+type navigator struct {
+	find func(kind navigationKind, path string, src []byte, offset int) ([]codeLocation, error)
+	// running is true while a query is answered, its result arrives in
+	// done. If another query was made in the mean time, pending is that one.
+	running bool
+	pending *navigationQuery
+	done    chan navigationResult
+}
+
+type navigationQuery struct {
+	kind   navigationKind
+	path   string
+	src    []byte
+	offset int
+}
+
+type navigationResult struct {
+	kind      navigationKind
+	locations []codeLocation
+	err       error
+}
+
+func newNavigator(find func(kind navigationKind, path string, src []byte, offset int) ([]codeLocation, error)) *navigator {
+	return &navigator{find: find, done: make(chan navigationResult, 1)}
+}
+
+// run answers q, after the current query if there is one.
+func (n *navigator) run(q navigationQuery) {
+	if n.running {
+		n.pending = &q
+		return
+	}
+	n.running = true
+	go func() {
+		list, err := n.find(q.kind, q.path, q.src, q.offset)
+		n.done <- navigationResult{kind: q.kind, locations: list, err: err}
+	}()
+}
+
+// update returns the result of a finished query. Results of queries that
+// were replaced by a pending one are dropped. busy is true while a query is
+// still running.
+func (n *navigator) update() (result *navigationResult, busy bool) {
+	if !n.running {
+		return nil, false
+	}
+	select {
+	case r := <-n.done:
+		n.running = false
+		if n.pending != nil {
+			q := *n.pending
+			n.pending = nil
+			n.run(q)
+			return nil, true
+		}
+		return &r, false
+	default:
+		return nil, true
+	}
+}
+
+// registerNavigationCommands registers the commands that jump through the
+// code of the app's module.
+func registerNavigationCommands(r *commandRegistry, a *app) {
+	for _, c := range []struct {
+		name string
+		kind navigationKind
+	}{
+		{"editor.goToDefinition", findDefinition},
+		{"editor.goToTypeDefinition", findTypeDefinition},
+		{"editor.findReferences", findReferences},
+		{"editor.findImplementations", findImplementations},
+	} {
+		kind := c.kind
+		r.register(c.name, func(*editor) {
+			a.findLocations(kind)
+		})
+	}
+	r.register("navigate.back", func(*editor) {
+		if current, ok := a.currentLocation(); ok {
+			if to, ok := a.history.goBack(current); ok {
+				a.openFileAt(to.path, to.pos)
+			}
+		}
+	})
+	r.register("navigate.forward", func(*editor) {
+		if current, ok := a.currentLocation(); ok {
+			if to, ok := a.history.goForward(current); ok {
+				a.openFileAt(to.path, to.pos)
+			}
+		}
+	})
+	r.register("editor.nextLocation", func(*editor) {
+		a.goToLocation(1)
+	})
+	r.register("editor.previousLocation", func(*editor) {
+		a.goToLocation(-1)
+	})
+	r.register("view.closeLocations", func(*editor) {
+		if a.locations.visible {
+			a.locations.visible = false
+			a.frames.invalidateAll()
+		}
+	})
+}
+
+// findLocations starts a search for the identifier at the caret. The
+// language server, if there is one, finds definitions and references, the
+// other searches load the module.
+func (a *app) findLocations(kind navigationKind) {
+	if a.editor == nil || !isGoFile(a.path) {
+		return
+	}
+	caret := a.editor.primaryCursor().caret
+	if lsp := a.lsp; lsp != nil && lsp.ready && (kind == findDefinition || kind == findReferences) {
+		find := lsp.definition
+		if kind == findReferences {
+			find = lsp.references
+		}
+		find(a.path, caret, func(list []lspLocation, err error) {
+			if err == nil && len(list) == 0 {
+				err = errors.New("no " + strings.ToLower(navigationTitles[kind]) + " found")
+			}
+			locations := lsp.codeLocations(list)
+			sort.SliceStable(locations, func(i, j int) bool {
+				return locationLess(locations[i].path, locations[i].pos, locations[j].path, locations[j].pos)
+			})
+			a.showNavigationResult(navigationResult{kind: kind, locations: locations, err: err})
+		})
+		return
+	}
+	a.navigator.run(navigationQuery{
+		kind:   kind,
+		path:   a.path,
+		src:    a.editor.doc.bytes(),
+		offset: caret,
+	})
+	a.platform.startTimer(navigationTimer, navigationPoll)
+}
+
+// updateNavigation shows the result of a search once it is done.
+func (a *app) updateNavigation() {
+	result, busy := a.navigator.update()
+	if !busy {
+		a.platform.stopTimer(navigationTimer)
+	}
+	if result != nil {
+		a.showNavigationResult(*result)
+	}
+}
+
+// showNavigationResult jumps to a single location and lists several in the
+// locations panel.
+func (a *app) showNavigationResult(result navigationResult) {
+	title := navigationTitles[result.kind]
+	if result.err != nil {
+		a.platform.showError(title, result.err.Error())
+		return
+	}
+	if len(result.locations) == 1 {
+		a.jumpTo(result.locations[0])
+		return
+	}
+	a.locations.setList(title, result.locations)
+	a.locations.visible = true
+	a.frames.invalidateAll()
+}
+
+// currentLocation is where the caret is in the current file.
+func (a *app) currentLocation() (codeLocation, bool) {
+	if a.editor == nil || a.path == "" {
+		return codeLocation{}, false
+	}
+	line, column := a.editor.doc.offsetToLineCol(a.editor.primaryCursor().caret)
+	return codeLocation{
+		path: diagnosticPath(a.path),
+		pos:  textPosition{line: line, column: column},
+	}, true
+}
+
+// jumpTo opens loc and remembers the current location to go back to.
+func (a *app) jumpTo(loc codeLocation) {
+	if current, ok := a.currentLocation(); ok {
+		a.history.jumped(current)
+	}
+	a.openFileAt(loc.path, loc.pos)
+}
+
+// goToLocation jumps to the next (step 1) or previous (step -1) row of the
+// locations panel, it wraps around at the ends. While only the output panel
+// is shown, it goes through the output's links instead.
+func (a *app) goToLocation(step int) {
+	if !a.locations.visible && a.output.visible {
+		a.goToOutputLink(step)
+		return
+	}
+	n := len(a.locations.list)
+	if n == 0 {
+		return
+	}
+	next := a.locations.selected + step
+	if a.locations.selected == -1 && step < 0 {
+		next = n - 1
+	}
+	a.showLocation((next + n) % n)
+}
+
+// showLocation selects row i of the locations panel and jumps to it.
+func (a *app) showLocation(i int) {
+	a.locations.visible = true
+	a.locations.selectRow(i)
+	a.jumpTo(a.locations.list[i])
+	a.frames.invalidateAll()
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// navigationModule has an interface with two implementations in one package
+// and uses them from another.
+var navigationModule = map[string]string{
+	"go.mod": "module example.com/nav\n",
+	"shape/shape.go": `package shape
+
+// Shape has an area.
+type Shape interface {
+	Area() float64
+}
+
+type Square struct{ Side float64 }
+
+func (s Square) Area() float64 { return s.Side * s.Side }
+
+type Circle struct{ R float64 }
+
+func (c *Circle) Area() float64 { return 3 * c.R * c.R }
+
+type Other struct{}
+`,
+	"shape/shape_test.go": `package shape
+
+func ExampleSquare() {
+	println((Square{Side: 2}).Area())
+}
+`,
+	"main.go": `package main
+
+import (
+	"errors"
+
+	"example.com/nav/shape"
+)
+
+func main() {
+	var s shape.Shape = shape.Square{Side: 1}
+	sq := &shape.Square{}
+	println(s.Area(), sq, errors.New("x"))
+}
+`,
+}
+
+// locationStrings describes the locations with their paths relative to dir
+// and 1-based lines and columns.
+func locationStrings(dir string, list []codeLocation) []string {
+	var s []string
+	for _, loc := range list {
+		rel, err := filepath.Rel(dir, loc.path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			rel = loc.path
+		}
+		s = append(s, fmt.Sprintf("%s:%d:%d %s", filepath.ToSlash(rel), loc.pos.line+1, loc.pos.column+1, loc.text))
+	}
+	return s
+}
+
+func TestFindLocations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "navigation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, navigationModule)
+
+	tests := []struct {
+		kind navigationKind
+		// file and at give the identifier, the first occurrence of at in the
+		// file
+		file, at string
+		want     []string
+	}{
+		{findDefinition, "main.go", "Square{Side: 1}", []string{
+			"shape/shape.go:8:6 type Square struct{ Side float64 }",
+		}},
+		{findDefinition, "main.go", "sq, errors", []string{
+			"main.go:11:2 sq := &shape.Square{}",
+		}},
+		{findTypeDefinition, "main.go", "sq, errors", []string{
+			"shape/shape.go:8:6 type Square struct{ Side float64 }",
+		}},
+		{findReferences, "main.go", "Area()", []string{
+			"main.go:12:12 println(s.Area(), sq, errors.New(\"x\"))",
+			"shape/shape.go:5:2 Area() float64",
+		}},
+		// including the example in the package's test
+		{findReferences, "shape/shape.go", "Square struct", []string{
+			"main.go:10:28 var s shape.Shape = shape.Square{Side: 1}",
+			"main.go:11:15 sq := &shape.Square{}",
+			"shape/shape.go:8:6 type Square struct{ Side float64 }",
+			"shape/shape.go:10:9 func (s Square) Area() float64 { return s.Side * s.Side }",
+			"shape/shape_test.go:4:11 println((Square{Side: 2}).Area())",
+		}},
+		{findImplementations, "main.go", "Shape =", []string{
+			"shape/shape.go:8:6 type Square struct{ Side float64 }",
+			"shape/shape.go:12:6 type Circle struct{ R float64 }",
+		}},
+		{findImplementations, "main.go", "Area()", []string{
+			"shape/shape.go:10:17 func (s Square) Area() float64 { return s.Side * s.Side }",
+			"shape/shape.go:14:18 func (c *Circle) Area() float64 { return 3 * c.R * c.R }",
+		}},
+		// and the other way around
+		{findImplementations, "shape/shape.go", "Square struct", []string{
+			"shape/shape.go:4:6 type Shape interface {",
+		}},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, filepath.FromSlash(tt.file))
+		src := navigationModule[tt.file]
+		list, err := findLocations(tt.kind, path, []byte(src), strings.Index(src, tt.at))
+		if err != nil {
+			t.Errorf("%s of %s: %v", navigationTitles[tt.kind], tt.at, err)
+			continue
+		}
+		got := locationStrings(dir, list)
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s of %s:\n%s\nwant\n%s", navigationTitles[tt.kind], tt.at,
+				strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+
+	// the standard library is found in GOROOT
+	mainPath := filepath.Join(dir, "main.go")
+	src := navigationModule["main.go"]
+	list, err := findLocations(findDefinition, mainPath, []byte(src), strings.Index(src, "New"))
+	if err != nil || len(list) != 1 || !strings.HasSuffix(list[0].path, filepath.Join("errors", "errors.go")) {
+		t.Errorf("the definition of errors.New is %v, %v", list, err)
+	}
+	// the unsaved content counts
+	edited := strings.Replace(src, "sq := &shape.Square{}", "sq := &shape.Square{}\n\t_ = sq", 1)
+	list, err = findLocations(findReferences, mainPath, []byte(edited), strings.Index(edited, "sq :="))
+	if err != nil || len(list) != 3 {
+		t.Errorf("the references of sq in the edited file are %v, %v", locationStrings(dir, list), err)
+	}
+
+	errs := []struct {
+		kind navigationKind
+		at   string
+		err  string
+	}{
+		{findDefinition, "\n\nimport", "there is no identifier at the cursor"},
+		{findImplementations, "sq :=", "no implementations found for sq"},
+		{findTypeDefinition, "errors.New", "no type definition found for errors"},
+	}
+	for _, tt := range errs {
+		_, err := findLocations(tt.kind, mainPath, []byte(src), strings.Index(src, tt.at))
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%s of %q gives %v, want %q", navigationTitles[tt.kind], tt.at, err, tt.err)
+		}
+	}
+}
+
+func TestNavigationHistory(t *testing.T) {
+	var h navigationHistory
+	a := codeLocation{path: "a"}
+	b := codeLocation{path: "b"}
+	c := codeLocation{path: "c"}
+	d := codeLocation{path: "d"}
+	// jump from a to b to c, go back twice and forward once
+	h.jumped(a)
+	h.jumped(b)
+	steps := []struct {
+		forward bool
+		from    codeLocation
+		to      codeLocation
+		ok      bool
+	}{
+		{false, c, b, true},
+		{false, b, a, true},
+		{false, a, codeLocation{}, false},
+		{true, a, b, true},
+		{true, b, c, true},
+		{true, c, codeLocation{}, false},
+		{false, c, b, true},
+	}
+	for i, s := range steps {
+		var to codeLocation
+		var ok bool
+		if s.forward {
+			to, ok = h.goForward(s.from)
+		} else {
+			to, ok = h.goBack(s.from)
+		}
+		if to != s.to || ok != s.ok {
+			t.Errorf("step %d from %s goes to %q %v, want %q %v", i, s.from.path, to.path, ok, s.to.path, s.ok)
+		}
+	}
+	// a new jump ends the way forward
+	h.jumped(d)
+	if _, ok := h.goForward(b); ok {
+		t.Error("the history goes forward after a jump")
+	}
+
+	// only the last jumps are remembered
+	h = navigationHistory{}
+	for i := 0; i < maxNavigationHistory+10; i++ {
+		h.jumped(codeLocation{pos: textPosition{line: i}})
+	}
+	if len(h.back) != maxNavigationHistory || h.back[0].pos.line != 10 {
+		t.Errorf("the history has %d locations from line %d", len(h.back), h.back[0].pos.line)
+	}
+}
+
+func TestHeadlessNavigation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "navigation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, navigationModule)
+	mainPath := filepath.Join(dir, "main.go")
+	shapePath := filepath.Join(dir, "shape", "shape.go")
+
+	s := newScenario(t)
+	d := s.driver
+	caretAt := func(path string, line, column int) bool {
+		e := d.editor()
+		if e == nil || d.app.path != path {
+			return false
+		}
+		l, c := e.doc.offsetToLineCol(e.primaryCursor().caret)
+		return l == line && c == column
+	}
+	s.openFile(mainPath)
+	d.editor().moveCaretTo(textPosition{line: 9, column: 28})
+
+	// F12 jumps to the definition, Alt+Left goes back and Alt+Right forward
+	d.keys("F12")
+	waitUntil(t, d, func() bool { return caretAt(shapePath, 7, 5) })
+	d.keys("Alt+Left")
+	waitUntil(t, d, func() bool { return caretAt(mainPath, 9, 28) })
+	d.keys("Alt+Right")
+	waitUntil(t, d, func() bool { return caretAt(shapePath, 7, 5) })
+
+	// several references are listed, F4 goes through them
+	d.keys("Shift+F12")
+	waitUntil(t, d, func() bool { return d.app.locations.visible })
+	if n := len(d.app.locations.list); n != 5 || d.app.locations.title != "References" {
+		t.Fatalf("the panel %q lists %d locations", d.app.locations.title, n)
+	}
+	d.keys("F4")
+	waitUntil(t, d, func() bool { return caretAt(mainPath, 9, 27) })
+	d.keys("Shift+F4")
+	waitUntil(t, d, func() bool { return caretAt(filepath.Join(dir, "shape", "shape_test.go"), 3, 10) })
+	// back goes through the jumps in reverse
+	d.keys("Alt+Left")
+	waitUntil(t, d, func() bool { return caretAt(mainPath, 9, 27) })
+	d.keys("Alt+Left")
+	waitUntil(t, d, func() bool { return caretAt(shapePath, 7, 5) })
+
+	d.keys("Shift+Escape")
+	if d.app.locations.visible {
+		t.Error("the locations panel is still visible")
+	}
+	// an error is shown
+	d.keys("Ctrl+Home F12")
+	waitUntil(t, d, func() bool { return len(d.platform.errors) > 0 })
+	if !strings.Contains(d.platform.errors[0], "there is no identifier at the cursor") {
+		t.Errorf("the errors are %v", d.platform.errors)
+	}
+}
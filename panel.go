@@ -0,0 +1,88 @@
+package main
+
+import "strconv"
+
+// listPanel is a list of rows below the editor, like the problems panel. It
+// keeps track of the highlighted row and the scroll position, the owner draws
+// the rows.
+type listPanel struct {
+	visible bool
+	title   string
+	// rows is the number of rows in the list
+	rows int
+	// selected is the index of the highlighted row or -1
+	selected int
+	// top is the index of the first visible row
+	top int
+	// area is the screen rectangle of the panel, it is updated when drawing
+	area rectangle
+}
+
+const (
+	// listPanelRows is the number of rows that a panel shows, plus one for
+	// its header
+	listPanelRows       = 8
+	listBackgroundColor = 0xFFF3F3F3
+	listHeaderColor     = 0xFFDDDDDD
+	listSelectionColor  = editorSelectionColor
+)
+
+// height is the number of pixels that the panel needs below the editor.
+func (p *listPanel) height(g graphics) int {
+	if !p.visible {
+		return 0
+	}
+	return (listPanelRows + 1) * g.lineHeight()
+}
+
+// setRows changes the number of rows. The selection stays on the same row, as
+// far as possible.
+func (p *listPanel) setRows(n int) {
+	p.rows = n
+	if p.selected >= n {
+		p.selected = n - 1
+	}
+	p.top = clamp(p.top, 0, max(0, n-listPanelRows))
+}
+
+// selectRow highlights row i and scrolls it into view.
+func (p *listPanel) selectRow(i int) {
+	p.selected = i
+	if i < p.top {
+		p.top = i
+	}
+	if i >= p.top+listPanelRows {
+		p.top = i - listPanelRows + 1
+	}
+}
+
+// rowAt returns the index of the row at screen position y or -1.
+func (p *listPanel) rowAt(g graphics, y int) int {
+	row := (y-p.area.y)/g.lineHeight() - 1
+	if row < 0 || p.top+row >= p.rows {
+		return -1
+	}
+	return p.top + row
+}
+
+// draw draws the header with the title and the number of rows, and the
+// background of the visible rows. drawRow is called for each of them with the
+// row's rectangle.
+func (p *listPanel) draw(g graphics, area rectangle, drawRow func(i int, row rectangle)) {
+	p.area = area
+	lineHeight := g.lineHeight()
+	g.rect(area.x, area.y, area.w, area.h, listBackgroundColor)
+	header := rect(area.x, area.y, area.w, lineHeight).intersect(area)
+	fillRect(g, header, listHeaderColor)
+	title := p.title + " (" + strconv.Itoa(p.rows) + ")"
+	g.text([]byte(title), header.x+4, header.y, header, editorTextColor)
+
+	for i := p.top; i < p.rows && i < p.top+listPanelRows; i++ {
+		row := rect(area.x, area.y+(i-p.top+1)*lineHeight, area.w, lineHeight)
+		row = row.intersect(area)
+		if i == p.selected {
+			fillRect(g, row, listSelectionColor)
+		}
+		drawRow(i, row)
+	}
+}
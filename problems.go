@@ -0,0 +1,155 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// problemsPanel lists the diagnostics of all files below the editor. A
+// clicked row jumps to its diagnostic.
+type problemsPanel struct {
+	listPanel
+	list []diagnostic
+}
+
+func newProblemsPanel() problemsPanel {
+	return problemsPanel{listPanel: listPanel{title: "Problems", selected: -1}}
+}
+
+// setList replaces the listed diagnostics.
+func (p *problemsPanel) setList(list []diagnostic) {
+	p.list = list
+	p.setRows(len(list))
+}
+
+func (p *problemsPanel) draw(g graphics, area rectangle) {
+	lineHeight := g.lineHeight()
+	p.listPanel.draw(g, area, func(i int, row rectangle) {
+		d := p.list[i]
+		marker := rect(
+			row.x+4,
+			row.y+(lineHeight-gutterMarkerSize)/2,
+			gutterMarkerSize,
+			gutterMarkerSize,
+		)
+		fillRect(g, marker.intersect(row), d.severity.color())
+		text := filepath.Base(d.path) + ":" +
+			strconv.Itoa(d.start.line+1) + ":" +
+			strconv.Itoa(d.start.column+1) + ": "
+		if d.source != "" {
+			text += "[" + d.source + "] "
+		}
+		text += d.message
+		x := marker.x + marker.w + 6
+		g.text([]byte(text), x, row.y, row, editorTextColor)
+	})
+}
+
+// registerProblemCommands registers the commands that work with the app's
+// diagnostics.
+func registerProblemCommands(r *commandRegistry, a *app) {
+	r.register("editor.nextProblem", func(*editor) {
+		a.goToProblem(1)
+	})
+	r.register("editor.previousProblem", func(*editor) {
+		a.goToProblem(-1)
+	})
+	r.register("view.toggleProblems", func(*editor) {
+		a.problems.visible = !a.problems.visible
+		a.frames.invalidateAll()
+	})
+}
+
+// goToProblem jumps to the next diagnostic after the caret, with step 1, or
+// the one before it, with step -1. At the end of the list it wraps around.
+func (a *app) goToProblem(step int) {
+	list := a.problems.list
+	if len(list) == 0 || a.editor == nil {
+		return
+	}
+	var path string
+	var caret textPosition
+	if a.path != "" {
+		path = diagnosticPath(a.path)
+		line, column := a.editor.doc.offsetToLineCol(a.editor.primaryCursor().caret)
+		caret = textPosition{line: line, column: column}
+	}
+	next := 0
+	if step > 0 {
+		for next < len(list) && !locationLess(path, caret, list[next].path, list[next].start) {
+			next++
+		}
+		if next == len(list) {
+			next = 0
+		}
+	} else {
+		next = len(list) - 1
+		for next >= 0 && !locationLess(list[next].path, list[next].start, path, caret) {
+			next--
+		}
+		if next < 0 {
+			next = len(list) - 1
+		}
+	}
+	a.showProblem(next)
+}
+
+// showProblem selects the diagnostic with index i in the problems panel and
+// opens its location.
+func (a *app) showProblem(i int) {
+	a.problems.selectRow(i)
+	d := a.problems.list[i]
+	a.openFileAt(d.path, d.start)
+	a.frames.invalidateAll()
+}
+
+// openFileAt places the caret at pos in the file at path. A different file
+// is opened first. The editor only holds one document, so if the current one
+// was modified, the user is asked whether to save it.
+func (a *app) openFileAt(path string, pos textPosition) {
+	if a.editor != nil && a.path != "" && diagnosticPath(a.path) == diagnosticPath(path) {
+		a.editor.moveCaretTo(pos)
+		return
+	}
+	a.leaveFile(func() {
+		if err := a.openFile(path); err != nil {
+			a.platform.showError("Open", err.Error())
+			return
+		}
+		a.jump = &pos
+	})
+}
+
+// leaveFile calls leave when the editor may stop showing its file, to open
+// another one or to quit. If the current document was modified, the user
+// decides first whether it is saved or its changes are discarded. leave is
+// not called if the prompt is cancelled.
+func (a *app) leaveFile(leave func()) {
+	if a.editor == nil || a.path == "" || !a.editor.history.isModified() {
+		leave()
+		return
+	}
+	label := "Save changes to " + filepath.Base(a.path) + " (yes/no)? "
+	a.showPrompt(label, "yes", func(answer string) {
+		switch strings.ToLower(answer) {
+		case "y", "yes":
+			if err := a.save(); err != nil {
+				a.platform.showError("Save", err.Error())
+				return
+			}
+			leave()
+		case "n", "no":
+			leave()
+		default:
+			a.platform.showError("Save", "answer yes or no, not "+strconv.Quote(answer))
+		}
+	})
+}
+
+// moveCaretTo collapses the cursors to a single caret at pos and scrolls it
+// into view.
+func (e *editor) moveCaretTo(pos textPosition) {
+	offset := e.doc.lineColToOffset(pos.line, pos.column)
+	e.setSelections([]selection{{anchor: offset, caret: offset}})
+}
@@ -0,0 +1,18 @@
+//+build !windows,!linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package main
+
+import "os/exec"
+
+// hideProcessWindow does nothing, only Windows opens console windows for
+// child processes.
+func hideProcessWindow(cmd *exec.Cmd) {}
+
+// newProcessGroup does nothing, there are no process groups to put cmd in.
+func newProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the started cmd, the processes that it started may
+// survive it.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
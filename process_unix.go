@@ -0,0 +1,27 @@
+//+build linux darwin freebsd netbsd openbsd
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// hideProcessWindow does nothing, only Windows opens console windows for
+// child processes.
+func hideProcessWindow(cmd *exec.Cmd) {}
+
+// newProcessGroup makes cmd start a process group of its own, which
+// killProcessGroup ends. Programs that cmd starts, like the one of go run,
+// belong to the group as well.
+func newProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// killProcessGroup kills the started cmd and all processes of its group.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
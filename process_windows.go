@@ -0,0 +1,31 @@
+//+build windows
+
+package main
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// hideProcessWindow keeps console programs that we start in the background
+// from opening a console window, our own process has no console to share.
+func hideProcessWindow(cmd *exec.Cmd) {
+	const createNoWindow = 0x08000000
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		HideWindow:    true,
+		CreationFlags: createNoWindow,
+	}
+}
+
+// newProcessGroup does nothing, killProcessGroup finds the processes that
+// cmd started through their parent process IDs.
+func newProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the started cmd and the tree of processes that it
+// started, like the program of go run.
+func killProcessGroup(cmd *exec.Cmd) error {
+	kill := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid))
+	hideProcessWindow(kill)
+	return kill.Run()
+}
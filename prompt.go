@@ -0,0 +1,121 @@
+package main
+
+import "bytes"
+
+// prompt asks the user for a line of text, e.g. the new name of an
+// identifier. The text is edited in an editor of its own, so all editing keys
+// work in it. The prompt is shown below the caret of the app's editor.
+type prompt struct {
+	label  string
+	editor *editor
+	// accept is called with the text when the user confirms it
+	accept func(text string)
+	// area is the screen rectangle of the prompt, it is updated when drawing
+	area rectangle
+}
+
+const (
+	promptWidth      = 360
+	promptPadding    = 4
+	promptBackground = 0xFFF3F3F3
+	promptBorder     = 0xFFC8C8C8
+)
+
+// keyMode is a set of key bindings that takes precedence over the default
+// ones while the app shows a prompt or a preview. An exclusive mode ignores
+// all keys that are not bound in it, and typed characters.
+type keyMode struct {
+	keys      *keymap
+	exclusive bool
+}
+
+// registerPromptCommands registers the commands that close the app's prompt.
+func registerPromptCommands(r *commandRegistry, a *app) {
+	r.register("prompt.accept", func(*editor) {
+		p := a.prompt
+		if p == nil {
+			return
+		}
+		a.closePrompt()
+		text := p.editor.doc.bytes()
+		if i := bytes.IndexByte(text, '\n'); i != -1 {
+			text = text[:i]
+		}
+		p.accept(string(bytes.TrimSpace(text)))
+	})
+	r.register("prompt.cancel", func(*editor) {
+		a.closePrompt()
+	})
+}
+
+// showPrompt asks for a line of text, it starts out as text, selected.
+func (a *app) showPrompt(label, text string, accept func(text string)) {
+	e := newEditor(newDocument([]byte(text)))
+	e.invalidate = a.frames.invalidate
+	e.now = a.platform.now
+	e.focused = a.focused
+	e.selectAll()
+	a.prompt = &prompt{label: label, editor: e, accept: accept}
+	a.keyboard.mode = &keyMode{keys: a.promptKeys}
+	if a.editor != nil {
+		a.editor.focused = false
+		a.editor.changed()
+	}
+	a.frames.invalidateAll()
+}
+
+func (a *app) closePrompt() {
+	if a.prompt == nil {
+		return
+	}
+	a.prompt = nil
+	a.keyboard.mode = nil
+	if a.editor != nil {
+		a.editor.focused = a.focused
+		a.editor.changed()
+	}
+	a.frames.invalidateAll()
+}
+
+// inputEditor is the editor that gets the keyboard input, the prompt's while
+// it is open.
+func (a *app) inputEditor() *editor {
+	if a.prompt != nil {
+		return a.prompt.editor
+	}
+	return a.editor
+}
+
+// draw shows the prompt below the caret of e, clipped to the window.
+func (p *prompt) draw(g graphics, e *editor, window rectangle) {
+	lineHeight := g.lineHeight()
+	caret := e.primaryCursor().caret
+	line := e.doc.lineOf(caret)
+	x := e.area.x + e.textWidth(g, e.doc.lineStart(line), caret)
+	y := e.area.y + (clamp(line, e.topLine, e.topLine+e.visibleLines-1)-e.topLine+1)*lineHeight
+	box := rect(x, y, promptWidth, lineHeight+2*promptPadding)
+	if box.x+box.w > window.x+window.w {
+		box.x = window.x + window.w - box.w
+	}
+	if box.y+box.h > window.y+window.h {
+		box.y = y - lineHeight - box.h
+	}
+	box.x = max(box.x, window.x)
+	box.y = max(box.y, window.y)
+	box = box.intersect(window)
+	p.area = box
+
+	fillRect(g, box, promptBorder)
+	inner := rect(box.x+1, box.y+1, box.w-2, box.h-2).intersect(box)
+	fillRect(g, inner, promptBackground)
+	labelWidth, _ := g.textExtent([]byte(p.label))
+	g.text([]byte(p.label), inner.x+promptPadding, inner.y+promptPadding-1, inner, editorTextColor)
+	// the editor's gutter is the space between the label and the text
+	input := rect(
+		inner.x+promptPadding+labelWidth,
+		inner.y+promptPadding-1,
+		inner.w-2*promptPadding-labelWidth,
+		lineHeight,
+	).intersect(inner)
+	p.editor.draw(g, input)
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// renamePlan contains the edits of all files for renaming an identifier.
+type renamePlan struct {
+	from, to string
+	files    []renamedFile
+}
+
+// renamedFile is a file of a rename plan. The edits replace the old name, they
+// are sorted by offset.
+type renamedFile struct {
+	path string
+	// src is the content that the edits apply to, the file must still have
+	// it when the plan is applied
+	src   []byte
+	edits []replacement
+}
+
+// result is the content of the file after the rename.
+func (f *renamedFile) result() []byte {
+	return applyEdits(f.src, f.edits)
+}
+
+// applyEdits returns src with the replacements, which are sorted by offset.
+func applyEdits(src []byte, edits []replacement) []byte {
+	var b bytes.Buffer
+	last := 0
+	for _, e := range edits {
+		b.Write(src[last:e.offset])
+		b.Write(e.text)
+		last = e.offset + e.count
+	}
+	b.Write(src[last:])
+	return b.Bytes()
+}
+
+// edits is the number of replacements in all files.
+func (p *renamePlan) edits() int {
+	n := 0
+	for _, f := range p.files {
+		n += len(f.edits)
+	}
+	return n
+}
+
+// planRename loads the module of the file at path, with src as its current
+// content, and finds all edits that rename the identifier at offset to
+// newName. Methods that implement an interface method, or are implemented by
+// it, are renamed together, as are types and the fields that embed them.
+func planRename(path string, src []byte, offset int, newName string) (*renamePlan, error) {
+	if !token.IsIdentifier(newName) {
+		return nil, errors.New(strconv.Quote(newName) + " is not a valid Go identifier")
+	}
+	path = diagnosticPath(path)
+	l := newModuleLoader(filepath.Dir(path), map[string][]byte{path: src})
+	l.loadAll()
+	obj := l.objectAt(path, offset)
+	if obj == nil {
+		return nil, errors.New("there is no identifier at the cursor")
+	}
+	if _, ok := obj.(*types.PkgName); ok {
+		return nil, errors.New("renaming imported packages is not supported")
+	}
+	if obj.Pkg() == nil {
+		return nil, errors.New(obj.Name() + " is built into the language and cannot be renamed")
+	}
+	if obj.Name() == newName {
+		return nil, errors.New("the identifier is already called " + newName)
+	}
+	targets := l.renameTargets(obj)
+	for _, o := range targets {
+		if file := l.fset.Position(o.Pos()).Filename; !l.inRoot(file) {
+			return nil, errors.New(o.Name() + " would have to be renamed in " + file +
+				", which is outside the module")
+		}
+	}
+	refs := l.references(targets)
+	if err := l.checkRename(targets, refs, newName); err != nil {
+		return nil, err
+	}
+
+	plan := &renamePlan{from: obj.Name(), to: newName}
+	byFile := make(map[string][]int)
+	seen := make(map[token.Pos]bool)
+	for _, r := range refs {
+		pos := l.fset.Position(r.id.Pos())
+		if !seen[r.id.Pos()] {
+			seen[r.id.Pos()] = true
+			byFile[pos.Filename] = append(byFile[pos.Filename], pos.Offset)
+		}
+	}
+	for file, offsets := range byFile {
+		content, ok := l.overlay[file]
+		if !ok {
+			var err error
+			if content, err = ioutil.ReadFile(file); err != nil {
+				return nil, makeErr("rename", err)
+			}
+		}
+		offsets = uniqueInts(offsets)
+		f := renamedFile{path: file, src: content}
+		for _, o := range offsets {
+			if o+len(plan.from) > len(content) || string(content[o:o+len(plan.from)]) != plan.from {
+				return nil, errors.New(file + " changed while it was analyzed")
+			}
+			f.edits = append(f.edits, replacement{offset: o, count: len(plan.from), text: []byte(newName)})
+		}
+		plan.files = append(plan.files, f)
+	}
+	sort.Slice(plan.files, func(i, j int) bool {
+		return plan.files[i].path < plan.files[j].path
+	})
+	return plan, nil
+}
+
+// lspRenamePlan turns the language server's edits for renaming from to to
+// into a plan. The file at path has the content src, the edits of the other
+// files apply to what is on disk.
+func lspRenamePlan(from, to string, edit *lspWorkspaceEdit, path string, src []byte, utf8Columns bool) (*renamePlan, error) {
+	path = diagnosticPath(path)
+	plan := &renamePlan{from: from, to: to}
+	for uri, edits := range edit.fileEdits() {
+		f := renamedFile{path: diagnosticPath(uriToPath(uri)), src: src}
+		if f.path != path {
+			var err error
+			if f.src, err = ioutil.ReadFile(f.path); err != nil {
+				return nil, makeErr("rename", err)
+			}
+		}
+		f.edits = lspReplacements(newDocument(f.src), edits, utf8Columns)
+		plan.files = append(plan.files, f)
+	}
+	if len(plan.files) == 0 {
+		return nil, errors.New("there is nothing to rename at the cursor")
+	}
+	sort.Slice(plan.files, func(i, j int) bool {
+		return plan.files[i].path < plan.files[j].path
+	})
+	return plan, nil
+}
+
+// inRoot tells if the file at path belongs to the loaded module.
+func (l *moduleLoader) inRoot(path string) bool {
+	rel, err := filepath.Rel(l.root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func uniqueInts(list []int) []int {
+	sort.Ints(list)
+	unique := list[:0]
+	for i, n := range list {
+		if i == 0 || n != list[i-1] {
+			unique = append(unique, n)
+		}
+	}
+	return unique
+}
+
+// renameTargets returns the objects that must be renamed together with obj,
+// including obj itself.
+func (l *moduleLoader) renameTargets(obj types.Object) map[objectKey]types.Object {
+	targets := make(map[objectKey]types.Object)
+	queue := []types.Object{obj}
+	for len(queue) > 0 {
+		o := queue[0]
+		queue = queue[1:]
+		key := l.keyOf(o)
+		if _, ok := targets[key]; ok {
+			continue
+		}
+		targets[key] = o
+		switch o := o.(type) {
+		case *types.Func:
+			queue = append(queue, l.implementations(o)...)
+		case *types.TypeName:
+			// the fields that embed the type have its name
+			for _, p := range l.all() {
+				for _, def := range p.info.Defs {
+					v, ok := def.(*types.Var)
+					if !ok || !v.Embedded() {
+						continue
+					}
+					if named := namedTypeOf(v.Type()); named != nil && l.keyOf(named.Obj()) == key {
+						queue = append(queue, v)
+					}
+				}
+			}
+		case *types.Var:
+			if named := namedTypeOf(o.Type()); o.Embedded() && named != nil {
+				queue = append(queue, named.Obj())
+			}
+		}
+	}
+	return targets
+}
+
+// renameReference is an identifier that refers to or declares one of the
+// renamed objects.
+type renameReference struct {
+	id  *ast.Ident
+	obj types.Object
+	pkg *loadedPackage
+}
+
+func (l *moduleLoader) references(targets map[objectKey]types.Object) []renameReference {
+	var refs []renameReference
+	for _, p := range l.all() {
+		for _, uses := range []map[*ast.Ident]types.Object{p.info.Defs, p.info.Uses} {
+			for id, o := range uses {
+				if o == nil {
+					continue
+				}
+				if _, ok := targets[l.keyOf(o)]; ok {
+					refs = append(refs, renameReference{id: id, obj: o, pkg: p})
+				}
+			}
+		}
+	}
+	return refs
+}
+
+// checkRename returns an error if the new name conflicts with an existing
+// one, which would change the meaning of the program or break it.
+func (l *moduleLoader) checkRename(targets map[objectKey]types.Object, refs []renameReference, newName string) error {
+	conflict := func(o types.Object, existing types.Object) error {
+		message := "renaming " + o.Name() + " to " + newName + " conflicts with " +
+			existing.Name()
+		if existing.Pos().IsValid() {
+			pos := l.fset.Position(existing.Pos())
+			message += " at " + filepath.Base(pos.Filename) + ":" + strconv.Itoa(pos.Line)
+		}
+		return errors.New(message)
+	}
+	isTarget := func(o types.Object) bool {
+		_, ok := targets[l.keyOf(o)]
+		return ok
+	}
+
+	for _, o := range targets {
+		switch o := o.(type) {
+		case *types.Func:
+			if sig, ok := o.Type().(*types.Signature); ok && sig.Recv() != nil {
+				existing, _, _ := types.LookupFieldOrMethod(sig.Recv().Type(), true, o.Pkg(), newName)
+				if existing != nil && !isTarget(existing) {
+					return conflict(o, existing)
+				}
+				continue
+			}
+		case *types.Var:
+			if o.IsField() {
+				for _, owner := range l.structsWithField(o) {
+					existing, _, _ := types.LookupFieldOrMethod(owner, true, o.Pkg(), newName)
+					if existing != nil && !isTarget(existing) {
+						return conflict(o, existing)
+					}
+				}
+				continue
+			}
+		}
+		if scope := o.Parent(); scope != nil {
+			if existing := scope.Lookup(newName); existing != nil && !isTarget(existing) {
+				return conflict(o, existing)
+			}
+			// imports are in the file scopes below the package scope
+			if scope == o.Pkg().Scope() {
+				for i := 0; i < scope.NumChildren(); i++ {
+					if existing := scope.Child(i).Lookup(newName); existing != nil {
+						return conflict(o, existing)
+					}
+				}
+			}
+		}
+	}
+
+	for _, r := range refs {
+		o := r.obj
+		if r.pkg.types == nil {
+			continue
+		}
+		if r.pkg.types.Path() != o.Pkg().Path() {
+			// a qualified reference from another package, which includes
+			// external tests
+			if !ast.IsExported(newName) {
+				return errors.New(o.Name() + " is used in package " + r.pkg.types.Path() +
+					", its new name must be exported")
+			}
+			continue
+		}
+		if field, ok := o.(*types.Var); ok && field.IsField() {
+			continue
+		}
+		if f, ok := o.(*types.Func); ok && f.Type().(*types.Signature).Recv() != nil {
+			continue
+		}
+		// the new name must not be shadowed where the object is used
+		scope := r.pkg.types.Scope().Innermost(r.id.Pos())
+		if scope == nil {
+			continue
+		}
+		if _, existing := scope.LookupParent(newName, r.id.Pos()); existing != nil && !isTarget(existing) {
+			return conflict(o, existing)
+		}
+	}
+	return nil
+}
+
+// structsWithField returns the named struct types of the module that declare
+// the field.
+func (l *moduleLoader) structsWithField(field *types.Var) []types.Type {
+	key := l.keyOf(field)
+	var owners []types.Type
+	for _, p := range l.all() {
+		if p.types == nil {
+			continue
+		}
+		scope := p.types.Scope()
+		for _, name := range scope.Names() {
+			t, ok := scope.Lookup(name).(*types.TypeName)
+			if !ok {
+				continue
+			}
+			s, ok := t.Type().Underlying().(*types.Struct)
+			if !ok {
+				continue
+			}
+			for i := 0; i < s.NumFields(); i++ {
+				if l.keyOf(s.Field(i)) == key {
+					owners = append(owners, t.Type())
+				}
+			}
+		}
+	}
+	return owners
+}
+
+// renamePreview shows the lines that a rename changes before it is applied.
+type renamePreview struct {
+	listPanel
+	plan *renamePlan
+	rows []previewRow
+}
+
+type previewRow struct {
+	text  string
+	color uint32
+}
+
+const (
+	previewRemovedColor = 0xFFB31D28
+	previewAddedColor   = 0xFF22863A
+)
+
+// newRenamePreview lists the changed lines of all files, each one as it was
+// and as it will be. Paths are shown relative to root.
+func newRenamePreview(plan *renamePlan, root string) *renamePreview {
+	p := &renamePreview{plan: plan}
+	p.visible = true
+	p.selected = -1
+	p.title = "Rename " + plan.from + " to " + plan.to + ": " +
+		strconv.Itoa(plan.edits()) + " changes in " + strconv.Itoa(len(plan.files)) +
+		" files, Enter applies, Escape cancels"
+	for i := range plan.files {
+		f := &plan.files[i]
+		name := f.path
+		if rel, err := filepath.Rel(root, f.path); err == nil && !strings.HasPrefix(rel, "..") {
+			name = filepath.ToSlash(rel)
+		}
+		p.rows = append(p.rows, previewRow{text: name, color: editorTextColor})
+		old := newDocument(f.src)
+		renamed := newDocument(f.result())
+		shift := 0
+		lastLine := -1
+		for _, e := range f.edits {
+			line := old.lineOf(e.offset)
+			newOffset := e.offset + shift
+			shift += len(e.text) - e.count
+			if line == lastLine {
+				continue
+			}
+			lastLine = line
+			number := strconv.Itoa(line+1) + ": "
+			oldText := old.slice(old.lineStart(line), old.lineEnd(line))
+			newLine := renamed.lineOf(newOffset)
+			newText := renamed.slice(renamed.lineStart(newLine), renamed.lineEnd(newLine))
+			p.rows = append(p.rows,
+				previewRow{text: "  - " + number + strings.TrimSpace(string(oldText)), color: previewRemovedColor},
+				previewRow{text: "  + " + number + strings.TrimSpace(string(newText)), color: previewAddedColor},
+			)
+		}
+	}
+	p.setRows(len(p.rows))
+	return p
+}
+
+func (p *renamePreview) draw(g graphics, area rectangle) {
+	p.listPanel.draw(g, area, func(i int, row rectangle) {
+		r := p.rows[i]
+		g.text([]byte(r.text), row.x+4, row.y, row, r.color)
+	})
+}
+
+// scroll moves the visible rows by delta.
+func (p *renamePreview) scroll(delta int) {
+	p.top = clamp(p.top+delta, 0, max(0, len(p.rows)-listPanelRows))
+}
+
+// registerRenameCommands registers the commands that rename identifiers in
+// the app's module.
+func registerRenameCommands(r *commandRegistry, a *app) {
+	r.register("editor.rename", func(*editor) {
+		a.startRename()
+	})
+	r.register("rename.apply", func(*editor) {
+		p := a.renamePreview
+		a.closeRenamePreview()
+		if p == nil {
+			return
+		}
+		if err := a.applyRename(p.plan); err != nil {
+			a.platform.showError("Rename", err.Error())
+		}
+	})
+	r.register("rename.cancel", func(*editor) {
+		a.closeRenamePreview()
+	})
+	for _, c := range []struct {
+		name  string
+		delta int
+	}{
+		{"rename.scrollDown", 1},
+		{"rename.scrollUp", -1},
+		{"rename.pageDown", listPanelRows},
+		{"rename.pageUp", -listPanelRows},
+	} {
+		delta := c.delta
+		r.register(c.name, func(*editor) {
+			if a.renamePreview != nil {
+				a.renamePreview.scroll(delta)
+				a.frames.invalidateAll()
+			}
+		})
+	}
+}
+
+// startRename asks for the new name of the identifier at the caret. The
+// language server, if there is one, computes the rename, otherwise it is done
+// in the background.
+func (a *app) startRename() {
+	e := a.editor
+	if e == nil || !isGoFile(a.path) || a.renaming.running {
+		return
+	}
+	caret := e.primaryCursor().caret
+	isWord := func(_ int, r rune) bool { return charClassOf(r) == wordClass }
+	start := scanBackward(e.doc, caret, isWord)
+	end := scanForward(e.doc, caret, isWord)
+	if start == end {
+		return
+	}
+	path := a.path
+	src := e.doc.bytes()
+	from := string(e.doc.slice(start, end))
+	a.showPrompt("Rename to: ", from, func(newName string) {
+		if lsp := a.lsp; lsp != nil && lsp.ready {
+			lsp.rename(path, caret, newName, func(edit *lspWorkspaceEdit, err error) {
+				var plan *renamePlan
+				if err == nil {
+					plan, err = lspRenamePlan(from, newName, edit, path, src, lsp.utf8)
+				}
+				a.showRenamePreview(path, plan, err)
+			})
+			return
+		}
+		a.renaming.start(func() func() {
+			plan, err := planRename(path, src, caret, newName)
+			return func() {
+				a.showRenamePreview(path, plan, err)
+			}
+		})
+		a.platform.startTimer(renameTimer, renamePoll)
+	})
+}
+
+// showRenamePreview shows the plan for renaming in the file at path, or the
+// error that kept it from being made.
+func (a *app) showRenamePreview(path string, plan *renamePlan, err error) {
+	if err != nil {
+		a.platform.showError("Rename", err.Error())
+		return
+	}
+	root := filepath.Dir(diagnosticPath(path))
+	if r, _, ok := findModule(root); ok {
+		root = r
+	}
+	a.renamePreview = newRenamePreview(plan, root)
+	a.keyboard.mode = &keyMode{keys: a.renamePreviewKeys, exclusive: true}
+	a.frames.invalidateAll()
+}
+
+func (a *app) closeRenamePreview() {
+	if a.renamePreview != nil {
+		a.renamePreview = nil
+		a.keyboard.mode = nil
+		a.frames.invalidateAll()
+	}
+}
+
+// applyRename writes the renamed files, the one in the editor is changed in
+// the document instead, as one undo step. Nothing is changed if any of the
+// files was modified since the plan was made.
+func (a *app) applyRename(plan *renamePlan) error {
+	current := ""
+	if a.editor != nil && a.path != "" {
+		current = diagnosticPath(a.path)
+	}
+	contents := make(map[string][]byte)
+	var inEditor *renamedFile
+	for i := range plan.files {
+		f := &plan.files[i]
+		if f.path == current {
+			if !bytes.Equal(a.editor.doc.bytes(), f.src) {
+				return errors.New(f.path + " was changed, please rename again")
+			}
+			inEditor = f
+			continue
+		}
+		data, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			return makeErr("rename", err)
+		}
+		if !bytes.Equal(data, f.src) {
+			return errors.New(f.path + " was changed, please rename again")
+		}
+		contents[f.path] = f.result()
+	}
+	if err := writeFiles(contents); err != nil {
+		return err
+	}
+	if inEditor != nil {
+		a.editor.applyReplacements(otherEdit, inEditor.edits, a.platform.now())
+	}
+	return nil
+}
+
+// backgroundWork runs one function at a time on another goroutine. The
+// function returns a callback that is run on the UI thread, when the app
+// calls poll.
+type backgroundWork struct {
+	running bool
+	done    chan func()
+}
+
+func newBackgroundWork() *backgroundWork {
+	return &backgroundWork{done: make(chan func(), 1)}
+}
+
+// start runs work unless other work is still running, in which case it
+// returns false.
+func (w *backgroundWork) start(work func() func()) bool {
+	if w.running {
+		return false
+	}
+	w.running = true
+	go func() {
+		w.done <- work()
+	}()
+	return true
+}
+
+// poll runs the callback of finished work. busy is true while work is still
+// running.
+func (w *backgroundWork) poll() (busy bool) {
+	if !w.running {
+		return false
+	}
+	select {
+	case callback := <-w.done:
+		w.running = false
+		callback()
+		return w.running
+	default:
+		return true
+	}
+}
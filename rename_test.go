@@ -0,0 +1,220 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// renameModule is a small module with two packages, the example uses the
+// shape package from outside.
+var renameModule = map[string]string{
+	"go.mod": "module example.com/ren\n",
+	"shape/shape.go": `package shape
+
+type Shape interface {
+	Area() float64
+}
+
+type Square struct{ Side float64 }
+
+func (s Square) Area() float64 { return s.Side * s.Side }
+
+func helper() int {
+	x := 1
+	{
+		y := 2
+		_ = y
+	}
+	return x
+}
+`,
+	"shape/named.go": `package shape
+
+type Named struct {
+	Square
+	Name string
+}
+
+func (n Named) Describe() string { return n.Name + count() }
+
+func count() string { return "" }
+`,
+	"shape/example_test.go": `package shape_test
+
+import "example.com/ren/shape"
+
+func ExampleNamed() {
+	n := shape.Named{Square: shape.Square{Side: 2}, Name: "n"}
+	println(n.Area() == 4, n.Square.Side)
+}
+`,
+	"main.go": `package main
+
+import (
+	"errors"
+
+	"example.com/ren/shape"
+)
+
+func main() {
+	var s shape.Shape = shape.Square{Side: 1}
+	println(s.Area(), errors.New("none"))
+}
+`,
+}
+
+func TestPlanRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, renameModule)
+
+	tests := []struct {
+		name string
+		// file and at give the renamed identifier, the first occurrence of
+		// at in the file
+		file, at string
+		newName  string
+		// want are the changed lines of the changed files
+		want map[string][]string
+	}{
+		{
+			name:    "a local variable",
+			file:    "shape/shape.go",
+			at:      "y := 2",
+			newName: "z",
+			want: map[string][]string{
+				"shape/shape.go": {"\t\tz := 2", "\t\t_ = z"},
+			},
+		},
+		{
+			name:    "a field",
+			file:    "shape/named.go",
+			at:      "Name string",
+			newName: "Title",
+			want: map[string][]string{
+				"shape/named.go": {
+					"\tTitle string",
+					"func (n Named) Describe() string { return n.Title + count() }",
+				},
+				"shape/example_test.go": {
+					"\tn := shape.Named{Square: shape.Square{Side: 2}, Title: \"n\"}",
+				},
+			},
+		},
+		{
+			name:    "an interface method and its implementation",
+			file:    "main.go",
+			at:      "Area()",
+			newName: "Size",
+			want: map[string][]string{
+				"main.go":        {"\tprintln(s.Size(), errors.New(\"none\"))"},
+				"shape/shape.go": {"\tSize() float64", "func (s Square) Size() float64 { return s.Side * s.Side }"},
+				"shape/example_test.go": {
+					"\tprintln(n.Size() == 4, n.Square.Side)",
+				},
+			},
+		},
+		{
+			name:    "a package-level function in another file",
+			file:    "shape/named.go",
+			at:      "count() string",
+			newName: "suffix",
+			want: map[string][]string{
+				"shape/named.go": {
+					"func (n Named) Describe() string { return n.Name + suffix() }",
+					"func suffix() string { return \"\" }",
+				},
+			},
+		},
+		{
+			name:    "a type and the field that embeds it",
+			file:    "shape/shape.go",
+			at:      "Square struct",
+			newName: "Box",
+			want: map[string][]string{
+				"main.go":        {"\tvar s shape.Shape = shape.Box{Side: 1}"},
+				"shape/shape.go": {"type Box struct{ Side float64 }", "func (s Box) Area() float64 { return s.Side * s.Side }"},
+				"shape/named.go": {"\tBox"},
+				"shape/example_test.go": {
+					"\tn := shape.Named{Box: shape.Box{Side: 2}, Name: \"n\"}",
+					"\tprintln(n.Area() == 4, n.Box.Side)",
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, filepath.FromSlash(tt.file))
+		src := []byte(renameModule[tt.file])
+		plan, err := planRename(path, src, strings.Index(string(src), tt.at), tt.newName)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got := make(map[string][]string)
+		for _, f := range plan.files {
+			rel, _ := filepath.Rel(dir, f.path)
+			rel = filepath.ToSlash(rel)
+			before := strings.Split(renameModule[rel], "\n")
+			after := strings.Split(string(f.result()), "\n")
+			if len(before) != len(after) {
+				t.Errorf("%s: %s has %d lines instead of %d", tt.name, rel, len(after), len(before))
+				continue
+			}
+			for i := range after {
+				if after[i] != before[i] {
+					got[rel] = append(got[rel], after[i])
+				}
+			}
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: the changed files are %v", tt.name, got)
+		}
+		for file, lines := range tt.want {
+			if strings.Join(got[file], "\n") != strings.Join(lines, "\n") {
+				t.Errorf("%s: the changed lines of %s are\n%s\nwant\n%s",
+					tt.name, file, strings.Join(got[file], "\n"), strings.Join(lines, "\n"))
+			}
+		}
+	}
+}
+
+func TestPlanRenameConflicts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, renameModule)
+
+	tests := []struct {
+		file, at string
+		newName  string
+		err      string
+	}{
+		{"shape/named.go", "Describe", "Name", "conflicts with Name"},
+		{"shape/named.go", "Name string", "Describe", "conflicts with Describe"},
+		{"shape/shape.go", "x := 1", "helper", "conflicts with helper"},
+		{"shape/shape.go", "y := 2", "x", "conflicts with x"},
+		{"shape/named.go", "count() string", "helper", "conflicts with helper"},
+		{"shape/shape.go", "Square struct", "Shape", "conflicts with Shape"},
+		{"shape/shape.go", "Square struct", "square", "must be exported"},
+		{"shape/shape.go", "float64", "float", "built into the language"},
+		{"main.go", "New", "Make", "outside the module"},
+		{"main.go", "main()", "1x", "not a valid Go identifier"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, filepath.FromSlash(tt.file))
+		src := []byte(renameModule[tt.file])
+		_, err := planRename(path, src, strings.Index(string(src), tt.at), tt.newName)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("renaming %s in %s to %s gives %v, want an error with %q",
+				tt.at, tt.file, tt.newName, err, tt.err)
+		}
+	}
+}
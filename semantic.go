@@ -0,0 +1,283 @@
+package main
+
+import (
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// semanticKind tells what an identifier refers to.
+type semanticKind int
+
+const (
+	packageName semanticKind = iota
+	typeName
+	functionName
+	methodName
+	fieldName
+	parameterName
+	localName
+	constantName
+	unusedVariable
+)
+
+// semanticColors are the text colors for all semantic kinds, they replace the
+// color of identifier tokens.
+var semanticColors = []uint32{
+	packageName:    0xFF6F42C1,
+	typeName:       0xFF267F99,
+	functionName:   0xFF795E26,
+	methodName:     0xFF9A6700,
+	fieldName:      0xFF0070C1,
+	parameterName:  0xFF5B2C6F,
+	localName:      0xFF001080,
+	constantName:   0xFF0451A5,
+	unusedVariable: 0xFF9E9E9E,
+}
+
+// semanticSpan is a classified identifier, start and end are byte offsets in
+// the line.
+type semanticSpan struct {
+	line, start, end int
+	kind             semanticKind
+}
+
+// analyzeGoPackage type-checks the package that the file at path belongs to,
+// with src as the file's current content, and classifies all identifiers in
+// that file. Whatever could be resolved is returned, together with the syntax
+// and type errors of all files in the package.
+func analyzeGoPackage(path string, src []byte, fset *token.FileSet, imp types.Importer) ([]semanticSpan, []diagnostic) {
+	var diagnostics []diagnostic
+	addError := func(pos token.Position, message string) {
+		start := textPosition{line: pos.Line - 1, column: max(0, pos.Column-1)}
+		diagnostics = append(diagnostics, diagnostic{
+			path:     pos.Filename,
+			start:    start,
+			end:      start,
+			severity: severityError,
+			message:  message,
+		})
+	}
+
+	read := func(filename string) ([]byte, error) {
+		if filename == path {
+			return src, nil
+		}
+		return ioutil.ReadFile(filename)
+	}
+
+	file, files, err := parseGoPackage(path, src, fset, 0)
+	if list, ok := err.(scanner.ErrorList); ok {
+		for _, e := range list {
+			addError(e.Pos, e.Msg)
+		}
+	}
+	if file == nil {
+		widenDiagnostics(diagnostics, read)
+		return nil, diagnostics
+	}
+
+	info := &types.Info{
+		Defs: make(map[*ast.Ident]types.Object),
+		Uses: make(map[*ast.Ident]types.Object),
+	}
+	conf := types.Config{
+		Importer: imp,
+		Error: func(err error) {
+			if e, ok := err.(types.Error); ok {
+				addError(e.Fset.Position(e.Pos), e.Msg)
+			}
+		},
+	}
+	conf.Check(file.Name.Name, fset, files, info)
+	widenDiagnostics(diagnostics, read)
+
+	// receivers, parameters and results are found through the function
+	// declarations and types
+	params := make(map[types.Object]bool)
+	addParams := func(list *ast.FieldList) {
+		if list == nil {
+			return
+		}
+		for _, field := range list.List {
+			for _, name := range field.Names {
+				params[info.Defs[name]] = true
+			}
+		}
+	}
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			addParams(n.Recv)
+		case *ast.FuncType:
+			addParams(n.Params)
+			addParams(n.Results)
+		}
+		return true
+	})
+	used := make(map[types.Object]bool)
+	for _, obj := range info.Uses {
+		used[obj] = true
+	}
+
+	tokens := fset.File(file.Pos())
+	var spans []semanticSpan
+	add := func(id *ast.Ident, obj types.Object, isDef bool) {
+		// the other files of the package are not shown
+		if obj == nil || id.Name == "_" || fset.File(id.Pos()) != tokens {
+			return
+		}
+		kind, ok := classifyObject(obj, params[obj])
+		if !ok {
+			return
+		}
+		if isDef && kind == localName && !used[obj] {
+			kind = unusedVariable
+		}
+		pos := tokens.Position(id.Pos())
+		spans = append(spans, semanticSpan{
+			line:  pos.Line - 1,
+			start: pos.Column - 1,
+			end:   pos.Column - 1 + len(id.Name),
+			kind:  kind,
+		})
+	}
+	for id, obj := range info.Defs {
+		add(id, obj, true)
+	}
+	for id, obj := range info.Uses {
+		add(id, obj, false)
+	}
+	return spans, diagnostics
+}
+
+// parseGoPackage parses the file at path, with src as its current content,
+// and the other files of its package from disk. file is the one at path, it
+// is the first of files. With syntax errors in src there is still a partial
+// syntax tree and the errors are returned, file is only nil if there is not
+// even a package clause.
+func parseGoPackage(path string, src []byte, fset *token.FileSet, mode parser.Mode) (file *ast.File, files []*ast.File, err error) {
+	file, err = parser.ParseFile(fset, path, src, mode)
+	if file == nil {
+		return nil, nil, err
+	}
+	files = []*ast.File{file}
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	infos, _ := ioutil.ReadDir(dir)
+	for _, info := range infos {
+		other := info.Name()
+		if other == name || info.IsDir() || !strings.HasSuffix(other, ".go") {
+			continue
+		}
+		if match, err := build.Default.MatchFile(dir, other); err != nil || !match {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(dir, other), nil, mode)
+		if err == nil && f.Name.Name == file.Name.Name {
+			files = append(files, f)
+		}
+	}
+	return file, files, err
+}
+
+func classifyObject(obj types.Object, isParam bool) (semanticKind, bool) {
+	switch obj := obj.(type) {
+	case *types.PkgName:
+		return packageName, true
+	case *types.TypeName:
+		return typeName, true
+	case *types.Func:
+		if sig, ok := obj.Type().(*types.Signature); ok && sig.Recv() != nil {
+			return methodName, true
+		}
+		return functionName, true
+	case *types.Const:
+		return constantName, true
+	case *types.Var:
+		if obj.IsField() {
+			return fieldName, true
+		}
+		if isParam {
+			return parameterName, true
+		}
+		return localName, true
+	}
+	return 0, false
+}
+
+// semanticAnalyzer runs analyzeGoPackage in the background whenever the
+// document changed. The app calls update periodically while there is work to
+// do.
+type semanticAnalyzer struct {
+	path     string
+	fset     *token.FileSet
+	importer types.Importer
+	// running is true while a goroutine analyzes the document as it was after
+	// version edits, the result arrives in done
+	running bool
+	version int
+	done    chan semanticResult
+	// diagnosticsChanged, if not nil, is called from update with the errors
+	// of every analysis that is up to date
+	diagnosticsChanged func([]diagnostic)
+}
+
+type semanticResult struct {
+	spans       []semanticSpan
+	diagnostics []diagnostic
+}
+
+func newSemanticAnalyzer(path string) *semanticAnalyzer {
+	fset := token.NewFileSet()
+	return &semanticAnalyzer{
+		path: path,
+		fset: fset,
+		// the source importer type-checks imported packages from source, it
+		// works without compiled packages and caches what it imported
+		importer: importer.ForCompiler(fset, "source", nil),
+		version:  -1,
+		done:     make(chan semanticResult, 1),
+	}
+}
+
+// update applies a finished analysis to h if the document did not change in
+// the mean time and starts a new analysis if the last one is outdated.
+// changed is true if h got new semantic spans, busy is true while an analysis
+// is still running.
+func (s *semanticAnalyzer) update(h *goHighlighter) (changed, busy bool) {
+	if s.running {
+		select {
+		case result := <-s.done:
+			s.running = false
+			if s.version == h.edits {
+				h.setSemanticSpans(result.spans)
+				changed = true
+				if s.diagnosticsChanged != nil {
+					s.diagnosticsChanged(result.diagnostics)
+				}
+			}
+		default:
+			return false, true
+		}
+	}
+	if s.version != h.edits {
+		s.running = true
+		s.version = h.edits
+		src := h.doc.bytes()
+		go func() {
+			spans, diagnostics := analyzeGoPackage(s.path, src, s.fset, s.importer)
+			s.done <- semanticResult{spans: spans, diagnostics: diagnostics}
+		}()
+	}
+	return changed, s.running
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"go/importer"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var semanticKindNames = []string{
+	packageName:    "package",
+	typeName:       "type",
+	functionName:   "func",
+	methodName:     "method",
+	fieldName:      "field",
+	parameterName:  "param",
+	localName:      "local",
+	constantName:   "const",
+	unusedVariable: "unused",
+}
+
+// describeSemanticSpans lists the identifiers in src as line:name:kind in the
+// order of the text.
+func describeSemanticSpans(src string, spans []semanticSpan) []string {
+	spans = append([]semanticSpan(nil), spans...)
+	sort.Slice(spans, func(i, j int) bool {
+		a, b := spans[i], spans[j]
+		return a.line < b.line || a.line == b.line && a.start < b.start
+	})
+	lines := strings.Split(src, "\n")
+	var list []string
+	for _, s := range spans {
+		name := lines[s.line][s.start:s.end]
+		list = append(list, strconv.Itoa(s.line+1)+":"+name+":"+semanticKindNames[s.kind])
+	}
+	return list
+}
+
+// writeSemanticPackage creates a package with the file other.go and returns
+// the path of the analyzed file p.go, which is not written.
+func writeSemanticPackage(t *testing.T) (path string, cleanUp func()) {
+	dir, err := ioutil.TempDir("", "semantic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTree(t, dir, map[string]string{
+		"go.mod":   "module example.com/p\n",
+		"other.go": "package p\n\ntype T struct{ F int }\n",
+	})
+	return filepath.Join(dir, "p.go"), func() { os.RemoveAll(dir) }
+}
+
+func TestAnalyzeGoPackage(t *testing.T) {
+	path, cleanUp := writeSemanticPackage(t)
+	defer cleanUp()
+	src := `package p
+
+import "errors"
+
+const C = 1
+
+func (t T) M(a int) (n int) {
+	unused := 2
+	x := errors.New("")
+	return t.F + a + C + len(x.Error())
+}
+`
+	fset := token.NewFileSet()
+	spans, diagnostics := analyzeGoPackage(path, []byte(src), fset, importer.ForCompiler(fset, "source", nil))
+	want := []string{
+		"5:C:const",
+		"7:t:param", "7:T:type", "7:M:method", "7:a:param", "7:int:type", "7:n:param", "7:int:type",
+		"8:unused:unused",
+		"9:x:local", "9:errors:package", "9:New:func",
+		"10:t:param", "10:F:field", "10:a:param", "10:C:const", "10:x:local", "10:Error:method",
+	}
+	got := describeSemanticSpans(src, spans)
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("the identifiers are\n%s\nwant\n%s", strings.Join(got, " "), strings.Join(want, " "))
+	}
+	// the unused variable is also a type error
+	if len(diagnostics) != 1 || !strings.Contains(diagnostics[0].message, "declared and not used") ||
+		diagnostics[0].start != (textPosition{line: 7, column: 1}) {
+		t.Errorf("the diagnostics are %+v", diagnostics)
+	}
+}
+
+func TestAnalyzeGoPackageErrors(t *testing.T) {
+	path, cleanUp := writeSemanticPackage(t)
+	defer cleanUp()
+	tests := []struct {
+		name string
+		src  string
+		// want are the identifiers that are still classified
+		want []string
+		errs []string
+	}{
+		{
+			name: "a type error",
+			src:  "package p\n\nvar v = nope + T{}.F\n\nvar _ = v\n",
+			want: []string{"3:v:local", "3:T:type", "3:F:field", "5:v:local"},
+			errs: []string{"undefined: nope"},
+		},
+		{
+			name: "a syntax error",
+			src:  "package p\n\nfunc f(t T) {\n\tt.F(\n}\n",
+			want: []string{"3:f:func", "3:t:param", "3:T:type", "4:t:param", "4:F:field"},
+			errs: []string{"expected"},
+		},
+		{
+			name: "no package clause",
+			src:  "func f() {}\n",
+			errs: []string{"expected 'package'"},
+		},
+	}
+	for _, tt := range tests {
+		fset := token.NewFileSet()
+		spans, diagnostics := analyzeGoPackage(path, []byte(tt.src), fset, importer.ForCompiler(fset, "source", nil))
+		if got := describeSemanticSpans(tt.src, spans); strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: the identifiers are %v, want %v", tt.name, got, tt.want)
+		}
+		if len(diagnostics) < len(tt.errs) {
+			t.Errorf("%s: the diagnostics are %+v, want %v", tt.name, diagnostics, tt.errs)
+			continue
+		}
+		for i, e := range tt.errs {
+			if !strings.Contains(diagnostics[i].message, e) || diagnostics[i].path != path {
+				t.Errorf("%s: diagnostic %d is %+v, want one with %q", tt.name, i, diagnostics[i], e)
+			}
+		}
+	}
+}
+
+func TestSemanticAnalyzer(t *testing.T) {
+	path, cleanUp := writeSemanticPackage(t)
+	defer cleanUp()
+	doc := newDocument([]byte("package p\n\nvar v T\n\nvar _ = v\n"))
+	h := newGoHighlighter(doc)
+	s := newSemanticAnalyzer(path)
+	var diagnostics [][]diagnostic
+	s.diagnosticsChanged = func(list []diagnostic) { diagnostics = append(diagnostics, list) }
+	update := func() (changed bool) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			changed, busy := s.update(h)
+			if !busy {
+				return changed
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("timeout")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if _, busy := s.update(h); !busy {
+		t.Fatal("the analysis did not start")
+	}
+	// the result of the text before the edit is dropped, the edited text is
+	// analyzed again
+	doc.insert(doc.len(), []byte("var w = nope\n"))
+	if !update() {
+		t.Fatal("the edited text was not analyzed")
+	}
+	if got := describeSemanticSpans(string(doc.bytes()), h.lines[2].semantic); strings.Join(got, " ") != "3:v:local 3:T:type" {
+		t.Errorf("the spans of line 3 are %v", got)
+	}
+	if len(diagnostics) != 1 || len(diagnostics[0]) != 1 || !strings.Contains(diagnostics[0][0].message, "undefined: nope") {
+		t.Errorf("the diagnostics are %+v", diagnostics)
+	}
+	// without edits there is nothing to do
+	if changed, busy := s.update(h); changed || busy {
+		t.Errorf("without an edit the update gives %v %v", changed, busy)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// settings are the user's preferences, see defaultSettings for the values
+// that are used if they are not in the settings file.
+type settings struct {
+	// FormatOnSave formats Go files with gofmt before they are saved
+	FormatOnSave bool `json:"formatOnSave"`
+	// OrganizeImportsOnSave adds missing and removes unused imports in Go
+	// files before they are saved
+	OrganizeImportsOnSave bool `json:"organizeImportsOnSave"`
+	// LanguageServer is the command that is started for Go files, it is
+	// looked up in the PATH. An empty command turns the language server off.
+	LanguageServer string `json:"languageServer"`
+	// PersistentUndo saves the undo history next to the file whenever the
+	// file is saved, so undo works across sessions
+	PersistentUndo bool `json:"persistentUndo"`
+	// VetOnSave runs go vet on the package of a Go file after it is saved
+	VetOnSave bool `json:"vetOnSave"`
+	// Debugger is Delve's command, it is looked up in the PATH and started as
+	// a debug adapter
+	Debugger string `json:"debugger"`
+	// BenchmarkCount is how often the benchmark commands run each benchmark,
+	// the comparison of two runs needs several
+	BenchmarkCount int `json:"benchmarkCount"`
+}
+
+func defaultSettings() settings {
+	return settings{LanguageServer: "gopls", VetOnSave: true, Debugger: "dlv", BenchmarkCount: 6}
+}
+
+// settingsPath is the user's settings file.
+func settingsPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "gonutz-ide", "settings.json")
+}
+
+// loadSettings reads the JSON file at path, e.g.
+//
+//	{ "formatOnSave": true, "languageServer": "" }
+//
+// Settings that are not in the file keep their default. A missing file is not
+// an error.
+func loadSettings(path string) (settings, error) {
+	s := defaultSettings()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, makeErr("load settings", err)
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, makeErr("load settings from "+path, err)
+	}
+	return s, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"go/scanner"
+	"go/token"
+	"strings"
+)
+
+// tokenKind classifies a piece of source code for coloring.
+type tokenKind int
+
+const (
+	plainToken tokenKind = iota
+	keywordToken
+	identifierToken
+	literalToken
+	commentToken
+	operatorToken
+)
+
+// tokenColors are the text colors for all token kinds.
+var tokenColors = []uint32{
+	plainToken:      editorTextColor,
+	keywordToken:    0xFF0000FF,
+	identifierToken: 0xFF001080,
+	literalToken:    0xFFA31515,
+	commentToken:    0xFF008000,
+	operatorToken:   0xFF404040,
+}
+
+// tokenSpan is a token in a line, start and end are byte offsets relative to
+// the line start.
+type tokenSpan struct {
+	start, end int
+	kind       tokenKind
+}
+
+// lineState is what a line inherits from the lines above it. Only block
+// comments and raw strings can span multiple lines in Go.
+type lineState int
+
+const (
+	normalState lineState = iota
+	inBlockComment
+	inRawString
+)
+
+// tokenizeGoLine splits one line of Go code into tokens. The line starts in
+// the given state, the state at the end of the line is returned.
+func tokenizeGoLine(line []byte, state lineState) ([]tokenSpan, lineState) {
+	// go/scanner cannot start in the middle of a comment or string so we
+	// re-open them with a prefix which is not part of the line
+	prefix := ""
+	switch state {
+	case inBlockComment:
+		prefix = "/*"
+	case inRawString:
+		prefix = "`"
+	}
+	src := append([]byte(prefix), line...)
+
+	var s scanner.Scanner
+	file := token.NewFileSet().AddFile("", -1, len(src))
+	s.Init(file, src, func(token.Position, string) {}, scanner.ScanComments)
+
+	var spans []tokenSpan
+	endState := normalState
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.SEMICOLON && lit == "\n" {
+			// automatically inserted, it is not in the source
+			continue
+		}
+		start := file.Offset(pos)
+		end := start + len(lit)
+		if lit == "" {
+			end = start + len(tok.String())
+		}
+		endState = normalState
+		if tok == token.COMMENT && strings.HasPrefix(lit, "/*") &&
+			(len(lit) < 4 || !strings.HasSuffix(lit, "*/")) {
+			endState = inBlockComment
+		}
+		if tok == token.STRING && strings.HasPrefix(lit, "`") &&
+			(len(lit) < 2 || !strings.HasSuffix(lit, "`")) {
+			endState = inRawString
+		}
+		spans = append(spans, tokenSpan{
+			start: max(0, start-len(prefix)),
+			end:   min(len(line), end-len(prefix)),
+			kind:  goTokenKind(tok),
+		})
+	}
+	return spans, endState
+}
+
+func goTokenKind(tok token.Token) tokenKind {
+	switch {
+	case tok == token.COMMENT:
+		return commentToken
+	case tok == token.IDENT:
+		return identifierToken
+	case tok.IsKeyword():
+		return keywordToken
+	case tok.IsLiteral():
+		return literalToken
+	case tok.IsOperator():
+		return operatorToken
+	default:
+		return plainToken
+	}
+}
+
+// goHighlighter caches the tokens of every line of a Go document. After an
+// edit, lines are re-tokenized on demand, starting at the first edited line
+// and only as far as they are requested.
+type goHighlighter struct {
+	doc   *document
+	lines []highlightedLine
+	// valid is the number of lines at the start whose state and spans are
+	// known to be right
+	valid int
+	// edits counts the document changes, it tells if background results
+	// still belong to the current text
+	edits int
+	// changed, if not nil, is called after every edit
+	changed func()
+}
+
+type highlightedLine struct {
+	// start is the state at the beginning of the line
+	start lineState
+	spans []tokenSpan
+	// end is the state at the end of the line, it is the next line's start
+	end lineState
+	// dirty is true if the line's text changed since it was tokenized
+	dirty bool
+	// semantic are the identifiers classified by type-checking, they are
+	// dropped when the line is edited
+	semantic []semanticSpan
+}
+
+// newGoHighlighter highlights the document and follows its edits.
+func newGoHighlighter(doc *document) *goHighlighter {
+	h := &goHighlighter{
+		doc:   doc,
+		lines: make([]highlightedLine, doc.lineCount()),
+	}
+	for i := range h.lines {
+		h.lines[i].dirty = true
+	}
+	doc.edited = h.edited
+	return h
+}
+
+// edited updates the line cache after removedLines line breaks were removed
+// from or addedLines were added to the given line.
+func (h *goHighlighter) edited(line, removedLines, addedLines int) {
+	if line >= len(h.lines) {
+		return
+	}
+	removedLines = min(removedLines, len(h.lines)-line-1)
+	// the lines after the edited one only move, they keep their tokens
+	rest := h.lines[line+1+removedLines:]
+	lines := append([]highlightedLine(nil), h.lines[:line]...)
+	for i := 0; i <= addedLines; i++ {
+		lines = append(lines, highlightedLine{dirty: true})
+	}
+	h.lines = append(lines, rest...)
+	h.valid = min(h.valid, line)
+	h.edits++
+	if h.changed != nil {
+		h.changed()
+	}
+}
+
+// setSemanticSpans replaces all semantic spans, they must belong to the
+// current document.
+func (h *goHighlighter) setSemanticSpans(spans []semanticSpan) {
+	for i := range h.lines {
+		h.lines[i].semantic = nil
+	}
+	for _, s := range spans {
+		if 0 <= s.line && s.line < len(h.lines) {
+			h.lines[s.line].semantic = append(h.lines[s.line].semantic, s)
+		}
+	}
+}
+
+// semanticKindAt returns the semantic kind of the identifier in the given
+// byte range of the line.
+func (h *goHighlighter) semanticKindAt(line, start, end int) (semanticKind, bool) {
+	for _, s := range h.lines[line].semantic {
+		if s.start == start && s.end == end {
+			return s.kind, true
+		}
+	}
+	return 0, false
+}
+
+// lineSpans returns the tokens of the given line.
+func (h *goHighlighter) lineSpans(line int) []tokenSpan {
+	if line < 0 || line >= len(h.lines) {
+		return nil
+	}
+	for h.valid <= line {
+		i := h.valid
+		state := normalState
+		if i > 0 {
+			state = h.lines[i-1].end
+		}
+		l := &h.lines[i]
+		if l.dirty || l.start != state {
+			start, end := h.doc.lineStart(i), h.doc.lineEnd(i)
+			l.spans, l.end = tokenizeGoLine(h.doc.slice(start, end), state)
+			l.start = state
+			l.dirty = false
+		}
+		h.valid++
+	}
+	return h.lines[line].spans
+}
+
+// colorRuns converts the tokens of a line to color runs for the first length
+// bytes of the line. Bytes between tokens get the plain text color.
+// Identifiers are colored by their semantic kind if it is known.
+func (h *goHighlighter) colorRuns(line, length int) []colorRun {
+	var runs []colorRun
+	at := 0
+	add := func(end int, color uint32) {
+		end = min(end, length)
+		if end > at {
+			runs = appendColorRun(runs, end-at, color)
+			at = end
+		}
+	}
+	for _, s := range h.lineSpans(line) {
+		add(s.start, tokenColors[plainToken])
+		color := tokenColors[s.kind]
+		if s.kind == identifierToken {
+			if kind, ok := h.semanticKindAt(line, s.start, s.end); ok {
+				color = semanticColors[kind]
+			}
+		}
+		add(s.end, color)
+	}
+	add(length, tokenColors[plainToken])
+	return runs
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+var tokenKindNames = []string{
+	plainToken:      "plain",
+	keywordToken:    "keyword",
+	identifierToken: "ident",
+	literalToken:    "literal",
+	commentToken:    "comment",
+	operatorToken:   "op",
+}
+
+// describeSpans lists the tokens of the line as kind:text.
+func describeSpans(line string, spans []tokenSpan) string {
+	var parts []string
+	for _, s := range spans {
+		parts = append(parts, tokenKindNames[s.kind]+":"+line[s.start:s.end])
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestTokenizeGoLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		start lineState
+		want  string
+		end   lineState
+	}{
+		{
+			"func f(x int) string {", normalState,
+			"keyword:func ident:f op:( ident:x ident:int op:) ident:string op:{",
+			normalState,
+		},
+		{
+			`return "a\"b" + 'c' + 1.5e3 // done`, normalState,
+			`keyword:return literal:"a\"b" op:+ literal:'c' op:+ literal:1.5e3 comment:// done`,
+			normalState,
+		},
+		{"x := y /* a */ + z", normalState, "ident:x op::= ident:y comment:/* a */ op:+ ident:z", normalState},
+		// block comments and raw strings continue in the next line
+		{"x := 1 /* a", normalState, "ident:x op::= literal:1 comment:/* a", inBlockComment},
+		{"/*/", normalState, "comment:/*/", inBlockComment},
+		{"still", inBlockComment, "comment:still", inBlockComment},
+		{"still */ x", inBlockComment, "comment:still */ ident:x", normalState},
+		{"*/", inBlockComment, "comment:*/", normalState},
+		{"s := `raw", normalState, "ident:s op::= literal:`raw", inRawString},
+		{"`", normalState, "literal:`", inRawString},
+		{"// no */ and no `", inRawString, "literal:// no */ and no `", normalState},
+		{"raw` + `again", inRawString, "literal:raw` op:+ literal:`again", inRawString},
+		{"in /* raw", inRawString, "literal:in /* raw", inRawString},
+		// an empty line keeps the state
+		{"", inRawString, "literal:", inRawString},
+		{"", inBlockComment, "comment:", inBlockComment},
+		{"", normalState, "", normalState},
+	}
+	for _, tt := range tests {
+		spans, end := tokenizeGoLine([]byte(tt.line), tt.start)
+		if got := describeSpans(tt.line, spans); got != tt.want || end != tt.end {
+			t.Errorf("%q in state %d gives\n%s in state %d, want\n%s in state %d",
+				tt.line, tt.start, got, end, tt.want, tt.end)
+		}
+	}
+}
+
+// highlightedLines describes the tokens of all lines of the document.
+func highlightedLines(h *goHighlighter) []string {
+	var lines []string
+	for i := 0; i < h.doc.lineCount(); i++ {
+		text := string(h.doc.slice(h.doc.lineStart(i), h.doc.lineEnd(i)))
+		lines = append(lines, describeSpans(text, h.lineSpans(i)))
+	}
+	return lines
+}
+
+func TestGoHighlighter(t *testing.T) {
+	doc := newDocument([]byte("x := `a\nb\nc`\ny := 1\nz := 2"))
+	h := newGoHighlighter(doc)
+	want := []string{
+		"ident:x op::= literal:`a",
+		"literal:b",
+		"literal:c`",
+		"ident:y op::= literal:1",
+		"ident:z op::= literal:2",
+	}
+	if got := highlightedLines(h); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("the lines are\n%s", strings.Join(got, "\n"))
+	}
+
+	// removing the opening quote changes the following lines up to the
+	// closing one, which now opens a raw string
+	doc.delete(5, 1)
+	if h.valid != 0 {
+		t.Errorf("after the edit %d lines are valid", h.valid)
+	}
+	want = []string{
+		"ident:x op::= ident:a",
+		"ident:b",
+		"ident:c literal:`",
+		"literal:y := 1",
+		"literal:z := 2",
+	}
+	if got := highlightedLines(h); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("after the edit the lines are\n%s", strings.Join(got, "\n"))
+	}
+
+	// lines are only tokenized as far as they are needed
+	doc.insert(0, []byte("// new\n"))
+	h.lineSpans(1)
+	if h.valid != 2 {
+		t.Errorf("after asking for line 1 there are %d valid lines", h.valid)
+	}
+	// the lines below the edit kept their tokens
+	for i := 2; i < len(h.lines); i++ {
+		if h.lines[i].dirty {
+			t.Errorf("line %d is re-tokenized", i)
+		}
+	}
+	if len(h.lines) != doc.lineCount() {
+		t.Errorf("the highlighter has %d lines for %d", len(h.lines), doc.lineCount())
+	}
+}
+
+func TestGoHighlighterFollowsRandomEdits(t *testing.T) {
+	doc := newDocument([]byte("package main\n/* a\nb */\nfunc f() {\n\ts := `x\ny`\n}\n"))
+	h := newGoHighlighter(doc)
+	r := rand.New(rand.NewSource(1))
+	pieces := []string{"/*", "*/", "`", "\n", "x", " ", "\"", "func", "\r\n"}
+	for i := 0; i < 2000; i++ {
+		if r.Intn(2) == 0 && doc.len() > 0 {
+			doc.delete(r.Intn(doc.len()), r.Intn(5))
+		} else {
+			doc.insert(r.Intn(doc.len()+1), []byte(pieces[r.Intn(len(pieces))]))
+		}
+		if r.Intn(3) == 0 {
+			// several edits before the next request
+			continue
+		}
+		state := normalState
+		for line := 0; line < doc.lineCount(); line++ {
+			text := doc.slice(doc.lineStart(line), doc.lineEnd(line))
+			var want []tokenSpan
+			want, state = tokenizeGoLine(text, state)
+			got := h.lineSpans(line)
+			if describeSpans(string(text), got) != describeSpans(string(text), want) {
+				t.Fatalf("edit %d: line %d of %q has the tokens\n%s\nwant\n%s", i, line, doc.bytes(),
+					describeSpans(string(text), got), describeSpans(string(text), want))
+			}
+		}
+	}
+}
+
+func TestGoHighlighterColorRuns(t *testing.T) {
+	doc := newDocument([]byte("x := f(1) // c"))
+	h := newGoHighlighter(doc)
+	h.setSemanticSpans([]semanticSpan{{line: 0, start: 5, end: 6, kind: functionName}})
+	line := []colorRun{
+		{1, tokenColors[identifierToken]},
+		{1, tokenColors[plainToken]},
+		{2, tokenColors[operatorToken]},
+		{1, tokenColors[plainToken]},
+		{1, semanticColors[functionName]},
+		{1, tokenColors[operatorToken]},
+		{1, tokenColors[literalToken]},
+		{1, tokenColors[operatorToken]},
+		{1, tokenColors[plainToken]},
+		{4, tokenColors[commentToken]},
+	}
+	tests := []struct {
+		length int
+		want   []colorRun
+	}{
+		{14, line},
+		// only the visible part of the line
+		{3, []colorRun{
+			{1, tokenColors[identifierToken]},
+			{1, tokenColors[plainToken]},
+			{1, tokenColors[operatorToken]},
+		}},
+		// the space after the line
+		{16, append(line, colorRun{2, tokenColors[plainToken]})},
+	}
+	for _, tt := range tests {
+		got := h.colorRuns(0, tt.length)
+		if len(got) != len(tt.want) {
+			t.Errorf("the runs for %d bytes are %v, want %v", tt.length, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("the runs for %d bytes are %v, want %v", tt.length, got, tt.want)
+				break
+			}
+		}
+	}
+
+	// an edit of the line drops its semantic colors
+	doc.insert(0, []byte(" "))
+	for _, run := range h.colorRuns(0, 15) {
+		if run.argb == semanticColors[functionName] {
+			t.Error("the edited line keeps its semantic color")
+		}
+	}
+}
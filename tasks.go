@@ -0,0 +1,436 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// task is a go command, like go build or go test, that runs in a directory.
+type task struct {
+	// title is the command line as the user would type it
+	title string
+	dir   string
+	// args are the arguments of the go command
+	args []string
+	// tests is true for go test -json, the test explorer reads its output
+	tests bool
+	// coverProfile, if not empty, is the file that go test writes the
+	// coverage to
+	coverProfile string
+	// benchmarks is true for go test -bench, the benchmarks panel keeps the
+	// results
+	benchmarks bool
+}
+
+// goTasks are the go commands that the task commands run for the package of
+// the current file and, if moduleArgs are given, for its whole module.
+var goTasks = []struct {
+	name       string
+	args       []string
+	moduleArgs []string
+}{
+	{"build", []string{"build", "."}, []string{"build", "./..."}},
+	{"run", []string{"run", "."}, nil},
+	{"test", []string{"test", "-json", "."}, []string{"test", "-json", "./..."}},
+	{"vet", []string{"vet", "."}, []string{"vet", "./..."}},
+}
+
+// startGoCommand starts the task's go command, which writes its output to
+// output. wait waits for the command to finish, kill ends it together with
+// the programs it started.
+func startGoCommand(t task, output io.Writer) (wait func() error, kill func(), err error) {
+	cmd := exec.Command("go", t.args...)
+	cmd.Dir = t.dir
+	cmd.Stdout = output
+	cmd.Stderr = output
+	hideProcessWindow(cmd)
+	newProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, nil, makeErr(t.title, err)
+	}
+	return cmd.Wait, func() { killProcessGroup(cmd) }, nil
+}
+
+// taskRunner runs one task at a time in the background. The app polls it
+// for the output while the task is running.
+type taskRunner struct {
+	start func(t task, output io.Writer) (wait func() error, kill func(), err error)
+	// running is true until the task's result was polled. cancelled is true
+	// if it was killed.
+	running   bool
+	cancelled bool
+	kill      func()
+	done      chan error
+	// output is what the task wrote since the last poll
+	mu     sync.Mutex
+	output []byte
+}
+
+func newTaskRunner(start func(t task, output io.Writer) (wait func() error, kill func(), err error)) *taskRunner {
+	return &taskRunner{start: start, done: make(chan error, 1)}
+}
+
+// run starts t, unless another task is still running.
+func (r *taskRunner) run(t task) error {
+	if r.running {
+		return errors.New("another task is still running, cancel it first")
+	}
+	wait, kill, err := r.start(t, taskOutput{r})
+	if err != nil {
+		return err
+	}
+	r.running = true
+	r.cancelled = false
+	r.kill = kill
+	go func() {
+		r.done <- wait()
+	}()
+	return nil
+}
+
+// cancel kills the running task, poll reports when it is gone.
+func (r *taskRunner) cancel() {
+	if r.running && !r.cancelled {
+		r.cancelled = true
+		r.kill()
+	}
+}
+
+// poll returns the output that arrived since the last call. Once the task is
+// done, finished is true and err is the result of the command.
+func (r *taskRunner) poll() (output []byte, finished bool, err error) {
+	if !r.running {
+		return nil, false, nil
+	}
+	// the command is done after all its output was written
+	select {
+	case err = <-r.done:
+		r.running = false
+		finished = true
+	default:
+	}
+	r.mu.Lock()
+	output = r.output
+	r.output = nil
+	r.mu.Unlock()
+	return output, finished, err
+}
+
+// taskOutput collects the output of the runner's task, the command writes it
+// from other goroutines.
+type taskOutput struct {
+	r *taskRunner
+}
+
+func (o taskOutput) Write(p []byte) (int, error) {
+	o.r.mu.Lock()
+	o.r.output = append(o.r.output, p...)
+	o.r.mu.Unlock()
+	return len(p), nil
+}
+
+// outputPanel shows the output of the last task below the editor. Lines with
+// a file location are links, a click jumps to the location.
+type outputPanel struct {
+	listPanel
+	lines []outputLine
+	task  task
+	// dir is where the paths in the output are relative to
+	dir string
+	// partial is the last line of the output while it is incomplete
+	partial string
+	// follow keeps the last line in view while output arrives, it ends when
+	// the user scrolls up
+	follow bool
+}
+
+type outputLine struct {
+	text string
+	// link tells if the line names a file location, which is path at pos
+	link bool
+	path string
+	pos  textPosition
+}
+
+const (
+	// maxOutputLines is the number of lines that the output panel keeps, the
+	// oldest ones are dropped
+	maxOutputLines  = 10000
+	outputLinkColor = 0xFF0366D6
+)
+
+func newOutputPanel() outputPanel {
+	return outputPanel{listPanel: listPanel{title: "Output", selected: -1}}
+}
+
+// start clears the panel for the output of t.
+func (p *outputPanel) start(t task) {
+	p.task = t
+	p.dir = t.dir
+	p.title = t.title + " - running"
+	p.lines = nil
+	p.partial = ""
+	p.follow = true
+	p.selected = -1
+	p.top = 0
+	p.setRows(0)
+}
+
+// write adds output of the task, it may end in the middle of a line.
+func (p *outputPanel) write(output []byte) {
+	lines := strings.Split(p.partial+string(output), "\n")
+	p.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		p.add(line)
+	}
+	p.setRows(len(p.lines))
+	if p.follow {
+		p.top = max(0, len(p.lines)-listPanelRows)
+	}
+}
+
+// writeIn is like write for output whose paths are relative to dir.
+func (p *outputPanel) writeIn(dir, text string) {
+	p.dir = dir
+	p.write([]byte(text))
+}
+
+// show replaces the output with text, e.g. the output of a test.
+func (p *outputPanel) show(t task, text string) {
+	p.start(t)
+	p.write([]byte(text))
+	if p.partial != "" {
+		p.write([]byte("\n"))
+	}
+	p.title = t.title
+	p.follow = false
+	p.top = 0
+}
+
+// add appends a line, a location at its start is relative to the panel's
+// directory.
+func (p *outputPanel) add(text string) {
+	text = strings.Replace(strings.TrimRight(text, "\r"), "\t", "    ", -1)
+	line := outputLine{text: text}
+	if path, l, column, _, ok := parseErrorLine(text); ok {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(p.dir, path)
+		}
+		line.link = true
+		line.path = path
+		line.pos = textPosition{line: l - 1, column: max(0, column-1)}
+	}
+	if len(p.lines) == maxOutputLines {
+		p.lines = p.lines[1:]
+		p.selected = max(-1, p.selected-1)
+	}
+	p.lines = append(p.lines, line)
+}
+
+// finish adds the rest of the output and the task's result.
+func (p *outputPanel) finish(result string) {
+	if p.partial != "" {
+		p.write([]byte("\n"))
+	}
+	p.title = p.task.title + " - " + result
+}
+
+// scroll moves the visible rows by delta, scrolling to the end follows the
+// output again.
+func (p *outputPanel) scroll(delta int) {
+	last := max(0, len(p.lines)-listPanelRows)
+	p.top = clamp(p.top+delta, 0, last)
+	p.follow = p.top == last
+}
+
+func (p *outputPanel) draw(g graphics, area rectangle) {
+	lineHeight := g.lineHeight()
+	p.listPanel.draw(g, area, func(i int, row rectangle) {
+		line := p.lines[i]
+		color := uint32(editorTextColor)
+		if line.link {
+			color = outputLinkColor
+			w, _ := g.textExtent([]byte(line.text))
+			underline := rect(row.x+4, row.y+lineHeight-2, w, 1)
+			fillRect(g, underline.intersect(row), color)
+		}
+		g.text([]byte(line.text), row.x+4, row.y, row, color)
+	})
+}
+
+// registerTaskCommands registers the commands that run go commands for the
+// package of the app's file, or its module, and show their output.
+func registerTaskCommands(r *commandRegistry, a *app) {
+	for _, t := range goTasks {
+		args, moduleArgs := t.args, t.moduleArgs
+		r.register("task."+t.name, func(*editor) {
+			a.runTask(args, false)
+		})
+		if moduleArgs != nil {
+			r.register("task."+t.name+"Module", func(*editor) {
+				a.runTask(moduleArgs, true)
+			})
+		}
+	}
+	r.register("task.cancel", func(*editor) {
+		a.tasks.cancel()
+	})
+	r.register("view.toggleOutput", func(*editor) {
+		a.output.visible = !a.output.visible
+		a.frames.invalidateAll()
+	})
+	r.register("output.pageUp", func(*editor) {
+		a.output.scroll(-listPanelRows)
+		a.frames.invalidateAll()
+	})
+	r.register("output.pageDown", func(*editor) {
+		a.output.scroll(listPanelRows)
+		a.frames.invalidateAll()
+	})
+}
+
+// runTask runs the go command with args in the directory of the current
+// file, or in the root of its module. Test runs replace the results in the
+// test explorer.
+func (a *app) runTask(args []string, moduleWide bool) {
+	title := "go " + strings.Join(args, " ")
+	dir, ok := a.taskDir(title, moduleWide)
+	if !ok {
+		return
+	}
+	t := task{title: title, dir: dir, args: args, tests: args[0] == "test"}
+	if t.tests {
+		a.explorer.clear()
+	}
+	a.startTask(t)
+}
+
+// taskDir returns the directory of the current file, or the root of its
+// module, for a task. It shows an error and returns false if the task cannot
+// run now.
+func (a *app) taskDir(title string, moduleWide bool) (string, bool) {
+	if a.path == "" {
+		a.platform.showError(title, "save the file first, tasks run in its directory")
+		return "", false
+	}
+	if !a.prepareTask(title) {
+		return "", false
+	}
+	dir := filepath.Dir(diagnosticPath(a.path))
+	if moduleWide {
+		if root, _, ok := findModule(dir); ok {
+			dir = root
+		}
+	}
+	return dir, true
+}
+
+// prepareTask makes sure that no other task or debugger is running and saves
+// the file, since the go command reads it from disk. It returns false if the
+// task cannot run.
+func (a *app) prepareTask(title string) bool {
+	if a.tasks.running {
+		a.platform.showError(title, a.output.task.title+" is still running, cancel it first")
+		return false
+	}
+	if a.debug != nil {
+		a.platform.showError(title, "the debugger is still running, stop it first")
+		return false
+	}
+	if a.editor != nil && a.path != "" && a.editor.history.isModified() {
+		if err := a.save(); err != nil {
+			a.platform.showError("Save", err.Error())
+			return false
+		}
+	}
+	return true
+}
+
+// startTask runs t and shows its output.
+func (a *app) startTask(t task) {
+	if err := a.tasks.run(t); err != nil {
+		a.platform.showError(t.title, err.Error())
+		return
+	}
+	a.output.start(t)
+	a.output.visible = true
+	if t.tests {
+		a.explorer.start(t.dir)
+		a.explorer.visible = true
+	}
+	a.platform.startTimer(taskTimer, taskPoll)
+	a.frames.invalidateAll()
+}
+
+// updateTask shows the output of the running task and its result once it is
+// done.
+func (a *app) updateTask() {
+	output, finished, err := a.tasks.poll()
+	tests := a.output.task.tests
+	if len(output) > 0 {
+		if tests {
+			a.explorer.write(output, a.output.writeIn)
+		} else {
+			a.output.write(output)
+		}
+		a.frames.invalidateAll()
+	}
+	if !finished {
+		return
+	}
+	a.platform.stopTimer(taskTimer)
+	result := "done"
+	if a.tasks.cancelled {
+		result = "cancelled"
+	} else if err != nil {
+		result = err.Error()
+	}
+	if tests {
+		a.explorer.finish(err != nil && !a.tasks.cancelled, a.output.writeIn)
+	}
+	if t := a.output.task; t.coverProfile != "" {
+		if a.tasks.cancelled {
+			os.Remove(t.coverProfile)
+		} else {
+			a.showCoverage(t, err != nil)
+		}
+	}
+	if a.output.task.benchmarks && !a.tasks.cancelled {
+		a.addBenchmarkRun(err != nil)
+	}
+	a.output.finish(result)
+	a.frames.invalidateAll()
+}
+
+// goToOutputLink jumps to the next (step 1) or previous (step -1) link in the
+// output panel, it wraps around at the ends.
+func (a *app) goToOutputLink(step int) {
+	n := len(a.output.lines)
+	from := a.output.selected
+	if from == -1 && step < 0 {
+		from = 0
+	}
+	for i := 1; i <= n; i++ {
+		next := ((from+step*i)%n + n) % n
+		if a.output.lines[next].link {
+			a.showOutputLine(next)
+			return
+		}
+	}
+}
+
+// showOutputLine selects row i of the output panel and jumps to its location
+// if it has one.
+func (a *app) showOutputLine(i int) {
+	a.output.selectRow(i)
+	a.output.follow = false
+	if line := a.output.lines[i]; line.link {
+		a.jumpTo(codeLocation{path: line.path, pos: line.pos})
+	}
+	a.frames.invalidateAll()
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeGoCommand replaces startGoCommand in the tests. The test writes the
+// command's output and ends it with exit.
+type fakeGoCommand struct {
+	started []task
+	output  io.Writer
+	done    chan error
+	killed  bool
+	// err, if not nil, is returned instead of starting the command
+	err error
+}
+
+func newFakeGoCommand() *fakeGoCommand {
+	return &fakeGoCommand{done: make(chan error, 1)}
+}
+
+func (f *fakeGoCommand) start(t task, output io.Writer) (wait func() error, kill func(), err error) {
+	if f.err != nil {
+		return nil, nil, f.err
+	}
+	f.started = append(f.started, t)
+	f.output = output
+	wait = func() error { return <-f.done }
+	kill = func() {
+		f.killed = true
+		f.exit(errors.New("signal: killed"))
+	}
+	return wait, kill, nil
+}
+
+func (f *fakeGoCommand) write(text string) {
+	f.output.Write([]byte(text))
+}
+
+// exit ends the command with the result err.
+func (f *fakeGoCommand) exit(err error) {
+	f.done <- err
+}
+
+// pollToEnd polls the runner until its task is finished and returns the
+// output since the last poll and the result.
+func pollToEnd(t *testing.T, r *taskRunner) (string, error) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	var output []byte
+	for {
+		o, finished, err := r.poll()
+		output = append(output, o...)
+		if finished {
+			return string(output), err
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTaskRunner(t *testing.T) {
+	cmd := newFakeGoCommand()
+	r := newTaskRunner(cmd.start)
+	if o, finished, err := r.poll(); o != nil || finished || err != nil {
+		t.Errorf("polling without a task gives %q %v %v", o, finished, err)
+	}
+
+	cmd.err = errors.New("go build .: go not found")
+	if err := r.run(task{title: "go build ."}); err != cmd.err || r.running {
+		t.Errorf("a command that does not start gives %v, running: %v", err, r.running)
+	}
+	cmd.err = nil
+
+	build := task{title: "go build .", dir: "dir", args: []string{"build", "."}}
+	if err := r.run(build); err != nil {
+		t.Fatal(err)
+	}
+	if len(cmd.started) != 1 || cmd.started[0].title != build.title {
+		t.Fatalf("the started tasks are %v", cmd.started)
+	}
+	if err := r.run(task{title: "go vet ."}); err == nil || !strings.Contains(err.Error(), "still running") {
+		t.Errorf("a second task gives %v", err)
+	}
+
+	// the output arrives in pieces until the command exits
+	cmd.write("a\nb")
+	if o, finished, _ := r.poll(); string(o) != "a\nb" || finished {
+		t.Errorf("the first poll gives %q, finished: %v", o, finished)
+	}
+	if o, _, _ := r.poll(); len(o) != 0 {
+		t.Errorf("the output %q came twice", o)
+	}
+	cmd.write("c\n")
+	cmd.exit(errors.New("exit status 1"))
+	o, err := pollToEnd(t, r)
+	if o != "c\n" || err == nil || err.Error() != "exit status 1" {
+		t.Errorf("the end of the task gives %q %v", o, err)
+	}
+	if r.running || r.cancelled {
+		t.Errorf("after the task, running: %v, cancelled: %v", r.running, r.cancelled)
+	}
+
+	// a cancelled task is killed and reports that once it is gone
+	if err := r.run(build); err != nil {
+		t.Fatal(err)
+	}
+	r.cancel()
+	r.cancel()
+	if _, err := pollToEnd(t, r); !cmd.killed || !r.cancelled || err == nil {
+		t.Errorf("after the cancel, killed: %v, cancelled: %v, err: %v", cmd.killed, r.cancelled, err)
+	}
+	// the next task is not cancelled
+	cmd.killed = false
+	r.run(build)
+	cmd.exit(nil)
+	if _, err := pollToEnd(t, r); err != nil || r.cancelled {
+		t.Errorf("the next task gives %v, cancelled: %v", err, r.cancelled)
+	}
+	// cancelling without a task does nothing
+	r.cancel()
+	if cmd.killed {
+		t.Error("cancel killed a finished task")
+	}
+}
+
+func TestOutputPanel(t *testing.T) {
+	dir := filepath.FromSlash("/mod/pkg")
+	abs := filepath.Join(filepath.FromSlash("/abs"), "b.go")
+	p := newOutputPanel()
+	p.start(task{title: "go vet .", dir: dir})
+	if p.title != "go vet . - running" {
+		t.Errorf("the title is %q", p.title)
+	}
+
+	// lines are added once they are complete
+	p.write([]byte("# pkg\n./a.go:3:5: x declared and not used\n" + abs + ":10: ba"))
+	p.write([]byte("d\r\n\tmore"))
+	if len(p.lines) != 3 || p.partial != "\tmore" {
+		t.Fatalf("the lines are %v with the rest %q", p.lines, p.partial)
+	}
+	p.finish("exit status 1")
+	if p.title != "go vet . - exit status 1" {
+		t.Errorf("the finished title is %q", p.title)
+	}
+	want := []outputLine{
+		{text: "# pkg"},
+		{text: "./a.go:3:5: x declared and not used", link: true,
+			path: filepath.Join(dir, "a.go"), pos: textPosition{line: 2, column: 4}},
+		{text: abs + ":10: bad", link: true, path: abs, pos: textPosition{line: 9}},
+		{text: "    more"},
+	}
+	if len(p.lines) != len(want) {
+		t.Fatalf("the lines are %v, want %v", p.lines, want)
+	}
+	for i := range want {
+		if p.lines[i] != want[i] {
+			t.Errorf("line %d is %+v, want %+v", i, p.lines[i], want[i])
+		}
+	}
+
+	// test output names files relative to its package
+	p.writeIn(filepath.Join(dir, "sub"), "    sub_test.go:7: failed\n")
+	if l := p.lines[4]; !l.link || l.path != filepath.Join(dir, "sub", "sub_test.go") {
+		t.Errorf("the test output is %+v", l)
+	}
+}
+
+func TestOutputPanelFollowsTheOutput(t *testing.T) {
+	p := newOutputPanel()
+	p.start(task{title: "go test ."})
+	for i := 0; i < 20; i++ {
+		p.write([]byte("line\n"))
+	}
+	if p.top != len(p.lines)-listPanelRows || !p.follow {
+		t.Fatalf("the top row is %d of %d", p.top, len(p.lines))
+	}
+	// scrolling up stops following, scrolling to the end follows again
+	p.scroll(-3)
+	p.write([]byte("line\n"))
+	if p.follow || p.top != len(p.lines)-1-listPanelRows-3 {
+		t.Errorf("after scrolling up the top row is %d of %d", p.top, len(p.lines))
+	}
+	p.scroll(100)
+	p.write([]byte("line\n"))
+	if !p.follow || p.top != len(p.lines)-listPanelRows {
+		t.Errorf("after scrolling down the top row is %d of %d", p.top, len(p.lines))
+	}
+}
+
+func TestOutputPanelDropsOldLines(t *testing.T) {
+	p := newOutputPanel()
+	p.start(task{title: "go run ."})
+	p.write([]byte(strings.Repeat("old\n", maxOutputLines-1) + "last\n"))
+	p.selectRow(maxOutputLines - 1)
+	p.write([]byte("new 1\nnew 2\n"))
+	if len(p.lines) != maxOutputLines || p.rows != maxOutputLines {
+		t.Errorf("the panel has %d lines in %d rows", len(p.lines), p.rows)
+	}
+	if p.lines[len(p.lines)-1].text != "new 2" {
+		t.Errorf("the last line is %q", p.lines[len(p.lines)-1].text)
+	}
+	// the selection stays on its line
+	if p.selected != maxOutputLines-3 || p.lines[p.selected].text != "last" {
+		t.Errorf("the selected row is %d", p.selected)
+	}
+
+	// the selected line is dropped
+	p.selectRow(0)
+	p.write([]byte("new 3\n"))
+	if p.selected != -1 {
+		t.Errorf("the dropped line is still selected as row %d", p.selected)
+	}
+}
+
+func TestHeadlessTasks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tasks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTree(t, dir, map[string]string{
+		"go.mod":      "module example.com/tasks\n",
+		"cmd/main.go": "package main\n\nfunc main() {\n\tvar x int\n}\n",
+	})
+	path := filepath.Join(dir, "cmd", "main.go")
+
+	s := newScenario(t)
+	d := s.driver
+	cmd := newFakeGoCommand()
+	d.app.tasks = newTaskRunner(cmd.start)
+	s.openFile(path)
+	finish := func(err error) {
+		t.Helper()
+		cmd.exit(err)
+		waitUntil(t, d, func() bool { return !d.app.tasks.running })
+	}
+
+	// unsaved changes are saved before the build
+	d.typeText("\n")
+	d.keys("Ctrl+Shift+B")
+	if got := s.fileContent(path); !strings.HasPrefix(got, "\n") {
+		t.Errorf("the file was not saved before the build: %q", got)
+	}
+	if len(cmd.started) != 1 || cmd.started[0].dir != filepath.Dir(path) ||
+		strings.Join(cmd.started[0].args, " ") != "build ." {
+		t.Fatalf("the started tasks are %+v", cmd.started)
+	}
+	o := &d.app.output
+	if !o.visible || o.title != "go build . - running" {
+		t.Errorf("the output panel is visible: %v with the title %q", o.visible, o.title)
+	}
+	d.keys("Ctrl+Shift+V")
+	if n := len(d.platform.errors); n != 1 || !strings.Contains(d.platform.errors[0], "still running") {
+		t.Errorf("a second task gives the errors %v", d.platform.errors)
+	}
+
+	cmd.write("# example.com/tasks/cmd\n./main.go:5:6: x declared and not used\n")
+	finish(errors.New("exit status 1"))
+	if o.title != "go build . - exit status 1" || len(o.lines) != 2 || !o.lines[1].link {
+		t.Fatalf("the output is %q with the lines %v", o.title, o.lines)
+	}
+	// F4 jumps to the link
+	d.keys("Ctrl+Home F4")
+	if l, c := d.editor().doc.offsetToLineCol(d.editor().primaryCursor().caret); l != 4 || c != 5 {
+		t.Errorf("F4 jumps to line %d, column %d", l, c)
+	}
+
+	// module-wide tasks run in the module's root
+	d.keys("Ctrl+K Ctrl+B")
+	if len(cmd.started) != 2 || cmd.started[1].dir != dir || cmd.started[1].args[1] != "./..." {
+		t.Fatalf("the started tasks are %+v", cmd.started)
+	}
+	d.keys("Ctrl+Alt+C")
+	waitUntil(t, d, func() bool { return !d.app.tasks.running })
+	if !cmd.killed || o.title != "go build ./... - cancelled" {
+		t.Errorf("after the cancel the title is %q", o.title)
+	}
+
+	d.keys("Ctrl+Shift+U")
+	if o.visible {
+		t.Error("the output panel is still visible")
+	}
+}
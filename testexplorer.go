@@ -0,0 +1,573 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// testState is the result of a test or package in the test explorer.
+type testState int
+
+const (
+	testNotRun testState = iota
+	testRunning
+	testPassed
+	testFailed
+	testSkipped
+)
+
+func (s testState) color() uint32 {
+	switch s {
+	case testRunning:
+		return 0xFF0366D6
+	case testPassed:
+		return 0xFF2DA44E
+	case testFailed:
+		return 0xFFCF222E
+	case testSkipped:
+		return 0xFFBF8700
+	}
+	return 0xFFAAAAAA
+}
+
+func (s testState) String() string {
+	switch s {
+	case testRunning:
+		return "RUN"
+	case testPassed:
+		return "PASS"
+	case testFailed:
+		return "FAIL"
+	case testSkipped:
+		return "SKIP"
+	}
+	return ""
+}
+
+// testEvent is a line of the output of go test -json.
+type testEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+// testNode is a package, test or subtest in the test explorer.
+type testNode struct {
+	// name is the import path of a package or the full name of a test, like
+	// TestParse/empty_input for a subtest. label is the last part of it.
+	name  string
+	label string
+	// dir is the package's directory, test output names files relative to it
+	dir      string
+	state    testState
+	elapsed  float64
+	output   []string
+	depth    int
+	children []*testNode
+	// tests are all tests of a package by their full names
+	tests map[string]*testNode
+}
+
+// failure returns the first location in a _test.go file that the output of
+// the failed node or one of its failed children names.
+func (n *testNode) failure() (codeLocation, bool) {
+	for _, line := range n.output {
+		path, l, column, _, ok := parseErrorLine(line)
+		if ok && strings.HasSuffix(path, "_test.go") {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(n.dir, path)
+			}
+			pos := textPosition{line: l - 1, column: max(0, column-1)}
+			return codeLocation{path: path, pos: pos}, true
+		}
+	}
+	for _, child := range n.children {
+		if child.state == testFailed {
+			if loc, ok := child.failure(); ok {
+				return loc, true
+			}
+		}
+	}
+	return codeLocation{}, false
+}
+
+// log returns the output of the node and its children.
+func (n *testNode) log() string {
+	text := strings.Join(n.output, "")
+	for _, child := range n.children {
+		text += child.log()
+	}
+	return text
+}
+
+// testExplorer lists the results of go test -json as a tree of packages, tests
+// and subtests. It keeps the results of earlier runs for the tests that did
+// not run again.
+type testExplorer struct {
+	listPanel
+	packages []*testNode
+	// rows are the visible nodes, the tree in depth-first order
+	rows []*testNode
+	// dir is where the last run was started, root and module locate the
+	// packages of its module
+	dir, root, module string
+	// partial is the last line of the output while it is incomplete
+	partial string
+}
+
+func newTestExplorer() testExplorer {
+	return testExplorer{listPanel: listPanel{title: "Tests", selected: -1}}
+}
+
+// clear removes all results.
+func (e *testExplorer) clear() {
+	e.packages = nil
+	e.selected = -1
+	e.top = 0
+	e.updateRows()
+}
+
+// start prepares for the output of go test -json run in dir.
+func (e *testExplorer) start(dir string) {
+	e.dir = dir
+	e.root, e.module = "", ""
+	if root, module, ok := findModule(dir); ok {
+		e.root, e.module = root, module
+	}
+	e.partial = ""
+}
+
+// write adds output of go test -json, it may end in the middle of a line.
+// The text of the tests and other lines of output are passed to output with
+// the directory that the paths in them are relative to.
+func (e *testExplorer) write(data []byte, output func(dir, text string)) {
+	lines := strings.Split(e.partial+string(data), "\n")
+	e.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		var ev testEvent
+		if strings.HasPrefix(line, "{") && json.Unmarshal([]byte(line), &ev) == nil {
+			e.event(ev, output)
+		} else {
+			// e.g. build errors of older go versions
+			output(e.dir, line+"\n")
+		}
+	}
+	e.updateRows()
+}
+
+func (e *testExplorer) event(ev testEvent, output func(dir, text string)) {
+	if ev.Package == "" {
+		if ev.Output != "" {
+			output(e.dir, ev.Output)
+		}
+		return
+	}
+	pkg := e.pkg(ev.Package)
+	node := pkg
+	if ev.Test != "" {
+		node = e.test(pkg, ev.Test)
+	}
+	switch ev.Action {
+	case "start":
+		pkg.state = testRunning
+		pkg.output = nil
+	case "run":
+		node.state = testRunning
+		node.elapsed = 0
+		node.output = nil
+	case "pass":
+		node.state = testPassed
+		node.elapsed = ev.Elapsed
+	case "fail":
+		node.state = testFailed
+		node.elapsed = ev.Elapsed
+	case "skip":
+		node.state = testSkipped
+		node.elapsed = ev.Elapsed
+	case "output":
+		node.output = append(node.output, ev.Output)
+		output(pkg.dir, ev.Output)
+	case "build-output":
+		// the go command names the files relative to where it runs
+		pkg.output = append(pkg.output, ev.Output)
+		output(e.dir, ev.Output)
+	case "build-fail":
+		pkg.state = testFailed
+	}
+}
+
+// pkg returns the node of the package with the import path, it is added if
+// it is new.
+func (e *testExplorer) pkg(path string) *testNode {
+	for _, p := range e.packages {
+		if p.name == path {
+			return p
+		}
+	}
+	dir := e.dir
+	if e.module != "" && (path == e.module || strings.HasPrefix(path, e.module+"/")) {
+		dir = filepath.Join(e.root, filepath.FromSlash(strings.TrimPrefix(path, e.module)))
+	}
+	p := &testNode{
+		name:  path,
+		label: path,
+		dir:   dir,
+		state: testRunning,
+		tests: make(map[string]*testNode),
+	}
+	e.packages = append(e.packages, p)
+	return p
+}
+
+// test returns the node of the test with the full name in pkg, it is added
+// below its parent test if it is new.
+func (e *testExplorer) test(pkg *testNode, name string) *testNode {
+	if t, ok := pkg.tests[name]; ok {
+		return t
+	}
+	parent := pkg
+	label := name
+	if slash := strings.LastIndex(name, "/"); slash != -1 {
+		parent = e.test(pkg, name[:slash])
+		label = name[slash+1:]
+	}
+	t := &testNode{name: name, label: label, dir: pkg.dir, depth: parent.depth + 1}
+	parent.children = append(parent.children, t)
+	pkg.tests[name] = t
+	return t
+}
+
+// finish ends the run, the rest of the output goes to output like in write.
+// Tests that are still running when go test is done did not finish, they
+// failed with the run or did not run at all if it was cancelled.
+func (e *testExplorer) finish(failed bool, output func(dir, text string)) {
+	if e.partial != "" {
+		e.write([]byte("\n"), output)
+	}
+	state := testNotRun
+	if failed {
+		state = testFailed
+	}
+	for _, p := range e.packages {
+		if p.state == testRunning {
+			p.state = state
+		}
+		for _, t := range p.tests {
+			if t.state == testRunning {
+				t.state = state
+			}
+		}
+	}
+	e.updateRows()
+}
+
+// failed returns the top-level tests that failed and the packages that
+// failed.
+func (e *testExplorer) failed() (tests, packages []string) {
+	seen := make(map[string]bool)
+	for _, p := range e.packages {
+		if p.state != testFailed {
+			continue
+		}
+		packages = append(packages, p.name)
+		for _, t := range p.children {
+			if t.state == testFailed && !seen[t.name] {
+				seen[t.name] = true
+				tests = append(tests, t.name)
+			}
+		}
+	}
+	return tests, packages
+}
+
+// state returns the last result of the test with the full name in the
+// package in dir.
+func (e *testExplorer) state(dir, name string) testState {
+	for _, p := range e.packages {
+		if p.dir == dir {
+			if t, ok := p.tests[name]; ok {
+				return t.state
+			}
+		}
+	}
+	return testNotRun
+}
+
+func (e *testExplorer) updateRows() {
+	e.rows = e.rows[:0]
+	var add func(nodes []*testNode)
+	add = func(nodes []*testNode) {
+		for _, n := range nodes {
+			e.rows = append(e.rows, n)
+			add(n.children)
+		}
+	}
+	add(e.packages)
+	e.setRows(len(e.rows))
+}
+
+func (e *testExplorer) draw(g graphics, area rectangle) {
+	lineHeight := g.lineHeight()
+	e.listPanel.draw(g, area, func(i int, row rectangle) {
+		n := e.rows[i]
+		marker := rect(
+			row.x+4+n.depth*gutterMarkerSize*2,
+			row.y+(lineHeight-gutterMarkerSize)/2,
+			gutterMarkerSize,
+			gutterMarkerSize,
+		)
+		fillRect(g, marker.intersect(row), n.state.color())
+		text := n.label
+		if n.state != testNotRun && n.state != testRunning {
+			text += "  " + n.state.String() + " " +
+				strconv.FormatFloat(n.elapsed, 'f', 2, 64) + "s"
+		}
+		x := marker.x + marker.w + 6
+		g.text([]byte(text), x, row.y, row, editorTextColor)
+	})
+}
+
+// testMarker is a test function or subtest in the editor's gutter, a click
+// on it runs the test.
+type testMarker struct {
+	line  int
+	name  string
+	state testState
+}
+
+var (
+	testFuncPattern = regexp.MustCompile(`^func (Test\w*)\(\w+ \*testing\.T\)`)
+	subtestPattern  = regexp.MustCompile("^\\w+\\.Run\\((\"(?:[^\"\\\\]|\\\\.)*\"|`[^`]*`),")
+)
+
+// maxTestLineLength is the part of a line that is searched for a test.
+const maxTestLineLength = 200
+
+// findTestMarkers finds the test functions and their subtests, started with
+// t.Run and a literal name, in the lines first to last. The lines above are
+// read back to the start of the function so that subtests get their full
+// names. Subtests belong to the closest t.Run that is indented less and not
+// closed yet.
+func findTestMarkers(doc *document, first, last int) []testMarker {
+	lineText := func(line int) string {
+		start := doc.lineStart(line)
+		end := min(doc.lineEnd(line), start+maxTestLineLength)
+		return strings.TrimRight(string(doc.slice(start, end)), "\r")
+	}
+	start := first
+	for start > 0 && !strings.HasPrefix(lineText(start), "func ") {
+		start--
+	}
+	type openRun struct {
+		indent int
+		name   string
+	}
+	var markers []testMarker
+	var test string
+	var runs []openRun
+	for line := start; line <= last && line < doc.lineCount(); line++ {
+		text := lineText(line)
+		if strings.HasPrefix(text, "func ") {
+			test, runs = "", nil
+			if m := testFuncPattern.FindStringSubmatch(text); m != nil && isTestName(m[1]) {
+				test = m[1]
+				if line >= first {
+					markers = append(markers, testMarker{line: line, name: test})
+				}
+			}
+			continue
+		}
+		if test == "" {
+			continue
+		}
+		trimmed := strings.TrimLeft(text, " \t")
+		indent := len(text) - len(trimmed)
+		m := subtestPattern.FindStringSubmatch(trimmed)
+		if strings.HasPrefix(trimmed, "}") || m != nil {
+			for len(runs) > 0 && runs[len(runs)-1].indent >= indent {
+				runs = runs[:len(runs)-1]
+			}
+		}
+		if m == nil {
+			continue
+		}
+		sub, err := strconv.Unquote(m[1])
+		if err != nil {
+			continue
+		}
+		parent := test
+		if len(runs) > 0 {
+			parent = runs[len(runs)-1].name
+		}
+		// go test names subtests with underscores for spaces
+		name := parent + "/" + strings.Replace(sub, " ", "_", -1)
+		runs = append(runs, openRun{indent: indent, name: name})
+		if line >= first {
+			markers = append(markers, testMarker{line: line, name: name})
+		}
+	}
+	return markers
+}
+
+// isTestName tells if go test runs the function as a test, the name must not
+// continue with a lower case letter after Test.
+func isTestName(name string) bool {
+	rest := strings.TrimPrefix(name, "Test")
+	return rest == "" || !('a' <= rest[0] && rest[0] <= 'z')
+}
+
+// testRunPattern is the -run flag of go test that runs only the test with the
+// full name and its subtests.
+func testRunPattern(name string) string {
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		parts[i] = "^" + regexp.QuoteMeta(parts[i]) + "$"
+	}
+	return strings.Join(parts, "/")
+}
+
+// drawTestMarkers draws a triangle in the gutter next to the tests in the
+// visible lines, in the color of their last result.
+func (e *editor) drawTestMarkers(g graphics, lastLine int) {
+	lineHeight := g.lineHeight()
+	const size = gutterMarkerSize + 1
+	for _, m := range e.testMarkers(e.doc, e.topLine, lastLine) {
+		x := e.gutter.x + (e.gutter.w-size)/2
+		y := e.area.y + (m.line-e.topLine)*lineHeight + (lineHeight-size)/2
+		for i := 0; i < size; i++ {
+			// the rows get wider up to the middle
+			w := 2*min(i, size-1-i) + 1
+			fillRect(g, rect(x, y+i, w, 1).intersect(e.gutter), m.state.color())
+		}
+	}
+}
+
+// testMarkerAt returns the test marker in the gutter at screen position y.
+func (e *editor) testMarkerAt(g graphics, y int) (testMarker, bool) {
+	if e.testMarkers == nil {
+		return testMarker{}, false
+	}
+	line := e.topLine + (y-e.gutter.y)/g.lineHeight()
+	for _, m := range e.testMarkers(e.doc, line, line) {
+		if m.line == line {
+			return m, true
+		}
+	}
+	return testMarker{}, false
+}
+
+// registerTestCommands registers the commands of the test explorer.
+func registerTestCommands(r *commandRegistry, a *app) {
+	r.register("test.runAtCaret", func(*editor) {
+		if m, ok := a.testAtCaret(); ok {
+			a.runTest(m.name)
+		} else {
+			a.platform.showError("Run Test", "the caret is not in a test")
+		}
+	})
+	r.register("test.rerunFailed", func(*editor) {
+		a.rerunFailedTests()
+	})
+	r.register("view.toggleTests", func(*editor) {
+		a.explorer.visible = !a.explorer.visible
+		a.frames.invalidateAll()
+	})
+}
+
+// testMarkers returns the tests in the lines of the app's test file, with
+// their last results.
+func (a *app) testMarkers(doc *document, first, last int) []testMarker {
+	markers := findTestMarkers(doc, first, last)
+	dir := filepath.Dir(diagnosticPath(a.path))
+	for i := range markers {
+		markers[i].state = a.explorer.state(dir, markers[i].name)
+	}
+	return markers
+}
+
+// testAtCaret returns the closest test or subtest that starts at or above the
+// caret in the same function.
+func (a *app) testAtCaret() (testMarker, bool) {
+	e := a.editor
+	if e == nil || e.testMarkers == nil {
+		return testMarker{}, false
+	}
+	line := e.doc.lineOf(e.primaryCursor().caret)
+	markers := a.testMarkers(e.doc, line, line)
+	if len(markers) > 0 {
+		return markers[0], true
+	}
+	for above := line - 1; above >= 0; above-- {
+		if markers := a.testMarkers(e.doc, above, above); len(markers) > 0 {
+			return markers[0], true
+		}
+		start := e.doc.lineStart(above)
+		if string(e.doc.slice(start, min(start+5, e.doc.lineEnd(above)))) == "func " {
+			break
+		}
+	}
+	return testMarker{}, false
+}
+
+// runTest runs the test or subtest with the full name in the package of the
+// app's file.
+func (a *app) runTest(name string) {
+	args := []string{"test", "-json", "-run", testRunPattern(name), "."}
+	title := "go test -run " + testRunPattern(name)
+	dir, ok := a.taskDir(title, false)
+	if !ok {
+		return
+	}
+	a.startTask(task{title: title, dir: dir, args: args, tests: true})
+}
+
+// rerunFailedTests runs the tests that failed in the last runs again, in the
+// packages that they failed in. Packages that failed without a failed test,
+// e.g. because they do not build, are tested completely.
+func (a *app) rerunFailedTests() {
+	tests, packages := a.explorer.failed()
+	if len(packages) == 0 {
+		a.platform.showError("Rerun Failed Tests", "no tests failed")
+		return
+	}
+	args := []string{"test", "-json"}
+	title := "go test"
+	if len(tests) > 0 {
+		quoted := make([]string, len(tests))
+		for i, t := range tests {
+			quoted[i] = regexp.QuoteMeta(t)
+		}
+		pattern := "^(" + strings.Join(quoted, "|") + ")$"
+		args = append(args, "-run", pattern)
+		title += " -run " + pattern
+	}
+	args = append(args, packages...)
+	title += " " + strings.Join(packages, " ")
+	if !a.prepareTask(title) {
+		return
+	}
+	a.startTask(task{title: title, dir: a.explorer.dir, args: args, tests: true})
+}
+
+// showTest selects row i of the test explorer and shows the output of its
+// test. For a failed test, it jumps to the failure. While a task is running,
+// the output panel keeps showing its output.
+func (a *app) showTest(i int) {
+	a.explorer.selectRow(i)
+	n := a.explorer.rows[i]
+	if !a.tasks.running {
+		a.output.show(task{title: n.name, dir: n.dir}, n.log())
+		a.output.visible = true
+	}
+	if n.state == testFailed {
+		if loc, ok := n.failure(); ok {
+			a.jumpTo(loc)
+		}
+	}
+	a.frames.invalidateAll()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// recordedTestEvents is the output of go test -json for a package with a
+// passed test, a failed test with a passed and a failed subtest, and a
+// skipped test.
+func recordedTestEvents(t *testing.T) string {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "test_events.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// testRows describes the rows of the test explorer, indented by depth.
+func testRows(e *testExplorer) string {
+	var rows []string
+	for _, n := range e.rows {
+		rows = append(rows, strings.Repeat(" ", n.depth)+n.label+" "+n.state.String())
+	}
+	return strings.Join(rows, "\n")
+}
+
+func TestTestExplorer(t *testing.T) {
+	dir := filepath.FromSlash("/nomodule/rec")
+	events := recordedTestEvents(t)
+	// older go versions print build errors without JSON
+	events = "# example.com/rec\n" + events
+
+	e := newTestExplorer()
+	e.start(dir)
+	var output []string
+	collect := func(dir, text string) { output = append(output, dir+"|"+text) }
+	// the output comes in arbitrary pieces, they end in the middle of lines
+	for len(events) > 0 {
+		n := min(37, len(events))
+		e.write([]byte(events[:n]), collect)
+		events = events[n:]
+	}
+	e.finish(true, collect)
+
+	want := `example.com/rec FAIL
+ TestOK PASS
+ TestBad FAIL
+  fine PASS
+  bad_one FAIL
+ TestSkipped SKIP`
+	if got := testRows(&e); got != want {
+		t.Fatalf("the rows are\n%s\nwant\n%s", got, want)
+	}
+	wantOutput := []string{
+		"# example.com/rec\n",
+		"=== RUN   TestOK\n",
+		"--- PASS: TestOK (0.00s)\n",
+		"=== RUN   TestBad\n",
+		"=== RUN   TestBad/fine\n",
+		"--- PASS: TestBad/fine (0.00s)\n",
+		"=== RUN   TestBad/bad_one\n",
+		"    a_test.go:10: broken\n",
+		"--- FAIL: TestBad/bad_one (0.00s)\n",
+		"--- FAIL: TestBad (0.00s)\n",
+		"=== RUN   TestSkipped\n",
+		"    a_test.go:15: later\n",
+		"--- SKIP: TestSkipped (0.00s)\n",
+		"FAIL\n",
+		"FAIL\texample.com/rec\t0.004s\n",
+	}
+	for i := range wantOutput {
+		wantOutput[i] = dir + "|" + wantOutput[i]
+	}
+	if strings.Join(output, "") != strings.Join(wantOutput, "") {
+		t.Errorf("the output is %q, want %q", output, wantOutput)
+	}
+
+	// the failed test leads to the line of its failed subtest
+	for _, i := range []int{2, 4} {
+		loc, ok := e.rows[i].failure()
+		if !ok || loc.path != filepath.Join(dir, "a_test.go") || loc.pos != (textPosition{line: 9}) {
+			t.Errorf("the failure of %s is at %+v", e.rows[i].name, loc)
+		}
+	}
+	if _, ok := e.rows[1].failure(); ok {
+		t.Error("the passed test has a failure")
+	}
+
+	tests, packages := e.failed()
+	if strings.Join(tests, ",") != "TestBad" || strings.Join(packages, ",") != "example.com/rec" {
+		t.Errorf("the failed tests are %v in %v", tests, packages)
+	}
+	states := []struct {
+		dir, name string
+		want      testState
+	}{
+		{dir, "TestOK", testPassed},
+		{dir, "TestBad/bad_one", testFailed},
+		{dir, "TestSkipped", testSkipped},
+		{dir, "TestMissing", testNotRun},
+		{filepath.FromSlash("/other"), "TestOK", testNotRun},
+	}
+	for _, s := range states {
+		if got := e.state(s.dir, s.name); got != s.want {
+			t.Errorf("%s in %s is %v, want %v", s.name, s.dir, got, s.want)
+		}
+	}
+
+	// running one test again keeps the results of the others
+	e.start(dir)
+	e.write([]byte(`{"Action":"run","Package":"example.com/rec","Test":"TestBad/bad_one"}
+{"Action":"pass","Package":"example.com/rec","Test":"TestBad/bad_one","Elapsed":0.1}
+{"Action":"pass","Package":"example.com/rec","Elapsed":0.2}`), collect)
+	e.finish(false, collect)
+	want = `example.com/rec PASS
+ TestOK PASS
+ TestBad FAIL
+  fine PASS
+  bad_one PASS
+ TestSkipped SKIP`
+	if got := testRows(&e); got != want {
+		t.Fatalf("after the second run the rows are\n%s\nwant\n%s", got, want)
+	}
+	if len(e.rows[4].output) != 0 {
+		t.Errorf("the rerun test kept the output %q", e.rows[4].output)
+	}
+}
+
+func TestTestExplorerUnfinishedTests(t *testing.T) {
+	start := `{"Action":"start","Package":"p"}
+{"Action":"run","Package":"p","Test":"TestHangs"}
+`
+	tests := []struct {
+		failed bool
+		want   testState
+	}{
+		// go test failed, e.g. with a panic or a timeout
+		{true, testFailed},
+		// the run was cancelled
+		{false, testNotRun},
+	}
+	for _, tt := range tests {
+		e := newTestExplorer()
+		e.start(filepath.FromSlash("/nomodule/p"))
+		e.write([]byte(start), func(dir, text string) {})
+		e.finish(tt.failed, func(dir, text string) {})
+		if e.rows[0].state != tt.want || e.rows[1].state != tt.want {
+			t.Errorf("after a run that failed: %v the rows are\n%s", tt.failed, testRows(&e))
+		}
+	}
+}
+
+func TestFindTestMarkers(t *testing.T) {
+	src := `package p
+
+func TestA(t *testing.T) {
+	t.Run("one two", func(t *testing.T) {
+		t.Run("inner", func(t *testing.T) {})
+		if true {
+		}
+		t.Run("second", nil)
+	})
+	t.Run(` + "`raw`" + `, func(t *testing.T) {
+	})
+}
+
+func Testing(t *testing.T) {
+	t.Run("not a test", nil)
+}
+
+func helper(t *testing.T) {
+	t.Run("no", nil)
+}
+
+func Test(t *testing.T) {}
+`
+	doc := newDocument([]byte(src))
+	tests := []struct {
+		first, last int
+		want        []testMarker
+	}{
+		{0, doc.lineCount() - 1, []testMarker{
+			{line: 2, name: "TestA"},
+			{line: 3, name: "TestA/one_two"},
+			{line: 4, name: "TestA/one_two/inner"},
+			{line: 7, name: "TestA/one_two/second"},
+			{line: 9, name: "TestA/raw"},
+			{line: 21, name: "Test"},
+		}},
+		// the lines above the range give the full names
+		{7, 9, []testMarker{
+			{line: 7, name: "TestA/one_two/second"},
+			{line: 9, name: "TestA/raw"},
+		}},
+		{5, 6, nil},
+		{13, 19, nil},
+	}
+	for _, tt := range tests {
+		got := findTestMarkers(doc, tt.first, tt.last)
+		if len(got) != len(tt.want) {
+			t.Errorf("lines %d to %d have the markers %v, want %v", tt.first, tt.last, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("lines %d to %d have the markers %v, want %v", tt.first, tt.last, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestTestRunPattern(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"TestA", "^TestA$"},
+		{"TestA/a.b", `^TestA$/^a\.b$`},
+		{"TestA/one_two/x(1)", `^TestA$/^one_two$/^x\(1\)$`},
+	}
+	for _, tt := range tests {
+		if got := testRunPattern(tt.name); got != tt.want {
+			t.Errorf("the pattern for %s is %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
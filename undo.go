@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// replacement replaces count bytes at offset with text. It is how changes are
+// passed to the history.
+type replacement struct {
+	offset, count int
+	text          []byte
+}
+
+// edit is a replacement as it is recorded in the history, it also stores the
+// deleted text so the replacement can be reverted.
+type edit struct {
+	offset   int
+	deleted  []byte
+	inserted []byte
+}
+
+func (e edit) apply(doc *document) {
+	doc.delete(e.offset, len(e.deleted))
+	doc.insert(e.offset, e.inserted)
+}
+
+func (e edit) revert(doc *document) {
+	doc.delete(e.offset, len(e.inserted))
+	doc.insert(e.offset, e.deleted)
+}
+
+// editKind decides which consecutive edits are combined into one undo step.
+type editKind int
+
+const (
+	// otherEdit is never grouped with any other edit
+	otherEdit editKind = iota
+	// typingEdit is inserting characters from the keyboard
+	typingEdit
+	// deletingEdit is removing characters with backspace or delete
+	deletingEdit
+)
+
+// undoGroupTimeout is the pause in typing after which a new undo step starts.
+const undoGroupTimeout = time.Second
+
+// undoStep is what is reverted by one undo. It is a list of edits that are
+// applied in order and the selections before and after the step.
+type undoStep struct {
+	kind          editKind
+	edits         []edit
+	before, after []selection
+	lastChange    time.Time
+}
+
+// history is a linear undo/redo history for a document. All changes to the
+// document must go through the history, otherwise the recorded offsets do not
+// match the document anymore.
+type history struct {
+	doc   *document
+	steps []undoStep
+	// current is the number of steps in steps that are applied, all steps
+	// after it can be re-done
+	current int
+	// saved is the value of current when the document was last saved or -1
+	// if that state of the document is not in the history anymore
+	saved int
+	// closed is true if the next change must start a new undo step
+	closed bool
+}
+
+func newHistory(doc *document) *history {
+	return &history{doc: doc}
+}
+
+// change applies the replacements, in the given order, to the document and
+// records them. Changes of the same kind are combined with the last undo step
+// if they follow it within undoGroupTimeout, the selection was not changed in
+// between and no line break was typed.
+func (h *history) change(
+	kind editKind,
+	changes []replacement,
+	before, after []selection,
+	now time.Time,
+) {
+	edits := make([]edit, len(changes))
+	for i, c := range changes {
+		edits[i] = edit{
+			offset:   c.offset,
+			deleted:  h.doc.slice(c.offset, c.offset+c.count),
+			inserted: append([]byte(nil), c.text...),
+		}
+		edits[i].apply(h.doc)
+	}
+
+	h.discardRedo()
+
+	if h.canGroup(kind, before, now) {
+		last := &h.steps[h.current-1]
+		last.edits = append(last.edits, edits...)
+		last.after = after
+		last.lastChange = now
+	} else {
+		h.steps = append(h.steps, undoStep{
+			kind:       kind,
+			edits:      edits,
+			before:     before,
+			after:      after,
+			lastChange: now,
+		})
+		h.current++
+	}
+	h.closed = kind == typingEdit && insertsLineBreak(edits)
+}
+
+func (h *history) canGroup(kind editKind, before []selection, now time.Time) bool {
+	if h.closed || kind == otherEdit || h.current == 0 {
+		return false
+	}
+	if h.saved == h.current {
+		// keep the saved state reachable with undo
+		return false
+	}
+	last := &h.steps[h.current-1]
+	return last.kind == kind &&
+		now.Sub(last.lastChange) < undoGroupTimeout &&
+		sameSelections(last.after, before)
+}
+
+func insertsLineBreak(edits []edit) bool {
+	for _, e := range edits {
+		for _, b := range e.inserted {
+			if b == '\n' {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sameSelections(a, b []selection) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *history) discardRedo() {
+	if h.saved > h.current {
+		h.saved = -1
+	}
+	h.steps = h.steps[:h.current]
+}
+
+// closeStep makes sure that the next change starts a new undo step. Call it
+// when the cursor is moved or the editor loses focus.
+func (h *history) closeStep() {
+	h.closed = true
+}
+
+func (h *history) canUndo() bool {
+	return h.current > 0
+}
+
+func (h *history) canRedo() bool {
+	return h.current < len(h.steps)
+}
+
+// undo reverts the last step and returns the selections from before it. The
+// returned bool is false if there is nothing to undo.
+func (h *history) undo() ([]selection, bool) {
+	if !h.canUndo() {
+		return nil, false
+	}
+	h.current--
+	step := h.steps[h.current]
+	for i := len(step.edits) - 1; i >= 0; i-- {
+		step.edits[i].revert(h.doc)
+	}
+	h.closed = true
+	return step.before, true
+}
+
+// redo re-applies the next step and returns the selections from after it.
+// The returned bool is false if there is nothing to redo.
+func (h *history) redo() ([]selection, bool) {
+	if !h.canRedo() {
+		return nil, false
+	}
+	step := h.steps[h.current]
+	for _, e := range step.edits {
+		e.apply(h.doc)
+	}
+	h.current++
+	h.closed = true
+	return step.after, true
+}
+
+// markSaved remembers the current state as the one that is on disk.
+func (h *history) markSaved() {
+	h.saved = h.current
+	h.closed = true
+}
+
+// isModified returns true if the document differs from the last saved state.
+func (h *history) isModified() bool {
+	return h.saved != h.current
+}
+
+// historyPath returns the path under which the undo history for the file at
+// path is stored. It is a hidden file right next to the original.
+func historyPath(path string) string {
+	dir, name := filepath.Split(path)
+	return filepath.Join(dir, "."+name+".undo")
+}
+
+// historyFile is the on-disk format of a history. gob needs exported fields
+// which is why it does not use the in-memory types directly.
+type historyFile struct {
+	// Size and Checksum identify the document content that the history was
+	// saved with, at the state Current
+	Size     int
+	Checksum uint32
+	Current  int
+	Saved    int
+	Steps    []historyFileStep
+}
+
+type historyFileStep struct {
+	Kind          int
+	Edits         []historyFileEdit
+	Before, After []historyFileSelection
+}
+
+type historyFileEdit struct {
+	Offset            int
+	Deleted, Inserted []byte
+}
+
+type historyFileSelection struct {
+	Anchor, Caret int
+}
+
+// save writes the history to the given path, usually historyPath of the
+// document file. Call this right after saving the document itself so that
+// the checksum matches the file on disk.
+func (h *history) save(path string) error {
+	checksum, err := documentChecksum(h.doc)
+	if err != nil {
+		return makeErr("save undo history", err)
+	}
+	data := historyFile{
+		Size:     h.doc.len(),
+		Checksum: checksum,
+		Current:  h.current,
+		Saved:    h.saved,
+	}
+	for _, step := range h.steps {
+		s := historyFileStep{
+			Kind:   int(step.kind),
+			Before: toHistoryFileSelections(step.before),
+			After:  toHistoryFileSelections(step.after),
+		}
+		for _, e := range step.edits {
+			s.Edits = append(s.Edits, historyFileEdit{
+				Offset:   e.offset,
+				Deleted:  e.deleted,
+				Inserted: e.inserted,
+			})
+		}
+		data.Steps = append(data.Steps, s)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return makeErr("save undo history", err)
+	}
+	w := bufio.NewWriter(f)
+	err = gob.NewEncoder(w).Encode(&data)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return makeErr("save undo history", err)
+	}
+	return nil
+}
+
+// loadHistory reads a history saved with history.save. It fails if the
+// document content is not the same as when the history was saved, e.g.
+// because the file was changed by another program in the meantime.
+func loadHistory(path string, doc *document) (*history, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, makeErr("load undo history", err)
+	}
+	defer f.Close()
+
+	var data historyFile
+	if err := gob.NewDecoder(bufio.NewReader(f)).Decode(&data); err != nil {
+		return nil, makeErr("load undo history", err)
+	}
+
+	if data.Size != doc.len() {
+		return nil, errors.New("load undo history: document size changed")
+	}
+	checksum, err := documentChecksum(doc)
+	if err != nil {
+		return nil, makeErr("load undo history", err)
+	}
+	if data.Checksum != checksum {
+		return nil, errors.New("load undo history: document content changed")
+	}
+	if data.Current < 0 || data.Current > len(data.Steps) {
+		return nil, errors.New("load undo history: invalid current step")
+	}
+
+	h := newHistory(doc)
+	h.current = data.Current
+	h.saved = data.Saved
+	h.closed = true
+	for _, s := range data.Steps {
+		step := undoStep{
+			kind:   editKind(s.Kind),
+			before: fromHistoryFileSelections(s.Before),
+			after:  fromHistoryFileSelections(s.After),
+		}
+		for _, e := range s.Edits {
+			step.edits = append(step.edits, edit{
+				offset:   e.Offset,
+				deleted:  e.Deleted,
+				inserted: e.Inserted,
+			})
+		}
+		h.steps = append(h.steps, step)
+	}
+	return h, nil
+}
+
+func toHistoryFileSelections(s []selection) []historyFileSelection {
+	result := make([]historyFileSelection, len(s))
+	for i := range s {
+		result[i] = historyFileSelection{Anchor: s[i].anchor, Caret: s[i].caret}
+	}
+	return result
+}
+
+func fromHistoryFileSelections(s []historyFileSelection) []selection {
+	result := make([]selection, len(s))
+	for i := range s {
+		result[i] = selection{anchor: s[i].Anchor, caret: s[i].Caret}
+	}
+	return result
+}
+
+func documentChecksum(doc *document) (uint32, error) {
+	hash := crc32.NewIEEE()
+	err := doc.writeTo(hash)
+	return hash.Sum32(), err
+}
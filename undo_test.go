@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryGroupsTyping(t *testing.T) {
+	d := newDocument([]byte("hello"))
+	h := newHistory(d)
+	now := time.Unix(0, 0)
+	at := func(i int) []selection { return []selection{{i, i}} }
+	h.change(typingEdit, []replacement{{5, 0, []byte(" ")}}, at(5), at(6), now)
+	h.change(typingEdit, []replacement{{6, 0, []byte("w")}}, at(6), at(7), now)
+	// a pause starts a new step
+	h.change(typingEdit, []replacement{{7, 0, []byte("o")}}, at(7), at(8), now.Add(2*undoGroupTimeout))
+	h.change(otherEdit, []replacement{{0, 1, []byte("J")}}, at(8), at(8), now.Add(2*undoGroupTimeout))
+
+	steps := []struct {
+		text  string
+		caret int
+	}{
+		{"hello wo", 8},
+		{"hello w", 7},
+		{"hello", 5},
+	}
+	for _, want := range steps {
+		selections, ok := h.undo()
+		if !ok || string(d.bytes()) != want.text || selections[0].caret != want.caret {
+			t.Fatalf("undo gives %q with the caret at %v, want %q at %d", d.bytes(), selections, want.text, want.caret)
+		}
+	}
+	if _, ok := h.undo(); ok || h.canUndo() {
+		t.Error("undo beyond the first step")
+	}
+	h.redo()
+	if string(d.bytes()) != "hello w" {
+		t.Errorf("redo gives %q", d.bytes())
+	}
+	// a new change drops the steps that could be redone
+	h.change(otherEdit, []replacement{{0, 0, []byte(">")}}, at(0), at(1), now)
+	if h.canRedo() || string(d.bytes()) != ">hello w" {
+		t.Errorf("redo is possible after a change, the text is %q", d.bytes())
+	}
+}
+
+func TestHistorySaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "undo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.undo")
+
+	d := newDocument([]byte("abc"))
+	h := newHistory(d)
+	h.change(otherEdit, []replacement{{3, 0, []byte("d")}}, []selection{{3, 3}}, []selection{{4, 4}}, time.Unix(0, 0))
+	h.change(otherEdit, []replacement{{0, 1, nil}}, []selection{{1, 1}}, []selection{{0, 0}}, time.Unix(0, 0))
+	h.undo()
+	h.markSaved()
+	if err := h.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadHistory(path, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.isModified() {
+		t.Error("the loaded history is modified")
+	}
+	loaded.redo()
+	if string(d.bytes()) != "bcd" {
+		t.Errorf("redo gives %q", d.bytes())
+	}
+	loaded.undo()
+	loaded.undo()
+	if string(d.bytes()) != "abc" {
+		t.Errorf("undo gives %q", d.bytes())
+	}
+	// the history does not fit a different text
+	if _, err := loadHistory(path, newDocument([]byte("xyz"))); err == nil {
+		t.Error("a history was loaded for different content")
+	}
+}
+
+func TestPersistentUndo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "undo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notes.txt")
+	ioutil.WriteFile(path, []byte("first"), 0666)
+
+	d := newHeadlessDriver(newRecordingGraphics(fixedWidthFont{10, 20}), 800, 600, time.Unix(0, 0))
+	open := func() {
+		if err := d.app.openFile(path); err != nil {
+			t.Fatal(err)
+		}
+		for d.app.editor == nil {
+			time.Sleep(time.Millisecond)
+			d.advance(100 * time.Millisecond)
+		}
+	}
+	edit := func() {
+		open()
+		d.keys("Ctrl+End")
+		d.typeText(" second")
+		d.keys("Ctrl+S")
+	}
+
+	edit()
+	if _, err := os.Stat(historyPath(path)); !os.IsNotExist(err) {
+		t.Fatal("the history was saved without the setting")
+	}
+	open()
+	if d.editor().history.canUndo() {
+		t.Fatal("the history was restored without the setting")
+	}
+
+	d.app.settings.PersistentUndo = true
+	edit()
+	open()
+	d.keys("Ctrl+Z")
+	if text := string(d.editor().doc.bytes()); text != "first second" {
+		t.Fatalf("undo after reopening gives %q", text)
+	}
+	if len(d.platform.errors) > 0 {
+		t.Fatal(d.platform.errors)
+	}
+}
@@ -516,3 +516,20 @@ const (
 	FCONTROL  = 0x08
 	FALT      = 0x10
 )
+
+// mouse message key state flags
+const (
+	MK_LBUTTON  = 0x0001
+	MK_RBUTTON  = 0x0002
+	MK_SHIFT    = 0x0004
+	MK_CONTROL  = 0x0008
+	MK_MBUTTON  = 0x0010
+	MK_XBUTTON1 = 0x0020
+	MK_XBUTTON2 = 0x0040
+)
+
+// bitmap compression and color table usage
+const (
+	BI_RGB         = 0
+	DIB_RGB_COLORS = 0
+)
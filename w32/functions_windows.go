@@ -8,6 +8,7 @@ import (
 var (
 	user32   = syscall.NewLazyDLL("user32.dll")
 	kernel32 = syscall.NewLazyDLL("kernel32.dll")
+	gdi32    = syscall.NewLazyDLL("gdi32.dll")
 )
 
 var (
@@ -25,6 +26,8 @@ var (
 	getWindowThreadProcessId = user32.NewProc("GetWindowThreadProcessId")
 	showWindowAsync          = user32.NewProc("ShowWindowAsync")
 	setTimer                 = user32.NewProc("SetTimer")
+	killTimer                = user32.NewProc("KillTimer")
+	destroyWindow            = user32.NewProc("DestroyWindow")
 	getClientRect            = user32.NewProc("GetClientRect")
 	registerRawInputDevices  = user32.NewProc("RegisterRawInputDevices")
 	getKeyState              = user32.NewProc("GetKeyState")
@@ -32,10 +35,18 @@ var (
 	translateAccelerator     = user32.NewProc("TranslateAccelerator")
 	setCapture               = user32.NewProc("SetCapture")
 	releaseCapture           = user32.NewProc("ReleaseCapture")
+	invalidateRect           = user32.NewProc("InvalidateRect")
+	validateRect             = user32.NewProc("ValidateRect")
+	getUpdateRect            = user32.NewProc("GetUpdateRect")
+	postMessage              = user32.NewProc("PostMessageW")
+	getDC                    = user32.NewProc("GetDC")
+	releaseDC                = user32.NewProc("ReleaseDC")
 
 	getModuleHandle     = kernel32.NewProc("GetModuleHandleW")
 	getConsoleWindow    = kernel32.NewProc("GetConsoleWindow")
 	getCurrentProcessId = kernel32.NewProc("GetCurrentProcessId")
+
+	setDIBitsToDevice = gdi32.NewProc("SetDIBitsToDevice")
 )
 
 func MakeIntResource(id uint16) *uint16 {
@@ -175,6 +186,16 @@ func SetTimer(window, idEvent, elapse uintptr) uintptr {
 	return ret
 }
 
+func KillTimer(window, idEvent uintptr) bool {
+	ret, _, _ := killTimer.Call(window, idEvent)
+	return ret != 0
+}
+
+func DestroyWindow(window uintptr) bool {
+	ret, _, _ := destroyWindow.Call(window)
+	return ret != 0
+}
+
 func GetClientRect(window uintptr) (RECT, bool) {
 	var r RECT
 	ret, _, _ := getClientRect.Call(window, uintptr(unsafe.Pointer(&r)))
@@ -228,6 +249,76 @@ func ReleaseCapture() bool {
 	return ret != 0
 }
 
+// InvalidateRect adds r to the update region of the window, a nil r means the
+// whole client area.
+func InvalidateRect(window uintptr, r *RECT, erase bool) bool {
+	var e uintptr
+	if erase {
+		e = 1
+	}
+	ret, _, _ := invalidateRect.Call(window, uintptr(unsafe.Pointer(r)), e)
+	return ret != 0
+}
+
+// ValidateRect removes r from the update region of the window, a nil r means
+// the whole client area.
+func ValidateRect(window uintptr, r *RECT) bool {
+	ret, _, _ := validateRect.Call(window, uintptr(unsafe.Pointer(r)))
+	return ret != 0
+}
+
+func GetUpdateRect(window uintptr, erase bool) (RECT, bool) {
+	var r RECT
+	var e uintptr
+	if erase {
+		e = 1
+	}
+	ret, _, _ := getUpdateRect.Call(window, uintptr(unsafe.Pointer(&r)), e)
+	return r, ret != 0
+}
+
+func PostMessage(window, message, wParam, lParam uintptr) bool {
+	ret, _, _ := postMessage.Call(window, message, wParam, lParam)
+	return ret != 0
+}
+
+func GetDC(window uintptr) uintptr {
+	ret, _, _ := getDC.Call(window)
+	return ret
+}
+
+func ReleaseDC(window, dc uintptr) bool {
+	ret, _, _ := releaseDC.Call(window, dc)
+	return ret != 0
+}
+
+// SetDIBitsToDevice copies the pixels of the device-independent bitmap, which
+// starts at bits, to the device context. It returns the number of scan lines
+// that were set.
+func SetDIBitsToDevice(
+	dc uintptr,
+	destX, destY, width, height, srcX, srcY, startScan, scanLines int,
+	bits unsafe.Pointer,
+	info *BITMAPINFOHEADER,
+	colorUse uint32,
+) int {
+	ret, _, _ := setDIBitsToDevice.Call(
+		dc,
+		uintptr(destX),
+		uintptr(destY),
+		uintptr(width),
+		uintptr(height),
+		uintptr(srcX),
+		uintptr(srcY),
+		uintptr(startScan),
+		uintptr(scanLines),
+		uintptr(bits),
+		uintptr(unsafe.Pointer(info)),
+		uintptr(colorUse),
+	)
+	return int(ret)
+}
+
 func GetModuleHandle(moduleName string) uintptr {
 	var name uintptr
 	if moduleName != "" {